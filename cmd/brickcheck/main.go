@@ -0,0 +1,84 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/abhinav-upadhyay/brickdb/pkg/brickdb"
+)
+
+/**
+ * Offline consistency checker. Prints the report of brickdb.Verify as JSON
+ * and exits with 1 if the database has problems, or 2 if it could not be
+ * checked. With -repair the database is rebuilt with brickdb.Repair instead
+ * and the report of the repair is printed.
+ */
+func main() {
+	repair := flag.Bool("repair", false, "rebuild the database from its intact records")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-repair] <database name>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	if *repair {
+		report, err := brickdb.Repair(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to repair database %s: %v\n", name, err)
+			os.Exit(2)
+		}
+		printReport(report)
+		return
+	}
+	report, err := brickdb.Verify(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check database %s: %v\n", name, err)
+		os.Exit(2)
+	}
+	printReport(report)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func printReport(report interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the report: %v\n", err)
+		os.Exit(2)
+	}
+}
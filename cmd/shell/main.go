@@ -28,6 +28,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -63,6 +64,14 @@ func openDB(name string) *brickdb.Brickdb {
 	}
 	db := brickdb.New(name, index.LinearHashIndexType)
 	err = db.Open()
+	if errors.Is(err, brickdb.ErrLegacyFormat) {
+		fmt.Printf("Upgrading database %s to the binary format\n", name)
+		err = brickdb.Upgrade(name)
+		if err != nil {
+			panic(err)
+		}
+		err = db.Open()
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -81,6 +90,10 @@ func executeCmd(db *brickdb.Brickdb, cmdArgs string) bool {
 		key := args[1]
 		val := args[2]
 		err := db.Store(key, val, brickdb.Insert)
+		if errors.Is(err, brickdb.ErrKeyExists) {
+			fmt.Printf("Key %s already exists, use update to change its value\n", key)
+			return false
+		}
 		if err != nil {
 			fmt.Printf("Failed to insert key %s with value %s due to error %v\n", key, val, err)
 			return false
@@ -93,6 +106,10 @@ func executeCmd(db *brickdb.Brickdb, cmdArgs string) bool {
 		key := args[1]
 		val := args[2]
 		err := db.Store(key, val, brickdb.Update)
+		if errors.Is(err, brickdb.ErrNotFound) {
+			fmt.Printf("Key %s not found, use put to add it\n", key)
+			return false
+		}
 		if err != nil {
 			fmt.Printf("Failed to update key %s with value %s due to error %v\n", key, val, err)
 			return false
@@ -115,12 +132,12 @@ func executeCmd(db *brickdb.Brickdb, cmdArgs string) bool {
 			return false
 		}
 		val, err := db.Fetch(key)
-		if err != nil {
-			fmt.Printf("Failed to get key %s, due to error %v\n", key, err)
+		if errors.Is(err, brickdb.ErrNotFound) {
+			fmt.Printf("Key %s not found\n", key)
 			return false
 		}
-		if val == "" {
-			fmt.Printf("Key %s not found\n", key)
+		if err != nil {
+			fmt.Printf("Failed to get key %s, due to error %v\n", key, err)
 			return false
 		}
 		fmt.Printf("%s\n", val)
@@ -137,11 +154,32 @@ func executeCmd(db *brickdb.Brickdb, cmdArgs string) bool {
 			return false
 		}
 		return false
+	case "repair":
+		report, err := brickdb.Repair(db.Name())
+		if err != nil {
+			fmt.Printf("Failed to repair the database due to error %v\n", err)
+			return false
+		}
+		for _, key := range report.Recovered {
+			fmt.Printf("recovered: %s\n", key)
+		}
+		for _, key := range report.Unlinked {
+			fmt.Printf("recovered outside of the hash chains: %s\n", key)
+		}
+		for _, discarded := range report.Discarded {
+			if discarded.Key != "" {
+				fmt.Printf("discarded %s at offset %d for key %s: %s\n", discarded.File, discarded.Offset, discarded.Key, discarded.Reason)
+			} else {
+				fmt.Printf("discarded %s at offset %d: %s\n", discarded.File, discarded.Offset, discarded.Reason)
+			}
+		}
+		fmt.Printf("%d keys recovered, the damaged files are kept as %s\n", len(report.Recovered), report.BackupName)
+		return false
 	case "quit":
 		return true
 	default:
 		fmt.Printf("Invalid command %s\n", cmd)
-		fmt.Printf("Supported commands are: [put|get|update|delete]\n")
+		fmt.Printf("Supported commands are: [put|get|update|delete|repair]\n")
 		return false
 	}
 	return false
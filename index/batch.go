@@ -0,0 +1,127 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"io"
+	"sort"
+)
+
+/**
+ * A store or delete of a batch, a store creates the key or replaces its
+ * value
+ */
+type BatchOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+/**
+ * Implemented by the indexes which apply a batch of writes in one go. The
+ * keys are grouped by hash chain, the chains locked once each in the order
+ * of their offsets, and the new values appended to the data file with a
+ * single write. The batch is checked before anything is written, a key or
+ * value which is too large fails it as a whole, and the values are appended
+ * before any record is changed, a batch whose values can't be written
+ * leaves the index as it was.
+ */
+type BatchIndex interface {
+	WriteBatch(ops []BatchOp) error
+}
+
+/**
+ * Check the sizes of the keys and values of a batch and drop the operations
+ * a later one on the same key overrides
+ */
+func checkBatch(ops []BatchOp, maxKey int64, maxValue int64) ([]BatchOp, error) {
+	last := make(map[string]int, len(ops))
+	for i, op := range ops {
+		value := op.Value
+		if op.Delete {
+			value = nil
+		}
+		err := checkSizes(op.Key, value, maxKey, maxValue)
+		if err != nil {
+			return nil, err
+		}
+		last[string(op.Key)] = i
+	}
+	checked := make([]BatchOp, 0, len(last))
+	for i, op := range ops {
+		if last[string(op.Key)] == i {
+			checked = append(checked, op)
+		}
+	}
+	return checked, nil
+}
+
+/**
+ * The operations of a batch along with the offsets of the pointers to their
+ * hash chains, sorted by chain
+ */
+type batchByChain struct {
+	ops       []BatchOp
+	chainoffs []int64
+}
+
+func (self batchByChain) Len() int           { return len(self.ops) }
+func (self batchByChain) Less(i, j int) bool { return self.chainoffs[i] < self.chainoffs[j] }
+func (self batchByChain) Swap(i, j int) {
+	self.ops[i], self.ops[j] = self.ops[j], self.ops[i]
+	self.chainoffs[i], self.chainoffs[j] = self.chainoffs[j], self.chainoffs[i]
+}
+
+/**
+ * Write lock the chains of a batch sorted with batchByChain, each of them
+ * once, before anything is written. Returns the offsets of the locks taken.
+ */
+func (self *lockWaiter) lockChains(fd uintptr, chainoffs []int64) ([]int64, error) {
+	var locks []int64
+	for i, chainoff := range chainoffs {
+		if i > 0 && chainoff == chainoffs[i-1] {
+			continue
+		}
+		err := self.writeLockW(fd, chainoff, io.SeekStart, 1)
+		if err != nil {
+			unlockChains(fd, locks)
+			return nil, err
+		}
+		locks = append(locks, chainoff)
+	}
+	return locks, nil
+}
+
+func unlockChains(fd uintptr, locks []int64) {
+	for _, lock := range locks {
+		Unlock(fd, lock, io.SeekStart, 1)
+	}
+}
+
+func sortBatch(ops []BatchOp, chainoffs []int64) {
+	sort.Stable(batchByChain{ops: ops, chainoffs: chainoffs})
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const (
+	batch_test_db_name = "batch_test"
+)
+
+func TestWriteBatch(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, testWriteBatch)
+}
+
+/**
+ * A batch of new keys, overwrites of the same and of a different length,
+ * deletes and repeated keys leaves the same records as the writes one by
+ * one, and a consistent database
+ */
+func testWriteBatch(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, batch_test_db_name, idxType, Options{InitialBuckets: 4, SplitThreshold: 2})
+	defer idx.Close()
+	var err error
+	batchIndex := idx.(BatchIndex)
+
+	expected := make(map[string]string)
+	var ops []BatchOp
+	nrecords := 300
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value := largeValue(i*29, byte(i))
+		ops = append(ops, BatchOp{Key: []byte(key), Value: value})
+		expected[key] = string(value)
+	}
+	err = batchIndex.WriteBatch(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops = nil
+	for i := 0; i < nrecords; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		ops = append(ops, BatchOp{Key: []byte(key), Delete: true})
+		delete(expected, key)
+	}
+	for i := 1; i < nrecords; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		value := largeValue(i*29, byte(i+1)) // same length
+		if i%2 == 0 {
+			value = largeValue(i*13+5, byte(i+2))
+		}
+		ops = append(ops, BatchOp{Key: []byte(key), Value: value})
+		expected[key] = string(value)
+	}
+	/* the last operation on a key wins */
+	ops = append(ops, BatchOp{Key: []byte("key2"), Delete: true}, BatchOp{Key: []byte("key2"), Value: []byte("again")})
+	expected["key2"] = "again"
+	err = batchIndex.WriteBatch(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* nothing is written if one of the values is too large */
+	err = batchIndex.WriteBatch([]BatchOp{{Key: []byte("key1"), Value: []byte("small")}, {Key: []byte("big"), Value: make([]byte, DefaultMaxValueSize+1)}})
+	if err == nil {
+		t.Errorf("Expected the batch with a value too large to fail")
+	}
+
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %d records after the batches, got %d", len(expected), len(records))
+	}
+	report, err := Verify(batch_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("Expected a consistent database, got %+v", report.Problems)
+	}
+	if linearIndex, ok := idx.(*LinearHashIndex); ok {
+		err = linearIndex.readHeader(false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linearIndex.nrecords != int64(len(expected)) || linearIndex.nhash <= 4 {
+			t.Errorf("Expected %d records over more than 4 buckets, got %d over %d", len(expected), linearIndex.nrecords, linearIndex.nhash)
+		}
+	}
+}
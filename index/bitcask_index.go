@@ -0,0 +1,937 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+/**
+ * A Bitcask style index. All the writes are appended to the active segment
+ * of the data log and an in-memory keydir maps every key to the segment and
+ * offset of its latest value, so a Fetch is a single read. When the active
+ * segment grows past bitcask_segment_max it becomes immutable, a hint file
+ * with the keys and value locations of the segment is written next to it,
+ * and a new active segment is started. Merging rewrites the live records of
+ * the immutable segments into a fresh segment and drops the rest.
+ *
+ * The .idx file only holds the header:
+ *	file header (8 bytes) | max value size (8 bytes) | max key size (8 bytes) |
+ *	active segment length (8 bytes) | next segment id (8 bytes) | merge generation (8 bytes) |
+ *	number of segments (8 bytes) | segment ids, oldest first with the active segment last (8 bytes each)
+ * Segments are named <name>.<id>.log and use the record encoding of the LSM
+ * log, with a checksum of the whole record. Hint files are named
+ * <name>.<id>.hint and hold an entry per record:
+ *	flags (1 byte) | key length (4 bytes) | value offset (8 bytes) | value length (4 bytes) | checksum (4 bytes) | key
+ * where the checksum is the CRC32C of the fields before it and the key.
+ *
+ * Every handle keeps its own keydir, built from the hint files on the first
+ * operation and brought up to date with the active segment before every
+ * operation after that. A merge bumps the merge generation which makes the
+ * handles rebuild their keydir. Locking works the same way as for the LSM
+ * index: readers share bitcask_read_lock, a single writer holds
+ * bitcask_write_lock and only keeps the readers out while publishing a new
+ * header, bitcask_merge_lock allows a single merge at a time.
+ */
+const (
+	bitcask_maxvalue_off  = file_header_size
+	bitcask_maxkey_off    = bitcask_maxvalue_off + 8
+	bitcask_activelen_off = bitcask_maxkey_off + 8
+	bitcask_nextseg_off   = bitcask_activelen_off + 8
+	bitcask_mergegen_off  = bitcask_nextseg_off + 8
+	bitcask_nsegments_off = bitcask_mergegen_off + 8
+	bitcask_header_size   = bitcask_nsegments_off + 8
+	bitcask_hint_size     = 21 // flags(1) + keylen(4) + value offset(8) + value length(4) + crc(4)
+	bitcask_hint_crc_off  = 17
+	bitcask_read_lock     = 0
+	bitcask_write_lock    = 1
+	bitcask_merge_lock    = 2
+	bitcask_segment_max   = 64 << 20 // start a new segment once the active one is this long
+	bitcask_merge_trigger = 4        // number of immutable segments starting a merge
+	bitcask_key_max       = lsm_key_max
+)
+
+type bitcaskHeader struct {
+	activeLen     int64
+	nextSegmentId int64
+	mergeGen      int64
+	segmentIds    []int64
+}
+
+func (self *bitcaskHeader) activeId() int64 {
+	return self.segmentIds[len(self.segmentIds)-1]
+}
+
+/**
+ * Location of the latest value of a key
+ */
+type bitcaskEntry struct {
+	segment int64
+	offset  int64
+	size    int64
+}
+
+type BitcaskIndex struct {
+	lockWaiter
+	idxFile      *os.File
+	opts         Options
+	name         string
+	maxValue     int64
+	maxKey       int64
+	header       bitcaskHeader
+	keydir       map[string]bitcaskEntry
+	mergeGen     int64 // merge generation the keydir was built for
+	readSegment  int64 // segment the keydir has been caught up with
+	readOff      int64 // length of readSegment already applied to the keydir
+	segments     map[int64]*os.File
+	activeFile   *os.File // the active segment opened for writing
+	activeFileId int64
+	segmentMax   int64
+	merges       sync.WaitGroup
+	mutex        sync.Mutex // protects mergeErr
+	mergeErr     error
+}
+
+func (self *BitcaskIndex) Open(name string, mode int) error {
+	self.name = name
+	self.segmentMax = bitcask_segment_max
+	self.segments = make(map[int64]*os.File)
+	opts, err := self.opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create index file %s", self.name+".idx")
+	}
+
+	isCreateMode := mode&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE || mode&(os.O_CREATE|os.O_TRUNC) == os.O_TRUNC
+	if isCreateMode {
+		/**
+		 * If the database was created we need to initialize it. We need to lock the entire file,
+		 * stat it, check its size and initialize it atomically
+		 */
+		if WriteLockW(self.idxFile.Fd(), 0, io.SeekStart, 0) != nil {
+			return errors.New("Failed to write lock index for init")
+		}
+		defer func() error {
+			return Unlock(self.idxFile.Fd(), 0, io.SeekStart, 0)
+		}()
+
+		idxFileInfo, err := self.idxFile.Stat()
+		if err != nil {
+			return errors.New("Failed to stat the index file")
+		}
+
+		if idxFileInfo.Size() == 0 {
+			self.maxValue = opts.MaxValueSize
+			self.maxKey = opts.MaxKeySize
+			err = self.writeHeader(bitcaskHeader{nextSegmentId: 2, segmentIds: []int64{1}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = verifyFileHeader(self.idxFile, BitcaskIndexType)
+	if err != nil {
+		self.Close()
+		return err
+	}
+	/* The maximum value and key sizes never change, read them once without locking */
+	buf := make([]byte, 16)
+	_, err = self.idxFile.ReadAt(buf, bitcask_maxvalue_off)
+	if err != nil {
+		self.Close()
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.maxValue = int64(byteOrder.Uint64(buf))
+	self.maxKey = int64(byteOrder.Uint64(buf[8:]))
+	return nil
+}
+
+/**
+ * Close the handle, waits for a merge started by this handle to finish and
+ * returns its error if it failed
+ */
+func (self *BitcaskIndex) Close() error {
+	self.merges.Wait()
+	self.closeSegments(nil)
+	if self.activeFile != nil {
+		self.activeFile.Close()
+		self.activeFile = nil
+	}
+	if self.idxFile != nil {
+		err := self.idxFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.mergeErr
+}
+
+func (self *BitcaskIndex) segmentName(id int64) string {
+	return fmt.Sprintf("%s.%d.log", self.name, id)
+}
+
+func (self *BitcaskIndex) hintName(id int64) string {
+	return fmt.Sprintf("%s.%d.hint", self.name, id)
+}
+
+func readBitcaskHeader(f *os.File) (bitcaskHeader, error) {
+	var header bitcaskHeader
+	buf := make([]byte, bitcask_header_size)
+	_, err := f.ReadAt(buf, 0)
+	if err != nil {
+		return header, fmt.Errorf("Failed to read index header: %w", err)
+	}
+	header.activeLen = int64(byteOrder.Uint64(buf[bitcask_activelen_off:]))
+	header.nextSegmentId = int64(byteOrder.Uint64(buf[bitcask_nextseg_off:]))
+	header.mergeGen = int64(byteOrder.Uint64(buf[bitcask_mergegen_off:]))
+	nsegments := int64(byteOrder.Uint64(buf[bitcask_nsegments_off:]))
+	if nsegments < 1 || nsegments > 1<<20 {
+		return header, fmt.Errorf("Invalid number of segments %d in index header", nsegments)
+	}
+	idsbuf := make([]byte, nsegments*8)
+	_, err = f.ReadAt(idsbuf, bitcask_header_size)
+	if err != nil {
+		return header, fmt.Errorf("Failed to read index header: %w", err)
+	}
+	header.segmentIds = make([]int64, nsegments)
+	for i := range header.segmentIds {
+		header.segmentIds[i] = int64(byteOrder.Uint64(idsbuf[i*8:]))
+	}
+	return header, nil
+}
+
+func (self *BitcaskIndex) writeHeader(header bitcaskHeader) error {
+	buf := make([]byte, bitcask_header_size+len(header.segmentIds)*8)
+	copy(buf, encodeFileHeader(BitcaskIndexType))
+	byteOrder.PutUint64(buf[bitcask_maxvalue_off:], uint64(self.maxValue))
+	byteOrder.PutUint64(buf[bitcask_maxkey_off:], uint64(self.maxKey))
+	byteOrder.PutUint64(buf[bitcask_activelen_off:], uint64(header.activeLen))
+	byteOrder.PutUint64(buf[bitcask_nextseg_off:], uint64(header.nextSegmentId))
+	byteOrder.PutUint64(buf[bitcask_mergegen_off:], uint64(header.mergeGen))
+	byteOrder.PutUint64(buf[bitcask_nsegments_off:], uint64(len(header.segmentIds)))
+	for i, id := range header.segmentIds {
+		byteOrder.PutUint64(buf[bitcask_header_size+i*8:], uint64(id))
+	}
+	_, err := self.idxFile.WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	self.header = header
+	return nil
+}
+
+/**
+ * Write the new header while keeping the readers out
+ */
+func (self *BitcaskIndex) publish(header bitcaskHeader) error {
+	err := WriteLockW(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	return self.writeHeader(header)
+}
+
+/**
+ * Return the segment opened for reading, a segment nobody wrote to yet may
+ * not exist and is returned as nil
+ */
+func (self *BitcaskIndex) segment(id int64) (*os.File, error) {
+	f, ok := self.segments[id]
+	if ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(self.segmentName(id), os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	self.segments[id] = f
+	return f, nil
+}
+
+/**
+ * Close the segments which are not in the list anymore
+ */
+func (self *BitcaskIndex) closeSegments(ids []int64) {
+	live := make(map[int64]bool)
+	for _, id := range ids {
+		live[id] = true
+	}
+	for id, f := range self.segments {
+		if !live[id] {
+			f.Close()
+			delete(self.segments, id)
+		}
+	}
+}
+
+/**
+ * Bring the keydir up to date with the header. Must be called with either
+ * bitcask_read_lock or bitcask_write_lock held.
+ */
+func (self *BitcaskIndex) catchUp() error {
+	header, err := readBitcaskHeader(self.idxFile)
+	if err != nil {
+		return err
+	}
+	self.header = header
+	activeId := header.activeId()
+	if self.keydir == nil || header.mergeGen != self.mergeGen {
+		self.closeSegments(header.segmentIds)
+		self.keydir = make(map[string]bitcaskEntry)
+		for _, id := range header.segmentIds[:len(header.segmentIds)-1] {
+			err = self.loadSegment(id, 0, -1)
+			if err != nil {
+				return err
+			}
+		}
+		self.mergeGen = header.mergeGen
+		self.readSegment = activeId
+		self.readOff = 0
+	} else if self.readSegment != activeId {
+		/**
+		 * The segment we were reading is immutable now and so are the ones
+		 * started after it, except for the new active one
+		 */
+		pos := -1
+		for i, id := range header.segmentIds {
+			if id == self.readSegment {
+				pos = i
+			}
+		}
+		if pos == -1 {
+			return fmt.Errorf("Segment %d of %s disappeared without a merge", self.readSegment, self.name)
+		}
+		err = self.loadSegment(self.readSegment, self.readOff, -1)
+		if err != nil {
+			return err
+		}
+		for _, id := range header.segmentIds[pos+1 : len(header.segmentIds)-1] {
+			err = self.loadSegment(id, 0, -1)
+			if err != nil {
+				return err
+			}
+		}
+		self.readSegment = activeId
+		self.readOff = 0
+	}
+	if header.activeLen < self.readOff {
+		return fmt.Errorf("Active segment of %s shrunk from %d to %d bytes", self.name, self.readOff, header.activeLen)
+	}
+	if header.activeLen > self.readOff {
+		err = self.loadSegment(activeId, self.readOff, header.activeLen)
+		if err != nil {
+			return err
+		}
+		self.readOff = header.activeLen
+	}
+	return nil
+}
+
+/**
+ * Apply the records of the segment between start and end to the keydir, an
+ * end of -1 means the end of the file. Immutable segments read from the
+ * start are loaded from their hint file when there is one.
+ */
+func (self *BitcaskIndex) loadSegment(id int64, start int64, end int64) error {
+	if start == 0 && end == -1 {
+		loaded, err := self.loadHint(id)
+		if err != nil || loaded {
+			return err
+		}
+	}
+	f, err := self.segment(id)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return nil
+	}
+	if end == -1 {
+		finfo, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		end = finfo.Size()
+	}
+	return scanBitcaskSegment(f, start, end, self.maxValue, func(rec lsmRecord, valueOff int64) error {
+		self.apply(string(rec.key), rec.deleted, bitcaskEntry{segment: id, offset: valueOff, size: int64(len(rec.value))})
+		return nil
+	})
+}
+
+func (self *BitcaskIndex) apply(key string, deleted bool, entry bitcaskEntry) {
+	if deleted {
+		delete(self.keydir, key)
+	} else {
+		self.keydir[key] = entry
+	}
+}
+
+/**
+ * Call fn for every record of the segment between start and end along with
+ * the offset of its value
+ */
+func scanBitcaskSegment(f *os.File, start int64, end int64, maxValue int64, fn func(rec lsmRecord, valueOff int64) error) error {
+	r := bufio.NewReader(io.NewSectionReader(f, start, end-start))
+	offset := start
+	for offset < end {
+		rec, reclen, err := readLsmRecord(r, maxValue)
+		if err != nil {
+			return fmt.Errorf("Corrupted segment %s at offset %d: %w", f.Name(), offset, err)
+		}
+		err = fn(rec, offset+lsm_record_header_size+int64(len(rec.key)))
+		if err != nil {
+			return err
+		}
+		offset += reclen
+	}
+	return nil
+}
+
+func (self *BitcaskIndex) loadHint(id int64) (bool, error) {
+	f, err := os.OpenFile(self.hintName(id), os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	hdrbuf := make([]byte, bitcask_hint_size)
+	var offset int64
+	for {
+		_, err = io.ReadFull(r, hdrbuf)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("Corrupted hint file %s: %w", self.hintName(id), err)
+		}
+		keylen := int64(byteOrder.Uint32(hdrbuf[1:]))
+		if keylen < 1 || keylen > bitcask_key_max {
+			return false, fmt.Errorf("Corrupted hint file %s: invalid key length %d: %w", self.hintName(id), keylen, ErrCorrupt)
+		}
+		key := make([]byte, keylen)
+		_, err = io.ReadFull(r, key)
+		if err != nil {
+			return false, fmt.Errorf("Corrupted hint file %s: %w", self.hintName(id), err)
+		}
+		if byteOrder.Uint32(hdrbuf[bitcask_hint_crc_off:]) != bitcaskHintCrc(hdrbuf, key) {
+			return false, &CorruptError{File: self.hintName(id), Offset: offset, Reason: "hint checksum mismatch"}
+		}
+		offset += bitcask_hint_size + keylen
+		entry := bitcaskEntry{
+			segment: id,
+			offset:  int64(byteOrder.Uint64(hdrbuf[5:])),
+			size:    int64(byteOrder.Uint32(hdrbuf[13:])),
+		}
+		self.apply(string(key), hdrbuf[0]&lsm_tombstone != 0, entry)
+	}
+}
+
+/**
+ * Write the hint file for an immutable segment, it is on disk by the time
+ * it returns
+ */
+func writeBitcaskHint(segment *os.File, hintName string, maxValue int64) error {
+	finfo, err := segment.Stat()
+	if err != nil {
+		return err
+	}
+	tmpName := hintName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	err = scanBitcaskSegment(segment, 0, finfo.Size(), maxValue, func(rec lsmRecord, valueOff int64) error {
+		buf := make([]byte, bitcask_hint_size+len(rec.key))
+		if rec.deleted {
+			buf[0] = lsm_tombstone
+		}
+		byteOrder.PutUint32(buf[1:], uint32(len(rec.key)))
+		byteOrder.PutUint64(buf[5:], uint64(valueOff))
+		byteOrder.PutUint32(buf[13:], uint32(len(rec.value)))
+		copy(buf[bitcask_hint_size:], rec.key)
+		byteOrder.PutUint32(buf[bitcask_hint_crc_off:], bitcaskHintCrc(buf, rec.key))
+		_, err := w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, hintName)
+	if err != nil {
+		return err
+	}
+	return syncDir(hintName)
+}
+
+func bitcaskHintCrc(hdrbuf []byte, key []byte) uint32 {
+	crc := crc32.Update(0, crcTable, hdrbuf[:bitcask_hint_crc_off])
+	return crc32.Update(crc, crcTable, key)
+}
+
+/**
+ * Read the value of the key, along with the rest of its record to check the
+ * checksum
+ */
+func (self *BitcaskIndex) readValue(key []byte, entry bitcaskEntry) ([]byte, error) {
+	f, err := self.segment(entry.segment)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, fmt.Errorf("Missing segment %s", self.segmentName(entry.segment))
+	}
+	recoff := entry.offset - lsm_record_header_size - int64(len(key))
+	buf := make([]byte, entry.offset+entry.size-recoff)
+	_, err = f.ReadAt(buf, recoff)
+	if err == io.EOF {
+		return nil, &CorruptError{File: f.Name(), Offset: recoff, Key: key, Reason: "record past the end of the segment"}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read value from segment %d at offset %d: %w", entry.segment, entry.offset, err)
+	}
+	if !verifyLsmRecord(buf) || !bytes.Equal(buf[lsm_record_header_size:lsm_record_header_size+len(key)], key) {
+		return nil, &CorruptError{File: f.Name(), Offset: recoff, Key: key, Reason: "record checksum mismatch"}
+	}
+	return buf[lsm_record_header_size+len(key):], nil
+}
+
+func (self *BitcaskIndex) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of the given key, returns nil if the key does not exist
+ */
+func (self *BitcaskIndex) FetchBytes(key []byte) ([]byte, error) {
+	err := self.readLockW(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	err = self.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	entry, found := self.keydir[string(key)]
+	if !found {
+		return nil, nil
+	}
+	return self.readValue(key, entry)
+}
+
+func (self *BitcaskIndex) FetchAll() (map[string]string, error) {
+	err := self.readLockW(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	err = self.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]string)
+	for key, entry := range self.keydir {
+		value, err := self.readValue([]byte(key), entry)
+		if err != nil {
+			return nil, err
+		}
+		records[key] = string(value)
+	}
+	return records, nil
+}
+
+func (self *BitcaskIndex) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *BitcaskIndex) DeleteBytes(key []byte) error {
+	return self.write(lsmRecord{key: key, deleted: true}, Update, false)
+}
+
+func (self *BitcaskIndex) Insert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Insert)
+}
+
+func (self *BitcaskIndex) Update(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Update)
+}
+
+func (self *BitcaskIndex) Upsert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Upsert)
+}
+
+func (self *BitcaskIndex) StoreBytes(key []byte, value []byte, op StoreOp) error {
+	return self.store(key, value, op)
+}
+
+func (self *BitcaskIndex) store(key []byte, value []byte, op StoreOp) error {
+	err := checkSizes(key, value, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
+	}
+	return self.write(lsmRecord{key: key, value: value}, op, true)
+}
+
+/**
+ * Append the record to the active segment and update the keydir. Deletes of
+ * missing keys are ignored instead of failing like an update would.
+ */
+func (self *BitcaskIndex) write(rec lsmRecord, op StoreOp, failMissing bool) error {
+	err := self.writeLockW(self.idxFile.Fd(), bitcask_write_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), bitcask_write_lock, io.SeekStart, 1)
+	err = self.catchUp()
+	if err != nil {
+		return err
+	}
+
+	_, exists := self.keydir[string(rec.key)]
+	if op == Insert && exists {
+		return fmt.Errorf("%w: %s", ErrKeyExists, rec.key)
+	}
+	if op == Update && !exists {
+		if !failMissing {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrNotFound, rec.key)
+	}
+
+	header := self.header
+	activeId := header.activeId()
+	if self.activeFile == nil || self.activeFileId != activeId {
+		if self.activeFile != nil {
+			self.activeFile.Close()
+		}
+		self.activeFile, err = os.OpenFile(self.segmentName(activeId), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			self.activeFile = nil
+			return err
+		}
+		self.activeFileId = activeId
+	}
+	/**
+	 * Anything in the segment past the length in the header is left over
+	 * from a writer which died before publishing it, so we write over it
+	 */
+	buf := encodeLsmRecord(rec)
+	bytesWritten, err := self.activeFile.WriteAt(buf, header.activeLen)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Error while writing to the active segment")
+	}
+	valueOff := header.activeLen + lsm_record_header_size + int64(len(rec.key))
+	header.activeLen += int64(len(buf))
+	err = self.publish(header)
+	if err != nil {
+		return err
+	}
+	self.apply(string(rec.key), rec.deleted, bitcaskEntry{segment: activeId, offset: valueOff, size: int64(len(rec.value))})
+	self.readOff = header.activeLen
+
+	if header.activeLen >= self.segmentMax {
+		return self.rotate()
+	}
+	return nil
+}
+
+/**
+ * Make the active segment immutable and start a new one. Called with
+ * bitcask_write_lock held.
+ */
+func (self *BitcaskIndex) rotate() error {
+	header := self.header
+	activeId := header.activeId()
+	err := self.activeFile.Truncate(header.activeLen)
+	if err != nil {
+		return err
+	}
+	err = self.activeFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = writeBitcaskHint(self.activeFile, self.hintName(activeId), self.maxValue)
+	if err != nil {
+		return err
+	}
+	header.segmentIds = append(append([]int64(nil), header.segmentIds...), header.nextSegmentId)
+	header.nextSegmentId++
+	header.activeLen = 0
+	err = self.publish(header)
+	if err != nil {
+		return err
+	}
+	if len(header.segmentIds)-1 >= bitcask_merge_trigger {
+		self.startMerge()
+	}
+	return nil
+}
+
+/**
+ * Merge the immutable segments in the background. The merge uses its own
+ * file handle so the locks it takes are separate from the ones of this
+ * handle, which keeps being usable in the meantime.
+ */
+func (self *BitcaskIndex) startMerge() {
+	self.merges.Add(1)
+	go func() {
+		defer self.merges.Done()
+		err := mergeBitcask(self.name, self.maxValue, self.maxKey)
+		if err != nil {
+			self.mutex.Lock()
+			self.mergeErr = err
+			self.mutex.Unlock()
+		}
+	}()
+}
+
+/**
+ * Rewrite the live records of the immutable segments into a single new
+ * segment and drop the old ones. Returns without doing anything if another
+ * merge is running.
+ */
+func (self *BitcaskIndex) Merge() error {
+	return mergeBitcask(self.name, self.maxValue, self.maxKey)
+}
+
+func mergeBitcask(name string, maxValue int64, maxKey int64) error {
+	f, err := os.OpenFile(name+".idx", os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	merger := &BitcaskIndex{name: name, maxValue: maxValue, maxKey: maxKey, idxFile: f, segments: make(map[int64]*os.File)}
+	defer merger.closeSegments(nil)
+
+	/**
+	 * The merges started by the rotations made while we were merging found
+	 * the lock taken, so we go again if enough segments have piled up. That
+	 * includes the ones made after our last look but before we let go of
+	 * the lock, we look again once it is released.
+	 */
+	for {
+		err = WriteLock(f.Fd(), bitcask_merge_lock, io.SeekStart, 1)
+		if errors.Is(err, ErrLocked) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = merger.mergeWhileFull()
+		Unlock(f.Fd(), bitcask_merge_lock, io.SeekStart, 1)
+		if err != nil {
+			return err
+		}
+		nimmutable, err := merger.immutableSegments()
+		if err != nil || nimmutable < bitcask_merge_trigger {
+			return err
+		}
+	}
+}
+
+func (self *BitcaskIndex) mergeWhileFull() error {
+	for {
+		nimmutable, err := self.mergeSegments()
+		if err != nil || nimmutable < bitcask_merge_trigger {
+			return err
+		}
+	}
+}
+
+/**
+ * The number of segments besides the active one
+ */
+func (self *BitcaskIndex) immutableSegments() (int, error) {
+	err := ReadLockW(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return 0, err
+	}
+	defer Unlock(self.idxFile.Fd(), bitcask_read_lock, io.SeekStart, 1)
+	header, err := readBitcaskHeader(self.idxFile)
+	if err != nil {
+		return 0, err
+	}
+	return len(header.segmentIds) - 1, nil
+}
+
+/**
+ * Merge the immutable segments, returns the number of immutable segments
+ * left afterwards
+ */
+func (self *BitcaskIndex) mergeSegments() (int, error) {
+	/* Reserve an id for the merged segment */
+	var header bitcaskHeader
+	err := self.updateHeader(func(h *bitcaskHeader) {
+		header = *h
+		h.nextSegmentId++
+	})
+	if err != nil {
+		return 0, err
+	}
+	immutable := header.segmentIds[:len(header.segmentIds)-1]
+	if len(immutable) < 2 {
+		return len(immutable), nil
+	}
+
+	/**
+	 * Segments are only ever added after the ones we are merging, so only
+	 * their live records need to be kept and the tombstones can go
+	 */
+	self.keydir = make(map[string]bitcaskEntry)
+	for _, id := range immutable {
+		err = self.loadSegment(id, 0, -1)
+		if err != nil {
+			return 0, err
+		}
+	}
+	id := header.nextSegmentId
+	err = self.writeMerged(id)
+	if err != nil {
+		os.Remove(self.segmentName(id))
+		return 0, err
+	}
+
+	merged := make(map[int64]bool)
+	for _, mergedId := range immutable {
+		merged[mergedId] = true
+	}
+	var nimmutable int
+	err = self.updateHeader(func(h *bitcaskHeader) {
+		segmentIds := []int64{id}
+		for _, segmentId := range h.segmentIds {
+			if !merged[segmentId] {
+				segmentIds = append(segmentIds, segmentId)
+			}
+		}
+		h.segmentIds = segmentIds
+		h.mergeGen++
+		nimmutable = len(segmentIds) - 1
+	})
+	if err != nil {
+		os.Remove(self.segmentName(id))
+		os.Remove(self.hintName(id))
+		return 0, err
+	}
+	/* the header listing the merged segment is on disk before the inputs go */
+	err = self.idxFile.Sync()
+	if err != nil {
+		return 0, err
+	}
+	self.closeSegments(nil)
+	for mergedId := range merged {
+		os.Remove(self.segmentName(mergedId))
+		os.Remove(self.hintName(mergedId))
+	}
+	return nimmutable, nil
+}
+
+/**
+ * Write the records in the keydir into a new segment along with its hint file
+ */
+func (self *BitcaskIndex) writeMerged(id int64) error {
+	f, err := os.OpenFile(self.segmentName(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for key, entry := range self.keydir {
+		value, err := self.readValue([]byte(key), entry)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(encodeLsmRecord(lsmRecord{key: []byte(key), value: value}))
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = syncDir(self.segmentName(id))
+	if err != nil {
+		return err
+	}
+	return writeBitcaskHint(f, self.hintName(id), self.maxValue)
+}
+
+/**
+ * Read, modify and publish the header as the writer
+ */
+func (self *BitcaskIndex) updateHeader(fn func(header *bitcaskHeader)) error {
+	err := WriteLockW(self.idxFile.Fd(), bitcask_write_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), bitcask_write_lock, io.SeekStart, 1)
+	header, err := readBitcaskHeader(self.idxFile)
+	if err != nil {
+		return err
+	}
+	fn(&header)
+	return self.publish(header)
+}
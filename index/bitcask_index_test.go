@@ -0,0 +1,382 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	bitcask_test_db_name = "bitcask_index_test"
+)
+
+func TestStoreFetchDeleteBitcaskIndex(t *testing.T) {
+	bitcaskIndex, err := bitcaskOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer bitcaskRemoveDB(bitcask_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Insert("k1", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when inserting an existing key")
+	}
+	err = bitcaskIndex.Update("k3", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when updating a missing key")
+	}
+	err = bitcaskIndex.Update("k1", "v1-updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Upsert("k3", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Delete("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Delete("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.Insert("k2", "v2-again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitcaskIndex.StoreBytes([]byte("empty"), []byte{}, Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitcaskIndex.Close()
+
+	/* a new handle has to build its keydir from the active segment */
+	bitcaskIndex, err = bitcaskOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcaskIndex.Close()
+	expected := map[string]string{"k1": "v1-updated", "k2": "v2-again", "k3": "v3", "empty": ""}
+	for k, v := range expected {
+		val, err := bitcaskIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+	valuesMap, err := bitcaskIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(valuesMap) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v from FetchAll, got %v", expected, valuesMap)
+	}
+}
+
+func TestSegmentsAndMergeBitcaskIndex(t *testing.T) {
+	bitcaskIndex, err := bitcaskOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer bitcaskRemoveDB(bitcask_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitcaskIndex.segmentMax = 4096
+	nrecords := 5000
+	keys := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		err = bitcaskIndex.Insert(keys[i], "val_"+keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i += 2 {
+		err = bitcaskIndex.Delete(keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < nrecords; i += 4 {
+		err = bitcaskIndex.Update(keys[i], "updated")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bitcaskIndex.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(bitcask_test_db_name + ".*.log")
+	if len(segments) > bitcask_merge_trigger+1 {
+		t.Errorf("Expected the segments to be merged, found %d segment files", len(segments))
+	}
+	hints, _ := filepath.Glob(bitcask_test_db_name + ".*.hint")
+	if len(hints) != len(segments)-1 {
+		t.Errorf("Expected a hint file for each of the %d immutable segments, found %d", len(segments)-1, len(hints))
+	}
+
+	bitcaskIndex, err = bitcaskOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcaskIndex.Close()
+	err = bitcaskIndex.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		expected := "val_" + k
+		if i%2 == 0 {
+			expected = ""
+		} else if i%4 == 1 {
+			expected = "updated"
+		}
+		val, err := bitcaskIndex.Fetch(k)
+		if expected == "" && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected {
+			t.Errorf("Expected value %q for key %s, got %q", expected, k, val)
+		}
+	}
+	valuesMap, err := bitcaskIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valuesMap) != nrecords/2 {
+		t.Errorf("Expected %d records from FetchAll, got %d", nrecords/2, len(valuesMap))
+	}
+}
+
+func TestUnpublishedSegmentTailBitcaskIndex(t *testing.T) {
+	bitcaskIndex, err := bitcaskOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer bitcaskRemoveDB(bitcask_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcaskIndex.Close()
+	err = bitcaskIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* a writer dying after appending to the segment but before publishing it */
+	f, err := os.OpenFile(bitcask_test_db_name+".1.log", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeLsmRecord(lsmRecord{key: []byte("k2"), value: []byte("torn")})[:12])
+	f.Close()
+
+	_, err = bitcaskIndex.Fetch("k2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the unpublished record to be ignored, got error %v", err)
+	}
+	err = bitcaskIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bitcaskOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for k, v := range map[string]string{"k1": "v1", "k2": "v2"} {
+		val, err := other.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+}
+
+func TestConcurrentReadWriteBitcaskIndex(t *testing.T) {
+	var wg sync.WaitGroup
+	bitcaskOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer bitcaskRemoveDB(bitcask_test_db_name)
+	nrecords := 10000
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		vals[i] = fmt.Sprintf("val_%d", i)
+	}
+	nthreads := 20
+	step := nrecords / nthreads
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		start := i * step
+		end := start + step
+		go bitcaskWork(t, &wg, keys[start:end], vals[start:end])
+	}
+	wg.Wait()
+}
+
+func bitcaskWork(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string) {
+	defer wg.Done()
+	bitcaskIndex, err := bitcaskOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		err := bitcaskIndex.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	/* small segments so the handles keep rotating and merging under each other */
+	bitcaskIndex.segmentMax = 16 << 10
+	for i, k := range keys {
+		err := bitcaskIndex.Insert(k, vals[i])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for i, k := range keys {
+		val, err := bitcaskIndex.Fetch(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if val != vals[i] {
+			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
+		}
+	}
+
+	for _, k := range keys {
+		err := bitcaskIndex.Delete(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, k := range keys {
+		_, err := bitcaskIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
+			return
+		}
+	}
+}
+
+func bitcaskOpenNewDB(removeExisting bool, mode int) (*BitcaskIndex, error) {
+	if removeExisting {
+		bitcaskRemoveDB(bitcask_test_db_name)
+	}
+	bitcaskIndex := new(BitcaskIndex)
+	err := bitcaskIndex.Open(bitcask_test_db_name, mode)
+	return bitcaskIndex, err
+}
+
+func bitcaskRemoveDB(name string) {
+	os.Remove(name + ".idx")
+	for _, pattern := range []string{".*.log", ".*.hint"} {
+		files, _ := filepath.Glob(name + pattern)
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+}
+
+func TestCorruptRecordBitcaskIndex(t *testing.T) {
+	bitcaskIndex, err := bitcaskOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer bitcaskRemoveDB(bitcask_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bitcaskIndex.Close()
+	bitcaskIndex.segmentMax = 1024
+	err = bitcaskIndex.Insert("victim", "value_of_victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		err = bitcaskIndex.Insert(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segmentName := bitcask_test_db_name + ".1.log"
+	hintName := bitcask_test_db_name + ".1.hint"
+	_, err = os.Stat(hintName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the key is in the keydir already, reading the value checks its record */
+	corruptOff := flipByte(t, segmentName, []byte("value_of_victim"))
+	_, err = bitcaskIndex.Fetch("victim")
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected a CorruptError fetching a corrupt record, got %v", err)
+	}
+	if corruptErr.File != segmentName || corruptErr.Offset > corruptOff {
+		t.Errorf("Expected the corrupt record in %s before offset %d, got %s at %d", segmentName, corruptOff, corruptErr.File, corruptErr.Offset)
+	}
+	val, err := bitcaskIndex.Fetch("key3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "value3" {
+		t.Errorf("Expected value3 for key3, got %s", val)
+	}
+
+	/* a new handle builds its keydir from the hint file */
+	flipByte(t, hintName, []byte("key3"))
+	other, err := bitcaskOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, err = other.Fetch("key3")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt loading a corrupt hint file, got %v", err)
+	}
+}
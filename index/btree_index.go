@@ -0,0 +1,760 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+/**
+ * A disk based B+tree index. The index file is made of fixed size pages, the
+ * first page holds the header and the rest are tree nodes. Leaf nodes hold
+ * the keys along with the location of their values in the data file and are
+ * linked together in key order, internal nodes hold separator keys and child
+ * page pointers.
+ *
+ * The header is laid out as:
+ *	file header (8 bytes) | root page ptr (8 bytes) | number of records (8 bytes) | max value size (8 bytes) |
+ *	max key size (8 bytes)
+ *
+ * A node is laid out as:
+ *	node type (1 byte) | number of keys (2 bytes) | next leaf ptr or leftmost child ptr (8 bytes) | entries
+ * where a leaf entry is:
+ *	key length (4 bytes) | data offset (8 bytes) | data length (4 bytes) | key
+ * and an internal entry is:
+ *	key length (4 bytes) | child ptr (8 bytes) | key
+ * The child following a separator key holds the keys greater than or equal to it.
+ *
+ * Concurrency is handled with a read/write lock on the first byte of the
+ * index file, readers share the tree and a writer has it to itself. Deleted
+ * keys are removed from their leaf but nodes are never merged.
+ */
+const (
+	btree_page_size           = 4096
+	btree_root_off            = file_header_size
+	btree_nrecords_off        = btree_root_off + ptr_size
+	btree_maxvalue_off        = btree_nrecords_off + 8
+	btree_maxkey_off          = btree_maxvalue_off + 8
+	btree_header_size         = btree_maxkey_off + 8
+	btree_node_header_size    = 11 // type(1) + nkeys(2) + next/leftmost child(8)
+	btree_leaf_entry_size     = 16 // keylen(4) + datoff(8) + datlen(4)
+	btree_internal_entry_size = 12 // keylen(4) + child(8)
+	btree_leaf_node           = 1
+	btree_internal_node       = 2
+	btree_key_max             = IDXLEN_MAX - idxrec_header_size
+)
+
+type btreeNode struct {
+	offset   int64
+	leaf     bool
+	keys     [][]byte
+	datoffs  []int64 // leaf only
+	datlens  []int64 // leaf only
+	children []int64 // internal only, one more than the keys
+	next     int64   // leaf only, the next leaf in key order
+}
+
+type BTreeIndex struct {
+	lockWaiter
+	idxFile  *os.File
+	datFile  *dataFile
+	opts     Options
+	name     string
+	root     int64
+	nrecords int64
+	maxValue int64
+	maxKey   int64
+}
+
+func (self *BTreeIndex) Open(name string, mode int) error {
+	self.name = name
+	opts, err := self.opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create index file %s", self.name+".idx")
+	}
+
+	self.datFile, err = openDataFile(self.name+".dat", mode)
+	if err != nil {
+		return fmt.Errorf("Failed to create data file %s", self.name+".dat")
+	}
+
+	isCreateMode := mode&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE || mode&(os.O_CREATE|os.O_TRUNC) == os.O_TRUNC
+	if isCreateMode {
+		/**
+		 * If the database was created we need to initialize it. We need to lock the entire file,
+		 * stat it, check its size and initialize it atomically
+		 */
+		if WriteLockW(self.idxFile.Fd(), 0, io.SeekStart, 0) != nil {
+			return errors.New("Failed to write lock index for init")
+		}
+		defer func() error {
+			return Unlock(self.idxFile.Fd(), 0, io.SeekStart, 0)
+		}()
+
+		idxFileInfo, err := self.idxFile.Stat()
+		if err != nil {
+			return errors.New("Failed to stat the index file")
+		}
+
+		if idxFileInfo.Size() == 0 {
+			/* An empty tree is a single empty leaf in the page following the header */
+			self.root = btree_page_size
+			self.nrecords = 0
+			self.maxValue = opts.MaxValueSize
+			self.maxKey = opts.MaxKeySize
+			err = self.writeHeader()
+			if err != nil {
+				return err
+			}
+			err = self.writeNode(&btreeNode{offset: self.root, leaf: true})
+			if err != nil {
+				return errors.New("Failed to initialize index file")
+			}
+		}
+	}
+	err = verifyFileHeader(self.idxFile, BTreeIndexType)
+	if err != nil {
+		self.Close()
+		return err
+	}
+	/* The maximum value and key sizes never change, read them once without locking */
+	buf := make([]byte, 16)
+	_, err = self.idxFile.ReadAt(buf, btree_maxvalue_off)
+	if err != nil {
+		self.Close()
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.maxValue = int64(byteOrder.Uint64(buf))
+	self.maxKey = int64(byteOrder.Uint64(buf[8:]))
+	return nil
+}
+
+func (self *BTreeIndex) Close() error {
+	if self.idxFile != nil {
+		err := self.idxFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if self.datFile != nil {
+		err := self.datFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Lock the tree and read the header. Readers share the lock, a writer
+ * holds it for the whole operation. The caller must call unlockTree.
+ */
+func (self *BTreeIndex) lockTree(isWriteLock bool) error {
+	var err error
+	if isWriteLock {
+		err = self.writeLockW(self.idxFile.Fd(), 0, io.SeekStart, 1)
+	} else {
+		err = self.readLockW(self.idxFile.Fd(), 0, io.SeekStart, 1)
+	}
+	if err != nil {
+		return err
+	}
+	err = self.readHeader()
+	if err != nil {
+		self.unlockTree()
+		return err
+	}
+	return nil
+}
+
+func (self *BTreeIndex) unlockTree() error {
+	return Unlock(self.idxFile.Fd(), 0, io.SeekStart, 1)
+}
+
+func (self *BTreeIndex) readHeader() error {
+	buf := make([]byte, btree_header_size)
+	_, err := self.idxFile.ReadAt(buf, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.root = decodePtr(buf[btree_root_off:])
+	self.nrecords = int64(byteOrder.Uint64(buf[btree_nrecords_off:]))
+	return nil
+}
+
+func (self *BTreeIndex) writeHeader() error {
+	header := make([]byte, btree_header_size)
+	copy(header, encodeFileHeader(BTreeIndexType))
+	byteOrder.PutUint64(header[btree_root_off:], uint64(self.root))
+	byteOrder.PutUint64(header[btree_nrecords_off:], uint64(self.nrecords))
+	byteOrder.PutUint64(header[btree_maxvalue_off:], uint64(self.maxValue))
+	byteOrder.PutUint64(header[btree_maxkey_off:], uint64(self.maxKey))
+	_, err := self.idxFile.WriteAt(header, 0)
+	return err
+}
+
+/**
+ * Size of the node once encoded, it has to be split if it does not fit
+ * in a page
+ */
+func (self *btreeNode) size() int {
+	size := btree_node_header_size
+	entrySize := btree_internal_entry_size
+	if self.leaf {
+		entrySize = btree_leaf_entry_size
+	}
+	for _, key := range self.keys {
+		size += entrySize + len(key)
+	}
+	return size
+}
+
+func (self *BTreeIndex) readNode(offset int64) (*btreeNode, error) {
+	if offset < btree_page_size || offset%btree_page_size != 0 {
+		return nil, fmt.Errorf("Invalid B+tree node pointer %d", offset)
+	}
+	buf := make([]byte, btree_page_size)
+	_, err := self.idxFile.ReadAt(buf, offset)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read B+tree node at offset %d: %w", offset, err)
+	}
+	node := &btreeNode{offset: offset}
+	switch buf[0] {
+	case btree_leaf_node:
+		node.leaf = true
+	case btree_internal_node:
+		node.leaf = false
+	default:
+		return nil, fmt.Errorf("Corrupted B+tree node at offset %d: invalid node type %d: %w", offset, buf[0], ErrCorrupt)
+	}
+	nkeys := int(byteOrder.Uint16(buf[1:]))
+	ptr := decodePtr(buf[3:])
+	if node.leaf {
+		node.next = ptr
+	} else {
+		node.children = append(node.children, ptr)
+	}
+
+	entrySize := btree_internal_entry_size
+	if node.leaf {
+		entrySize = btree_leaf_entry_size
+	}
+	pos := btree_node_header_size
+	for i := 0; i < nkeys; i++ {
+		if pos+entrySize > btree_page_size {
+			return nil, fmt.Errorf("Corrupted B+tree node at offset %d: %w", offset, ErrCorrupt)
+		}
+		keylen := int(byteOrder.Uint32(buf[pos:]))
+		if node.leaf {
+			datoff := decodePtr(buf[pos+4:])
+			datlen := int64(byteOrder.Uint32(buf[pos+12:]))
+			node.datoffs = append(node.datoffs, datoff)
+			node.datlens = append(node.datlens, datlen)
+		} else {
+			node.children = append(node.children, decodePtr(buf[pos+4:]))
+		}
+		pos += entrySize
+		if keylen < 1 || keylen > btree_key_max || pos+keylen > btree_page_size {
+			return nil, fmt.Errorf("Corrupted B+tree node at offset %d: invalid key length %d: %w", offset, keylen, ErrCorrupt)
+		}
+		node.keys = append(node.keys, buf[pos:pos+keylen])
+		pos += keylen
+	}
+	return node, nil
+}
+
+func (self *BTreeIndex) writeNode(node *btreeNode) error {
+	if node.size() > btree_page_size {
+		return fmt.Errorf("B+tree node at offset %d does not fit in a page", node.offset)
+	}
+	buf := make([]byte, btree_page_size)
+	if node.leaf {
+		buf[0] = btree_leaf_node
+		byteOrder.PutUint64(buf[3:], uint64(node.next))
+	} else {
+		buf[0] = btree_internal_node
+		byteOrder.PutUint64(buf[3:], uint64(node.children[0]))
+	}
+	byteOrder.PutUint16(buf[1:], uint16(len(node.keys)))
+	pos := btree_node_header_size
+	for i, key := range node.keys {
+		byteOrder.PutUint32(buf[pos:], uint32(len(key)))
+		if node.leaf {
+			byteOrder.PutUint64(buf[pos+4:], uint64(node.datoffs[i]))
+			byteOrder.PutUint32(buf[pos+12:], uint32(node.datlens[i]))
+			pos += btree_leaf_entry_size
+		} else {
+			byteOrder.PutUint64(buf[pos+4:], uint64(node.children[i+1]))
+			pos += btree_internal_entry_size
+		}
+		copy(buf[pos:], key)
+		pos += len(key)
+	}
+	bytesWritten, err := self.idxFile.WriteAt(buf, node.offset)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Error while writing B+tree node")
+	}
+	return nil
+}
+
+/**
+ * Allocate a page at the end of the index file. Only called with the tree
+ * write locked, so nobody else can be growing the file.
+ */
+func (self *BTreeIndex) allocNode(leaf bool) (*btreeNode, error) {
+	offset, err := self.idxFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if offset%btree_page_size != 0 {
+		offset += btree_page_size - offset%btree_page_size
+	}
+	node := &btreeNode{offset: offset, leaf: leaf}
+	if !leaf {
+		node.children = []int64{0}
+	}
+	return node, self.writeNode(node)
+}
+
+/**
+ * Position of the child to follow in an internal node for the given key
+ */
+func (self *btreeNode) childIndex(key []byte) int {
+	return sort.Search(len(self.keys), func(i int) bool {
+		return bytes.Compare(self.keys[i], key) > 0
+	})
+}
+
+/**
+ * Position of the key in a leaf node, or where it should be inserted
+ */
+func (self *btreeNode) keyIndex(key []byte) (int, bool) {
+	i := sort.Search(len(self.keys), func(i int) bool {
+		return bytes.Compare(self.keys[i], key) >= 0
+	})
+	return i, i < len(self.keys) && bytes.Equal(self.keys[i], key)
+}
+
+type btreePathEntry struct {
+	node  *btreeNode
+	child int
+}
+
+/**
+ * Walk down from the root to the leaf which should hold the key, returns
+ * the leaf and the internal nodes on the way along with the child followed
+ * in each of them. A nil key leads to the leftmost leaf.
+ *
+ * A node holding keys past the separator which bounds it in its parent is
+ * left over from a split cut short by a crash, those keys were already
+ * moved to the sibling. They are dropped here, and a writer which writes
+ * the node back finishes the split.
+ */
+func (self *BTreeIndex) findLeaf(key []byte) (*btreeNode, []btreePathEntry, error) {
+	var path []btreePathEntry
+	node, err := self.readNode(self.root)
+	if err != nil {
+		return nil, nil, err
+	}
+	for !node.leaf {
+		node.trim(upperBound(path))
+		child := 0
+		if key != nil {
+			child = node.childIndex(key)
+		}
+		path = append(path, btreePathEntry{node: node, child: child})
+		node, err = self.readNode(node.children[child])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	bound := upperBound(path)
+	if node.trim(bound) {
+		sibling, _, err := self.findLeaf(bound)
+		if err != nil {
+			return nil, nil, err
+		}
+		node.next = sibling.offset
+	}
+	return node, path, nil
+}
+
+/**
+ * The smallest key past the node the path leads to, nil for the rightmost
+ * node of its level
+ */
+func upperBound(path []btreePathEntry) []byte {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].child < len(path[i].node.keys) {
+			return path[i].node.keys[path[i].child]
+		}
+	}
+	return nil
+}
+
+/**
+ * Drop the keys from bound onwards, along with the children following them
+ * in an internal node. Returns whether there were any.
+ */
+func (self *btreeNode) trim(bound []byte) bool {
+	if bound == nil {
+		return false
+	}
+	i := sort.Search(len(self.keys), func(i int) bool {
+		return bytes.Compare(self.keys[i], bound) >= 0
+	})
+	if i == len(self.keys) {
+		return false
+	}
+	self.keys = self.keys[:i]
+	if self.leaf {
+		self.datoffs = self.datoffs[:i]
+		self.datlens = self.datlens[:i]
+	} else {
+		self.children = self.children[:i+1]
+	}
+	return true
+}
+
+func (self *BTreeIndex) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of the given key, returns nil if the key does not exist
+ */
+func (self *BTreeIndex) FetchBytes(key []byte) ([]byte, error) {
+	err := self.lockTree(false)
+	if err != nil {
+		return nil, err
+	}
+	defer self.unlockTree()
+	leaf, _, err := self.findLeaf(key)
+	if err != nil {
+		return nil, err
+	}
+	i, found := leaf.keyIndex(key)
+	if !found {
+		return nil, nil
+	}
+	return self.datFile.readValue(leaf.datoffs[i], leaf.datlens[i])
+}
+
+func (self *BTreeIndex) FetchAll() (map[string]string, error) {
+	records := make(map[string]string)
+	err := self.Range(nil, nil, func(key []byte, value []byte) error {
+		records[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+/**
+ * Call fn for every key in [start, end) in key order. A nil start begins
+ * with the smallest key and a nil end goes on until the largest one. The
+ * tree is read locked while fn runs, so fn must not modify the database.
+ */
+func (self *BTreeIndex) Range(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	err := self.lockTree(false)
+	if err != nil {
+		return err
+	}
+	defer self.unlockTree()
+	leaf, path, err := self.findLeaf(start)
+	if err != nil {
+		return err
+	}
+	i := 0
+	if start != nil {
+		i, _ = leaf.keyIndex(start)
+	}
+	for {
+		for ; i < len(leaf.keys); i++ {
+			if end != nil && bytes.Compare(leaf.keys[i], end) >= 0 {
+				return nil
+			}
+			value, err := self.datFile.readValue(leaf.datoffs[i], leaf.datlens[i])
+			if err != nil {
+				return err
+			}
+			err = fn(leaf.keys[i], value)
+			if err != nil {
+				return err
+			}
+		}
+		/* the next leaf is found from the root rather than through the
+		 * next pointer, which skips the sibling of a leaf whose split was
+		 * cut short */
+		bound := upperBound(path)
+		if bound == nil {
+			return nil
+		}
+		leaf, path, err = self.findLeaf(bound)
+		if err != nil {
+			return err
+		}
+		i = 0
+	}
+}
+
+func (self *BTreeIndex) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *BTreeIndex) DeleteBytes(key []byte) error {
+	err := self.lockTree(true)
+	if err != nil {
+		return err
+	}
+	defer self.unlockTree()
+	leaf, _, err := self.findLeaf(key)
+	if err != nil {
+		return err
+	}
+	i, found := leaf.keyIndex(key)
+	if !found {
+		return nil
+	}
+	leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+	leaf.datoffs = append(leaf.datoffs[:i], leaf.datoffs[i+1:]...)
+	leaf.datlens = append(leaf.datlens[:i], leaf.datlens[i+1:]...)
+	err = self.writeNode(leaf)
+	if err != nil {
+		return err
+	}
+	self.nrecords--
+	return self.writeHeader()
+}
+
+func (self *BTreeIndex) Insert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Insert)
+}
+
+func (self *BTreeIndex) Update(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Update)
+}
+
+func (self *BTreeIndex) Upsert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Upsert)
+}
+
+func (self *BTreeIndex) StoreBytes(key []byte, value []byte, op StoreOp) error {
+	return self.store(key, value, op)
+}
+
+func (self *BTreeIndex) store(key []byte, value []byte, op StoreOp) error {
+	valueLen := int64(len(value))
+	err := checkSizes(key, value, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
+	}
+
+	err = self.lockTree(true)
+	if err != nil {
+		return err
+	}
+	defer self.unlockTree()
+	leaf, path, err := self.findLeaf(key)
+	if err != nil {
+		return err
+	}
+	i, found := leaf.keyIndex(key)
+	if found {
+		if op == Insert {
+			return fmt.Errorf("%w: %s", ErrKeyExists, key)
+		}
+		if valueLen == leaf.datlens[i] {
+			return self.datFile.overwriteValue(leaf.datoffs[i], value)
+		}
+		datoff, err := self.datFile.appendValue(value)
+		if err != nil {
+			return err
+		}
+		leaf.datoffs[i] = datoff
+		leaf.datlens[i] = valueLen
+		return self.writeNode(leaf)
+	}
+
+	if op == Update {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	datoff, err := self.datFile.appendValue(value)
+	if err != nil {
+		return err
+	}
+	leaf.keys = insertKey(leaf.keys, i, append([]byte(nil), key...))
+	leaf.datoffs = insertInt64(leaf.datoffs, i, datoff)
+	leaf.datlens = insertInt64(leaf.datlens, i, valueLen)
+	err = self.splitUp(leaf, path)
+	if err != nil {
+		return err
+	}
+	self.nrecords++
+	return self.writeHeader()
+}
+
+/**
+ * Write the modified node, splitting it and inserting the separator key in
+ * the parent as long as the nodes on the path do not fit in a page. A new
+ * root is added when the root itself is split.
+ *
+ * A split node keeps the lower half of its keys, so it is only written once
+ * the level above points to its new sibling, top down. Until then the old
+ * node still holds every key and findLeaf drops the ones moved out of it.
+ */
+func (self *BTreeIndex) splitUp(node *btreeNode, path []btreePathEntry) error {
+	var split []*btreeNode
+	for node.size() > btree_page_size {
+		sibling, err := self.allocNode(node.leaf)
+		if err != nil {
+			return err
+		}
+		separator := node.split(sibling)
+		err = self.writeNode(sibling)
+		if err != nil {
+			return err
+		}
+		split = append(split, node)
+
+		if len(path) == 0 {
+			root, err := self.allocNode(false)
+			if err != nil {
+				return err
+			}
+			root.keys = [][]byte{separator}
+			root.children = []int64{node.offset, sibling.offset}
+			err = self.writeNode(root)
+			if err != nil {
+				return err
+			}
+			self.root = root.offset
+			err = self.writeHeader()
+			if err != nil {
+				return err
+			}
+			return self.writeSplit(split)
+		}
+		parent := path[len(path)-1]
+		path = path[:len(path)-1]
+		node = parent.node
+		node.keys = insertKey(node.keys, parent.child, separator)
+		node.children = insertInt64(node.children, parent.child+1, sibling.offset)
+	}
+	err := self.writeNode(node)
+	if err != nil {
+		return err
+	}
+	return self.writeSplit(split)
+}
+
+/**
+ * Write the lower halves of the split nodes, from the top of the tree down
+ */
+func (self *BTreeIndex) writeSplit(split []*btreeNode) error {
+	for i := len(split) - 1; i >= 0; i-- {
+		err := self.writeNode(split[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Move the upper half (by encoded size) of the node into the empty sibling,
+ * returns the separator key to insert in the parent
+ */
+func (self *btreeNode) split(sibling *btreeNode) []byte {
+	entrySize := btree_internal_entry_size
+	if self.leaf {
+		entrySize = btree_leaf_entry_size
+	}
+	half := self.size() / 2
+	size := btree_node_header_size
+	mid := 0
+	for mid < len(self.keys)-1 && size < half {
+		size += entrySize + len(self.keys[mid])
+		mid++
+	}
+	if mid == 0 {
+		mid = 1
+	}
+
+	if self.leaf {
+		sibling.keys = append([][]byte(nil), self.keys[mid:]...)
+		sibling.datoffs = append([]int64(nil), self.datoffs[mid:]...)
+		sibling.datlens = append([]int64(nil), self.datlens[mid:]...)
+		sibling.next = self.next
+		self.keys = self.keys[:mid]
+		self.datoffs = self.datoffs[:mid]
+		self.datlens = self.datlens[:mid]
+		self.next = sibling.offset
+		return append([]byte(nil), sibling.keys[0]...)
+	}
+
+	/* The middle key moves up to the parent */
+	if mid > len(self.keys)-2 {
+		mid = len(self.keys) - 2
+	}
+	separator := self.keys[mid]
+	sibling.keys = append([][]byte(nil), self.keys[mid+1:]...)
+	sibling.children = append([]int64(nil), self.children[mid+1:]...)
+	self.keys = self.keys[:mid]
+	self.children = self.children[:mid+1]
+	return separator
+}
+
+func insertKey(keys [][]byte, i int, key []byte) [][]byte {
+	keys = append(keys, nil)
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+func insertInt64(vals []int64, i int, val int64) []int64 {
+	vals = append(vals, 0)
+	copy(vals[i+1:], vals[i:])
+	vals[i] = val
+	return vals
+}
@@ -0,0 +1,418 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const (
+	btree_test_db_name = "btree_index_test"
+)
+
+func TestCreateBTreeIndex(t *testing.T) {
+	_, err := btreeOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer btreeRemoveDB(btree_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxFinfo, err := os.Stat(btree_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxFinfo.Size() != 2*btree_page_size {
+		t.Errorf("Initial index file size %d, want %d", idxFinfo.Size(), 2*btree_page_size)
+	}
+	idxType, version, err := ReadFileHeader(btree_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxType != BTreeIndexType || version != FormatVersion {
+		t.Errorf("Expected index type %d version %d, got type %d version %d", BTreeIndexType, FormatVersion, idxType, version)
+	}
+}
+
+func TestStoreFetchDeleteBTreeIndex(t *testing.T) {
+	btreeIndex, err := btreeOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer btreeRemoveDB(btree_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	err = btreeIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = btreeIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = btreeIndex.Insert("k1", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when inserting an existing key")
+	}
+	err = btreeIndex.Update("k3", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when updating a missing key")
+	}
+	err = btreeIndex.Update("k1", "v1-updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = btreeIndex.Upsert("k3", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = btreeIndex.Delete("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"k1": "v1-updated", "k2": "", "k3": "v3"}
+	for k, v := range expected {
+		val, err := btreeIndex.Fetch(k)
+		if v == "" && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+	if btreeIndex.nrecords != 2 {
+		t.Errorf("Expected 2 records in the header, got %d", btreeIndex.nrecords)
+	}
+}
+
+func TestSplitAndRangeBTreeIndex(t *testing.T) {
+	btreeIndex, err := btreeOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer btreeRemoveDB(btree_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrecords := 20000
+	keys := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%06d", i)
+	}
+	/* insert in random order to exercise splits all over the tree */
+	for _, i := range rand.New(rand.NewSource(1)).Perm(nrecords) {
+		err = btreeIndex.Insert(keys[i], "val_"+keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i += 2 {
+		err = btreeIndex.Delete(keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	btreeIndex.Close()
+
+	btreeIndex, err = btreeOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	var scanned []string
+	err = btreeIndex.Range(nil, nil, func(key []byte, value []byte) error {
+		if string(value) != "val_"+string(key) {
+			t.Errorf("Expected value val_%s for key %s, got %s", key, key, value)
+		}
+		scanned = append(scanned, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != nrecords/2 {
+		t.Fatalf("Expected %d keys in the scan, got %d", nrecords/2, len(scanned))
+	}
+	if !sort.StringsAreSorted(scanned) {
+		t.Errorf("Keys returned by the scan are not sorted")
+	}
+	for i, k := range scanned {
+		if k != keys[2*i+1] {
+			t.Fatalf("Expected key %s at position %d of the scan, got %s", keys[2*i+1], i, k)
+		}
+	}
+
+	/* [start, end) where start is a deleted key */
+	scanned = nil
+	err = btreeIndex.Range([]byte(keys[1000]), []byte(keys[1010]), func(key []byte, value []byte) error {
+		scanned = append(scanned, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{keys[1001], keys[1003], keys[1005], keys[1007], keys[1009]}
+	if fmt.Sprint(scanned) != fmt.Sprint(expected) {
+		t.Errorf("Expected range %v, got %v", expected, scanned)
+	}
+
+	valuesMap, err := btreeIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valuesMap) != nrecords/2 {
+		t.Errorf("Expected %d records from FetchAll, got %d", nrecords/2, len(valuesMap))
+	}
+}
+
+/**
+ * A split writes the sibling and the parent before the node it splits, a
+ * crash in between leaves the moved keys in both. The ones in the node must
+ * not show up in a scan once the sibling changes.
+ */
+func TestCrashDuringSplitBTreeIndex(t *testing.T) {
+	btreeIndex, err := btreeOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer btreeRemoveDB(btree_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrecords := 2000
+	keys := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%06d", i)
+		err = btreeIndex.Insert(keys[i], "val_"+keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	/* the first half of a split, the node itself is not written */
+	leaf, path, err := btreeIndex.findLeaf([]byte(keys[nrecords/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) == 0 {
+		t.Fatal("Expected the tree to have more than one level")
+	}
+	sibling, err := btreeIndex.allocNode(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	separator := leaf.split(sibling)
+	err = btreeIndex.writeNode(sibling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := path[len(path)-1]
+	parent.node.keys = insertKey(parent.node.keys, parent.child, separator)
+	parent.node.children = insertInt64(parent.node.children, parent.child+1, sibling.offset)
+	err = btreeIndex.writeNode(parent.node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	btreeIndex.Close()
+
+	btreeIndex, err = btreeOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	moved := string(separator)
+	err = btreeIndex.Update(moved, "new_"+moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{moved: "new_" + moved}
+	for _, k := range keys {
+		if k != moved {
+			values[k] = "val_" + k
+		}
+	}
+	checkRange := func() {
+		var scanned []string
+		err := btreeIndex.Range(nil, nil, func(key []byte, value []byte) error {
+			if string(value) != values[string(key)] {
+				t.Errorf("Expected value %s for key %s, got %s", values[string(key)], key, value)
+			}
+			scanned = append(scanned, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(scanned) != len(values) {
+			t.Fatalf("Expected %d keys in the scan, got %d", len(values), len(scanned))
+		}
+		if !sort.StringsAreSorted(scanned) {
+			t.Errorf("Keys returned by the scan are not sorted")
+		}
+	}
+	checkRange()
+
+	/* a store to the split node writes it back and finishes the split */
+	lower := string(leaf.keys[0]) + "_0"
+	err = btreeIndex.Insert(lower, "val_"+lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values[lower] = "val_" + lower
+	checkRange()
+	for i := 0; i < nrecords; i++ {
+		k := fmt.Sprintf("%s_%d", keys[nrecords/2], i)
+		err = btreeIndex.Insert(k, "val_"+k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[k] = "val_" + k
+	}
+	checkRange()
+	for k, v := range values {
+		val, err := btreeIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %s for key %s, got %s", v, k, val)
+		}
+	}
+}
+
+func TestLargeKeysBTreeIndex(t *testing.T) {
+	btreeIndex, err := btreeOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer btreeRemoveDB(btree_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	/* keys of the maximum length only fit a few to a page */
+	nrecords := 200
+	keys := make([][]byte, nrecords)
+	for i := range keys {
+		keys[i] = bytes.Repeat([]byte{byte(i)}, btree_key_max)
+		err = btreeIndex.StoreBytes(keys[i], keys[i][:i], Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, k := range keys {
+		val, err := btreeIndex.FetchBytes(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, k[:i]) {
+			t.Errorf("Expected value of %d bytes for key %d, got %d bytes", i, i, len(val))
+		}
+	}
+	err = btreeIndex.StoreBytes(make([]byte, btree_key_max+1), []byte("v"), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing a key longer than %d bytes", btree_key_max)
+	}
+}
+
+func TestConcurrentReadWriteBTreeIndex(t *testing.T) {
+	var wg sync.WaitGroup
+	btreeOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer btreeRemoveDB(btree_test_db_name)
+	nrecords := 10000
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		vals[i] = fmt.Sprintf("val_%d", i)
+	}
+	nthreads := 20
+	step := nrecords / nthreads
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		start := i * step
+		end := start + step
+		go btreeWork(t, &wg, keys[start:end], vals[start:end])
+	}
+	wg.Wait()
+}
+
+func btreeWork(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string) {
+	defer wg.Done()
+	btreeIndex, err := btreeOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer btreeIndex.Close()
+	for i, k := range keys {
+		err := btreeIndex.Insert(k, vals[i])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for i, k := range keys {
+		val, err := btreeIndex.Fetch(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if val != vals[i] {
+			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
+		}
+	}
+
+	for _, k := range keys {
+		err := btreeIndex.Delete(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, k := range keys {
+		_, err := btreeIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
+			return
+		}
+	}
+}
+
+func btreeOpenNewDB(removeExisting bool, mode int) (*BTreeIndex, error) {
+	if removeExisting {
+		btreeRemoveDB(btree_test_db_name)
+	}
+	btreeIndex := new(BTreeIndex)
+	err := btreeIndex.Open(btree_test_db_name, mode)
+	return btreeIndex, err
+}
+
+func btreeRemoveDB(name string) {
+	os.Remove(name + ".idx")
+	os.Remove(name + ".dat")
+}
@@ -0,0 +1,188 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const (
+	checksum_test_db_name = "checksum_test"
+)
+
+func TestCorruptValue(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, func(t *testing.T, idxType IndexType) {
+		testCorruptRecord(t, idxType, ".dat", []byte("value_of_victim"))
+	})
+}
+
+func TestCorruptIdxRecord(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, func(t *testing.T, idxType IndexType) {
+		recExt := ".idx"
+		if idxType == LinearHashIndexType {
+			recExt = ".bkt"
+		}
+		testCorruptRecord(t, idxType, recExt, []byte("victim"))
+	})
+}
+
+/**
+ * Flip a byte of the record of the key "victim" in the given file, reads of
+ * the key fail with ErrCorrupt until the index is opened with
+ * QuarantineCorrupt, then the record is skipped and logged
+ */
+func testCorruptRecord(t *testing.T, idxType IndexType, ext string, pattern []byte) {
+	defer os.Remove(checksum_test_db_name + quarantine_name_ext)
+	idx := openNewIndex(t, checksum_test_db_name, idxType, Options{InitialBuckets: 1})
+	/* all the records share a single chain, the victim is at its end */
+	err := idx.Insert("victim", "value_of_victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		err = idx.Insert(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Close()
+
+	corruptOff := flipByte(t, checksum_test_db_name+ext, pattern)
+	idx, err = NewIndex(idxType, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Open(checksum_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.Fetch("victim")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt fetching a corrupt record, got %v", err)
+	}
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected a CorruptError, got %T", err)
+	}
+	if corruptErr.File != checksum_test_db_name+ext {
+		t.Errorf("Expected the corrupt record to be in %s, got %s", checksum_test_db_name+ext, corruptErr.File)
+	}
+	if corruptErr.Offset > corruptOff || corruptOff-corruptErr.Offset > int64(idxrec_header_size+len(pattern)) {
+		t.Errorf("Expected the corrupt record to start right before offset %d, got %d", corruptOff, corruptErr.Offset)
+	}
+	_, err = idx.FetchAll()
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt fetching all the records, got %v", err)
+	}
+	val, err := idx.Fetch("key3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "value3" {
+		t.Errorf("Expected value3 for key3, got %s", val)
+	}
+	idx.Close()
+
+	idx, err = NewIndex(idxType, Options{QuarantineCorrupt: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Open(checksum_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	for i := 0; i < 2; i++ {
+		_, err = idx.Fetch("victim")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected a quarantined record not to be found, got error %v", err)
+		}
+	}
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Errorf("Expected the 5 healthy records, got %d", len(records))
+	}
+	if _, ok := records["victim"]; ok {
+		t.Errorf("Expected the quarantined record to be skipped")
+	}
+	lines := readLines(t, checksum_test_db_name+quarantine_name_ext)
+	if len(lines) != 1 {
+		t.Fatalf("Expected the corrupt record to be logged once, got %q", lines)
+	}
+	if lines[0] != corruptErr.Error() {
+		t.Errorf("Expected %q in the quarantine log, got %q", corruptErr.Error(), lines[0])
+	}
+}
+
+/**
+ * Flip the last byte of the first occurrence of pattern in the file, returns
+ * the offset of the byte
+ */
+func flipByte(t *testing.T, fileName string, pattern []byte) int64 {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(buf, pattern)
+	if pos < 0 {
+		t.Fatalf("%q not found in %s", pattern, fileName)
+	}
+	off := int64(pos + len(pattern) - 1)
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt([]byte{buf[off] ^ 0xff}, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return off
+}
+
+func readLines(t *testing.T, fileName string) []string {
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
@@ -0,0 +1,651 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * Compaction rewrites the live records of a database into fresh files and
+ * renames them over the old ones. Handles which still have the old files
+ * open need to notice and reopen the database, so every operation of a
+ * handle takes a shared flock(2) lock on its index file, and then checks
+ * whether the index file is still the one under the database name. Compact
+ * holds the lock exclusively from before it reads the old files until it is
+ * done renaming the new ones. CompactWithLog only holds it to start the
+ * copy and to catch up with the writes made meanwhile, which its ChangeLog
+ * keeps track of. flock locks are independent of the fcntl record locks
+ * taken by the indexes, so the two never conflict, not even with the record
+ * locks which run to the end of the file.
+ *
+ * Compactions of the same database keep out of each other's way with a
+ * flock lock on <name>.compact.lock, held for the whole compaction.
+ *
+ * The LSM tree and Bitcask indexes already rewrite their files online, for
+ * them Compact runs their compaction right away.
+ */
+const (
+	compact_name_ext      = ".compact"
+	compact_lock_name_ext = ".compact.lock"
+	compact_max_retry     = 16
+	compact_page_size     = 256 // records copied by a single Scan or Range
+)
+
+/**
+ * Implemented by the indexes which are compacted by copying their records
+ * into a new database created with the same options
+ */
+type rewritableIndex interface {
+	BrickIndex
+	options() Options
+}
+
+/**
+ * Implemented by the indexes which compact their own files
+ */
+type selfCompactingIndex interface {
+	BrickIndex
+	compact() error
+}
+
+/**
+ * Take the lock held by an operation of a database handle, or by Compact if
+ * isWriteLock is set. idxFile has to be the index file of the database.
+ */
+func LockDatabase(idxFile *os.File, isWriteLock bool) error {
+	how := unix.LOCK_SH
+	if isWriteLock {
+		how = unix.LOCK_EX
+	}
+	return flock(idxFile, how)
+}
+
+/**
+ * Like LockDatabase, but gives up once ctx is done
+ */
+func LockDatabaseContext(ctx context.Context, idxFile *os.File, isWriteLock bool) error {
+	if ctx == nil || ctx.Done() == nil {
+		return LockDatabase(idxFile, isWriteLock)
+	}
+	how := unix.LOCK_SH
+	if isWriteLock {
+		how = unix.LOCK_EX
+	}
+	return pollLock(ctx, func() error {
+		err := flock(idxFile, how|unix.LOCK_NB)
+		if err == unix.EWOULDBLOCK {
+			return fmt.Errorf("%w: %s", ErrLocked, idxFile.Name())
+		}
+		return err
+	})
+}
+
+func UnlockDatabase(idxFile *os.File) error {
+	return flock(idxFile, unix.LOCK_UN)
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+/**
+ * Check whether the open index file has been replaced by a compaction, the
+ * database has to be reopened if it has
+ */
+func IsObsolete(idxFile *os.File) (bool, error) {
+	openInfo, err := idxFile.Stat()
+	if err != nil {
+		return false, err
+	}
+	nameInfo, err := os.Stat(idxFile.Name())
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(openInfo, nameInfo), nil
+}
+
+/**
+ * Reclaim the space taken up by deleted and overwritten records. Returns the
+ * number of bytes by which the database shrunk. The handles wait for the
+ * whole copy, see CompactWithLog.
+ */
+func Compact(name string) (int64, error) {
+	return CompactWithLog(name, nil)
+}
+
+/**
+ * The writes made to a database while CompactWithLog copies it. Start is
+ * called with the database locked against the handles, and CatchUp with it
+ * locked again once the copy is done. CatchUp has to apply every write
+ * which finished after Start to dst. The copy may or may not have them
+ * already, applying a write the copy has must leave it unchanged. Finish is
+ * called once the compaction is over, whether or not it succeeded.
+ */
+type ChangeLog interface {
+	Start() error
+	CatchUp(dst BrickIndex) error
+	Finish()
+}
+
+/**
+ * Like Compact, but with changes the handles only wait while the writes
+ * made during the copy are caught up with and the files are renamed. The
+ * copy reads the database a bucket or a page at a time, without holding
+ * any lock between them.
+ */
+func CompactWithLog(name string, changes ChangeLog) (int64, error) {
+	guard, err := lockCompaction(name, true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlockCompaction(guard)
+	err = recoverCompactionLocked(name)
+	if err != nil {
+		return 0, err
+	}
+	idxType, version, err := ReadFileHeader(name + ".idx")
+	if err != nil {
+		return 0, err
+	}
+	if version == LegacyFormatVersion {
+		return 0, ErrLegacyFormat
+	}
+	before, err := databaseSize(name, idxType)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := NewIndex(idxType, Options{})
+	if err != nil {
+		return 0, err
+	}
+	if selfCompacting, ok := idx.(selfCompactingIndex); ok {
+		err = compactInPlace(name, selfCompacting)
+	} else if changes == nil {
+		err = withDatabaseLocked(name, func() error {
+			return rewrite(name, idxType, nil, func(fn func() error) error { return fn() })
+		})
+	} else {
+		err = rewrite(name, idxType, changes, func(fn func() error) error { return withDatabaseLocked(name, fn) })
+	}
+	if err != nil {
+		return 0, err
+	}
+	after, err := databaseSize(name, idxType)
+	if err != nil {
+		return 0, err
+	}
+	return before - after, nil
+}
+
+func compactInPlace(name string, idx selfCompactingIndex) error {
+	err := idx.Open(name, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	err = idx.compact()
+	closeErr := idx.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/**
+ * Copy the live records into a new database and rename its files over the
+ * ones of the old database. lock runs its function with the database locked
+ * against the handles, it is taken to open the files and start the change
+ * log, and again to catch up with the changes and rename the files. The new
+ * files are flushed before they are renamed, see swapFiles.
+ */
+func rewrite(name string, idxType IndexType, changes ChangeLog, lock func(fn func() error) error) error {
+	tmpName := name + compact_name_ext
+	exts := IndexFileExts(idxType)
+	removeFiles(tmpName, exts)
+	var src, dst BrickIndex
+	var srcInfo os.FileInfo
+	err := lock(func() error {
+		var err error
+		srcInfo, err = os.Stat(name + ".idx")
+		if err != nil {
+			return err
+		}
+		src, dst, err = openRewrite(name, tmpName, idxType)
+		if err != nil || changes == nil {
+			return err
+		}
+		err = changes.Start()
+		if err != nil {
+			src.Close()
+			dst.Close()
+		}
+		return err
+	})
+	if err != nil {
+		removeFiles(tmpName, exts)
+		return err
+	}
+	if changes != nil {
+		defer changes.Finish()
+	}
+	err = copyRecords(src, dst)
+	src.Close()
+	swapping := false
+	if err == nil {
+		err = lock(func() error {
+			finfo, err := os.Stat(name + ".idx")
+			if err != nil {
+				return err
+			}
+			if !os.SameFile(srcInfo, finfo) {
+				return fmt.Errorf("Database %s was replaced while it was copied", name)
+			}
+			if changes != nil {
+				err = changes.CatchUp(dst)
+				if err != nil {
+					return err
+				}
+			}
+			err = dst.Close()
+			dst = nil
+			if err == nil {
+				err = SyncDatabase(tmpName, idxType)
+			}
+			if err != nil {
+				return err
+			}
+			swapping = true
+			return swapFiles(name, tmpName, exts)
+		})
+	}
+	if dst != nil {
+		dst.Close()
+	}
+	if err != nil {
+		/* once the renames have started the copy is the database, RecoverCompaction moves in the rest */
+		if !swapping {
+			removeFiles(tmpName, exts)
+		}
+		return fmt.Errorf("Failed to compact database %s: %w", name, err)
+	}
+	return nil
+}
+
+/**
+ * Open the database and a new one under tmpName, created with the options
+ * of the database
+ */
+func openRewrite(name string, tmpName string, idxType IndexType) (BrickIndex, BrickIndex, error) {
+	src, err := NewIndex(idxType, Options{})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = src.Open(name, os.O_RDWR)
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := NewIndex(idxType, src.(rewritableIndex).options())
+	if err == nil {
+		err = dst.Open(tmpName, os.O_RDWR|os.O_CREATE)
+	}
+	if err != nil {
+		src.Close()
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+/**
+ * Copy the records of src into dst compact_page_size records at a time.
+ * The hash indexes are read with Scan and the B+tree with Range, which
+ * holds no lock between the pages either. A key copied twice, because it
+ * was written meanwhile, is overwritten.
+ */
+func copyRecords(src BrickIndex, dst BrickIndex) error {
+	store := func(key []byte, value []byte) error {
+		return dst.StoreBytes(key, value, Upsert)
+	}
+	if scanner, ok := src.(ScannableIndex); ok {
+		var cursor []byte
+		for {
+			var err error
+			cursor, err = scanner.Scan(cursor, compact_page_size, false, store)
+			if err != nil || cursor == nil {
+				return err
+			}
+		}
+	}
+	ordered, ok := src.(OrderedIndex)
+	if !ok {
+		return fmt.Errorf("Index type %T does not support scans", src)
+	}
+	var start []byte
+	for {
+		var last []byte
+		n := 0
+		err := ordered.Range(start, nil, func(key []byte, value []byte) error {
+			if n == compact_page_size {
+				return errPageFull
+			}
+			n++
+			last = append(last[:0], key...)
+			return store(key, value)
+		})
+		if err != errPageFull {
+			return err
+		}
+		/* the smallest key after the last one copied */
+		start = append(last, 0)
+	}
+}
+
+var errPageFull = errors.New("page full")
+
+/**
+ * Rename the files of the copy under tmpName over the ones of the database,
+ * the index file goes last. The handles check it to find out they need to
+ * reopen, and a crash in between leaves it behind to tell finishSwap the
+ * copy was complete.
+ */
+func swapFiles(name string, tmpName string, exts []string) error {
+	for i := len(exts) - 1; i >= 0; i-- {
+		err := os.Rename(tmpName+exts[i], name+exts[i])
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(name)
+}
+
+/**
+ * Move in the rest of a copy whose files were being renamed over the
+ * database by swapFiles when it crashed. If the index file of the copy is
+ * still there while another file of the copy is gone, the copy was
+ * complete. Returns whether there was such a swap to finish.
+ */
+func finishSwap(name string, tmpName string) (bool, error) {
+	idxType, _, err := ReadFileHeader(tmpName + ".idx")
+	if err != nil {
+		/* no copy, or one which did not get as far as its header */
+		return false, nil
+	}
+	exts := IndexFileExts(idxType)
+	moving := false
+	for _, ext := range exts {
+		_, err = os.Stat(tmpName + ext)
+		if os.IsNotExist(err) {
+			moving = true
+		}
+	}
+	if !moving {
+		return false, nil
+	}
+	for i := len(exts) - 1; i >= 0; i-- {
+		err = os.Rename(tmpName+exts[i], name+exts[i])
+		if err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+/**
+ * Finish a compaction which crashed while it renamed the new files over the
+ * old ones, or remove the copy of one which crashed before. The handles call
+ * it before they open the database, so they never open the old index file
+ * along with a new data file. Leaves the files alone while a compaction is
+ * running.
+ */
+func RecoverCompaction(name string) error {
+	_, err := os.Stat(name + compact_name_ext + ".idx")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	guard, err := lockCompaction(name, false)
+	if errors.Is(err, ErrLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlockCompaction(guard)
+	return recoverCompactionLocked(name)
+}
+
+/**
+ * RecoverCompaction with the compaction lock held. The database is locked
+ * against the handles too, one which opened it in the middle reopens it.
+ */
+func recoverCompactionLocked(name string) error {
+	tmpName := name + compact_name_ext
+	_, err := os.Stat(tmpName + ".idx")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return withDatabaseLocked(name, func() error {
+		finished, err := finishSwap(name, tmpName)
+		if err != nil || finished {
+			return err
+		}
+		idxType, _, err := ReadFileHeader(name + ".idx")
+		if err != nil {
+			return err
+		}
+		removeFiles(tmpName, IndexFileExts(idxType))
+		return nil
+	})
+}
+
+/**
+ * Take the lock which keeps out other compactions, a flock(2) lock on
+ * <name>.compact.lock. Without wait it fails with ErrLocked if another
+ * compaction holds it. The file is removed when the lock is released, a
+ * compaction which opened it before has to retry with a new one.
+ */
+func lockCompaction(name string, wait bool) (*os.File, error) {
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	for i := 0; i < compact_max_retry; i++ {
+		guard, err := os.OpenFile(name+compact_lock_name_ext, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = flock(guard, how)
+		if err == unix.EWOULDBLOCK {
+			guard.Close()
+			return nil, fmt.Errorf("%w: %s", ErrLocked, guard.Name())
+		}
+		if err != nil {
+			guard.Close()
+			return nil, err
+		}
+		obsolete, err := IsObsolete(guard)
+		if err == nil && !obsolete {
+			return guard, nil
+		}
+		guard.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Failed to lock database %s for compaction", name)
+}
+
+func unlockCompaction(guard *os.File) {
+	os.Remove(guard.Name())
+	guard.Close()
+}
+
+/**
+ * Run fn with the database locked exclusively against the handles and
+ * other compactions
+ */
+func withDatabaseLocked(name string, fn func() error) error {
+	for i := 0; i < compact_max_retry; i++ {
+		guard, err := os.OpenFile(name+".idx", os.O_RDONLY, 0644)
+		if err != nil {
+			return err
+		}
+		err = LockDatabase(guard, true)
+		if err != nil {
+			guard.Close()
+			return err
+		}
+		/* Someone else may have compacted the database while we waited for the lock */
+		obsolete, err := IsObsolete(guard)
+		if err == nil && !obsolete {
+			err = fn()
+		}
+		/* Closing the file releases the lock */
+		guard.Close()
+		if err != nil || !obsolete {
+			return err
+		}
+	}
+	return fmt.Errorf("Failed to lock database %s", name)
+}
+
+/**
+ * Names of the files making up the database
+ */
+func databaseFiles(name string, idxType IndexType) []string {
+	files := make([]string, 0)
+	for _, ext := range IndexFileExts(idxType) {
+		files = append(files, name+ext)
+	}
+	switch idxType {
+	case LSMIndexType:
+		tables, _ := filepath.Glob(name + ".*.sst")
+		files = append(files, tables...)
+	case BitcaskIndexType:
+		segments, _ := filepath.Glob(name + ".*.log")
+		hints, _ := filepath.Glob(name + ".*.hint")
+		files = append(append(files, segments...), hints...)
+	}
+	return files
+}
+
+/**
+ * Total size of the files making up the database
+ */
+func databaseSize(name string, idxType IndexType) (int64, error) {
+	var size int64
+	for _, file := range databaseFiles(name, idxType) {
+		finfo, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += finfo.Size()
+	}
+	return size, nil
+}
+
+/**
+ * Flush the files of the database to disk, along with the writes of every
+ * other handle
+ */
+func SyncDatabase(name string, idxType IndexType) error {
+	for _, file := range databaseFiles(name, idxType) {
+		f, err := os.OpenFile(file, os.O_RDONLY, 0644)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	/* the segments and tables of the log indexes come and go */
+	return syncDir(name)
+}
+
+/**
+ * Flush the directory holding the file, so that the file created, renamed
+ * or removed there stays that way after a crash
+ */
+func syncDir(name string) error {
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (self *HashIndex) options() Options {
+	return Options{MaxValueSize: self.maxValue, MaxKeySize: self.maxKey, InitialBuckets: self.nhash, HashSeed: self.seed}
+}
+
+/**
+ * The table starts out with the size it was created with, so it can still
+ * shrink back to it. The splits are redone as the records are copied.
+ */
+func (self *LinearHashIndex) options() Options {
+	return Options{
+		MaxValueSize:   self.maxValue,
+		MaxKeySize:     self.maxKey,
+		InitialBuckets: self.minBuckets,
+		SplitThreshold: self.threshold,
+		HashSeed:       self.seed,
+	}
+}
+
+func (self *BTreeIndex) options() Options {
+	return Options{MaxValueSize: self.maxValue, MaxKeySize: self.maxKey}
+}
+
+func (self *ExtendibleHashIndex) options() Options {
+	return Options{MaxValueSize: self.maxValue, MaxKeySize: self.maxKey, HashSeed: self.seed}
+}
+
+func (self *LSMIndex) compact() error {
+	return compactLsm(self.name, self.maxValue, self.maxKey)
+}
+
+func (self *BitcaskIndex) compact() error {
+	return self.Merge()
+}
@@ -0,0 +1,443 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	compact_test_db_name = "compact_test"
+)
+
+func TestCompact(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType, BTreeIndexType, ExtendibleHashIndexType}, testCompact)
+}
+
+func testCompact(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, compact_test_db_name, idxType, Options{MaxValueSize: 1000, MaxKeySize: 100})
+	var err error
+	nrecords := 3000
+	for i := 0; i < nrecords; i++ {
+		err = idx.StoreBytes([]byte(fmt.Sprintf("key_%d", i)), largeValue(200, byte(i)), Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* delete two thirds of the records and change the length of the rest */
+	for i := 0; i < nrecords; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if i%3 != 0 {
+			err = idx.DeleteBytes(key)
+		} else {
+			err = idx.StoreBytes(key, largeValue(300, byte(i)), Update)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Close()
+
+	before, err := databaseSize(compact_test_db_name, idxType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reclaimed, err := Compact(compact_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := databaseSize(compact_test_db_name, idxType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed <= 0 || before-after != reclaimed {
+		t.Errorf("Expected %d bytes to be reclaimed, reported %d", before-after, reclaimed)
+	}
+	if _, err := os.Stat(compact_test_db_name + compact_name_ext + ".idx"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary compaction files to be gone")
+	}
+
+	idx, err = NewIndex(idxType, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Open(compact_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nrecords/3 {
+		t.Errorf("Expected %d records after compaction, got %d", nrecords/3, len(records))
+	}
+	for i := 0; i < nrecords; i += 3 {
+		key := fmt.Sprintf("key_%d", i)
+		if records[key] != string(largeValue(300, byte(i))) {
+			t.Errorf("Unexpected value for key %s after compaction", key)
+		}
+	}
+	/* the options the database was created with are kept */
+	err = idx.StoreBytes([]byte("big"), largeValue(1001, 0), Insert)
+	if err == nil {
+		t.Errorf("Expected the maximum value size to survive the compaction")
+	}
+}
+
+func TestCompactObsoleteHandle(t *testing.T) {
+	exts := IndexFileExts(HashIndexType)
+	removeFiles(compact_test_db_name, exts)
+	defer removeFiles(compact_test_db_name, exts)
+	h, err := compactOpenHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.idx.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Compact(compact_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obsolete, err := IsObsolete(h.idxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !obsolete {
+		t.Errorf("Expected the index file to be obsolete after a compaction")
+	}
+	/* writes to the old files are lost, a handle has to reopen before using the database */
+	err = h.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.idx.Insert("k2", "v2")
+	h.unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.close()
+
+	h, err = compactOpenHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	for k, v := range map[string]string{"k1": "v1", "k2": "v2"} {
+		val, err := h.idx.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+}
+
+func TestConcurrentCompact(t *testing.T) {
+	testConcurrentCompact(t, nil)
+}
+
+/**
+ * With a change log the handles keep writing while the records are copied
+ */
+func TestConcurrentCompactWithLog(t *testing.T) {
+	testConcurrentCompact(t, &testChangeLog{})
+}
+
+func testConcurrentCompact(t *testing.T, changes *testChangeLog) {
+	exts := IndexFileExts(LinearHashIndexType)
+	removeFiles(compact_test_db_name, exts)
+	defer removeFiles(compact_test_db_name, exts)
+	idx := &LinearHashIndex{}
+	err := idx.Open(compact_test_db_name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	nthreads := 10
+	nrecords := 500
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		go compactWork(t, &wg, i, nrecords, changes)
+	}
+	compacted := make(chan int)
+	go func() {
+		ncompactions := 0
+		defer func() { compacted <- ncompactions }()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			var err error
+			if changes == nil {
+				_, err = Compact(compact_test_db_name)
+			} else {
+				_, err = CompactWithLog(compact_test_db_name, changes)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ncompactions++
+		}
+	}()
+	wg.Wait()
+	close(done)
+	if <-compacted == 0 {
+		t.Errorf("Expected the database to be compacted while it was in use")
+	}
+
+	h, err := compactOpenHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	records, err := h.idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nthreads*nrecords/2 {
+		t.Errorf("Expected %d records, got %d", nthreads*nrecords/2, len(records))
+	}
+}
+
+func compactWork(t *testing.T, wg *sync.WaitGroup, id int, nrecords int, changes *testChangeLog) {
+	defer wg.Done()
+	h, err := compactOpenHandle()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer h.close()
+	for i := 0; i < nrecords; i++ {
+		err = h.lock()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		key := fmt.Sprintf("key_%d_%d", id, i)
+		err = h.idx.Insert(key, "val_"+key)
+		if err == nil {
+			changes.record(BatchOp{Key: []byte(key), Value: []byte("val_" + key)})
+		}
+		if err == nil && i%2 == 1 {
+			key = fmt.Sprintf("key_%d_%d", id, i-1)
+			err = h.idx.Delete(key)
+			if err == nil {
+				changes.record(BatchOp{Key: []byte(key), Delete: true})
+			}
+		}
+		h.unlock()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+/**
+ * Keeps the writes of compactWork, made with the database locked, the way
+ * the journal of brickdb.Brickdb does
+ */
+type testChangeLog struct {
+	mutex  sync.Mutex
+	writes []BatchOp
+	start  int
+}
+
+func (self *testChangeLog) record(op BatchOp) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.writes = append(self.writes, op)
+}
+
+func (self *testChangeLog) Start() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.start = len(self.writes)
+	return nil
+}
+
+func (self *testChangeLog) CatchUp(dst BrickIndex) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, op := range self.writes[self.start:] {
+		var err error
+		if op.Delete {
+			err = dst.DeleteBytes(op.Key)
+		} else {
+			err = dst.StoreBytes(op.Key, op.Value, Upsert)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *testChangeLog) Finish() {
+}
+
+/**
+ * A crash while the files of the copy were renamed over the database is
+ * finished by RecoverCompaction, one before is cleared away
+ */
+func TestRecoverCompaction(t *testing.T) {
+	exts := IndexFileExts(LinearHashIndexType)
+	tmpName := compact_test_db_name + compact_name_ext
+	removeFiles(compact_test_db_name, exts)
+	defer removeFiles(compact_test_db_name, exts)
+	defer removeFiles(tmpName, exts)
+	for _, renamed := range []int{0, 1, 2} {
+		for name, value := range map[string]string{compact_test_db_name: "old", tmpName: "new"} {
+			removeFiles(name, exts)
+			idx := &LinearHashIndex{}
+			err := idx.Open(name, os.O_RDWR|os.O_CREATE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = idx.Insert("k1", value)
+			idx.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		/* the files are renamed from the last one on, the index file never got its turn */
+		for i := len(exts) - 1; i >= len(exts)-renamed; i-- {
+			err := os.Rename(tmpName+exts[i], compact_test_db_name+exts[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := RecoverCompaction(compact_test_db_name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ext := range exts {
+			if _, err := os.Stat(tmpName + ext); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be gone with %d files renamed", tmpName+ext, renamed)
+			}
+		}
+		idx := &LinearHashIndex{}
+		err = idx.Open(compact_test_db_name, os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := idx.Fetch("k1")
+		idx.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "new"
+		if renamed == 0 {
+			expected = "old"
+		}
+		if val != expected {
+			t.Errorf("Expected value %q with %d files renamed, got %q", expected, renamed, val)
+		}
+	}
+}
+
+/**
+ * A database handle following the same protocol as brickdb.Brickdb
+ */
+type compactHandle struct {
+	idxFile *os.File
+	idx     BrickIndex
+}
+
+func compactOpenHandle() (*compactHandle, error) {
+	h := &compactHandle{}
+	var err error
+	h.idxFile, err = os.OpenFile(compact_test_db_name+".idx", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	idxType, _, err := ReadFileHeader(compact_test_db_name + ".idx")
+	if err != nil {
+		idxType = HashIndexType
+	}
+	h.idx, err = NewIndex(idxType, Options{})
+	if err != nil {
+		h.idxFile.Close()
+		return nil, err
+	}
+	err = h.idx.Open(compact_test_db_name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		h.idxFile.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (self *compactHandle) lock() error {
+	for {
+		err := LockDatabase(self.idxFile, false)
+		if err != nil {
+			return err
+		}
+		obsolete, err := IsObsolete(self.idxFile)
+		if err == nil && !obsolete {
+			return nil
+		}
+		UnlockDatabase(self.idxFile)
+		if err != nil {
+			return err
+		}
+		self.close()
+		reopened, err := compactOpenHandle()
+		if err != nil {
+			return err
+		}
+		*self = *reopened
+	}
+}
+
+func (self *compactHandle) unlock() {
+	UnlockDatabase(self.idxFile)
+}
+
+func (self *compactHandle) close() {
+	self.idx.Close()
+	self.idxFile.Close()
+}
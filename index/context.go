@@ -0,0 +1,146 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * A lock wait which can give up polls the lock instead of sleeping in the
+ * kernel, backing off from lock_poll_min to lock_poll_max between tries.
+ * Waiters which can't give up still queue in F_OFD_SETLKW and get the lock
+ * first when it is busy.
+ */
+const (
+	lock_poll_min = time.Millisecond
+	lock_poll_max = 32 * time.Millisecond
+)
+
+/**
+ * Implemented by all the indexes. The operations started after SetContext
+ * give up waiting for a lock with a *LockWaitError once ctx is done, a nil
+ * ctx makes them wait for as long as it takes again. Only the locks taken
+ * before an operation changes anything give up, once a write has started
+ * it runs to the end.
+ */
+type ContextIndex interface {
+	SetContext(ctx context.Context)
+}
+
+/**
+ * Returned when the context of an operation is done before a lock it waits
+ * for is free. Matches ErrLocked with errors.Is, and the error of the
+ * context, context.DeadlineExceeded if it timed out or context.Canceled.
+ */
+type LockWaitError struct {
+	Err error // the error of the context
+}
+
+func (self *LockWaitError) Error() string {
+	return fmt.Sprintf("Gave up waiting for a lock: %v", self.Err)
+}
+
+func (self *LockWaitError) Unwrap() error {
+	return self.Err
+}
+
+func (self *LockWaitError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+/**
+ * Like ReadLockW, but gives up once ctx is done
+ */
+func ReadLockContext(ctx context.Context, fd uintptr, offset int64, whence int16, len int64) error {
+	return lockContext(ctx, fd, unix.F_RDLCK, offset, whence, len)
+}
+
+/**
+ * Like WriteLockW, but gives up once ctx is done
+ */
+func WriteLockContext(ctx context.Context, fd uintptr, offset int64, whence int16, len int64) error {
+	return lockContext(ctx, fd, unix.F_WRLCK, offset, whence, len)
+}
+
+func lockContext(ctx context.Context, fd uintptr, lockType int16, offset int64, whence int16, len int64) error {
+	if ctx == nil || ctx.Done() == nil {
+		return getLock(fd, unix.F_OFD_SETLKW, lockType, offset, whence, len)
+	}
+	return pollLock(ctx, func() error {
+		return getLock(fd, unix.F_OFD_SETLK, lockType, offset, whence, len)
+	})
+}
+
+/**
+ * Call tryLock until it does not fail with ErrLocked or ctx is done
+ */
+func pollLock(ctx context.Context, tryLock func() error) error {
+	wait := lock_poll_min
+	for {
+		err := tryLock()
+		if !errors.Is(err, ErrLocked) {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &LockWaitError{Err: ctx.Err()}
+		case <-timer.C:
+		}
+		if wait < lock_poll_max {
+			wait *= 2
+		}
+	}
+}
+
+/**
+ * The context an index handle waits for its locks with, embedded in every
+ * index to implement ContextIndex. Like the rest of the handle it belongs to
+ * one goroutine at a time.
+ */
+type lockWaiter struct {
+	ctx context.Context
+}
+
+func (self *lockWaiter) SetContext(ctx context.Context) {
+	self.ctx = ctx
+}
+
+func (self *lockWaiter) readLockW(fd uintptr, offset int64, whence int16, len int64) error {
+	return lockContext(self.ctx, fd, unix.F_RDLCK, offset, whence, len)
+}
+
+func (self *lockWaiter) writeLockW(fd uintptr, offset int64, whence int16, len int64) error {
+	return lockContext(self.ctx, fd, unix.F_WRLCK, offset, whence, len)
+}
@@ -0,0 +1,116 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	context_test_db_name = "context_test"
+)
+
+func TestLockContext(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType, BTreeIndexType, LSMIndexType, BitcaskIndexType,
+		ExtendibleHashIndexType}, testLockContext)
+}
+
+/**
+ * With the whole index file locked by someone else, the operations of a
+ * handle with a deadline give up in time, and go through again once the
+ * lock is gone
+ */
+func testLockContext(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, context_test_db_name, idxType, Options{})
+	defer idx.Close()
+	err := idx.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(context_test_db_name+".idx", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = WriteLockW(f.Fd(), 0, io.SeekStart, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctxIndex := idx.(ContextIndex)
+	for _, op := range []func() error{
+		func() error {
+			_, err := idx.Fetch("k1")
+			return err
+		},
+		func() error {
+			return idx.Upsert("k2", "v2")
+		},
+		func() error {
+			return idx.Delete("k1")
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		ctxIndex.SetContext(ctx)
+		start := time.Now()
+		err = op()
+		cancel()
+		if !errors.Is(err, ErrLocked) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected a LockWaitError for the deadline, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the operation to give up after 50ms, it took %v", elapsed)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctxIndex.SetContext(ctx)
+	/* joined before f is closed */
+	unlocked := make(chan struct{})
+	go func() {
+		defer close(unlocked)
+		time.Sleep(20 * time.Millisecond)
+		Unlock(f.Fd(), 0, io.SeekStart, 0)
+	}()
+	err = idx.Upsert("k2", "v2")
+	<-unlocked
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxIndex.SetContext(nil)
+	val, err := idx.Fetch("k2")
+	if err != nil || val != "v2" {
+		t.Errorf("Expected value v2 for key k2, got %q and %v", val, err)
+	}
+}
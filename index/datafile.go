@@ -0,0 +1,297 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const max_iovecs = 1024 // IOV_MAX on Linux
+
+/**
+ * The data file holding the values. A value is stored as a chain of extents
+ * (see encoding.go), so values larger than a single extent are split into
+ * overflow extents and reassembled on read.
+ *
+ * Appends lock the whole file, overwriting an existing chain does not need
+ * any locking here since the caller holds the lock on the hash chain of the
+ * key owning it.
+ */
+type dataFile struct {
+	*os.File
+}
+
+func openDataFile(name string, mode int) (*dataFile, error) {
+	f, err := os.OpenFile(name, mode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &dataFile{File: f}, nil
+}
+
+/**
+ * Number of extents needed to store a value of the given length, an empty
+ * value still takes one extent
+ */
+func numExtents(datlen int64) int64 {
+	if datlen == 0 {
+		return 1
+	}
+	return (datlen + datext_payload_max - 1) / datext_payload_max
+}
+
+/**
+ * Number of bytes taken up in the data file by a value of the given length
+ */
+func valueSize(datlen int64) int64 {
+	return numExtents(datlen)*datext_header_size + datlen
+}
+
+/**
+ * Encode the value as a chain of contiguous extents starting at the given
+ * offset in the file
+ */
+func encodeExtents(data []byte, offset int64) []byte {
+	datlen := int64(len(data))
+	n := numExtents(datlen)
+	buf := make([]byte, n*datext_header_size+datlen)
+	var pos, i int64
+	for i = 0; i < n; i++ {
+		start := i * datext_payload_max
+		end := start + datext_payload_max
+		if end > datlen {
+			end = datlen
+		}
+		var next int64
+		if i < n-1 {
+			next = offset + pos + datext_header_size + end - start
+		}
+		encodeExtentHeader(buf[pos:], next, data[start:end])
+		copy(buf[pos+datext_header_size:], data[start:end])
+		pos += datext_header_size + end - start
+	}
+	return buf
+}
+
+/**
+ * Append the value at the end of the data file, returns the offset of the
+ * first extent
+ */
+func (self *dataFile) appendValue(data []byte) (int64, error) {
+	err := WriteLockW(self.Fd(), 0, io.SeekStart, 0) //lock whole file
+	if err != nil {
+		return -1, err
+	}
+	defer Unlock(self.Fd(), 0, io.SeekStart, 0)
+
+	offset, err := self.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1, err
+	}
+	buf := encodeExtents(data, offset)
+	bytesWritten, err := self.WriteAt(buf, offset)
+	if err != nil {
+		return -1, err
+	}
+	if bytesWritten != len(buf) {
+		return -1, errors.New("Error while writing data record")
+	}
+	return offset, nil
+}
+
+/**
+ * Append the values at the end of the data file with a single write, returns
+ * the offsets of their first extents
+ */
+func (self *dataFile) appendValues(values [][]byte) ([]int64, error) {
+	offsets := make([]int64, len(values))
+	if len(values) == 0 {
+		return offsets, nil
+	}
+	err := WriteLockW(self.Fd(), 0, io.SeekStart, 0) //lock whole file
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.Fd(), 0, io.SeekStart, 0)
+
+	offset, err := self.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	iovs := make([][]byte, len(values))
+	end := offset
+	for i, value := range values {
+		offsets[i] = end
+		iovs[i] = encodeExtents(value, end)
+		end += int64(len(iovs[i]))
+	}
+	for len(iovs) > 0 {
+		n := len(iovs)
+		if n > max_iovecs {
+			n = max_iovecs
+		}
+		length := 0
+		for _, iov := range iovs[:n] {
+			length += len(iov)
+		}
+		bytesWritten, err := unix.Pwritev(int(self.Fd()), iovs[:n], offset)
+		if err != nil {
+			return nil, err
+		}
+		if bytesWritten != length {
+			return nil, errors.New("Error while writing data record")
+		}
+		offset += int64(length)
+		iovs = iovs[n:]
+	}
+	return offsets, nil
+}
+
+/**
+ * Write the value into free space at the given offset, the caller must have
+ * allocated at least valueSize bytes there
+ */
+func (self *dataFile) writeValue(offset int64, data []byte) error {
+	buf := encodeExtents(data, offset)
+	bytesWritten, err := self.WriteAt(buf, offset)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Error while writing data record")
+	}
+	return nil
+}
+
+/**
+ * Overwrite the payload of an existing chain of extents. The chain must
+ * have been allocated for a value of the same length.
+ */
+func (self *dataFile) overwriteValue(datoff int64, data []byte) error {
+	hdrbuf := make([]byte, datext_header_size)
+	offset := datoff
+	var written int64
+	for {
+		_, err := self.ReadAt(hdrbuf, offset)
+		if err != nil {
+			return fmt.Errorf("Failed to read data extent at offset %d: %w", offset, err)
+		}
+		next, length := decodeExtentHeader(hdrbuf)
+		if written+length > int64(len(data)) {
+			return fmt.Errorf("Data extent at offset %d does not fit the value", offset)
+		}
+		/* the checksum goes right before the payload, so both are written at once */
+		payload := data[written : written+length]
+		buf := make([]byte, datext_header_size-datext_crc_off+length)
+		byteOrder.PutUint32(buf, extentCrc(hdrbuf, payload))
+		copy(buf[datext_header_size-datext_crc_off:], payload)
+		_, err = self.WriteAt(buf, offset+datext_crc_off)
+		if err != nil {
+			return err
+		}
+		written += length
+		if next == 0 {
+			break
+		}
+		offset = next
+	}
+	if written != int64(len(data)) {
+		return fmt.Errorf("Data record at offset %d does not fit the value", datoff)
+	}
+	return nil
+}
+
+/**
+ * Read the value of length datlen stored in the chain of extents starting
+ * at datoff. Extents written together are contiguous, so we try to read all
+ * of them at once and only go back to the file when the chain jumps. Every
+ * extent is checked against its checksum, a damaged one fails the read with
+ * a CorruptError.
+ */
+func (self *dataFile) readValue(datoff int64, datlen int64) ([]byte, error) {
+	value := make([]byte, 0, datlen)
+	offset := datoff
+	var buf []byte
+	var bufoff int64 // file offset of buf[0]
+	for {
+		remaining := datlen - int64(len(value))
+		if offset < bufoff || offset+datext_header_size > bufoff+int64(len(buf)) {
+			var err error
+			buf, err = self.readAt(offset, numExtents(remaining)*datext_header_size+remaining)
+			if err != nil {
+				return nil, err
+			}
+			bufoff = offset
+		}
+		pos := offset - bufoff
+		if pos+datext_header_size > int64(len(buf)) {
+			return nil, self.corrupt(offset, "data extent past the end of the file")
+		}
+		next, length := decodeExtentHeader(buf[pos:])
+		if length > datext_payload_max || length > remaining {
+			return nil, self.corrupt(offset, fmt.Sprintf("invalid data extent length %d", length))
+		}
+		if pos+datext_header_size+length > int64(len(buf)) {
+			return nil, self.corrupt(offset, "data extent past the end of the file")
+		}
+		payload := buf[pos+datext_header_size : pos+datext_header_size+length]
+		if !verifyExtent(buf[pos:], payload) {
+			return nil, self.corrupt(offset, "data extent checksum mismatch")
+		}
+		value = append(value, payload...)
+		if next == 0 {
+			break
+		}
+		offset = next
+	}
+	if int64(len(value)) != datlen {
+		return nil, self.corrupt(datoff, fmt.Sprintf("data record shorter than %d bytes", datlen))
+	}
+	return value, nil
+}
+
+func (self *dataFile) corrupt(offset int64, reason string) error {
+	return &CorruptError{File: self.Name(), Offset: offset, Reason: reason}
+}
+
+/**
+ * Read up to size bytes from the given offset, a short read at the end of
+ * the file is not an error
+ */
+func (self *dataFile) readAt(offset int64, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	bytesRead, err := self.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf[:bytesRead], nil
+}
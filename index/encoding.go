@@ -0,0 +1,251 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/**
+ * On-disk encoding of the index and data files. All the integers are stored
+ * as fixed width little-endian values.
+ *
+ * Every index file starts with the file header:
+ *	magic (4 bytes) | format version (2 bytes) | index type (2 bytes)
+ *
+ * An index record in a hash chain is laid out as:
+ *	next record ptr (8 bytes) | key length (4 bytes) | data offset (8 bytes) | data length (4 bytes) | checksum (4 bytes) | key
+ * The checksum is the CRC32C of the fields between the next record pointer
+ * and the checksum, followed by the key. The pointer is left out since it
+ * is rewritten in place whenever the chain is relinked, a damaged pointer
+ * leads to a record which fails its own check.
+ *
+ * Values are stored in the data file as a chain of one or more extents,
+ * the index record points to the first extent and holds the total length
+ * of the value. An extent is laid out as:
+ *	next extent ptr (8 bytes) | payload length (4 bytes) | checksum (4 bytes) | payload
+ * The checksum is the CRC32C of the pointer, the length and the payload.
+ * Values longer than datext_payload_max are split over multiple extents.
+ *
+ * Format version 1 is the original ASCII encoding where every number was
+ * stored as a space padded decimal string, see legacy.go. The binary
+ * versions before the current one are not read:
+ *	2	32 bit file offsets
+ *	3	values stored as a single data record
+ *	4	no creation options in the index header
+ *	5	no checksums in the index records and extents
+ *	6	no checksums in the LSM tree and Bitcask records
+ */
+const (
+	file_magic          = "BRKD"
+	file_header_size    = 8
+	FormatVersion       = 7
+	LegacyFormatVersion = 1
+	ptr_size            = 8  // a file offset
+	idxrec_header_size  = 28 // next(8) + keylen(4) + datoff(8) + datlen(4) + crc(4)
+	idxrec_crc_off      = 24
+	datext_header_size  = 16 // next(8) + payload length(4) + crc(4)
+	datext_crc_off      = 12
+	datext_payload_max  = 4096
+	key_size_max        = 1000
+)
+
+var byteOrder = binary.LittleEndian
+
+var ErrLegacyFormat = errors.New("database uses the legacy ASCII format and needs to be upgraded")
+
+var ErrCorrupt = errors.New("corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+/**
+ * Returned when a record fails its checksum or does not make sense, matches
+ * ErrCorrupt with errors.Is
+ */
+type CorruptError struct {
+	File   string
+	Offset int64
+	Key    []byte // the key of the record when only its value is damaged
+	Reason string
+}
+
+func (self *CorruptError) Error() string {
+	if self.Key != nil {
+		return fmt.Sprintf("Corrupt record in %s at offset %d for key %q: %s", self.File, self.Offset, self.Key, self.Reason)
+	}
+	return fmt.Sprintf("Corrupt record in %s at offset %d: %s", self.File, self.Offset, self.Reason)
+}
+
+func (self *CorruptError) Unwrap() error {
+	return ErrCorrupt
+}
+
+func encodeFileHeader(idxType IndexType) []byte {
+	buf := make([]byte, file_header_size)
+	copy(buf, file_magic)
+	byteOrder.PutUint16(buf[4:], FormatVersion)
+	byteOrder.PutUint16(buf[6:], uint16(idxType))
+	return buf
+}
+
+/**
+ * Parse the header at the start of an index file. Returns the index type and
+ * the format version of the file.
+ */
+func decodeFileHeader(buf []byte) (IndexType, int, error) {
+	if len(buf) >= file_header_size && string(buf[:len(file_magic)]) == file_magic {
+		return IndexType(byteOrder.Uint16(buf[6:])), int(byteOrder.Uint16(buf[4:])), nil
+	}
+	/* The ASCII format starts with the index type as a space padded number */
+	if len(buf) >= legacy_idxtype_sz {
+		idxType, err := parseInt(string(buf[:legacy_idxtype_sz]))
+		if err == nil {
+			return IndexType(idxType), LegacyFormatVersion, nil
+		}
+	}
+	return 0, 0, errors.New("Invalid index file header")
+}
+
+/**
+ * Read the header of the given index file and return the index type and
+ * format version of the database
+ */
+func ReadFileHeader(idxFileName string) (IndexType, int, error) {
+	f, err := os.OpenFile(idxFileName, os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	buf := make([]byte, file_header_size)
+	bytesRead, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, 0, err
+	}
+	return decodeFileHeader(buf[:bytesRead])
+}
+
+/**
+ * Validate the header of an already initialized index file against the
+ * index type trying to open it
+ */
+func verifyFileHeader(f *os.File, idxType IndexType) error {
+	buf := make([]byte, file_header_size)
+	bytesRead, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	fileIdxType, version, err := decodeFileHeader(buf[:bytesRead])
+	if err != nil {
+		return err
+	}
+	if version == LegacyFormatVersion {
+		return ErrLegacyFormat
+	}
+	if version != FormatVersion {
+		return fmt.Errorf("Unsupported format version %d", version)
+	}
+	if fileIdxType != idxType {
+		return fmt.Errorf("Index type mismatch, file has type %d, expected %d", fileIdxType, idxType)
+	}
+	return nil
+}
+
+func encodePtr(ptrval int64) []byte {
+	buf := make([]byte, ptr_size)
+	byteOrder.PutUint64(buf, uint64(ptrval))
+	return buf
+}
+
+func decodePtr(buf []byte) int64 {
+	return int64(byteOrder.Uint64(buf))
+}
+
+func encodeIdxRecord(ptrval int64, key []byte, datoff int64, datlen int64) []byte {
+	buf := make([]byte, idxrec_header_size+len(key))
+	byteOrder.PutUint64(buf[0:], uint64(ptrval))
+	byteOrder.PutUint32(buf[8:], uint32(len(key)))
+	byteOrder.PutUint64(buf[12:], uint64(datoff))
+	byteOrder.PutUint32(buf[20:], uint32(datlen))
+	copy(buf[idxrec_header_size:], key)
+	byteOrder.PutUint32(buf[idxrec_crc_off:], idxRecordCrc(buf[:idxrec_header_size], key))
+	return buf
+}
+
+func idxRecordCrc(hdrbuf []byte, key []byte) uint32 {
+	crc := crc32.Update(0, crcTable, hdrbuf[ptr_size:idxrec_crc_off])
+	return crc32.Update(crc, crcTable, key)
+}
+
+/**
+ * Check the checksum of an index record read as its header and key
+ */
+func verifyIdxRecord(hdrbuf []byte, key []byte) bool {
+	return byteOrder.Uint32(hdrbuf[idxrec_crc_off:]) == idxRecordCrc(hdrbuf, key)
+}
+
+func encodeExtentHeader(buf []byte, next int64, payload []byte) {
+	byteOrder.PutUint64(buf[0:], uint64(next))
+	byteOrder.PutUint32(buf[8:], uint32(len(payload)))
+	byteOrder.PutUint32(buf[datext_crc_off:], extentCrc(buf, payload))
+}
+
+func extentCrc(hdrbuf []byte, payload []byte) uint32 {
+	crc := crc32.Update(0, crcTable, hdrbuf[:datext_crc_off])
+	return crc32.Update(crc, crcTable, payload)
+}
+
+/**
+ * Check the checksum of a data extent read as its header and payload
+ */
+func verifyExtent(hdrbuf []byte, payload []byte) bool {
+	return byteOrder.Uint32(hdrbuf[datext_crc_off:]) == extentCrc(hdrbuf, payload)
+}
+
+/**
+ * Decode the header of a data extent, returns the pointer to the next
+ * extent and the length of the payload
+ */
+func decodeExtentHeader(buf []byte) (int64, int64) {
+	return int64(byteOrder.Uint64(buf[0:])), int64(byteOrder.Uint32(buf[8:]))
+}
+
+/**
+ * Decode the fixed length header of an index record, returns the next record
+ * pointer, key length, data offset and data length
+ */
+func decodeIdxHeader(buf []byte) (int64, int64, int64, int64) {
+	ptrval := int64(byteOrder.Uint64(buf[0:]))
+	keylen := int64(byteOrder.Uint32(buf[8:]))
+	datoff := int64(byteOrder.Uint64(buf[12:]))
+	datlen := int64(byteOrder.Uint32(buf[20:]))
+	return ptrval, keylen, datoff, datlen
+}
@@ -0,0 +1,798 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+/**
+ * An extendible hashing index. The index file is made of fixed size pages,
+ * the first page holds the header, the directory and the buckets follow.
+ * The directory has 2^global depth bucket pointers and is indexed by the low
+ * global depth bits of the hash of the key. A bucket with a local depth of d
+ * is pointed to by all the directory slots sharing the low d bits. When a
+ * bucket overflows only that bucket is split, the directory is doubled first
+ * if the local depth of the bucket has caught up with the global depth. The
+ * directory is moved to the end of the file when it doubles.
+ *
+ * The header is laid out as:
+ *	file header (8 bytes) | global depth (8 bytes) | directory ptr (8 bytes) | max value size (8 bytes) |
+ *	max key size (8 bytes) | hash seed (8 bytes)
+ *
+ * A bucket page is laid out as:
+ *	local depth (1 byte) | number of entries (2 bytes) | overflow page ptr (8 bytes) | entries
+ * where an entry is:
+ *	hash (8 bytes) | key length (4 bytes) | data offset (8 bytes) | data length (4 bytes) | key
+ * Buckets whose keys share ext_depth_max hash bits are not split further,
+ * overflow pages are chained to them instead.
+ *
+ * Readers and writers share the lock on the first byte of the index file
+ * and then lock the first page of their bucket. Splitting a bucket and
+ * adding overflow pages is done with the first byte write locked, which
+ * keeps everyone else out of the directory and the buckets.
+ */
+const (
+	ext_page_size         = 4096
+	ext_depth_off         = file_header_size
+	ext_dir_off           = ext_depth_off + 8
+	ext_maxvalue_off      = ext_dir_off + ptr_size
+	ext_maxkey_off        = ext_maxvalue_off + 8
+	ext_seed_off          = ext_maxkey_off + 8
+	ext_header_size       = ext_seed_off + 8
+	ext_bucket_header_sz  = 11 // local depth(1) + nentries(2) + overflow(8)
+	ext_entry_header_size = 24 // hash(8) + keylen(4) + datoff(8) + datlen(4)
+	ext_depth_max         = 24
+	ext_key_max           = IDXLEN_MAX - idxrec_header_size
+)
+
+type extEntry struct {
+	hash   uint64
+	key    []byte
+	datoff int64
+	datlen int64
+}
+
+type extBucket struct {
+	offset   int64
+	depth    uint
+	overflow int64
+	entries  []extEntry
+}
+
+type ExtendibleHashIndex struct {
+	lockWaiter
+	idxFile  *os.File
+	datFile  *dataFile
+	opts     Options
+	name     string
+	depth    uint
+	dirOff   int64
+	maxValue int64
+	maxKey   int64
+	seed     uint64
+}
+
+func (self *ExtendibleHashIndex) Open(name string, mode int) error {
+	self.name = name
+	opts, err := self.opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create index file %s", self.name+".idx")
+	}
+
+	self.datFile, err = openDataFile(self.name+".dat", mode)
+	if err != nil {
+		return fmt.Errorf("Failed to create data file %s", self.name+".dat")
+	}
+
+	isCreateMode := mode&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE || mode&(os.O_CREATE|os.O_TRUNC) == os.O_TRUNC
+	if isCreateMode {
+		/**
+		 * If the database was created we need to initialize it. We need to lock the entire file,
+		 * stat it, check its size and initialize it atomically
+		 */
+		if WriteLockW(self.idxFile.Fd(), 0, io.SeekStart, 0) != nil {
+			return errors.New("Failed to write lock index for init")
+		}
+		defer func() error {
+			return Unlock(self.idxFile.Fd(), 0, io.SeekStart, 0)
+		}()
+
+		idxFileInfo, err := self.idxFile.Stat()
+		if err != nil {
+			return errors.New("Failed to stat the index file")
+		}
+
+		if idxFileInfo.Size() == 0 {
+			err = self.create(opts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = verifyFileHeader(self.idxFile, ExtendibleHashIndexType)
+	if err != nil {
+		self.Close()
+		return err
+	}
+	/* The options never change, read them once without locking */
+	buf := make([]byte, ext_header_size-ext_maxvalue_off)
+	_, err = self.idxFile.ReadAt(buf, ext_maxvalue_off)
+	if err != nil {
+		self.Close()
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.maxValue = int64(byteOrder.Uint64(buf))
+	self.maxKey = int64(byteOrder.Uint64(buf[ext_maxkey_off-ext_maxvalue_off:]))
+	self.seed = byteOrder.Uint64(buf[ext_seed_off-ext_maxvalue_off:])
+	return nil
+}
+
+/**
+ * Initialize an empty index with a bucket for every directory slot, the
+ * directory starts out as deep as needed for the initial number of buckets
+ */
+func (self *ExtendibleHashIndex) create(opts Options) error {
+	nbuckets, err := opts.initialBuckets(1, true)
+	if err != nil {
+		return err
+	}
+	self.depth = uint(bits.Len64(nbuckets - 1))
+	self.dirOff = ext_page_size
+	self.maxValue = opts.MaxValueSize
+	self.maxKey = opts.MaxKeySize
+	self.seed = opts.HashSeed
+	err = self.writeHeader()
+	if err != nil {
+		return err
+	}
+	dirPages := (int64(nbuckets)*ptr_size + ext_page_size - 1) / ext_page_size
+	var slot uint64
+	for slot = 0; slot < nbuckets; slot++ {
+		offset := ext_page_size * (1 + dirPages + int64(slot))
+		err = self.writeDirSlot(slot, offset)
+		if err != nil {
+			return err
+		}
+		err = self.writeBucket(&extBucket{offset: offset, depth: self.depth})
+		if err != nil {
+			return errors.New("Failed to initialize index file")
+		}
+	}
+	return nil
+}
+
+func (self *ExtendibleHashIndex) Close() error {
+	if self.idxFile != nil {
+		err := self.idxFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if self.datFile != nil {
+		err := self.datFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Lock the directory and read the header. Readers and writers of individual
+ * buckets share the lock, splitting a bucket needs it exclusively. The caller
+ * must call unlockDir.
+ */
+func (self *ExtendibleHashIndex) lockDir(isWriteLock bool) error {
+	var err error
+	if isWriteLock {
+		err = self.writeLockW(self.idxFile.Fd(), 0, io.SeekStart, 1)
+	} else {
+		err = self.readLockW(self.idxFile.Fd(), 0, io.SeekStart, 1)
+	}
+	if err != nil {
+		return err
+	}
+	err = self.readHeader()
+	if err != nil {
+		self.unlockDir()
+		return err
+	}
+	return nil
+}
+
+func (self *ExtendibleHashIndex) unlockDir() error {
+	return Unlock(self.idxFile.Fd(), 0, io.SeekStart, 1)
+}
+
+func (self *ExtendibleHashIndex) readHeader() error {
+	buf := make([]byte, ext_header_size)
+	_, err := self.idxFile.ReadAt(buf, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.depth = uint(byteOrder.Uint64(buf[ext_depth_off:]))
+	self.dirOff = decodePtr(buf[ext_dir_off:])
+	if self.depth > ext_depth_max {
+		return fmt.Errorf("Invalid global depth %d in index header", self.depth)
+	}
+	return nil
+}
+
+func (self *ExtendibleHashIndex) writeHeader() error {
+	header := make([]byte, ext_header_size)
+	copy(header, encodeFileHeader(ExtendibleHashIndexType))
+	byteOrder.PutUint64(header[ext_depth_off:], uint64(self.depth))
+	byteOrder.PutUint64(header[ext_dir_off:], uint64(self.dirOff))
+	byteOrder.PutUint64(header[ext_maxvalue_off:], uint64(self.maxValue))
+	byteOrder.PutUint64(header[ext_maxkey_off:], uint64(self.maxKey))
+	byteOrder.PutUint64(header[ext_seed_off:], self.seed)
+	_, err := self.idxFile.WriteAt(header, 0)
+	return err
+}
+
+func (self *ExtendibleHashIndex) dbHash(key []byte) uint64 {
+	hasher := xxhash.NewS64(self.seed)
+	hasher.Write(key)
+	return hasher.Sum64()
+}
+
+func (self *ExtendibleHashIndex) readDirSlot(slot uint64) (int64, error) {
+	buf := make([]byte, ptr_size)
+	_, err := self.idxFile.ReadAt(buf, self.dirOff+int64(slot*ptr_size))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read directory slot %d: %w", slot, err)
+	}
+	return decodePtr(buf), nil
+}
+
+func (self *ExtendibleHashIndex) writeDirSlot(slot uint64, bucket int64) error {
+	_, err := self.idxFile.WriteAt(encodePtr(bucket), self.dirOff+int64(slot*ptr_size))
+	return err
+}
+
+/**
+ * Offset of the first page of the bucket holding the given hash, must be
+ * called with the directory locked
+ */
+func (self *ExtendibleHashIndex) findBucket(hash uint64) (int64, error) {
+	return self.readDirSlot(hash & (1<<self.depth - 1))
+}
+
+func (self *extBucket) size() int {
+	size := ext_bucket_header_sz
+	for _, entry := range self.entries {
+		size += ext_entry_header_size + len(entry.key)
+	}
+	return size
+}
+
+func (self *ExtendibleHashIndex) readBucket(offset int64) (*extBucket, error) {
+	if offset < 2*ext_page_size || offset%ext_page_size != 0 {
+		return nil, fmt.Errorf("Invalid bucket pointer %d", offset)
+	}
+	buf := make([]byte, ext_page_size)
+	_, err := self.idxFile.ReadAt(buf, offset)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read bucket at offset %d: %w", offset, err)
+	}
+	bucket := &extBucket{offset: offset, depth: uint(buf[0]), overflow: decodePtr(buf[3:])}
+	if bucket.depth > ext_depth_max {
+		return nil, fmt.Errorf("Corrupted bucket at offset %d: invalid local depth %d: %w", offset, bucket.depth, ErrCorrupt)
+	}
+	nentries := int(byteOrder.Uint16(buf[1:]))
+	pos := ext_bucket_header_sz
+	for i := 0; i < nentries; i++ {
+		if pos+ext_entry_header_size > ext_page_size {
+			return nil, fmt.Errorf("Corrupted bucket at offset %d: %w", offset, ErrCorrupt)
+		}
+		entry := extEntry{
+			hash:   byteOrder.Uint64(buf[pos:]),
+			datoff: decodePtr(buf[pos+12:]),
+			datlen: int64(byteOrder.Uint32(buf[pos+20:])),
+		}
+		keylen := int(byteOrder.Uint32(buf[pos+8:]))
+		pos += ext_entry_header_size
+		if keylen < 1 || keylen > ext_key_max || pos+keylen > ext_page_size {
+			return nil, fmt.Errorf("Corrupted bucket at offset %d: invalid key length %d: %w", offset, keylen, ErrCorrupt)
+		}
+		entry.key = buf[pos : pos+keylen]
+		pos += keylen
+		bucket.entries = append(bucket.entries, entry)
+	}
+	return bucket, nil
+}
+
+func (self *ExtendibleHashIndex) writeBucket(bucket *extBucket) error {
+	if bucket.size() > ext_page_size {
+		return fmt.Errorf("Bucket at offset %d does not fit in a page", bucket.offset)
+	}
+	buf := make([]byte, ext_page_size)
+	buf[0] = byte(bucket.depth)
+	byteOrder.PutUint16(buf[1:], uint16(len(bucket.entries)))
+	byteOrder.PutUint64(buf[3:], uint64(bucket.overflow))
+	pos := ext_bucket_header_sz
+	for _, entry := range bucket.entries {
+		byteOrder.PutUint64(buf[pos:], entry.hash)
+		byteOrder.PutUint32(buf[pos+8:], uint32(len(entry.key)))
+		byteOrder.PutUint64(buf[pos+12:], uint64(entry.datoff))
+		byteOrder.PutUint32(buf[pos+20:], uint32(entry.datlen))
+		pos += ext_entry_header_size
+		copy(buf[pos:], entry.key)
+		pos += len(entry.key)
+	}
+	bytesWritten, err := self.idxFile.WriteAt(buf, bucket.offset)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Error while writing bucket")
+	}
+	return nil
+}
+
+/**
+ * Read the bucket along with its overflow pages
+ */
+func (self *ExtendibleHashIndex) readChain(offset int64) ([]*extBucket, error) {
+	var chain []*extBucket
+	for offset != 0 {
+		bucket, err := self.readBucket(offset)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, bucket)
+		offset = bucket.overflow
+	}
+	return chain, nil
+}
+
+/**
+ * Find the key in the chain, returns the page and position of its entry
+ */
+func findExtEntry(chain []*extBucket, hash uint64, key []byte) (*extBucket, int) {
+	for _, bucket := range chain {
+		for i, entry := range bucket.entries {
+			if entry.hash == hash && bytes.Equal(entry.key, key) {
+				return bucket, i
+			}
+		}
+	}
+	return nil, -1
+}
+
+/**
+ * Allocate space at the end of the index file. Only called with the
+ * directory write locked, so nobody else can be growing the file.
+ */
+func (self *ExtendibleHashIndex) allocPage() (int64, error) {
+	offset, err := self.idxFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if offset%ext_page_size != 0 {
+		offset += ext_page_size - offset%ext_page_size
+	}
+	return offset, nil
+}
+
+func (self *ExtendibleHashIndex) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of the given key, returns nil if the key does not exist
+ */
+func (self *ExtendibleHashIndex) FetchBytes(key []byte) ([]byte, error) {
+	err := self.lockDir(false)
+	if err != nil {
+		return nil, err
+	}
+	defer self.unlockDir()
+	hash := self.dbHash(key)
+	offset, err := self.findBucket(hash)
+	if err != nil {
+		return nil, err
+	}
+	err = self.readLockW(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	chain, err := self.readChain(offset)
+	if err != nil {
+		return nil, err
+	}
+	bucket, i := findExtEntry(chain, hash, key)
+	if bucket == nil {
+		return nil, nil
+	}
+	return self.datFile.readValue(bucket.entries[i].datoff, bucket.entries[i].datlen)
+}
+
+func (self *ExtendibleHashIndex) FetchAll() (map[string]string, error) {
+	err := self.lockDir(false)
+	if err != nil {
+		return nil, err
+	}
+	defer self.unlockDir()
+	records := make(map[string]string)
+	seen := make(map[int64]bool)
+	var slot uint64
+	for slot = 0; slot < 1<<self.depth; slot++ {
+		offset, err := self.readDirSlot(slot)
+		if err != nil {
+			return nil, err
+		}
+		if seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		err = self.fetchBucket(offset, records)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func (self *ExtendibleHashIndex) fetchBucket(offset int64, records map[string]string) error {
+	err := self.readLockW(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	chain, err := self.readChain(offset)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range chain {
+		for _, entry := range bucket.entries {
+			val, err := self.datFile.readValue(entry.datoff, entry.datlen)
+			if err != nil {
+				return err
+			}
+			records[string(entry.key)] = string(val)
+		}
+	}
+	return nil
+}
+
+/**
+ * Read the records a bucket at a time, see ScannableIndex. The records are
+ * returned in the order of their hash with its bits reversed, a bucket
+ * holds the keys whose hash ends with its low local depth bits, so in that
+ * order it covers a single range, which a split cuts in two.
+ */
+func (self *ExtendibleHashIndex) Scan(cursor []byte, limit int, keysOnly bool, fn func(key []byte, value []byte) error) ([]byte, error) {
+	return scanRanges(cursor, limit, fn, func(pos uint64) ([]scanRecord, uint64, error) {
+		return self.scanBucket(pos, keysOnly)
+	})
+}
+
+/**
+ * Read the records of the bucket whose range holds pos, from pos on.
+ * Returns them along with the end of the range, 0 for the last bucket.
+ */
+func (self *ExtendibleHashIndex) scanBucket(pos uint64, keysOnly bool) ([]scanRecord, uint64, error) {
+	err := self.lockDir(false)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer self.unlockDir()
+	hash := bits.Reverse64(pos)
+	offset, err := self.findBucket(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = self.readLockW(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer Unlock(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	chain, err := self.readChain(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	depth := chain[0].depth
+	start := bits.Reverse64(hash & (1<<depth - 1))
+	end := start + uint64(1)<<(64-depth) // wraps to 0 for the last range
+	var records []scanRecord
+	for _, bucket := range chain {
+		for _, entry := range bucket.entries {
+			order := bits.Reverse64(entry.hash)
+			if order < pos {
+				continue
+			}
+			record := scanRecord{order: order, key: entry.key}
+			if !keysOnly {
+				record.value, err = self.datFile.readValue(entry.datoff, entry.datlen)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			records = append(records, record)
+		}
+	}
+	return records, end, nil
+}
+
+func (self *ExtendibleHashIndex) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *ExtendibleHashIndex) DeleteBytes(key []byte) error {
+	err := self.lockDir(false)
+	if err != nil {
+		return err
+	}
+	defer self.unlockDir()
+	hash := self.dbHash(key)
+	offset, err := self.findBucket(hash)
+	if err != nil {
+		return err
+	}
+	err = self.writeLockW(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	chain, err := self.readChain(offset)
+	if err != nil {
+		return err
+	}
+	bucket, i := findExtEntry(chain, hash, key)
+	if bucket == nil {
+		return nil
+	}
+	bucket.entries = append(bucket.entries[:i], bucket.entries[i+1:]...)
+	return self.writeBucket(bucket)
+}
+
+func (self *ExtendibleHashIndex) Insert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Insert)
+}
+
+func (self *ExtendibleHashIndex) Update(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Update)
+}
+
+func (self *ExtendibleHashIndex) Upsert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Upsert)
+}
+
+func (self *ExtendibleHashIndex) StoreBytes(key []byte, value []byte, op StoreOp) error {
+	return self.store(key, value, op)
+}
+
+func (self *ExtendibleHashIndex) store(key []byte, value []byte, op StoreOp) error {
+	err := checkSizes(key, value, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
+	}
+
+	/**
+	 * Most stores fit in their bucket and only need the bucket locked. If
+	 * the bucket is full we start over with the directory write locked and
+	 * split the bucket until the key fits.
+	 */
+	hash := self.dbHash(key)
+	full, err := self.tryStore(hash, key, value, op, false)
+	if err != nil || !full {
+		return err
+	}
+	_, err = self.tryStore(hash, key, value, op, true)
+	return err
+}
+
+/**
+ * Store the key in its bucket. Returns true without storing anything if the
+ * bucket is full and exclusive is not set, with exclusive set the bucket is
+ * split or given an overflow page until the key fits.
+ */
+func (self *ExtendibleHashIndex) tryStore(hash uint64, key []byte, value []byte, op StoreOp, exclusive bool) (bool, error) {
+	err := self.lockDir(exclusive)
+	if err != nil {
+		return false, err
+	}
+	defer self.unlockDir()
+	offset, err := self.findBucket(hash)
+	if err != nil {
+		return false, err
+	}
+	if !exclusive {
+		err = self.writeLockW(self.idxFile.Fd(), offset, io.SeekStart, 1)
+		if err != nil {
+			return false, err
+		}
+		defer Unlock(self.idxFile.Fd(), offset, io.SeekStart, 1)
+	}
+	chain, err := self.readChain(offset)
+	if err != nil {
+		return false, err
+	}
+
+	valueLen := int64(len(value))
+	bucket, i := findExtEntry(chain, hash, key)
+	if bucket != nil {
+		if op == Insert {
+			return false, fmt.Errorf("%w: %s", ErrKeyExists, key)
+		}
+		entry := &bucket.entries[i]
+		if valueLen == entry.datlen {
+			return false, self.datFile.overwriteValue(entry.datoff, value)
+		}
+		datoff, err := self.datFile.appendValue(value)
+		if err != nil {
+			return false, err
+		}
+		entry.datoff = datoff
+		entry.datlen = valueLen
+		return false, self.writeBucket(bucket)
+	}
+	if op == Update {
+		return false, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	entry := extEntry{hash: hash, key: append([]byte(nil), key...), datlen: valueLen}
+	entrySize := ext_entry_header_size + len(key)
+	for {
+		for _, bucket := range chain {
+			if bucket.size()+entrySize <= ext_page_size {
+				entry.datoff, err = self.datFile.appendValue(value)
+				if err != nil {
+					return false, err
+				}
+				bucket.entries = append(bucket.entries, entry)
+				return false, self.writeBucket(bucket)
+			}
+		}
+		if !exclusive {
+			return true, nil
+		}
+		err = self.split(chain, hash)
+		if err != nil {
+			return false, err
+		}
+		offset, err = self.findBucket(hash)
+		if err != nil {
+			return false, err
+		}
+		chain, err = self.readChain(offset)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+/**
+ * Split the full bucket holding the hash, doubling the directory if needed.
+ * A bucket which can not be split any further gets an overflow page. Must be
+ * called with the directory write locked.
+ */
+func (self *ExtendibleHashIndex) split(chain []*extBucket, hash uint64) error {
+	bucket := chain[0]
+	if bucket.depth >= ext_depth_max {
+		offset, err := self.allocPage()
+		if err != nil {
+			return err
+		}
+		last := chain[len(chain)-1]
+		err = self.writeBucket(&extBucket{offset: offset, depth: bucket.depth})
+		if err != nil {
+			return err
+		}
+		last.overflow = offset
+		return self.writeBucket(last)
+	}
+	if bucket.depth == self.depth {
+		err := self.doubleDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	offset, err := self.allocPage()
+	if err != nil {
+		return err
+	}
+	bit := uint64(1) << bucket.depth
+	sibling := &extBucket{offset: offset, depth: bucket.depth + 1}
+	var entries []extEntry
+	for _, entry := range bucket.entries {
+		if entry.hash&bit != 0 {
+			sibling.entries = append(sibling.entries, entry)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	bucket.entries = entries
+	bucket.depth++
+	err = self.writeBucket(sibling)
+	if err != nil {
+		return err
+	}
+
+	/**
+	 * Point the slots having the new bit set to the sibling before dropping
+	 * the moved entries from the bucket, so they are never unreachable
+	 */
+	slot := hash&(bit-1) | bit
+	for ; slot < 1<<self.depth; slot += bit << 1 {
+		err = self.writeDirSlot(slot, sibling.offset)
+		if err != nil {
+			return err
+		}
+	}
+	return self.writeBucket(bucket)
+}
+
+/**
+ * Double the directory, the new half points to the same buckets as the old
+ * one. The new directory is written at the end of the file before the header
+ * is switched to it.
+ */
+func (self *ExtendibleHashIndex) doubleDir() error {
+	size := int64(1<<self.depth) * ptr_size
+	buf := make([]byte, 2*size)
+	_, err := self.idxFile.ReadAt(buf[:size], self.dirOff)
+	if err != nil {
+		return fmt.Errorf("Failed to read the directory: %w", err)
+	}
+	copy(buf[size:], buf[:size])
+	offset, err := self.allocPage()
+	if err != nil {
+		return err
+	}
+	/* Keep the file page aligned for the buckets allocated after the directory */
+	if len(buf)%ext_page_size != 0 {
+		buf = append(buf, make([]byte, ext_page_size-len(buf)%ext_page_size)...)
+	}
+	bytesWritten, err := self.idxFile.WriteAt(buf, offset)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Error while writing the directory")
+	}
+	self.dirOff = offset
+	self.depth++
+	return self.writeHeader()
+}
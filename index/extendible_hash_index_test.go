@@ -0,0 +1,332 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+const (
+	ext_test_db_name = "extendible_hash_index_test"
+)
+
+func TestCreateExtendibleHashIndex(t *testing.T) {
+	_, err := extOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer extRemoveDB(ext_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxFinfo, err := os.Stat(ext_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxFinfo.Size() != 3*ext_page_size {
+		t.Errorf("Initial index file size %d, want %d", idxFinfo.Size(), 3*ext_page_size)
+	}
+	idxType, version, err := ReadFileHeader(ext_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxType != ExtendibleHashIndexType || version != FormatVersion {
+		t.Errorf("Expected index type %d version %d, got type %d version %d", ExtendibleHashIndexType, FormatVersion, idxType, version)
+	}
+}
+
+func TestInitialBucketsExtendibleHashIndex(t *testing.T) {
+	extRemoveDB(ext_test_db_name)
+	defer extRemoveDB(ext_test_db_name)
+	extIndex := &ExtendibleHashIndex{opts: Options{InitialBuckets: 8, HashSeed: 7}}
+	err := extIndex.Open(ext_test_db_name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extIndex.Close()
+	idxFinfo, err := os.Stat(ext_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* the header, a page for the directory and the buckets */
+	if idxFinfo.Size() != 10*ext_page_size {
+		t.Errorf("Initial index file size %d, want %d", idxFinfo.Size(), 10*ext_page_size)
+	}
+	for i := 0; i < 100; i++ {
+		err = extIndex.Insert(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = extIndex.lockDir(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extIndex.unlockDir()
+	if extIndex.depth != 3 {
+		t.Errorf("Expected global depth 3, got %d", extIndex.depth)
+	}
+	for i := 0; i < 100; i++ {
+		val, err := extIndex.Fetch(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != fmt.Sprintf("val_%d", i) {
+			t.Errorf("Expected value val_%d for key key_%d, got %q", i, i, val)
+		}
+	}
+}
+
+func TestStoreFetchDeleteExtendibleHashIndex(t *testing.T) {
+	extIndex, err := extOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer extRemoveDB(ext_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extIndex.Close()
+	err = extIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extIndex.Insert("k1", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when inserting an existing key")
+	}
+	err = extIndex.Update("k3", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when updating a missing key")
+	}
+	err = extIndex.Update("k1", "v1-updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extIndex.Upsert("k3", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extIndex.Delete("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extIndex.Delete("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"k1": "v1-updated", "k2": "", "k3": "v3"}
+	for k, v := range expected {
+		val, err := extIndex.Fetch(k)
+		if v == "" && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+}
+
+func TestSplitExtendibleHashIndex(t *testing.T) {
+	extIndex, err := extOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer extRemoveDB(ext_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrecords := 20000
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		err = extIndex.Insert(key, "val_"+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i += 2 {
+		err = extIndex.Delete(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	extIndex.Close()
+
+	extIndex, err = extOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extIndex.Close()
+	err = extIndex.lockDir(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extIndex.unlockDir()
+	/* a page holds about a hundred of these keys, every split only doubles the buckets it has to */
+	if extIndex.depth < 7 || extIndex.depth > 16 {
+		t.Errorf("Unexpected global depth %d for %d keys", extIndex.depth, nrecords)
+	}
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		expected := "val_" + key
+		if i%2 == 0 {
+			expected = ""
+		}
+		val, err := extIndex.Fetch(key)
+		if expected == "" && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected {
+			t.Errorf("Expected value %q for key %s, got %q", expected, key, val)
+		}
+	}
+	valuesMap, err := extIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valuesMap) != nrecords/2 {
+		t.Errorf("Expected %d records from FetchAll, got %d", nrecords/2, len(valuesMap))
+	}
+}
+
+func TestLargeKeysExtendibleHashIndex(t *testing.T) {
+	extIndex, err := extOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer extRemoveDB(ext_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extIndex.Close()
+	/* keys of the maximum length only fit a few to a page */
+	nrecords := 200
+	keys := make([][]byte, nrecords)
+	for i := range keys {
+		keys[i] = bytes.Repeat([]byte{byte(i)}, ext_key_max)
+		err = extIndex.StoreBytes(keys[i], keys[i][:i], Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, k := range keys {
+		val, err := extIndex.FetchBytes(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, k[:i]) {
+			t.Errorf("Expected value of %d bytes for key %d, got %d bytes", i, i, len(val))
+		}
+	}
+	err = extIndex.StoreBytes(make([]byte, ext_key_max+1), []byte("v"), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing a key longer than %d bytes", ext_key_max)
+	}
+}
+
+func TestConcurrentReadWriteExtendibleHashIndex(t *testing.T) {
+	var wg sync.WaitGroup
+	extOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer extRemoveDB(ext_test_db_name)
+	nrecords := 10000
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		vals[i] = fmt.Sprintf("val_%d", i)
+	}
+	nthreads := 20
+	step := nrecords / nthreads
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		start := i * step
+		end := start + step
+		go extWork(t, &wg, keys[start:end], vals[start:end])
+	}
+	wg.Wait()
+}
+
+func extWork(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string) {
+	defer wg.Done()
+	extIndex, err := extOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer extIndex.Close()
+	for i, k := range keys {
+		err := extIndex.Insert(k, vals[i])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for i, k := range keys {
+		val, err := extIndex.Fetch(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if val != vals[i] {
+			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
+		}
+	}
+
+	for _, k := range keys {
+		err := extIndex.Delete(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, k := range keys {
+		_, err := extIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
+			return
+		}
+	}
+}
+
+func extOpenNewDB(removeExisting bool, mode int) (*ExtendibleHashIndex, error) {
+	if removeExisting {
+		extRemoveDB(ext_test_db_name)
+	}
+	extIndex := new(ExtendibleHashIndex)
+	err := extIndex.Open(ext_test_db_name, mode)
+	return extIndex, err
+}
+
+func extRemoveDB(name string) {
+	os.Remove(name + ".idx")
+	os.Remove(name + ".dat")
+}
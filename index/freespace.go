@@ -0,0 +1,192 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+/**
+ * Free space management for the hash indexes. Space freed by deleted index
+ * records and values is kept on segregated free lists, one list for every
+ * power of two size class. The heads of the lists form a table in the index
+ * file:
+ *	head of class 0 (8 bytes) | ... | head of class free_nclasses-1 (8 bytes)
+ * Class c holds the blocks of size [2^c, 2^(c+1)), the last class holds all
+ * the bigger ones. A free block starts with a header linking it to the next
+ * block of its class:
+ *	next block ptr (8 bytes) | block size (4 bytes)
+ * The links are stored as offset+1, since offset 0 is a valid block in the
+ * data file.
+ *
+ * An allocation takes the head of the first list whose head fits, starting
+ * with the class of the requested size, and puts the rest of the block back
+ * on the list of its own size. Only the heads are looked at, so allocating
+ * and freeing take a fixed number of reads and writes no matter how long
+ * the lists get. Remainders too small to hold anything are given away along
+ * with the block and are lost until the database is compacted.
+ */
+const (
+	free_nclasses       = 32
+	free_table_size     = free_nclasses * ptr_size
+	freeblk_header_size = 12 // next(8) + size(4)
+)
+
+type freeList struct {
+	tableFile *os.File // file holding the table of list heads
+	tableOff  int64    // offset of the table, its first byte is the lock of the lists
+	blockFile *os.File // file holding the free blocks
+	minBlock  int64    // smallest block worth keeping
+}
+
+func freeClass(size int64) int {
+	c := bits.Len64(uint64(size)) - 1
+	if c >= free_nclasses {
+		return free_nclasses - 1
+	}
+	return c
+}
+
+func (self *freeList) readTable() ([]byte, error) {
+	table := make([]byte, free_table_size)
+	_, err := self.tableFile.ReadAt(table, self.tableOff)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the free list table: %w", err)
+	}
+	return table, nil
+}
+
+func (self *freeList) writeHead(class int, offset int64) error {
+	_, err := self.tableFile.WriteAt(encodePtr(offset+1), self.tableOff+int64(class*ptr_size))
+	return err
+}
+
+func (self *freeList) readBlock(offset int64) (int64, int64, error) {
+	buf := make([]byte, freeblk_header_size)
+	_, err := self.blockFile.ReadAt(buf, offset)
+	if err != nil {
+		return -1, 0, fmt.Errorf("Failed to read free block at offset %d: %w", offset, err)
+	}
+	next := int64(byteOrder.Uint64(buf[0:])) - 1
+	size := int64(byteOrder.Uint32(buf[8:]))
+	if size < self.minBlock {
+		return -1, 0, fmt.Errorf("Invalid free block at offset %d", offset)
+	}
+	return next, size, nil
+}
+
+/**
+ * Put the block on the list of its class. If zero is set the whole block
+ * is cleared first, so the deleted record does not linger in the file.
+ */
+func (self *freeList) push(table []byte, offset int64, size int64, zero bool) error {
+	class := freeClass(size)
+	buflen := int64(freeblk_header_size)
+	if zero {
+		buflen = size
+	}
+	buf := make([]byte, buflen)
+	copy(buf, table[class*ptr_size:(class+1)*ptr_size])
+	byteOrder.PutUint32(buf[8:], uint32(size))
+	_, err := self.blockFile.WriteAt(buf, offset)
+	if err != nil {
+		return err
+	}
+	byteOrder.PutUint64(table[class*ptr_size:], uint64(offset+1))
+	return self.writeHead(class, offset)
+}
+
+/**
+ * Find a free block of at least size bytes and take it off the lists.
+ * Returns the offset of the block, or -1 if none fits.
+ */
+func (self *freeList) alloc(size int64) (int64, error) {
+	err := WriteLockW(self.tableFile.Fd(), self.tableOff, io.SeekStart, 1)
+	if err != nil {
+		return -1, err
+	}
+	defer Unlock(self.tableFile.Fd(), self.tableOff, io.SeekStart, 1)
+	table, err := self.readTable()
+	if err != nil {
+		return -1, err
+	}
+	for class := freeClass(size); class < free_nclasses; class++ {
+		offset := int64(byteOrder.Uint64(table[class*ptr_size:])) - 1
+		if offset < 0 {
+			continue
+		}
+		next, blksize, err := self.readBlock(offset)
+		if err != nil {
+			return -1, err
+		}
+		/* only the lists of the size class itself and the last one can have blocks too small */
+		if blksize < size {
+			continue
+		}
+		byteOrder.PutUint64(table[class*ptr_size:], uint64(next+1))
+		err = self.writeHead(class, next)
+		if err != nil {
+			return -1, err
+		}
+		if blksize-size >= self.minBlock {
+			err = self.push(table, offset+size, blksize-size, false)
+			if err != nil {
+				return -1, err
+			}
+		}
+		return offset, nil
+	}
+	return -1, nil
+}
+
+/**
+ * Give back a block of the given size, blocks too small to be reused are
+ * left alone
+ */
+func (self *freeList) free(offset int64, size int64) error {
+	if offset < 0 {
+		return errors.New("Invalid free block offset")
+	}
+	if size < self.minBlock || size > math.MaxUint32 {
+		return nil
+	}
+	err := WriteLockW(self.tableFile.Fd(), self.tableOff, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.tableFile.Fd(), self.tableOff, io.SeekStart, 1)
+	table, err := self.readTable()
+	if err != nil {
+		return err
+	}
+	return self.push(table, offset, size, true)
+}
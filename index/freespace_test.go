@@ -0,0 +1,189 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+const (
+	freespace_test_db_name = "freespace_test"
+)
+
+func TestFreeListAlloc(t *testing.T) {
+	f, err := os.OpenFile(freespace_test_db_name+".idx", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(freespace_test_db_name + ".idx")
+	defer f.Close()
+	err = f.Truncate(free_table_size + 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeList := &freeList{tableFile: f, tableOff: 0, blockFile: f, minBlock: 16}
+
+	offset, err := freeList.alloc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != -1 {
+		t.Errorf("Expected no free space in an empty list, got offset %d", offset)
+	}
+	blockOff := int64(free_table_size)
+	err = freeList.free(blockOff, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* the block gets split, the rest stays on the lists */
+	for _, size := range []int64{100, 300, 500} {
+		offset, err = freeList.alloc(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != blockOff {
+			t.Errorf("Expected %d bytes to be allocated at offset %d, got %d", size, blockOff, offset)
+		}
+		blockOff += size
+	}
+	offset, err = freeList.alloc(101)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != -1 {
+		t.Errorf("Expected no free block of 101 bytes, got offset %d", offset)
+	}
+	/* the remaining 100 bytes fit exactly */
+	offset, err = freeList.alloc(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != blockOff {
+		t.Errorf("Expected 100 bytes to be allocated at offset %d, got %d", blockOff, offset)
+	}
+
+	/* blocks too small to be reused are not kept */
+	err = freeList.free(free_table_size+2000, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err = freeList.alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != -1 {
+		t.Errorf("Expected a block smaller than the minimum not to be reused, got offset %d", offset)
+	}
+
+	/* a bigger class is used if the class of the size has nothing which fits */
+	err = freeList.free(free_table_size+2000, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = freeList.free(free_table_size+3000, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err = freeList.alloc(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != free_table_size+3000 {
+		t.Errorf("Expected 50 bytes to be allocated at offset %d, got %d", free_table_size+3000, offset)
+	}
+}
+
+func TestFreeSpaceReuse(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, testFreeSpaceReuse)
+}
+
+/**
+ * Space freed by deleted records and by values which changed their length
+ * gets reused by records of other sizes, so the files stop growing
+ */
+func testFreeSpaceReuse(t *testing.T, idxType IndexType) {
+	exts := IndexFileExts(idxType)
+	idx := openNewIndex(t, freespace_test_db_name, idxType, Options{})
+	defer idx.Close()
+	var err error
+	nrecords := 200
+	for i := 0; i < nrecords; i++ {
+		err = idx.StoreBytes([]byte(fmt.Sprintf("long_key_%d", i)), largeValue(5000, byte(i)), Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizes := fileSizes(t, freespace_test_db_name, exts)
+	for i := 0; i < nrecords; i++ {
+		err = idx.DeleteBytes([]byte(fmt.Sprintf("long_key_%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < nrecords; i++ {
+			err = idx.StoreBytes([]byte(fmt.Sprintf("k%d", i)), largeValue(100*(round+1), byte(i)), Upsert)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	/* the new record of a resized value is written before the old one is freed, that takes a few records more */
+	slack := int64(8 * (idxrec_header_size + len("k199")))
+	for i, size := range fileSizes(t, freespace_test_db_name, exts) {
+		if size > sizes[i]+slack {
+			t.Errorf("Expected %s to reuse the free space, grew from %d to %d bytes", exts[i], sizes[i], size)
+		}
+	}
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nrecords {
+		t.Errorf("Expected %d records, got %d", nrecords, len(records))
+	}
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if records[key] != string(largeValue(300, byte(i))) {
+			t.Errorf("Unexpected value for key %s", key)
+		}
+	}
+}
+
+func fileSizes(t *testing.T, name string, exts []string) []int64 {
+	sizes := make([]int64, len(exts))
+	for i, ext := range exts {
+		finfo, err := os.Stat(name + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = finfo.Size()
+	}
+	return sizes
+}
@@ -27,39 +27,47 @@
 package index
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
 
 	"github.com/OneOfOne/xxhash"
-	"golang.org/x/sys/unix"
 )
 
 const (
 	idx_header_off  = 0
-	idx_header_size = 4 // idxtype(1)
-	idxtype_sz      = 3 //one byte
-	IDXLEN_SZ       = 4 //index record length
-	SEP             = ':'
-	SEP_STR         = ":"
-	PTR_SZ          = 7                                //size of ptr field in hash chain
-	PTR_MAX         = 9999999                          // max file offset = 10 ** PTR_SZ - 1
-	HASHTABLE_SIZE  = 137                              //hash table size
-	FREE_OFF        = idx_header_off + idx_header_size //free list offset in index file
-	HASH_OFF        = FREE_OFF + PTR_SZ                //hash table offset in index file
-	IDXLEN_MIN      = 6
-	IDXLEN_MAX      = 1024
-	DATLEN_MIN      = 2
-	DATLEN_MAX      = 1024
+	MAXVAL_OFF      = idx_header_off + file_header_size //max value size offset in index file
+	MAXVAL_SZ       = 8
+	MAXKEY_OFF      = MAXVAL_OFF + MAXVAL_SZ //max key size offset in index file
+	MAXKEY_SZ       = 8
+	NHASH_OFF       = MAXKEY_OFF + MAXKEY_SZ //hash table size offset in index file
+	NHASH_SZ        = 8
+	SEED_OFF        = NHASH_OFF + NHASH_SZ //hash seed offset in index file
+	SEED_SZ         = 8
+	idx_header_size = SEED_OFF + SEED_SZ
+	PTR_SZ          = ptr_size                         //size of ptr field in hash chain
+	HASHTABLE_SIZE  = 137                              //default hash table size
+	FREE_OFF        = idx_header_off + idx_header_size //free lists of the index records, see freespace.go
+	DATFREE_OFF     = FREE_OFF + free_table_size       //free lists of the data file
+	HASH_OFF        = DATFREE_OFF + free_table_size    //hash table offset in index file
+	IDXLEN_MIN      = idxrec_header_size + 1           // index record with a single byte key
+	IDXLEN_MAX      = idxrec_header_size + key_size_max
 )
 
 type HashIndex struct {
+	lockWaiter
 	idxFile  *os.File
-	datFile  *os.File
-	idxbuf   string
-	datbuf   string
+	datFile  *dataFile
+	idxFree  *freeList
+	datFree  *freeList
+	opts     Options
+	maxValue int64
+	maxKey   int64
+	seed     uint64
+	idxbuf   []byte
+	datbuf   []byte
 	name     string
 	idxoff   int64
 	idxlen   int64
@@ -73,19 +81,27 @@ type HashIndex struct {
 }
 
 func (self *HashIndex) Open(name string, mode int) error {
-	self.nhash = HASHTABLE_SIZE
 	self.hashoff = HASH_OFF
 	self.name = name
-	var err error
+	opts, err := self.opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	self.nhash, err = opts.initialBuckets(HASHTABLE_SIZE, false)
+	if err != nil {
+		return err
+	}
 	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
 	if err != nil {
 		return fmt.Errorf("Failed to create index file %s", self.name+".idx")
 	}
 
-	self.datFile, err = os.OpenFile(self.name+".dat", mode, 0644)
+	self.datFile, err = openDataFile(self.name+".dat", mode)
 	if err != nil {
 		return fmt.Errorf("Failed to create data file %s", self.name+".dat")
 	}
+	self.idxFree = &freeList{tableFile: self.idxFile, tableOff: FREE_OFF, blockFile: self.idxFile, minBlock: IDXLEN_MIN}
+	self.datFree = &freeList{tableFile: self.idxFile, tableOff: DATFREE_OFF, blockFile: self.datFile.File, minBlock: datext_header_size}
 
 	isCreateMode := mode&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE || mode&(os.O_CREATE|os.O_TRUNC) == os.O_TRUNC
 	if isCreateMode {
@@ -106,14 +122,15 @@ func (self *HashIndex) Open(name string, mode int) error {
 		}
 
 		if idxFileInfo.Size() == 0 {
-			self.writeHeader()
+			err = self.writeHeader(opts)
+			if err != nil {
+				return err
+			}
 			/**
-			 * We have to build a chain NHASH_DEF + 1 hash chain pointers
+			 * We have to build the free list tables followed by the NHASH_DEF
+			 * hash chain pointers
 			 */
-			hashPointer := fmt.Sprintf("%*d", PTR_SZ, 0)
-			hashPointer = strings.Repeat(hashPointer, HASHTABLE_SIZE+1)
-			hashPointer = hashPointer + "\n"
-			bytes := []byte(hashPointer)
+			bytes := make([]byte, HASH_OFF-FREE_OFF+int64(self.nhash*PTR_SZ))
 			bytesWritten, err := self.idxFile.Write(bytes)
 			if err != nil {
 				return errors.New("Write to index file failed")
@@ -124,21 +141,59 @@ func (self *HashIndex) Open(name string, mode int) error {
 		}
 
 	}
+	err = verifyFileHeader(self.idxFile, HashIndexType)
+	if err != nil {
+		self.Close()
+		return err
+	}
+	err = self.readHeader()
+	if err != nil {
+		self.Close()
+		return err
+	}
 	self.Rewind()
 	return nil
 }
 
-func (self *HashIndex) writeHeader() error {
+func (self *HashIndex) writeHeader(opts Options) error {
 	/**
-	 * We need to write the 256 byte index header first. Header is defined as:
-	 * number of buckets (4 bytes): split pointer (4 bytes): rest 0 bytes, reserved for future use
+	 * The size of the hash table is fixed, so apart from the common file
+	 * header we only need to store the options the index was created with
 	 */
-	header := fmt.Sprintf("%*d\n", idxtype_sz, HashIndexType)
+	header := make([]byte, idx_header_size)
+	copy(header, encodeFileHeader(HashIndexType))
+	byteOrder.PutUint64(header[MAXVAL_OFF:], uint64(opts.MaxValueSize))
+	byteOrder.PutUint64(header[MAXKEY_OFF:], uint64(opts.MaxKeySize))
+	byteOrder.PutUint64(header[NHASH_OFF:], self.nhash)
+	byteOrder.PutUint64(header[SEED_OFF:], opts.HashSeed)
 	_, err := self.idxFile.Seek(idx_header_off, io.SeekStart)
-	_, err = self.idxFile.Write([]byte(header))
+	if err != nil {
+		return err
+	}
+	_, err = self.idxFile.Write(header)
 	return err
 }
 
+/**
+ * Read the options the database was created with from the header, the
+ * header never changes after creation so there is no need to lock it
+ */
+func (self *HashIndex) readHeader() error {
+	buf := make([]byte, idx_header_size)
+	_, err := self.idxFile.ReadAt(buf, idx_header_off)
+	if err != nil {
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.maxValue = int64(byteOrder.Uint64(buf[MAXVAL_OFF:]))
+	self.maxKey = int64(byteOrder.Uint64(buf[MAXKEY_OFF:]))
+	self.nhash = byteOrder.Uint64(buf[NHASH_OFF:])
+	self.seed = byteOrder.Uint64(buf[SEED_OFF:])
+	if self.nhash == 0 {
+		return errors.New("Invalid hash table size 0 in index header")
+	}
+	return nil
+}
+
 func (self *HashIndex) Close() error {
 	if self.idxFile != nil {
 		err := self.idxFile.Close()
@@ -159,10 +214,10 @@ func (self *HashIndex) Close() error {
 func (self *HashIndex) FetchAll() (map[string]string, error) {
 	records := make(map[string]string)
 	var i uint64
-	var startOff int64 = FREE_OFF
+	var startOff int64 = self.hashoff - PTR_SZ
 	for i = 0; i < self.nhash; i++ {
 		startOff += PTR_SZ
-		err := ReadLockW(self.idxFile.Fd(), startOff, io.SeekStart, 1)
+		err := self.readLockW(self.idxFile.Fd(), startOff, io.SeekStart, 1)
 		if err != nil {
 			return nil, err
 		}
@@ -178,15 +233,20 @@ func (self *HashIndex) FetchAll() (map[string]string, error) {
 		for {
 			nextOffset, err := self.readIdx(offset)
 			if err != nil {
-				Unlock(self.idxFile.Fd(), startOff, io.SeekStart, 1)
-				return nil, err
+				/* in quarantine mode the chain ends at a damaged record */
+				nextOffset = 0
+			} else {
+				var val []byte
+				val, err = self.readData()
+				if err == nil {
+					records[string(self.idxbuf)] = string(val)
+				}
 			}
-			val, err := self.readData()
+			err = quarantine(self.name, self.opts.QuarantineCorrupt, err)
 			if err != nil {
 				Unlock(self.idxFile.Fd(), startOff, io.SeekStart, 1)
 				return nil, err
 			}
-			records[self.idxbuf] = val
 			if nextOffset != 0 {
 				offset = nextOffset
 			} else {
@@ -203,17 +263,26 @@ func (self *HashIndex) FetchAll() (map[string]string, error) {
 }
 
 func (self *HashIndex) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of the given key, returns nil if the key does not exist
+ */
+func (self *HashIndex) FetchBytes(key []byte) ([]byte, error) {
 	found, err := self.findAndLock(key, false)
 	defer Unlock(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if !found {
-		return "", nil
+		return nil, nil
 	}
 	val, err := self.readData()
 	if err != nil {
-		return "", err
+		/* a quarantined record is not there */
+		return nil, quarantine(self.name, self.opts.QuarantineCorrupt, err)
 	}
 	return val, nil
 }
@@ -221,13 +290,12 @@ func (self *HashIndex) Fetch(key string) (string, error) {
 /**
  * Find the record associated with the given key
  */
-func (self *HashIndex) findAndLock(key string, isWriteLock bool) (bool, error) {
+func (self *HashIndex) findAndLock(key []byte, isWriteLock bool) (bool, error) {
 	/**
 	 * Calculate the hash value for the key, and then calculate the offset of
 	 * corresponding chain pointer in hash table
 	 */
 	self.chainoff = int64(self.dbHash(key)*PTR_SZ) + self.hashoff
-	self.ptroff = self.chainoff
 	var err error
 
 	/**
@@ -235,28 +303,42 @@ func (self *HashIndex) findAndLock(key string, isWriteLock bool) (bool, error) {
 	 * the first byte
 	 */
 	if isWriteLock {
-		err = WriteLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
+		err = self.writeLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	} else {
-		err = ReadLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
+		err = self.readLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	}
 	if err != nil {
 		return false, err
 	}
+	return self.find(key)
+}
+
+/**
+ * Walk the hash chain at chainoff, which must be locked, looking for the key
+ */
+func (self *HashIndex) find(key []byte) (bool, error) {
+	self.ptroff = self.chainoff
 
 	/**
 	 * Get the offset of the first record in hash chain
 	 */
 	offset, err := self.readPtr(self.ptroff)
 	if err != nil {
-		return false, nil
+		return false, err
 	}
 
 	for offset != 0 {
 		nextOffset, err := self.readIdx(offset)
 		if err != nil {
-			return false, err
+			/* in quarantine mode the chain ends at a damaged record */
+			err = quarantine(self.name, self.opts.QuarantineCorrupt, err)
+			if err != nil {
+				return false, err
+			}
+			offset = 0
+			break
 		}
-		if self.idxbuf == key {
+		if bytes.Equal(self.idxbuf, key) {
 			break
 		}
 		self.ptroff = offset
@@ -269,10 +351,14 @@ func (self *HashIndex) findAndLock(key string, isWriteLock bool) (bool, error) {
 	return true, nil
 }
 
-func (self *HashIndex) dbHash(key string) uint64 {
-	hasher := xxhash.NewS64(42)
-	hasher.WriteString(key)
-	return hasher.Sum64() % uint64(self.nhash)
+func (self *HashIndex) dbHash(key []byte) uint64 {
+	return self.keyHash(key) % uint64(self.nhash)
+}
+
+func (self *HashIndex) keyHash(key []byte) uint64 {
+	hasher := xxhash.NewS64(self.seed)
+	hasher.Write(key)
+	return hasher.Sum64()
 }
 
 /**
@@ -293,16 +379,7 @@ func (self *HashIndex) readPtr(offset int64) (int64, error) {
 	if readBytes != PTR_SZ {
 		return -1, errors.New("Failed to read pointer data")
 	}
-	s := string(buf)
-	return parseInt(s)
-}
-
-func createIOVecArray(size int, byteArrays ...[]byte) [][]byte {
-	iovecBytes := make([][]byte, size)
-	for i, b := range byteArrays {
-		iovecBytes[i] = b
-	}
-	return iovecBytes
+	return decodePtr(buf), nil
 }
 
 /**
@@ -326,94 +403,67 @@ func (self *HashIndex) readIdx(offset int64) (int64, error) {
 	self.idxoff = curOffset
 
 	/* Read the fixed length header in the index record */
-	ptrbuf := make([]byte, PTR_SZ)
-	idxLenbuf := make([]byte, IDXLEN_SZ)
-	iovecBytes := make([][]byte, 2)
-	iovecBytes[0] = ptrbuf
-	iovecBytes[1] = idxLenbuf
-	// iovecBytes := createIOVecArray(2, ptrbuf, idxbuf)
-	bytesRead, err := unix.Readv(int(self.idxFile.Fd()), iovecBytes)
+	hdrbuf := make([]byte, idxrec_header_size)
+	bytesRead, err := io.ReadFull(self.idxFile, hdrbuf)
+	if err == io.EOF && offset == 0 {
+		return -1, nil
+	}
 	if err != nil {
 		return -1, err
 	}
 
-	if bytesRead == 0 && offset == 0 {
-		return -1, nil
-	}
-	self.ptrval, _ = parseInt(string(ptrbuf))
-	self.idxlen, _ = parseInt(string(idxLenbuf))
+	var keylen int64
+	self.ptrval, keylen, self.datoff, self.datlen = decodeIdxHeader(hdrbuf)
+	self.idxlen = idxrec_header_size + keylen
 	if self.idxlen < IDXLEN_MIN || self.idxlen > IDXLEN_MAX {
-		return -1, fmt.Errorf("Invalid index record length %d", self.idxlen)
+		return -1, self.corruptIdx(fmt.Sprintf("invalid index record length %d", self.idxlen))
 	}
-	idxbufBytes := make([]byte, self.idxlen)
+	idxbufBytes := make([]byte, keylen)
 
-	/* Now read the actual index record */
-	bytesRead, err = self.idxFile.Read(idxbufBytes)
+	/* Now read the key */
+	bytesRead, err = io.ReadFull(self.idxFile, idxbufBytes)
 	if err != nil {
-		return -1, err
+		return -1, fmt.Errorf("Failed to read index record at offset %d: %w", offset, err)
 	}
-	if int64(bytesRead) != self.idxlen {
+	if int64(bytesRead) != keylen {
 		return -1, fmt.Errorf("Failed to read index record at offset %d", offset)
 	}
-
-	if !testNewLine(string(idxbufBytes)) {
-		return -1, fmt.Errorf("Corrupted index record at offset %d, not ending with new line", offset)
-	}
-	idxbufBytes = idxbufBytes[:self.idxlen-1] //ignore the newline
-	idxbuf := string(idxbufBytes)
-
-	parts := strings.Split(idxbuf, SEP_STR)
-	if len(parts) == 0 {
-		return -1, fmt.Errorf("Invalid index record: missing separators")
-	}
-
-	if len(parts) > 3 {
-		return -1, fmt.Errorf("Invalid index record: too many separators (%d)", len(parts))
-	}
-
-	self.idxbuf = parts[0]
-	self.datoff, err = parseInt(parts[1])
-	if err != nil {
-		return -1, err
+	self.idxbuf = idxbufBytes
+	if !verifyIdxRecord(hdrbuf, idxbufBytes) {
+		return -1, self.corruptIdx("index record checksum mismatch")
 	}
 
 	if self.datoff < 0 {
-		return -1, errors.New("Starting data offset < 0")
+		return -1, self.corruptIdx("starting data offset < 0")
 	}
 
-	self.datlen, err = parseInt(parts[2])
-	if err != nil {
-		return -1, err
-	}
-	if self.datlen < 0 || self.datlen > DATLEN_MAX {
-		return -1, errors.New("Invalid data record length")
+	if self.datlen < 0 || self.datlen > self.maxValue {
+		return -1, self.corruptIdx("invalid data record length")
 	}
 	return self.ptrval, nil
 }
 
-func (self *HashIndex) readData() (string, error) {
-	_, err := self.datFile.Seek(self.datoff, io.SeekStart)
-	if err != nil {
-		return "", err
-	}
+func (self *HashIndex) corruptIdx(reason string) error {
+	return &CorruptError{File: self.idxFile.Name(), Offset: self.idxoff, Reason: reason}
+}
 
-	datbuf := make([]byte, self.datlen)
-	bytesRead, err := self.datFile.Read(datbuf)
-	if err != nil {
-		return "", err
-	}
-	if int64(bytesRead) != self.datlen {
-		return "", fmt.Errorf("Failed to read data record from offset %d", self.datoff)
+func (self *HashIndex) readData() ([]byte, error) {
+	datbuf, err := self.datFile.readValue(self.datoff, self.datlen)
+	if corruptErr, ok := err.(*CorruptError); ok {
+		corruptErr.Key = self.idxbuf
 	}
-	if !testNewLine(string(datbuf)) {
-		return "", errors.New("Corrupted data record: missing newline")
+	if err != nil {
+		return nil, err
 	}
-	datbuf = datbuf[:self.datlen-1]
-	self.datbuf = string(datbuf)
+	self.datbuf = datbuf
 	return self.datbuf, nil
 }
 
 func (self *HashIndex) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *HashIndex) DeleteBytes(key []byte) error {
 	found, err := self.findAndLock(key, true)
 	if err != nil {
 		return err
@@ -427,80 +477,84 @@ func (self *HashIndex) Delete(key string) error {
 	return nil
 }
 
+/**
+ * Unlink the current record from its chain and give its space and the
+ * space of its value back to the free lists
+ */
 func (self *HashIndex) _delete() error {
-	var freeptr, saveptr int64
-	self.datbuf = strings.Repeat(" ", len(self.datbuf))
-	self.idxbuf = strings.Repeat(" ", len(self.idxbuf))
-	err := WriteLockW(self.idxFile.Fd(), FREE_OFF, io.SeekStart, 1)
+	err := self.writePtr(self.ptroff, self.ptrval)
 	if err != nil {
 		return err
 	}
-	defer func() error {
-		return Unlock(self.idxFile.Fd(), FREE_OFF, io.SeekStart, 1)
-	}()
-	self.writeData(self.datbuf, self.datoff, io.SeekStart)
-	freeptr, err = self.readPtr(FREE_OFF)
+	err = self.idxFree.free(self.idxoff, self.idxlen)
 	if err != nil {
 		return err
 	}
-	saveptr = self.ptrval
-	err = self.writeIdx(self.idxbuf, self.idxoff, io.SeekStart, freeptr)
+	return self.datFree.free(self.datoff, valueSize(self.datlen))
+}
+
+/**
+ * Write the value of a new record into free space, or at the end of the
+ * data file if none fits
+ */
+func (self *HashIndex) writeNewData(data []byte) error {
+	offset, err := self.datFree.alloc(valueSize(int64(len(data))))
 	if err != nil {
 		return err
 	}
-	err = self.writePtr(FREE_OFF, self.idxoff)
+	if offset < 0 {
+		return self.writeData(data, 0, io.SeekEnd)
+	}
+	err = self.datFile.writeValue(offset, data)
 	if err != nil {
 		return err
 	}
-	return self.writePtr(self.ptroff, saveptr)
+	self.datoff = offset
+	self.datlen = int64(len(data))
+	return nil
 }
 
-func (self *HashIndex) writeData(data string, offset int64, whence int) error {
-	// we need to lock if we are adding a new record - no need for lock for overwriting
+/**
+ * Write the value either at the end of the data file (whence == io.SeekEnd)
+ * or over the extents of an existing value of the same length
+ */
+func (self *HashIndex) writeData(data []byte, offset int64, whence int) error {
 	if whence == io.SeekEnd {
-		err := WriteLockW(self.datFile.Fd(), 0, io.SeekStart, 0) //lock whole file
+		newoffset, err := self.datFile.appendValue(data)
+		if err != nil {
+			return err
+		}
+		offset = newoffset
+	} else {
+		err := self.datFile.overwriteValue(offset, data)
 		if err != nil {
 			return err
 		}
-		defer func() error {
-			return Unlock(self.datFile.Fd(), 0, io.SeekStart, 0)
-		}()
-	}
-
-	newoffset, err := self.datFile.Seek(offset, whence)
-	if err != nil {
-		return err
 	}
-	self.datoff = newoffset
-
-	self.datlen = int64(len(data) + 1) // +1 for newline
-	iovecBytes := make([][]byte, 2)
-	iovecBytes[0] = []byte(data)
-	iovecBytes[1] = []byte("\n")
-	_, err = unix.Writev(int(self.datFile.Fd()), iovecBytes)
-	return err
+	self.datoff = offset
+	self.datlen = int64(len(data))
+	return nil
 }
 
-func (self *HashIndex) writeIdx(key string, offset int64, whence int, ptrval int64) error {
-	if self.ptrval < 0 || self.ptrval > PTR_MAX {
-		return fmt.Errorf("Invalid pointer: %d", self.ptrval)
+func (self *HashIndex) writeIdx(key []byte, offset int64, whence int, ptrval int64) error {
+	if ptrval < 0 {
+		return fmt.Errorf("Invalid pointer: %d", ptrval)
 	}
-	self.idxbuf = fmt.Sprintf("%s%c%d%c%d\n", key, SEP, self.datoff, SEP, self.datlen)
-	length := len(self.idxbuf)
+	record := encodeIdxRecord(ptrval, key, self.datoff, self.datlen)
+	length := len(record)
 	if length < IDXLEN_MIN || length > IDXLEN_MAX {
 		return errors.New("Invalid index record length")
 	}
 
-	indexRecPrefix := fmt.Sprintf("%*d%*d", PTR_SZ, ptrval, IDXLEN_SZ, length)
-
-	// if we are appending we need to lock the index file
+	// if we are appending we need to lock the index file past the hash table
 	if whence == io.SeekEnd {
-		err := WriteLockW(self.idxFile.Fd(), ((int64(self.nhash)+1)*PTR_SZ)+1, io.SeekStart, 0)
+		lockOff := self.hashoff + int64(self.nhash)*PTR_SZ
+		err := WriteLockW(self.idxFile.Fd(), lockOff, io.SeekStart, 0)
 		if err != nil {
 			return err
 		}
 		defer func() error {
-			return Unlock(self.idxFile.Fd(), (int64(self.nhash+1)*PTR_SZ)+1, io.SeekStart, 0)
+			return Unlock(self.idxFile.Fd(), lockOff, io.SeekStart, 0)
 		}()
 	}
 
@@ -509,33 +563,48 @@ func (self *HashIndex) writeIdx(key string, offset int64, whence int, ptrval int
 		return err
 	}
 	self.idxoff = idxoff
-	iovecBytes := make([][]byte, 2)
-	iovecBytes[0] = []byte(indexRecPrefix)
-	iovecBytes[1] = []byte(self.idxbuf)
-	bytesWritten, err := unix.Writev(int(self.idxFile.Fd()), iovecBytes)
+	self.idxbuf = key
+	bytesWritten, err := self.idxFile.Write(record)
 	if err != nil {
 		return err
 	}
-	if bytesWritten != len(indexRecPrefix)+len(self.idxbuf) {
+	if bytesWritten != length {
 		return errors.New("Error while writing index record")
 	}
 
 	return nil
 }
 
+/**
+ * Write a new index record into free space, or at the end of the index file
+ * if none fits
+ */
+func (self *HashIndex) writeNewIdx(key []byte, ptrval int64) error {
+	offset, err := self.idxFree.alloc(idxrec_header_size + int64(len(key)))
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return self.writeIdx(key, 0, io.SeekEnd, ptrval)
+	}
+	return self.writeIdx(key, offset, io.SeekStart, ptrval)
+}
+
 /**
  * Write a chain pointer field in the index file
  */
 func (self *HashIndex) writePtr(offset int64, ptrval int64) error {
-	if ptrval < 0 || ptrval > PTR_MAX {
+	if ptrval < 0 {
 		return fmt.Errorf("Invalid ptrval: %d", ptrval)
 	}
-	asciiptr := fmt.Sprintf("%*d", PTR_SZ, ptrval)
 	_, err := self.idxFile.Seek(offset, io.SeekStart)
 	if err != nil {
 		return err
 	}
-	bytesWritten, err := self.idxFile.Write([]byte(asciiptr))
+	bytesWritten, err := self.idxFile.Write(encodePtr(ptrval))
+	if err != nil {
+		return err
+	}
 	if bytesWritten != PTR_SZ {
 		return errors.New("Failed to write index pointer")
 	}
@@ -543,22 +612,32 @@ func (self *HashIndex) writePtr(offset int64, ptrval int64) error {
 }
 
 func (self *HashIndex) Insert(key string, value string) error {
-	return self.store(key, value, insert)
+	return self.store([]byte(key), []byte(value), Insert)
 }
 
 func (self *HashIndex) Update(key string, value string) error {
-	return self.store(key, value, update)
+	return self.store([]byte(key), []byte(value), Update)
 }
 
 func (self *HashIndex) Upsert(key string, value string) error {
-	return self.store(key, value, upsert)
+	return self.store([]byte(key), []byte(value), Upsert)
 }
 
-func (self *HashIndex) store(key string, value string, op indexStoreOp) error {
-	keyLen := int64(len(key))
+/**
+ * Store the value of the key as op says, Insert fails with ErrKeyExists if
+ * the key is there and Update with ErrNotFound if it is not. A value of the
+ * same length is written over the old one, any other value is stored in a
+ * new record and the old record is freed.
+ */
+func (self *HashIndex) StoreBytes(key []byte, value []byte, op StoreOp) error {
+	return self.store(key, value, op)
+}
+
+func (self *HashIndex) store(key []byte, value []byte, op StoreOp) error {
 	valueLen := int64(len(value))
-	if valueLen < DATLEN_MIN || valueLen > DATLEN_MAX {
-		return fmt.Errorf("Invalid data length: %d", valueLen)
+	err := checkSizes(key, value, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
 	}
 
 	found, err := self.findAndLock(key, true)
@@ -569,96 +648,253 @@ func (self *HashIndex) store(key string, value string, op indexStoreOp) error {
 		return err
 	}
 	if !found {
-		if op == update {
-			return fmt.Errorf("Record with key %s does not exist", key)
+		if op == Update {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
+		return self.insertRecord(key, value)
+	}
+	if op == Insert {
+		return fmt.Errorf("%w: %s", ErrKeyExists, key)
+	}
+	if valueLen == self.datlen {
+		return self.writeData(value, self.datoff, io.SeekStart)
+	}
+	return self.replaceRecord(key, value, -1)
+}
 
-		ptrval, err := self.readPtr(self.chainoff)
+/**
+ * Write a new record for the value and link it in place of the record found
+ * last, the value is written first unless it is already at datoff. The swap
+ * is a single pointer write and the old record is only freed after it, so a
+ * crash at any point leaves either the old or the new record in the chain.
+ */
+func (self *HashIndex) replaceRecord(key []byte, value []byte, datoff int64) error {
+	ptroff, ptrval := self.ptroff, self.ptrval
+	idxoff, idxlen := self.idxoff, self.idxlen
+	olddatoff, olddatlen := self.datoff, self.datlen
+	if datoff < 0 {
+		err := self.writeNewData(value)
 		if err != nil {
 			return err
 		}
+	} else {
+		self.datoff = datoff
+		self.datlen = int64(len(value))
+	}
+	err := self.writeNewIdx(key, ptrval)
+	if err != nil {
+		return err
+	}
+	err = self.writePtr(ptroff, self.idxoff)
+	if err != nil {
+		return err
+	}
+	err = self.idxFree.free(idxoff, idxlen)
+	if err != nil {
+		return err
+	}
+	return self.datFree.free(olddatoff, valueSize(olddatlen))
+}
 
-		foundFree, err := self.findFree(keyLen, valueLen)
+/**
+ * Write a new record and link it at the head of the locked hash chain
+ */
+func (self *HashIndex) insertRecord(key []byte, value []byte) error {
+	ptrval, err := self.readPtr(self.chainoff)
+	if err != nil {
+		return err
+	}
+	err = self.writeNewData(value)
+	if err != nil {
+		return err
+	}
+	err = self.writeNewIdx(key, ptrval)
+	if err != nil {
+		return err
+	}
+	return self.writePtr(self.chainoff, self.idxoff)
+}
+
+/**
+ * Apply the stores and deletes of a batch, see BatchIndex
+ */
+func (self *HashIndex) WriteBatch(ops []BatchOp) error {
+	ops, err := checkBatch(ops, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
+	}
+	chainoffs := make([]int64, len(ops))
+	for i, op := range ops {
+		chainoffs[i] = int64(self.dbHash(op.Key)*PTR_SZ) + self.hashoff
+	}
+	sortBatch(ops, chainoffs)
+	locks, err := self.lockChains(self.idxFile.Fd(), chainoffs)
+	if err != nil {
+		return err
+	}
+	defer unlockChains(self.idxFile.Fd(), locks)
+
+	/* the new values are appended before any record changes */
+	var values [][]byte
+	for i, op := range ops {
+		if op.Delete {
+			continue
+		}
+		self.chainoff = chainoffs[i]
+		found, err := self.find(op.Key)
 		if err != nil {
 			return err
 		}
-		if !foundFree {
-			err = self.writeData(value, 0, io.SeekEnd)
-			if err != nil {
-				return err
-			}
-			err = self.writeIdx(key, 0, io.SeekEnd, ptrval)
-			if err != nil {
-				return err
-			}
-			err = self.writePtr(self.chainoff, self.idxoff)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = self.writeData(value, self.datoff, io.SeekStart)
-			if err != nil {
-				return err
-			}
-			err = self.writeIdx(key, self.idxoff, io.SeekStart, ptrval)
-			if err != nil {
-				return err
+		if !found || int64(len(op.Value)) != self.datlen {
+			values = append(values, op.Value)
+		}
+	}
+	datoffs, err := self.datFile.appendValues(values)
+	if err != nil {
+		return err
+	}
+	for i, op := range ops {
+		self.chainoff = chainoffs[i]
+		found, err := self.find(op.Key)
+		if err != nil {
+			return err
+		}
+		if found && !op.Delete {
+			if int64(len(op.Value)) == self.datlen {
+				err = self.writeData(op.Value, self.datoff, io.SeekStart)
+			} else {
+				err = self.replaceRecord(op.Key, op.Value, datoffs[0])
+				datoffs = datoffs[1:]
 			}
-			err = self.writePtr(self.chainoff, self.idxoff)
 			if err != nil {
 				return err
 			}
+			continue
 		}
-	} else {
-		if op == insert {
-			return fmt.Errorf("Record already exists with key: %s", key)
-		}
-		if valueLen != self.datlen {
+		if found {
 			err = self._delete()
 			if err != nil {
 				return err
 			}
-			ptrval, err := self.readPtr(self.chainoff)
-			if err != nil {
-				return err
-			}
-			self.writeData(value, 0, io.SeekEnd)
-			self.writeIdx(key, 0, io.SeekEnd, ptrval)
-			self.writePtr(self.chainoff, self.idxoff)
-		} else {
-			self.writeData(value, self.datoff, io.SeekStart)
+		}
+		if op.Delete {
+			continue
+		}
+		self.chainoff = chainoffs[i]
+		self.datoff = datoffs[0]
+		self.datlen = int64(len(op.Value))
+		datoffs = datoffs[1:]
+		ptrval, err := self.readPtr(self.chainoff)
+		if err != nil {
+			return err
+		}
+		err = self.writeNewIdx(op.Key, ptrval)
+		if err != nil {
+			return err
+		}
+		err = self.writePtr(self.chainoff, self.idxoff)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (self *HashIndex) findFree(keylen int64, datlen int64) (bool, error) {
-	var offset, nextOffset, saveOffset int64
-	err := WriteLockW(self.idxFile.Fd(), FREE_OFF, io.SeekStart, 1)
+/**
+ * Read the records a chain at a time, see ScannableIndex. The cursor holds
+ * the bucket and the hash to continue from, the records of a chain are
+ * returned in the order of their hash.
+ */
+func (self *HashIndex) Scan(cursor []byte, limit int, keysOnly bool, fn func(key []byte, value []byte) error) ([]byte, error) {
+	var bucket, pos uint64
+	if cursor != nil {
+		if len(cursor) != 2*ptr_size {
+			return nil, ErrInvalidCursor
+		}
+		bucket = byteOrder.Uint64(cursor)
+		pos = byteOrder.Uint64(cursor[ptr_size:])
+		if bucket >= self.nhash {
+			return nil, ErrInvalidCursor
+		}
+	}
+	count := 0
+	for ; bucket < self.nhash; bucket++ {
+		records, err := self.scanChain(bucket, pos, keysOnly)
+		if err != nil {
+			return nil, err
+		}
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - count
+		}
+		n, next, stopped, err := emitScan(records, remaining, fn)
+		if err != nil {
+			return nil, err
+		}
+		count += n
+		if stopped {
+			return self.scanCursor(bucket, next), nil
+		}
+		pos = 0
+		if limit > 0 && count >= limit && bucket+1 < self.nhash {
+			return self.scanCursor(bucket+1, 0), nil
+		}
+	}
+	return nil, nil
+}
+
+func (self *HashIndex) scanCursor(bucket uint64, pos uint64) []byte {
+	cursor := make([]byte, 2*ptr_size)
+	byteOrder.PutUint64(cursor, bucket)
+	byteOrder.PutUint64(cursor[ptr_size:], pos)
+	return cursor
+}
+
+/**
+ * Read the records of a chain whose hash is pos or more, with the chain
+ * read locked
+ */
+func (self *HashIndex) scanChain(bucket uint64, pos uint64, keysOnly bool) ([]scanRecord, error) {
+	chainoff := int64(bucket*PTR_SZ) + self.hashoff
+	err := self.readLockW(self.idxFile.Fd(), chainoff, io.SeekStart, 1)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), chainoff, io.SeekStart, 1)
+	offset, err := self.readPtr(chainoff)
+	if err != nil {
+		return nil, err
 	}
-	defer Unlock(self.idxFile.Fd(), FREE_OFF, io.SeekStart, 1)
-	saveOffset = FREE_OFF
-	offset, err = self.readPtr(saveOffset)
-	found := false
+	var records []scanRecord
 	for offset != 0 {
-		nextOffset, err = self.readIdx(offset)
-		if int64(len(self.idxbuf)) == keylen && self.datlen == datlen {
-			break
+		nextOffset, err := self.readIdx(offset)
+		if err != nil {
+			/* in quarantine mode the chain ends at a damaged record */
+			return records, quarantine(self.name, self.opts.QuarantineCorrupt, err)
 		}
-		saveOffset = offset
 		offset = nextOffset
+		order := self.keyHash(self.idxbuf)
+		if order < pos {
+			continue
+		}
+		record := scanRecord{order: order, key: self.idxbuf}
+		if !keysOnly {
+			record.value, err = self.readData()
+			if err != nil {
+				/* a quarantined record is not there */
+				err = quarantine(self.name, self.opts.QuarantineCorrupt, err)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		records = append(records, record)
 	}
-
-	if offset != 0 {
-		self.writePtr(saveOffset, self.ptrval)
-		found = true
-	}
-	return found, nil
+	return records, nil
 }
 
 func (self *HashIndex) Rewind() {
-	offset := (self.nhash + 1) * PTR_SZ
+	offset := uint64(self.hashoff) + self.nhash*PTR_SZ
 	self.idxFile.Seek(int64(offset), io.SeekStart)
 }
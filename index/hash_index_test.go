@@ -27,7 +27,10 @@
 package index
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -38,7 +41,8 @@ import (
 )
 
 const (
-	empty_index_file_size = 971
+	empty_index_file_size = 1648
+	large_file_offset     = 5 << 30
 	test_db_name          = "index_test"
 )
 
@@ -139,12 +143,9 @@ func TestDeleteSimpleHashIndex(t *testing.T) {
 	if val != "v1" {
 		t.Errorf("Expected value v1, got %s", val)
 	}
-	val, err = hashIndex.Fetch("k2")
-	if err != nil {
-		t.Fatal(err)
-	}
-	if val != "" {
-		t.Errorf("Expected value for k2 to be deleted, found value %s", val)
+	_, err = hashIndex.Fetch("k2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected key k2 to be deleted, got error %v", err)
 	}
 }
 
@@ -180,12 +181,9 @@ func TestDeleteMultiHashIndex(t *testing.T) {
 	}
 
 	for _, k := range delKeys {
-		val, err := hashIndex.Fetch(k)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if val != "" {
-			t.Errorf("Expected value for key %s to be deleted, found value %s returned", k, val)
+		_, err := hashIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
 		}
 	}
 
@@ -253,6 +251,101 @@ func TestUpdateHashIndex(t *testing.T) {
 
 }
 
+/**
+ * An update to a value of another size writes the new record before it
+ * unlinks the old one, a crash in between must leave the old value in place.
+ */
+func TestCrashDuringResizingUpdateHashIndex(t *testing.T) {
+	hashIndex, err := openNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer removeDB(test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the first half of the update, the new record is written but not linked */
+	found, err := hashIndex.findAndLock([]byte("k2"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("Expected to find k2")
+	}
+	err = hashIndex.writeNewData([]byte("a longer v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.writeNewIdx([]byte("k2"), hashIndex.ptrval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Unlock(hashIndex.idxFile.Fd(), hashIndex.chainoff, io.SeekStart, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashIndex, err = openNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	val, err := hashIndex.Fetch("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "v2" {
+		t.Errorf("Expected value v2 for key k2, got %s", val)
+	}
+	err = hashIndex.Update("k2", "a longer v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"k1": "v1", "k2": "a longer v2"} {
+		val, err = hashIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %s for key %s, got %s", v, k, val)
+		}
+	}
+}
+
+/**
+ * A hash table pointer which can't be read is an error, not a missing key
+ */
+func TestUnreadableChainHashIndex(t *testing.T) {
+	hashIndex, err := openNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer removeDB(test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	err = hashIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(test_db_name+".idx", hashIndex.hashoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.FetchBytes([]byte("k1"))
+	if err == nil {
+		t.Errorf("Expected an error fetching a key whose chain can't be read, got value %q", val)
+	}
+}
+
 func TestConcurrentReadWriteHashIndex(t *testing.T) {
 	fmt.Printf("Testing concurrent read/write")
 	go func() {
@@ -291,20 +384,23 @@ func work(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string) {
 	// fmt.Printf("working with keys %v\n", keys)
 	hashIndex, err := openNewDB(false, os.O_RDWR)
 	if err != nil {
-		t.Fatal(err)
+		t.Error(err)
+		return
 	}
 	defer hashIndex.Close()
 	for i, k := range keys {
 		err := hashIndex.Insert(k, vals[i])
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 	}
 
 	for i, k := range keys {
 		val, err := hashIndex.Fetch(k)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		if val != vals[i] {
 			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
@@ -315,17 +411,15 @@ func work(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string) {
 		// fmt.Printf("Deleting key %s\n", k)
 		err := hashIndex.Delete(k)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 	}
 
 	for _, k := range keys {
-		val, err := hashIndex.Fetch(k)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if val != "" {
-			t.Errorf("Expected key %s to be deleted, found value %s", k, val)
+		_, err := hashIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
 		}
 	}
 }
@@ -367,6 +461,322 @@ func TestFetchAllHashIndex(t *testing.T) {
 	}
 }
 
+func TestLargeOffsetsHashIndex(t *testing.T) {
+	hashIndex, err := openNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer removeDB(test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	/**
+	 * Grow the files past 4GB, the files stay sparse so this does not
+	 * need any disk space. All the new records get appended past this.
+	 */
+	err = os.Truncate(test_db_name+".idx", large_file_offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(test_db_name+".dat", large_file_offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrecords := 10
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("k%d", i)
+		vals[i] = fmt.Sprintf("v%d", i)
+	}
+	for i, k := range keys {
+		err = hashIndex.Insert(k, vals[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, k := range keys {
+		val, err := hashIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != vals[i] {
+			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
+		}
+		if hashIndex.idxoff < large_file_offset || hashIndex.datoff < large_file_offset {
+			t.Errorf("Expected key %s to be stored past offset %d, index offset %d, data offset %d", k, int64(large_file_offset), hashIndex.idxoff, hashIndex.datoff)
+		}
+	}
+
+	// the deleted record goes on the free list and gets reused
+	_, err = hashIndex.Fetch("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxoff, datoff := hashIndex.idxoff, hashIndex.datoff
+	err = hashIndex.Delete("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("k1", "v9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.Fetch("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "v9" {
+		t.Errorf("Expected value v9 for key k1, got %s", val)
+	}
+	if hashIndex.idxoff != idxoff || hashIndex.datoff != datoff {
+		t.Errorf("Expected the reinserted key to reuse index offset %d and data offset %d, got %d and %d", idxoff, datoff, hashIndex.idxoff, hashIndex.datoff)
+	}
+}
+
+func TestBinaryKeysAndValuesHashIndex(t *testing.T) {
+	hashIndex, err := openNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer removeDB(test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	keys := [][]byte{
+		[]byte("key:with:separators"),
+		[]byte("key\nwith\nnewlines"),
+		{0x00, 0xff, 0x0a, 0x3a},
+		{0x07},
+	}
+	vals := [][]byte{
+		[]byte("value\nwith\nnewlines\n"),
+		{0x00, 0x00, 0x0a},
+		{},
+		{0x0a},
+	}
+	for i, k := range keys {
+		err = hashIndex.StoreBytes(k, vals[i], Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, k := range keys {
+		val, err := hashIndex.FetchBytes(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val == nil || !bytes.Equal(val, vals[i]) {
+			t.Errorf("Expected value %q for key %q, got %q", vals[i], k, val)
+		}
+	}
+	valuesMap, err := hashIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if v, ok := valuesMap[string(k)]; !ok || v != string(vals[i]) {
+			t.Errorf("Expected value %q for key %q in FetchAll, got %q", vals[i], k, v)
+		}
+	}
+
+	err = hashIndex.StoreBytes(keys[0], []byte("new\nvalue"), Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.DeleteBytes(keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.FetchBytes(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "new\nvalue" {
+		t.Errorf("Expected value %q for key %q, got %q", "new\nvalue", keys[0], val)
+	}
+	val, err = hashIndex.FetchBytes(keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != nil {
+		t.Errorf("Expected key %q to be deleted, found value %q", keys[2], val)
+	}
+
+	err = hashIndex.StoreBytes([]byte{}, []byte("v"), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing an empty key")
+	}
+}
+
+func TestLargeValuesHashIndex(t *testing.T) {
+	hashIndex, err := openNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer removeDB(test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	large := largeValue(500*1024, 1)
+	err = hashIndex.StoreBytes([]byte("large"), large, Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("small", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.FetchBytes([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Errorf("Value of %d bytes does not match the stored value of %d bytes", len(val), len(large))
+	}
+
+	/* same length, the extents are overwritten in place */
+	large = largeValue(500*1024, 2)
+	err = hashIndex.StoreBytes([]byte("large"), large, Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = hashIndex.FetchBytes([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Errorf("Value does not match after update in place")
+	}
+
+	/* deleted extents are reused for a value of the same length */
+	err = hashIndex.Delete("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large = largeValue(500*1024, 3)
+	err = hashIndex.StoreBytes([]byte("large"), large, Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large = largeValue(700*1024+3, 4)
+	err = hashIndex.StoreBytes([]byte("large"), large, Upsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashIndex.Close()
+
+	hashIndex, err = openNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = hashIndex.FetchBytes([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Errorf("Value does not match after reopening the index")
+	}
+	val2, err := hashIndex.Fetch("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val2 != "v1" {
+		t.Errorf("Expected value v1 for key small, got %s", val2)
+	}
+	err = hashIndex.StoreBytes([]byte("too-large"), largeValue(DefaultMaxValueSize+1, 5), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing a value larger than the maximum value size")
+	}
+}
+
+func TestMaxValueSizeHashIndex(t *testing.T) {
+	removeDB(test_db_name)
+	defer removeDB(test_db_name)
+	hashIndex := &HashIndex{opts: Options{MaxValueSize: 100}}
+	err := hashIndex.Open(test_db_name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.StoreBytes([]byte("k1"), largeValue(100, 1), Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashIndex.Close()
+
+	/* the maximum value size is read from the header, not from the options */
+	hashIndex = &HashIndex{opts: Options{MaxValueSize: 1000}}
+	err = hashIndex.Open(test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	err = hashIndex.StoreBytes([]byte("k2"), largeValue(101, 1), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing a value larger than the maximum value size")
+	}
+
+	err = (&HashIndex{opts: Options{MaxValueSize: -1}}).Open(test_db_name+"_invalid", os.O_RDWR|os.O_CREATE)
+	if err == nil {
+		t.Errorf("Expected an error when opening an index with a negative maximum value size")
+	}
+}
+
+func TestCreateOptionsHashIndex(t *testing.T) {
+	removeDB(test_db_name)
+	defer removeDB(test_db_name)
+	hashIndex := &HashIndex{opts: Options{InitialBuckets: 11, MaxKeySize: 8, HashSeed: 7}}
+	err := hashIndex.Open(test_db_name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxFinfo, err := os.Stat(test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxFinfo.Size() != HASH_OFF+11*PTR_SZ {
+		t.Errorf("Initial index file size %d, want %d", idxFinfo.Size(), HASH_OFF+11*PTR_SZ)
+	}
+	for i := 0; i < 100; i++ {
+		err = hashIndex.Insert(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = hashIndex.Insert("key_too_long", "v")
+	if err == nil {
+		t.Errorf("Expected an error when storing a key longer than the maximum key size")
+	}
+	hashIndex.Close()
+
+	/* the table size and the seed are read from the header, not from the options */
+	hashIndex = &HashIndex{opts: Options{InitialBuckets: 500, HashSeed: 1}}
+	err = hashIndex.Open(test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	if hashIndex.nhash != 11 || hashIndex.seed != 7 || hashIndex.maxKey != 8 {
+		t.Errorf("Expected 11 buckets, seed 7 and maximum key size 8, got %d, %d and %d", hashIndex.nhash, hashIndex.seed, hashIndex.maxKey)
+	}
+	for i := 0; i < 100; i++ {
+		val, err := hashIndex.Fetch(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != fmt.Sprintf("val_%d", i) {
+			t.Errorf("Expected value val_%d for key key_%d, got %q", i, i, val)
+		}
+	}
+
+	err = (&HashIndex{opts: Options{MaxKeySize: DefaultMaxKeySize + 1}}).Open(test_db_name+"_invalid", os.O_RDWR|os.O_CREATE)
+	if err == nil {
+		t.Errorf("Expected an error when opening an index with a maximum key size above %d", DefaultMaxKeySize)
+	}
+}
+
+func largeValue(size int, seed byte) []byte {
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = byte(i*31) + seed
+	}
+	return value
+}
+
 func openNewDB(removeExisting bool, mode int) (*HashIndex, error) {
 	if removeExisting {
 		removeDB(test_db_name)
@@ -27,6 +27,9 @@
 package index
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -37,27 +40,202 @@ import (
 type IndexType int
 
 const (
-	HashIndexType       IndexType = 1
-	LinearHashIndexType IndexType = 2
+	HashIndexType           IndexType = 1
+	LinearHashIndexType     IndexType = 2
+	BTreeIndexType          IndexType = 3
+	LSMIndexType            IndexType = 4
+	BitcaskIndexType        IndexType = 5
+	ExtendibleHashIndexType IndexType = 6
 )
 
-type indexStoreOp int
+type StoreOp int
 
 const (
-	insert indexStoreOp = iota
-	update
-	upsert
+	Insert StoreOp = iota
+	Update
+	Upsert
 )
 
+const (
+	DefaultMaxValueSize   = 1 << 20
+	DefaultMaxKeySize     = IDXLEN_MAX - idxrec_header_size // also the largest key size supported
+	DefaultSplitThreshold = 30
+	DefaultHashSeed       = 42
+)
+
+/**
+ * Options used when creating a new index. They are stored in the header of
+ * the index, so opening an existing database always uses the options it
+ * was created with. Zero values are replaced by the defaults. The bucket
+ * options and the seed only apply to the hash based indexes.
+ *
+ * QuarantineCorrupt is the exception, it is not stored and applies to the
+ * handle being opened. It only affects the static and linear hash indexes.
+ */
+type Options struct {
+	MaxValueSize      int64   // maximum length of a value in bytes
+	MaxKeySize        int64   // maximum length of a key in bytes, at most DefaultMaxKeySize
+	InitialBuckets    uint64  // size of the hash table, or the initial one for the indexes which grow it
+	SplitThreshold    float64 // average number of records per bucket which makes the linear hash index split
+	HashSeed          uint64  // seed of the hash function
+	QuarantineCorrupt bool    // skip corrupt records and log them to <name>.quarantine instead of failing the read
+}
+
+func (self Options) withDefaults() (Options, error) {
+	if self.MaxValueSize == 0 {
+		self.MaxValueSize = DefaultMaxValueSize
+	}
+	if self.MaxKeySize == 0 {
+		self.MaxKeySize = DefaultMaxKeySize
+	}
+	if self.SplitThreshold == 0 {
+		self.SplitThreshold = DefaultSplitThreshold
+	}
+	if self.HashSeed == 0 {
+		self.HashSeed = DefaultHashSeed
+	}
+	if self.MaxValueSize < 0 || self.MaxValueSize > math.MaxUint32 {
+		return self, fmt.Errorf("Invalid maximum value size: %d", self.MaxValueSize)
+	}
+	if self.MaxKeySize < 0 || self.MaxKeySize > DefaultMaxKeySize {
+		return self, fmt.Errorf("Invalid maximum key size: %d", self.MaxKeySize)
+	}
+	if !(self.SplitThreshold > 0) || math.IsInf(self.SplitThreshold, 1) {
+		return self, fmt.Errorf("Invalid split threshold: %v", self.SplitThreshold)
+	}
+	return self, nil
+}
+
+/**
+ * Number of buckets to create, the given default unless set in the options.
+ * The indexes which grow by doubling need a power of two.
+ */
+func (self Options) initialBuckets(defaultBuckets uint64, powerOfTwo bool) (uint64, error) {
+	nbuckets := self.InitialBuckets
+	if nbuckets == 0 {
+		nbuckets = defaultBuckets
+	}
+	if nbuckets > 1<<ext_depth_max || (powerOfTwo && nbuckets&(nbuckets-1) != 0) {
+		return 0, fmt.Errorf("Invalid initial number of buckets: %d", nbuckets)
+	}
+	return nbuckets, nil
+}
+
+/**
+ * Errors returned by the indexes, wrapped with the key or the sizes
+ * involved, errors.Is tells them apart. A failed checksum, or a node,
+ * bucket or other structure of the files which does not make sense, is
+ * ErrCorrupt.
+ */
+var (
+	ErrNotFound      = errors.New("key not found")
+	ErrKeyExists     = errors.New("key already exists")
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrEmptyKey      = errors.New("empty key")
+	ErrLocked        = errors.New("database is locked")
+	ErrClosed        = errors.New("database is closed")
+)
+
+/**
+ * The string methods are convenience wrappers around the []byte ones, keys
+ * and values can contain arbitrary bytes.
+ *
+ * Fetch returns ErrNotFound for a key which does not exist, since an empty
+ * value would look the same, FetchBytes returns a nil value instead. Insert
+ * fails with ErrKeyExists if the key is there and Update with ErrNotFound
+ * if it is not, deleting a missing key is not an error. Stores of keys or
+ * values over the maximum sizes fail with ErrKeyTooLarge and
+ * ErrValueTooLarge, and stores of an empty key with ErrEmptyKey.
+ */
 type BrickIndex interface {
 	Open(name string, mode int) error
 	Close() error
 	Fetch(key string) (string, error)
+	FetchBytes(key []byte) ([]byte, error)
 	FetchAll() (map[string]string, error)
 	Delete(key string) error
+	DeleteBytes(key []byte) error
 	Insert(key string, value string) error
 	Update(key string, value string) error
 	Upsert(key string, value string) error
+	StoreBytes(key []byte, value []byte, op StoreOp) error
+}
+
+/**
+ * Implemented by the indexes which keep the keys in sorted order
+ */
+type OrderedIndex interface {
+	Range(start []byte, end []byte, fn func(key []byte, value []byte) error) error
+}
+
+/**
+ * Return an unopened index of the given type, opts are only used if Open
+ * creates the database
+ */
+func NewIndex(indexType IndexType, opts Options) (BrickIndex, error) {
+	switch indexType {
+	case HashIndexType:
+		return &HashIndex{opts: opts}, nil
+	case LinearHashIndexType:
+		return &LinearHashIndex{opts: opts}, nil
+	case BTreeIndexType:
+		return &BTreeIndex{opts: opts}, nil
+	case LSMIndexType:
+		return &LSMIndex{opts: opts}, nil
+	case BitcaskIndexType:
+		return &BitcaskIndex{opts: opts}, nil
+	case ExtendibleHashIndexType:
+		return &ExtendibleHashIndex{opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("Invalid indexType: %v", indexType)
+	}
+}
+
+/**
+ * Return the extensions of the files making up a database with the given
+ * index type, the index file is always the first one
+ */
+func IndexFileExts(indexType IndexType) []string {
+	switch indexType {
+	case LinearHashIndexType:
+		return []string{".idx", ".bkt", ".dat"}
+	case LSMIndexType:
+		return []string{".idx", ".wal"} // the tables are listed in the index header
+	case BitcaskIndexType:
+		return []string{".idx"} // the segments are listed in the index header
+	default:
+		return []string{".idx", ".dat"}
+	}
+}
+
+/**
+ * Check the key and value of a store against the maximum sizes of the index
+ */
+func checkSizes(key []byte, value []byte, maxKey int64, maxValue int64) error {
+	keyLen := int64(len(key))
+	valueLen := int64(len(value))
+	if keyLen < 1 {
+		return ErrEmptyKey
+	}
+	if keyLen > maxKey {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d", ErrKeyTooLarge, keyLen, maxKey)
+	}
+	if valueLen > maxValue {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d", ErrValueTooLarge, valueLen, maxValue)
+	}
+	return nil
+}
+
+/**
+ * The result of the string Fetch from the one of FetchBytes, ErrNotFound
+ * for a missing key. Shared with the handles built on the indexes.
+ */
+func FetchString(key string, val []byte, err error) (string, error) {
+	if err == nil && val == nil {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return string(val), err
 }
 
 func parseInt(s string) (int64, error) {
@@ -94,11 +272,38 @@ func Unlock(fd uintptr, offset int64, whence int16, len int64) error {
 	return getLock(fd, unix.F_OFD_SETLK, unix.F_UNLCK, offset, whence, len)
 }
 
+/**
+ * Every operation of the indexes starts by locking its files, the
+ * descriptor of a closed file, ^uintptr(0), fails it with ErrClosed
+ */
 func getLock(fd uintptr, cmd int, lockType int16, offset int64, whence int16, len int64) error {
+	if fd == ^uintptr(0) {
+		return ErrClosed
+	}
 	var lock *unix.Flock_t = new(unix.Flock_t)
 	lock.Type = lockType
 	lock.Whence = whence
 	lock.Start = offset
 	lock.Len = len
-	return unix.FcntlFlock(fd, cmd, lock)
+	err := unix.FcntlFlock(fd, cmd, lock)
+	if cmd == unix.F_OFD_SETLK && lockType != unix.F_UNLCK && (err == unix.EAGAIN || err == unix.EACCES) {
+		return fmt.Errorf("%w: byte range %d+%d is held by another open file", ErrLocked, offset, len)
+	}
+	return err
+}
+
+/**
+ * Check whether another open file holds a lock on the range, read or write
+ */
+func IsLocked(fd uintptr, offset int64, whence int16, len int64) (bool, error) {
+	var lock *unix.Flock_t = new(unix.Flock_t)
+	lock.Type = unix.F_WRLCK
+	lock.Whence = whence
+	lock.Start = offset
+	lock.Len = len
+	err := unix.FcntlFlock(fd, unix.F_OFD_GETLK, lock)
+	if err != nil {
+		return false, err
+	}
+	return lock.Type != unix.F_UNLCK, nil
 }
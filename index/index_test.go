@@ -0,0 +1,278 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	errors_test_db_name = "errors_test"
+)
+
+func TestErrors(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType, BTreeIndexType, LSMIndexType, BitcaskIndexType,
+		ExtendibleHashIndexType}, testErrors)
+}
+
+/**
+ * Run test as a subtest for each of the index types
+ */
+func forEachIndexType(t *testing.T, idxTypes []IndexType, test func(t *testing.T, idxType IndexType)) {
+	for _, idxType := range idxTypes {
+		idxType := idxType
+		t.Run(fmt.Sprintf("type%d", idxType), func(t *testing.T) {
+			test(t, idxType)
+		})
+	}
+}
+
+/**
+ * Create a test database with the given type and options, in place of the
+ * one left behind by an earlier run if any. Its files are removed once the
+ * test is done, closing the index is up to the test.
+ */
+func openNewIndex(t *testing.T, name string, idxType IndexType, opts Options) BrickIndex {
+	removeAnyDB(name)
+	t.Cleanup(func() { removeAnyDB(name) })
+	idx, err := NewIndex(idxType, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Open(name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+/**
+ * Remove the files of a test database of any index type
+ */
+func removeAnyDB(name string) {
+	removeFiles(name, IndexFileExts(HashIndexType))
+	removeFiles(name, IndexFileExts(LinearHashIndexType))
+	lsmRemoveDB(name)
+	bitcaskRemoveDB(name)
+}
+
+/**
+ * Every index fails with the same errors, and tells a missing key apart
+ * from an empty value
+ */
+func testErrors(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, errors_test_db_name, idxType, Options{MaxKeySize: 16, MaxValueSize: 32})
+	defer idx.Close()
+
+	err := idx.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Insert("empty", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Insert("k1", "v1")
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists for an insert of an existing key, got %v", err)
+	}
+	err = idx.Update("missing", "v")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an update of a missing key, got %v", err)
+	}
+	err = idx.Upsert(strings.Repeat("k", 17), "v")
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	err = idx.Upsert("k2", strings.Repeat("v", 33))
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+
+	_, err = idx.Fetch("missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing key, got %v", err)
+	}
+	val, err := idx.FetchBytes([]byte("missing"))
+	if err != nil || val != nil {
+		t.Errorf("Expected a nil value from FetchBytes for a missing key, got %q and %v", val, err)
+	}
+	strVal, err := idx.Fetch("empty")
+	if err != nil || strVal != "" {
+		t.Errorf("Expected an empty value, got %q and %v", strVal, err)
+	}
+	err = idx.Delete("missing")
+	if err != nil {
+		t.Errorf("Expected the delete of a missing key to succeed, got %v", err)
+	}
+}
+
+func TestErrClosed(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType, BTreeIndexType, LSMIndexType, BitcaskIndexType,
+		ExtendibleHashIndexType}, testErrClosed)
+}
+
+/**
+ * Every operation of an index fails with ErrClosed once it is closed
+ */
+func testErrClosed(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, errors_test_db_name, idxType, Options{})
+	err := idx.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = idx.Fetch("k1")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Fetch, got %v", err)
+	}
+	_, err = idx.FetchAll()
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from FetchAll, got %v", err)
+	}
+	err = idx.Upsert("k1", "v2")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Upsert, got %v", err)
+	}
+	err = idx.Delete("k1")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Delete, got %v", err)
+	}
+	if scanner, ok := idx.(ScannableIndex); ok {
+		_, err = scanner.Scan(nil, 0, false, func(key []byte, value []byte) error { return nil })
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed from Scan, got %v", err)
+		}
+	}
+	if batchIndex, ok := idx.(BatchIndex); ok {
+		err = batchIndex.WriteBatch([]BatchOp{{Key: []byte("k1"), Value: []byte("v2")}})
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed from WriteBatch, got %v", err)
+		}
+	}
+	if orderedIndex, ok := idx.(OrderedIndex); ok {
+		err = orderedIndex.Range(nil, nil, func(key []byte, value []byte) error { return nil })
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed from Range, got %v", err)
+		}
+	}
+}
+
+/**
+ * A B+tree node or extendible hash bucket which does not make sense fails
+ * the reads with ErrCorrupt
+ */
+func TestErrCorrupt(t *testing.T) {
+	forEachIndexType(t, []IndexType{BTreeIndexType, ExtendibleHashIndexType}, testErrCorrupt)
+}
+
+func testErrCorrupt(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, errors_test_db_name, idxType, Options{})
+	defer idx.Close()
+	err := idx.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(errors_test_db_name+".idx", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header := make([]byte, ext_header_size)
+	_, err = f.ReadAt(header, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* an invalid node type, or an invalid local depth */
+	var pages []int64
+	if idxType == BTreeIndexType {
+		pages = append(pages, decodePtr(header[btree_root_off:]))
+	} else {
+		depth := byteOrder.Uint64(header[ext_depth_off:])
+		dir := make([]byte, (1<<depth)*ptr_size)
+		_, err = f.ReadAt(dir, decodePtr(header[ext_dir_off:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pos := 0; pos < len(dir); pos += ptr_size {
+			pages = append(pages, decodePtr(dir[pos:]))
+		}
+	}
+	for _, page := range pages {
+		_, err = f.WriteAt([]byte{0xff}, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = idx.Fetch("k1")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestErrLocked(t *testing.T) {
+	name := errors_test_db_name + ".lock"
+	defer os.Remove(name)
+	f1, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	err = WriteLock(f1.Fd(), 0, io.SeekStart, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReadLock(f2.Fd(), 0, io.SeekStart, 1)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for a range locked by another open file, got %v", err)
+	}
+	err = Unlock(f1.Fd(), 0, io.SeekStart, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReadLock(f2.Fd(), 0, io.SeekStart, 1)
+	if err != nil {
+		t.Errorf("Expected the lock once released, got %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/**
+ * Reader for the original ASCII format (format version 1). In that format
+ * every pointer is a 7 character space padded decimal number and the index
+ * records are "key:datoff:datlen\n" strings, prefixed with the chain pointer
+ * and a 4 character record length. Values in the data file are terminated
+ * by a newline.
+ *
+ * The reader only walks the hash chains, it is used by Upgrade to copy the
+ * live records into a database in the current format.
+ */
+const (
+	legacy_idxtype_sz       = 3
+	legacy_ptr_sz           = 7
+	legacy_idxlen_sz        = 4
+	legacy_idxlen_min       = 6
+	legacy_idxlen_max       = 1024
+	legacy_hash_header_sz   = 4
+	legacy_hashtable_size   = 137
+	legacy_linidx_header    = 64
+	legacy_nbuckets_off     = legacy_idxtype_sz
+	legacy_nbuckets_sz      = 20
+	legacy_sep              = ":"
+	legacy_backup_name_ext  = ".v1"
+	legacy_upgrade_name_ext = ".upgrade"
+)
+
+type legacyReader struct {
+	idxType IndexType
+	idxFile *os.File // the hash table
+	recFile *os.File // the index records, same as idxFile for the static hash index
+	datFile *os.File
+	hashoff int64
+	nhash   uint64
+}
+
+func openLegacy(name string) (*legacyReader, error) {
+	idxType, version, err := ReadFileHeader(name + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	if version != LegacyFormatVersion {
+		return nil, fmt.Errorf("Database %s is not in the legacy format (version %d)", name, version)
+	}
+
+	reader := &legacyReader{idxType: idxType}
+	reader.idxFile, err = os.OpenFile(name+".idx", os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	reader.datFile, err = os.OpenFile(name+".dat", os.O_RDONLY, 0644)
+	if err != nil {
+		reader.close()
+		return nil, err
+	}
+
+	switch idxType {
+	case HashIndexType:
+		reader.recFile = reader.idxFile
+		reader.hashoff = legacy_hash_header_sz + legacy_ptr_sz
+		reader.nhash = legacy_hashtable_size
+	case LinearHashIndexType:
+		reader.recFile, err = os.OpenFile(name+".bkt", os.O_RDONLY, 0644)
+		if err != nil {
+			reader.close()
+			return nil, err
+		}
+		reader.hashoff = legacy_linidx_header + legacy_ptr_sz
+		buf := make([]byte, legacy_nbuckets_sz)
+		_, err = reader.idxFile.ReadAt(buf, legacy_nbuckets_off)
+		if err != nil {
+			reader.close()
+			return nil, err
+		}
+		reader.nhash, err = parseUint(string(buf))
+		if err != nil {
+			reader.close()
+			return nil, err
+		}
+	default:
+		reader.close()
+		return nil, fmt.Errorf("Invalid index type number %d", idxType)
+	}
+	return reader, nil
+}
+
+func (self *legacyReader) close() {
+	if self.recFile != nil && self.recFile != self.idxFile {
+		self.recFile.Close()
+	}
+	if self.idxFile != nil {
+		self.idxFile.Close()
+	}
+	if self.datFile != nil {
+		self.datFile.Close()
+	}
+}
+
+func (self *legacyReader) readPtr(f *os.File, offset int64) (int64, error) {
+	buf := make([]byte, legacy_ptr_sz)
+	_, err := f.ReadAt(buf, offset)
+	if err != nil {
+		return -1, err
+	}
+	return parseInt(string(buf))
+}
+
+/**
+ * Read the index record at the given offset, returns the pointer to the next
+ * record in the chain along with the key and the location of the value
+ */
+func (self *legacyReader) readIdx(offset int64) (int64, string, int64, int64, error) {
+	prefix := make([]byte, legacy_ptr_sz+legacy_idxlen_sz)
+	_, err := self.recFile.ReadAt(prefix, offset)
+	if err != nil {
+		return -1, "", 0, 0, err
+	}
+	ptrval, err := parseInt(string(prefix[:legacy_ptr_sz]))
+	if err != nil {
+		return -1, "", 0, 0, err
+	}
+	idxlen, err := parseInt(string(prefix[legacy_ptr_sz:]))
+	if err != nil {
+		return -1, "", 0, 0, err
+	}
+	if idxlen < legacy_idxlen_min || idxlen > legacy_idxlen_max {
+		return -1, "", 0, 0, fmt.Errorf("Invalid index record length %d", idxlen)
+	}
+
+	idxbuf := make([]byte, idxlen)
+	_, err = self.recFile.ReadAt(idxbuf, offset+int64(len(prefix)))
+	if err != nil {
+		return -1, "", 0, 0, err
+	}
+	if !testNewLine(string(idxbuf)) {
+		return -1, "", 0, 0, fmt.Errorf("Corrupted index record at offset %d, not ending with new line: %w", offset, ErrCorrupt)
+	}
+	parts := strings.Split(string(idxbuf[:idxlen-1]), legacy_sep)
+	if len(parts) != 3 {
+		return -1, "", 0, 0, fmt.Errorf("Invalid index record at offset %d", offset)
+	}
+	datoff, err := parseInt(parts[1])
+	if err != nil {
+		return -1, "", 0, 0, err
+	}
+	datlen, err := parseInt(parts[2])
+	if err != nil {
+		return -1, "", 0, 0, err
+	}
+	return ptrval, parts[0], datoff, datlen, nil
+}
+
+func (self *legacyReader) readData(datoff int64, datlen int64) (string, error) {
+	if datoff < 0 || datlen < 1 {
+		return "", errors.New("Invalid data record")
+	}
+	datbuf := make([]byte, datlen)
+	_, err := self.datFile.ReadAt(datbuf, datoff)
+	if err != nil {
+		return "", err
+	}
+	if !testNewLine(string(datbuf)) {
+		return "", fmt.Errorf("Corrupted data record, missing newline: %w", ErrCorrupt)
+	}
+	return string(datbuf[:datlen-1]), nil
+}
+
+/**
+ * Walk all the hash chains and call fn for every live record
+ */
+func (self *legacyReader) forEach(fn func(key string, value string) error) error {
+	var i uint64
+	for i = 0; i < self.nhash; i++ {
+		offset, err := self.readPtr(self.idxFile, self.hashoff+int64(i*legacy_ptr_sz))
+		if err != nil {
+			return err
+		}
+		for offset != 0 {
+			nextOffset, key, datoff, datlen, err := self.readIdx(offset)
+			if err != nil {
+				return err
+			}
+			value, err := self.readData(datoff, datlen)
+			if err != nil {
+				return err
+			}
+			err = fn(key, value)
+			if err != nil {
+				return err
+			}
+			offset = nextOffset
+		}
+	}
+	return nil
+}
+
+/**
+ * Convert a database in the legacy ASCII format to the current binary
+ * format. The records are copied into a fresh database which then replaces
+ * the original files. The original files are kept around with a ".v1"
+ * suffix added to the database name, as hard links made before anything is
+ * replaced, so there is a database under the name all along.
+ *
+ * The new files are renamed over the old ones one at a time, the index file
+ * last. A crash in between leaves a legacy index file in front of some of
+ * the new files, Open keeps returning ErrLegacyFormat and running Upgrade
+ * again moves in the rest of the new files.
+ */
+func Upgrade(name string) error {
+	tmpName := name + legacy_upgrade_name_ext
+	finished, err := finishSwap(name, tmpName)
+	if err != nil || finished {
+		return err
+	}
+	reader, err := openLegacy(name)
+	if err != nil {
+		return err
+	}
+	defer reader.close()
+
+	/* Keep everyone else out while we copy the records */
+	err = WriteLockW(reader.idxFile.Fd(), 0, io.SeekStart, 0)
+	if err != nil {
+		return err
+	}
+	defer Unlock(reader.idxFile.Fd(), 0, io.SeekStart, 0)
+
+	exts := IndexFileExts(reader.idxType)
+	removeFiles(tmpName, exts)
+	newIndex, err := NewIndex(reader.idxType, Options{})
+	if err != nil {
+		return err
+	}
+	err = newIndex.Open(tmpName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		removeFiles(tmpName, exts)
+		return err
+	}
+	err = reader.forEach(func(key string, value string) error {
+		return newIndex.Insert(key, value)
+	})
+	newIndex.Close()
+	if err == nil {
+		err = SyncDatabase(tmpName, reader.idxType)
+	}
+	if err != nil {
+		removeFiles(tmpName, exts)
+		return fmt.Errorf("Failed to upgrade database %s: %w", name, err)
+	}
+
+	for _, ext := range exts {
+		backup := name + legacy_backup_name_ext + ext
+		os.Remove(backup)
+		err = os.Link(name+ext, backup)
+		if err != nil {
+			return err
+		}
+	}
+	/* The index file goes last, its header decides the format of the database */
+	return swapFiles(name, tmpName, exts)
+}
+
+func removeFiles(name string, exts []string) {
+	for _, ext := range exts {
+		os.Remove(name + ext)
+	}
+}
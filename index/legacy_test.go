@@ -0,0 +1,205 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const legacy_test_db_name = "legacy_test"
+
+/**
+ * The fixtures in testdata were written by the ASCII implementation: keys
+ * key_0 to key_19 with values val_N, key_3 and key_7 deleted and key_5
+ * updated to updated_5.
+ */
+func legacyExpectedRecords() map[string]string {
+	records := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		records[fmt.Sprintf("key_%d", i)] = fmt.Sprintf("val_%d", i)
+	}
+	delete(records, "key_3")
+	delete(records, "key_7")
+	records["key_5"] = "updated_5"
+	return records
+}
+
+func copyLegacyFixture(t *testing.T, fixture string, idxType IndexType) {
+	for _, ext := range IndexFileExts(idxType) {
+		buf, err := ioutil.ReadFile("testdata/" + fixture + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(legacy_test_db_name+ext, buf, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func removeLegacyTestDB(idxType IndexType) {
+	removeFiles(legacy_test_db_name, IndexFileExts(idxType))
+	removeFiles(legacy_test_db_name+legacy_backup_name_ext, IndexFileExts(idxType))
+}
+
+func testUpgrade(t *testing.T, fixture string, idxType IndexType) {
+	copyLegacyFixture(t, fixture, idxType)
+	defer removeLegacyTestDB(idxType)
+
+	fileIdxType, version, err := ReadFileHeader(legacy_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileIdxType != idxType || version != LegacyFormatVersion {
+		t.Fatalf("Expected legacy index of type %d, got type %d version %d", idxType, fileIdxType, version)
+	}
+
+	idx, _ := NewIndex(idxType, Options{})
+	err = idx.Open(legacy_test_db_name, os.O_RDWR)
+	if err != ErrLegacyFormat {
+		t.Fatalf("Expected ErrLegacyFormat when opening a legacy database, got %v", err)
+	}
+
+	err = Upgrade(legacy_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, err = ReadFileHeader(legacy_test_db_name + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != FormatVersion {
+		t.Errorf("Expected format version %d after upgrade, got %d", FormatVersion, version)
+	}
+	_, err = os.Stat(legacy_test_db_name + legacy_backup_name_ext + ".idx")
+	if err != nil {
+		t.Errorf("Expected the legacy index to be kept as a backup: %v", err)
+	}
+
+	idx, _ = NewIndex(idxType, Options{})
+	err = idx.Open(legacy_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	expected := legacyExpectedRecords()
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(expected) {
+		t.Errorf("Expected %d records after upgrade, found %d", len(expected), len(records))
+	}
+	for k, v := range expected {
+		val, err := idx.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %s for key %s, got %s", v, k, val)
+		}
+	}
+	err = idx.Insert("key_3", "val_3")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeHashIndex(t *testing.T) {
+	testUpgrade(t, "legacy_hash", HashIndexType)
+}
+
+func TestUpgradeLinHashIndex(t *testing.T) {
+	testUpgrade(t, "legacy_linhash", LinearHashIndexType)
+}
+
+/**
+ * Put the database back the way a crash leaves it when the new index file
+ * is the only one not moved in yet, running Upgrade again finishes the job
+ */
+func testUpgradeInterrupted(t *testing.T, fixture string, idxType IndexType) {
+	copyLegacyFixture(t, fixture, idxType)
+	defer removeLegacyTestDB(idxType)
+	err := Upgrade(legacy_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpName := legacy_test_db_name + legacy_upgrade_name_ext
+	defer removeFiles(tmpName, IndexFileExts(idxType))
+	err = os.Rename(legacy_test_db_name+".idx", tmpName+".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(legacy_test_db_name + legacy_backup_name_ext + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(legacy_test_db_name+".idx", buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, _ := NewIndex(idxType, Options{})
+	err = idx.Open(legacy_test_db_name, os.O_RDWR)
+	if err != ErrLegacyFormat {
+		t.Fatalf("Expected ErrLegacyFormat before the upgrade is finished, got %v", err)
+	}
+	err = Upgrade(legacy_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(tmpName + ".idx")
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the upgraded index file to be moved in, got %v", err)
+	}
+	idx, _ = NewIndex(idxType, Options{})
+	err = idx.Open(legacy_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	for k, v := range legacyExpectedRecords() {
+		val, err := idx.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %s for key %s, got %s", v, k, val)
+		}
+	}
+}
+
+func TestUpgradeInterruptedHashIndex(t *testing.T) {
+	testUpgradeInterrupted(t, "legacy_hash", HashIndexType)
+}
+
+func TestUpgradeInterruptedLinHashIndex(t *testing.T) {
+	testUpgradeInterrupted(t, "legacy_linhash", LinearHashIndexType)
+}
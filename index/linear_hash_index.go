@@ -32,59 +32,72 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/bits"
 	"os"
 	"runtime"
 	"strconv"
-	"strings"
 
 	"github.com/OneOfOne/xxhash"
-	"golang.org/x/sys/unix"
 )
 
-// all sizes are in number of ascii characters since the current impl uses ascii encoding
-// TODO: switch to binary encoding to save space
+// all sizes are in bytes, see encoding.go for the layout of the records
 const (
 	linidx_header_off   = 0
-	linidx_header_size  = 64 // idxtype(1) + nbuckets(8) + split(8) + nrecords(8) + newline
-	linidxtype_sz       = 3  //one byte
-	nbuckets_sz         = 20 // 8 bytes - max number of buckets can be 2 ** 64
-	split_pointer_sz    = 20 // 8 bytes - max number of buckets can be 2 ** 64
-	nrecords_sz         = 20
-	idxlen_sz           = 4 //index record length
-	sep                 = ':'
-	sep_str             = ":"
-	ptr_sz              = 7                                      //size of ptr field in hash chain
-	ptr_max             = 9999999                                // max file offset = 10 ** PTR_SZ - 1
-	hashtable_size      = 1024                                   //initial hash table size
-	free_off            = linidx_header_off + linidx_header_size //free list offset in index file
-	hash_off            = free_off + ptr_sz                      //hash table offset in index file
-	idxlen_min          = 6
-	idxlen_max          = 1024
-	datlen_min          = 2
-	datlen_max          = 1024
-	idxfile_startoffset = 1
+	linidx_header_size  = minbuckets_off + minbuckets_sz
+	nbuckets_sz         = 8 // max number of buckets can be 2 ** 64
+	split_pointer_sz    = 8 // max number of buckets can be 2 ** 64
+	nrecords_sz         = 8
+	maxvalue_sz         = 8
+	maxvalue_off        = file_header_size + nbuckets_sz + split_pointer_sz + nrecords_sz
+	maxkey_sz           = 8
+	maxkey_off          = maxvalue_off + maxvalue_sz
+	seed_sz             = 8
+	seed_off            = maxkey_off + maxkey_sz
+	threshold_sz        = 8
+	threshold_off       = seed_off + seed_sz
+	minbuckets_sz       = 8
+	minbuckets_off      = threshold_off + threshold_sz
+	merge_ratio         = 0.5                                    // buckets are merged when the load factor drops below this fraction of the split threshold
+	ptr_sz              = ptr_size                               //size of ptr field in hash chain
+	hashtable_size      = 1024                                   //default initial hash table size
+	free_off            = linidx_header_off + linidx_header_size //free lists of the bucket file, see freespace.go
+	datfree_off         = free_off + free_table_size             //free lists of the data file
+	hash_off            = datfree_off + free_table_size          //hash table offset in index file
+	idxlen_min          = idxrec_header_size + 1                 // index record with a single byte key
+	idxlen_max          = idxrec_header_size + key_size_max
+	idxfile_startoffset = file_header_size // offset 0 in the bucket file is the nil pointer
 )
 
 type LinearHashIndex struct {
-	idxFile  *os.File
-	bktFile  *os.File
-	datFile  *os.File
-	idxbuf   string
-	datbuf   string
-	name     string
-	idxoff   int64
-	idxlen   int64
-	datoff   int64
-	datlen   int64
-	ptrval   int64
-	ptroff   int64
-	chainoff int64
-	hashoff  int64
-	nhash    uint64
-	i        int16
-	s        uint64
-	nrecords int64
-	debug    bool
+	lockWaiter
+	idxFile    *os.File
+	bktFile    *os.File
+	datFile    *dataFile
+	idxFree    *freeList
+	datFree    *freeList
+	opts       Options
+	maxValue   int64
+	maxKey     int64
+	seed       uint64
+	threshold  float64 // average number of records per bucket at which a bucket is split
+	minBuckets uint64  // the table never shrinks below the size it was created with
+	idxbuf     []byte
+	datbuf     []byte
+	name       string
+	idxoff     int64
+	idxlen     int64
+	datoff     int64
+	datlen     int64
+	ptrval     int64
+	ptroff     int64
+	ptrfile    *os.File // file holding the pointer at ptroff, the hash table or a bucket record
+	chainoff   int64
+	hashoff    int64
+	nhash      uint64
+	i          int16
+	s          uint64
+	nrecords   int64
+	debug      bool
 }
 
 func (self *LinearHashIndex) EnableDebug() {
@@ -92,13 +105,19 @@ func (self *LinearHashIndex) EnableDebug() {
 }
 
 func (self *LinearHashIndex) Open(name string, mode int) error {
-	self.nhash = hashtable_size
 	self.hashoff = hash_off
 	self.name = name
 	self.nrecords = 0
-	self.i = 10
 	self.s = 0
-	var err error
+	opts, err := self.opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	self.nhash, err = opts.initialBuckets(hashtable_size, true)
+	if err != nil {
+		return err
+	}
+	self.i = int16(bits.Len64(self.nhash - 1))
 	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
 	if err != nil {
 		return fmt.Errorf("Failed to create index file %s", self.name+".idx")
@@ -109,10 +128,12 @@ func (self *LinearHashIndex) Open(name string, mode int) error {
 		return err
 	}
 
-	self.datFile, err = os.OpenFile(self.name+".dat", mode, 0644)
+	self.datFile, err = openDataFile(self.name+".dat", mode)
 	if err != nil {
 		return fmt.Errorf("Failed to create data file %s", self.name+".dat")
 	}
+	self.idxFree = &freeList{tableFile: self.idxFile, tableOff: free_off, blockFile: self.bktFile, minBlock: idxlen_min}
+	self.datFree = &freeList{tableFile: self.idxFile, tableOff: datfree_off, blockFile: self.datFile.File, minBlock: datext_header_size}
 
 	isCreateMode := mode&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE || mode&(os.O_CREATE|os.O_TRUNC) == os.O_TRUNC
 	if isCreateMode {
@@ -134,27 +155,56 @@ func (self *LinearHashIndex) Open(name string, mode int) error {
 		}
 
 		if idxFileInfo.Size() == 0 {
+			self.maxValue = opts.MaxValueSize
+			self.maxKey = opts.MaxKeySize
+			self.seed = opts.HashSeed
+			self.threshold = opts.SplitThreshold
+			self.minBuckets = self.nhash
 			err = self.writeHeader()
 			if err != nil {
 				return err
 			}
 			/**
-			 * We have to build a chain NHASH_DEF + 1 hash chain pointers
+			 * We have to build the free list tables followed by the NHASH_DEF
+			 * hash chain pointers
 			 */
-			hashPointer := fmt.Sprintf("%*d", ptr_sz, 0)
-			hashPointer = strings.Repeat(hashPointer, hashtable_size+1)
-			bytes := []byte(hashPointer)
-			bytesWritten, err := self.idxFile.Write(bytes)
+			bytes := make([]byte, hash_off-free_off+int64(self.nhash*ptr_sz))
+			bytesWritten, err := self.idxFile.WriteAt(bytes, free_off)
 			if err != nil {
 				return errors.New("Write to index file failed")
 			}
 			if bytesWritten != len(bytes) {
 				return errors.New("Failed to initialize index file")
 			}
-			self.bktFile.Write([]byte("\n"))
+			/**
+			 * The bucket file gets the same file header, which also makes sure
+			 * no index record starts at offset 0
+			 */
+			_, err = self.bktFile.WriteAt(encodeFileHeader(LinearHashIndexType), 0)
+			if err != nil {
+				return err
+			}
 		}
-	} else {
-		self.readHeader(true, false)
+	}
+	err = verifyFileHeader(self.idxFile, LinearHashIndexType)
+	if err != nil {
+		self.Close()
+		return err
+	}
+	/* The options never change, read them once without locking */
+	buf := make([]byte, linidx_header_size-maxvalue_off)
+	_, err = self.idxFile.ReadAt(buf, maxvalue_off)
+	if err != nil {
+		self.Close()
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.maxValue = int64(byteOrder.Uint64(buf))
+	self.maxKey = int64(byteOrder.Uint64(buf[maxkey_off-maxvalue_off:]))
+	self.seed = byteOrder.Uint64(buf[seed_off-maxvalue_off:])
+	self.threshold = math.Float64frombits(byteOrder.Uint64(buf[threshold_off-maxvalue_off:]))
+	self.minBuckets = byteOrder.Uint64(buf[minbuckets_off-maxvalue_off:])
+	if !isCreateMode {
+		err = self.readHeader(true, false)
 		defer func() error {
 			return Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 		}()
@@ -189,14 +239,22 @@ func (self *LinearHashIndex) Close() error {
 	return nil
 }
 
-//TODO: fix this?
+/**
+ * The header is read locked for the whole scan, so the table can't be split
+ * or merged under us
+ */
 func (self *LinearHashIndex) FetchAll() (map[string]string, error) {
+	err := self.readHeader(true, false)
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 	records := make(map[string]string)
 	var i uint64
-	var startOff int64 = free_off
+	var startOff int64 = self.hashoff - ptr_sz
 	for i = 0; i < self.nhash; i++ {
 		startOff += ptr_sz
-		err := ReadLockW(self.idxFile.Fd(), startOff, io.SeekStart, 1)
+		err := self.readLockW(self.idxFile.Fd(), startOff, io.SeekStart, 1)
 		if err != nil {
 			return nil, err
 		}
@@ -213,15 +271,20 @@ func (self *LinearHashIndex) FetchAll() (map[string]string, error) {
 		for {
 			nextOffset, err := self.readIdx(offset)
 			if err != nil {
-				Unlock(self.idxFile.Fd(), startOff, io.SeekStart, 1)
-				return nil, err
+				/* in quarantine mode the chain ends at a damaged record */
+				nextOffset = 0
+			} else {
+				var val []byte
+				val, err = self.readData()
+				if err == nil {
+					records[string(self.idxbuf)] = string(val)
+				}
 			}
-			val, err := self.readData()
+			err = quarantine(self.name, self.opts.QuarantineCorrupt, err)
 			if err != nil {
 				Unlock(self.idxFile.Fd(), startOff, io.SeekStart, 1)
 				return nil, err
 			}
-			records[self.idxbuf] = val
 			if nextOffset != 0 {
 				offset = nextOffset
 			} else {
@@ -238,18 +301,27 @@ func (self *LinearHashIndex) FetchAll() (map[string]string, error) {
 }
 
 func (self *LinearHashIndex) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of the given key, returns nil if the key does not exist
+ */
+func (self *LinearHashIndex) FetchBytes(key []byte) ([]byte, error) {
 	found, err := self.findAndLock(key, false)
 	defer Unlock(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	defer Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if !found {
-		return "", nil
+		return nil, nil
 	}
 	val, err := self.readData()
 	if err != nil {
-		return "", err
+		/* a quarantined record is not there */
+		return nil, quarantine(self.name, self.opts.QuarantineCorrupt, err)
 	}
 	return val, nil
 }
@@ -257,7 +329,7 @@ func (self *LinearHashIndex) Fetch(key string) (string, error) {
 /**
  * Find the record associated with the given key
  */
-func (self *LinearHashIndex) findAndLock(key string, isWriteLock bool) (bool, error) {
+func (self *LinearHashIndex) findAndLock(key []byte, isWriteLock bool) (bool, error) {
 	/**
 	 * Calculate the hash value for the key, and then calculate the offset of
 	 * corresponding chain pointer in hash table
@@ -275,20 +347,28 @@ func (self *LinearHashIndex) findAndLock(key string, isWriteLock bool) (bool, er
 		}
 	}
 	self.chainoff = int64(hash*ptr_sz) + self.hashoff
-	self.ptroff = self.chainoff
 
 	/**
 	 * We lock the hash chain, the caller must unlock it. Note we lock and unlock only
 	 * the first byte
 	 */
 	if isWriteLock {
-		err = WriteLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
+		err = self.writeLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	} else {
-		err = ReadLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
+		err = self.readLockW(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	}
 	if err != nil {
 		return false, err
 	}
+	return self.find(key)
+}
+
+/**
+ * Walk the hash chain at chainoff, which must be locked, looking for the key
+ */
+func (self *LinearHashIndex) find(key []byte) (bool, error) {
+	self.ptroff = self.chainoff
+	self.ptrfile = self.idxFile
 
 	/**
 	 * Get the offset of the first record in hash chain
@@ -301,12 +381,19 @@ func (self *LinearHashIndex) findAndLock(key string, isWriteLock bool) (bool, er
 	for offset != 0 {
 		nextOffset, err := self.readIdx(offset)
 		if err != nil {
-			return false, err
+			/* in quarantine mode the chain ends at a damaged record */
+			err = quarantine(self.name, self.opts.QuarantineCorrupt, err)
+			if err != nil {
+				return false, err
+			}
+			offset = 0
+			break
 		}
-		if self.idxbuf == key {
+		if bytes.Equal(self.idxbuf, key) {
 			break
 		}
 		self.ptroff = offset
+		self.ptrfile = self.bktFile
 		offset = nextOffset
 	}
 
@@ -316,25 +403,34 @@ func (self *LinearHashIndex) findAndLock(key string, isWriteLock bool) (bool, er
 	return true, nil
 }
 
-func (self *LinearHashIndex) dbHash(key string) uint64 {
-	hasher := xxhash.NewS64(42)
-	hasher.WriteString(key)
-	hash := hasher.Sum64()
+func (self *LinearHashIndex) dbHash(key []byte) uint64 {
+	hash := self.keyHash(key)
 	if self.debug {
 		fmt.Printf("[%d] hash for key %s is %d, i=%d\n", getGID(), key, hash, self.i)
 	}
+	bktidx := self.hashBucket(hash)
+	if self.debug {
+		fmt.Printf("[%d] bucket for %s is %d, nhash: %d\n", getGID(), key, bktidx, self.nhash)
+	}
+	return bktidx
+}
+
+func (self *LinearHashIndex) keyHash(key []byte) uint64 {
+	hasher := xxhash.NewS64(self.seed)
+	hasher.Write(key)
+	return hasher.Sum64()
+}
+
+/**
+ * The bucket of a hash, the low i bits of the hash if that bucket exists,
+ * or the bucket it is going to be split from
+ */
+func (self *LinearHashIndex) hashBucket(hash uint64) uint64 {
 	bktidx := hash & ((1 << self.i) - 1)
 	if bktidx < self.nhash {
-		if self.debug {
-			fmt.Printf("[%d] 1- bucket for %s is %d\n", getGID(), key, bktidx)
-		}
 		return bktidx
-	} else {
-		if self.debug {
-			fmt.Printf("[%d] 2- bucket for %s is %d, nhash: %d\n", getGID(), key, (bktidx ^ (1 << (self.i - 1))), self.nhash)
-		}
-		return bktidx ^ (1 << (self.i - 1))
 	}
+	return bktidx ^ (1 << (self.i - 1))
 }
 
 /**
@@ -355,18 +451,9 @@ func (self *LinearHashIndex) readPtr(offset int64, f *os.File) (int64, error) {
 	if readBytes != ptr_sz {
 		return -1, errors.New("Failed to read pointer data")
 	}
-	s := string(buf)
-	return parseInt(s)
+	return decodePtr(buf), nil
 }
 
-// func createIOVecArray(size int, byteArrays ...[]byte) [][]byte {
-// 	iovecBytes := make([][]byte, size)
-// 	for i, b := range byteArrays {
-// 		iovecBytes[i] = b
-// 	}
-// 	return iovecBytes
-// }
-
 /**
  * Read next index record. Starting from the specified offset, we read
  * the index record into idxbuf field. We set datoff and datlen to
@@ -388,125 +475,84 @@ func (self *LinearHashIndex) readIdx(offset int64) (int64, error) {
 	self.idxoff = curOffset
 
 	/* Read the fixed length header in the index record */
-	ptrbuf := make([]byte, ptr_sz)
-	idxLenbuf := make([]byte, idxlen_sz)
-	iovecBytes := make([][]byte, 2)
-	iovecBytes[0] = ptrbuf
-	iovecBytes[1] = idxLenbuf
-	// iovecBytes := createIOVecArray(2, ptrbuf, idxbuf)
-	bytesRead, err := unix.Readv(int(self.bktFile.Fd()), iovecBytes)
+	hdrbuf := make([]byte, idxrec_header_size)
+	bytesRead, err := io.ReadFull(self.bktFile, hdrbuf)
+	if err == io.EOF && offset == 0 {
+		return -1, nil
+	}
 	if err != nil {
 		return -1, err
 	}
 
-	if bytesRead == 0 && offset == 0 {
-		return -1, nil
-	}
-	self.ptrval, _ = parseInt(string(ptrbuf))
-	self.idxlen, _ = parseInt(string(idxLenbuf))
+	var keylen int64
+	self.ptrval, keylen, self.datoff, self.datlen = decodeIdxHeader(hdrbuf)
+	self.idxlen = idxrec_header_size + keylen
 	if self.idxlen < idxlen_min || self.idxlen > idxlen_max {
-		return -1, fmt.Errorf("Invalid index record length %d", self.idxlen)
+		return -1, self.corruptIdx(fmt.Sprintf("invalid index record length %d", self.idxlen))
 	}
-	idxbufBytes := make([]byte, self.idxlen)
+	idxbufBytes := make([]byte, keylen)
 
-	/* Now read the actual index record */
-	bytesRead, err = self.bktFile.Read(idxbufBytes)
+	/* Now read the key */
+	bytesRead, err = io.ReadFull(self.bktFile, idxbufBytes)
 	if err != nil {
-		return -1, err
+		return -1, fmt.Errorf("Failed to read index record at offset %d: %w", offset, err)
 	}
-	if int64(bytesRead) != self.idxlen {
+	if int64(bytesRead) != keylen {
 		return -1, fmt.Errorf("Failed to read index record at offset %d", offset)
 	}
-
-	if !testNewLine(string(idxbufBytes)) {
-		return -1, fmt.Errorf("Corrupted index record at offset %d, not ending with new line", offset)
-	}
-	idxbufBytes = idxbufBytes[:self.idxlen-1] //ignore the newline
-	idxbuf := string(idxbufBytes)
-
-	parts := strings.Split(idxbuf, sep_str)
-	if len(parts) == 0 {
-		return -1, fmt.Errorf("Invalid index record: missing separators")
-	}
-
-	if len(parts) > 3 {
-		return -1, fmt.Errorf("Invalid index record: too many separators (%d)", len(parts))
-	}
-
-	self.idxbuf = parts[0]
-	self.datoff, err = parseInt(parts[1])
-	if err != nil {
-		return -1, err
+	self.idxbuf = idxbufBytes
+	if !verifyIdxRecord(hdrbuf, idxbufBytes) {
+		return -1, self.corruptIdx("index record checksum mismatch")
 	}
 
 	if self.datoff < 0 {
-		return -1, errors.New("Starting data offset < 0")
+		return -1, self.corruptIdx("starting data offset < 0")
 	}
 
-	self.datlen, err = parseInt(parts[2])
-	if err != nil {
-		return -1, err
-	}
-	if self.datlen < 0 || self.datlen > datlen_max {
-		return -1, errors.New("Invalid data record length")
+	if self.datlen < 0 || self.datlen > self.maxValue {
+		return -1, self.corruptIdx("invalid data record length")
 	}
 	return self.ptrval, nil
 }
 
-func (self *LinearHashIndex) readData() (string, error) {
-	_, err := self.datFile.Seek(self.datoff, io.SeekStart)
-	if err != nil {
-		return "", err
-	}
+func (self *LinearHashIndex) corruptIdx(reason string) error {
+	return &CorruptError{File: self.bktFile.Name(), Offset: self.idxoff, Reason: reason}
+}
 
-	datbuf := make([]byte, self.datlen)
-	bytesRead, err := self.datFile.Read(datbuf)
-	if err != nil {
-		return "", err
+func (self *LinearHashIndex) readData() ([]byte, error) {
+	datbuf, err := self.datFile.readValue(self.datoff, self.datlen)
+	if corruptErr, ok := err.(*CorruptError); ok {
+		corruptErr.Key = self.idxbuf
 	}
-	if int64(bytesRead) != self.datlen {
-		return "", fmt.Errorf("Failed to read data record from offset %d", self.datoff)
-	}
-	if !testNewLine(string(datbuf)) {
-		return "", errors.New("Corrupted data record: missing newline")
+	if err != nil {
+		return nil, err
 	}
-	datbuf = datbuf[:self.datlen-1]
-	self.datbuf = string(datbuf)
+	self.datbuf = datbuf
 	return self.datbuf, nil
 }
 
 func (self *LinearHashIndex) readHeader(doLock bool, isWriteLock bool) error {
 	if doLock {
 		var err error
+		/* the header is only write locked once a store or delete is done, that wait can't give up */
 		if isWriteLock {
 			err = WriteLockW(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 		} else {
-			err = ReadLockW(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+			err = self.readLockW(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 		}
 		if err != nil {
 			return err
 		}
 	}
-	_, err := self.idxFile.Seek(linidx_header_off, io.SeekStart)
+	headerBuf := make([]byte, linidx_header_size)
+	_, err := self.idxFile.ReadAt(headerBuf, linidx_header_off)
 	if err != nil {
 		return err
 	}
-	indexTypeBuf := make([]byte, 3)
-	nhashBuf := make([]byte, 20)
-	sBUf := make([]byte, 20)
-	nrecordsBuf := make([]byte, 20)
-	iovecBytes := make([][]byte, 4)
-	iovecBytes[0] = indexTypeBuf
-	iovecBytes[1] = nhashBuf
-	iovecBytes[2] = sBUf
-	iovecBytes[3] = nrecordsBuf
-	_, err = unix.Readv(int(self.idxFile.Fd()), iovecBytes)
-	if err != nil {
-		return err
-	}
-	self.nhash, _ = parseUint(string(nhashBuf))
-	self.s, _ = parseUint(string(sBUf))
-	self.nrecords, _ = parseInt(string(nrecordsBuf))
+	fieldsBuf := headerBuf[file_header_size:]
+	self.nhash = byteOrder.Uint64(fieldsBuf[0:])
+	self.s = byteOrder.Uint64(fieldsBuf[nbuckets_sz:])
+	self.nrecords = int64(byteOrder.Uint64(fieldsBuf[nbuckets_sz+split_pointer_sz:]))
 	self.i = int16(math.Ceil(math.Log2(float64(self.nhash))))
 	if self.debug {
 		fmt.Printf("[%d] read header with nhash:%d, s:%d, i:%d, nrecords:%d\n", getGID(), self.nhash, self.s, self.i, self.nrecords)
@@ -521,25 +567,35 @@ func (self *LinearHashIndex) updateHeader(nrecordsChange int64, nhashChange uint
 	if self.s*2 == self.nhash {
 		self.s = 0
 	}
-	self.writeHeader()
-	return nil
+	return self.writeHeader()
 }
 
 func (self *LinearHashIndex) writeHeader() error {
 	/**
-	 * We need to write the 256 byte index header first. Header is defined as:
-	 * number of buckets (4 bytes): split pointer (4 bytes): rest 0 bytes, reserved for future use
+	 * The header is defined as:
+	 * file header (8 bytes): number of buckets (8 bytes): split pointer (8 bytes): number of records (8 bytes):
+	 * maximum value size (8 bytes): maximum key size (8 bytes): hash seed (8 bytes): split threshold (8 bytes):
+	 * initial number of buckets (8 bytes)
 	 */
-	header := fmt.Sprintf("%*d%*d%*d%*d\n", linidxtype_sz, LinearHashIndexType, nbuckets_sz, self.nhash, split_pointer_sz, self.s, nrecords_sz, self.nrecords)
+	header := make([]byte, linidx_header_size)
+	copy(header, encodeFileHeader(LinearHashIndexType))
+	fieldsBuf := header[file_header_size:]
+	byteOrder.PutUint64(fieldsBuf[0:], self.nhash)
+	byteOrder.PutUint64(fieldsBuf[nbuckets_sz:], self.s)
+	byteOrder.PutUint64(fieldsBuf[nbuckets_sz+split_pointer_sz:], uint64(self.nrecords))
+	byteOrder.PutUint64(header[maxvalue_off:], uint64(self.maxValue))
+	byteOrder.PutUint64(header[maxkey_off:], uint64(self.maxKey))
+	byteOrder.PutUint64(header[seed_off:], self.seed)
+	byteOrder.PutUint64(header[threshold_off:], math.Float64bits(self.threshold))
+	byteOrder.PutUint64(header[minbuckets_off:], self.minBuckets)
 	if self.debug {
-		fmt.Printf("[%d] writing header %s", getGID(), header)
+		fmt.Printf("[%d] writing header nhash:%d, s:%d, nrecords:%d\n", getGID(), self.nhash, self.s, self.nrecords)
 	}
-	_, err := self.idxFile.Seek(linidx_header_off, io.SeekStart)
-	_, err = self.idxFile.Write([]byte(header))
+	_, err := self.idxFile.WriteAt(header, linidx_header_off)
 	return err
 }
 
-func (self *LinearHashIndex) delete2(key string) (bool, error) {
+func (self *LinearHashIndex) delete2(key []byte) (bool, error) {
 	found, err := self.findAndLock(key, true)
 	if err != nil {
 		return found, err
@@ -548,7 +604,6 @@ func (self *LinearHashIndex) delete2(key string) (bool, error) {
 		return found, Unlock(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	}()
 	if found {
-		//TODO: update nrecords in header
 		if self.debug {
 			fmt.Printf("[%d] offset for deleting %s: %d, ptroff: %d\n", getGID(), key, self.chainoff, self.ptroff)
 		}
@@ -559,107 +614,126 @@ func (self *LinearHashIndex) delete2(key string) (bool, error) {
 		if self.debug {
 			fmt.Printf("[%d] deleted key %s\n", getGID(), key)
 		}
-		// self.updateHeader(-1, 0, 0)
 	}
 	return found, nil
 }
 
 func (self *LinearHashIndex) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *LinearHashIndex) DeleteBytes(key []byte) error {
 	if self.debug {
 		fmt.Printf("[%d] deleting key %s\n", getGID(), key)
 	}
 
-	_, err := self.delete2(key)
+	found, err := self.delete2(key)
 	defer func() error {
 		return Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 	}()
+	if err != nil || !found {
+		return err
+	}
+	// same as in insert, we need the header write locked to update it
+	Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+	err = self.readHeader(true, true)
 	if err != nil {
 		return err
 	}
-	return nil
+	if self.nrecords > 0 {
+		self.nrecords--
+	}
+	if self.nhash > self.minBuckets && self.computeLoadFactor() < self.threshold*merge_ratio {
+		if self.debug {
+			fmt.Printf("[%d] Merging bucket %d\n", getGID(), self.nhash-1)
+		}
+		err = self.merge()
+		if err != nil {
+			return err
+		}
+	}
+	return self.updateHeader(0, 0, 0)
 }
 
+/**
+ * Unlink the current record from its chain and give its space and the
+ * space of its value back to the free lists
+ */
 func (self *LinearHashIndex) _delete() error {
-	var freeptr, saveptr int64
-	self.datbuf = strings.Repeat(" ", int(self.datlen)-1)
-	self.idxbuf = strings.Repeat(" ", len(self.idxbuf))
-	err := WriteLockW(self.idxFile.Fd(), free_off, io.SeekStart, 1)
+	/* offsets in the two files overlap, so ptroff alone can't tell where the pointer is */
+	err := self.writePtr(self.ptrfile, self.ptroff, self.ptrval)
 	if err != nil {
 		return err
 	}
-	defer func() error {
-		return Unlock(self.idxFile.Fd(), free_off, io.SeekStart, 1)
-	}()
-
-	self.writeData(self.datbuf, self.datoff, io.SeekStart)
-	freeptr, err = self.readPtr(free_off, self.idxFile)
+	err = self.idxFree.free(self.idxoff, self.idxlen)
 	if err != nil {
 		return err
 	}
-	saveptr = self.ptrval
-	err = self.writeIdx(self.idxbuf, self.idxoff, io.SeekStart, freeptr)
+	return self.datFree.free(self.datoff, valueSize(self.datlen))
+}
+
+/**
+ * Write the value of a new record into free space, or at the end of the
+ * data file if none fits
+ */
+func (self *LinearHashIndex) writeNewData(data []byte) error {
+	offset, err := self.datFree.alloc(valueSize(int64(len(data))))
 	if err != nil {
 		return err
 	}
-	err = self.writePtr(self.idxFile, free_off, self.idxoff)
+	if offset < 0 {
+		return self.writeData(data, 0, io.SeekEnd)
+	}
+	err = self.datFile.writeValue(offset, data)
 	if err != nil {
 		return err
 	}
-	if self.ptroff != self.chainoff {
-		return self.writePtr(self.bktFile, self.ptroff, saveptr)
-	} else {
-		return self.writePtr(self.idxFile, self.ptroff, saveptr)
-	}
+	self.datoff = offset
+	self.datlen = int64(len(data))
+	return nil
 }
 
-func (self *LinearHashIndex) writeData(data string, offset int64, whence int) error {
-	// we need to lock if we are adding a new record - no need for lock for overwriting
+/**
+ * Write the value either at the end of the data file (whence == io.SeekEnd)
+ * or over the extents of an existing value of the same length
+ */
+func (self *LinearHashIndex) writeData(data []byte, offset int64, whence int) error {
 	if whence == io.SeekEnd {
-		err := WriteLockW(self.datFile.Fd(), 0, io.SeekStart, 0) //lock whole file
+		newoffset, err := self.datFile.appendValue(data)
+		if err != nil {
+			return err
+		}
+		offset = newoffset
+	} else {
+		err := self.datFile.overwriteValue(offset, data)
 		if err != nil {
 			return err
 		}
-		defer func() error {
-			return Unlock(self.datFile.Fd(), 0, io.SeekStart, 0)
-		}()
-	}
-
-	newoffset, err := self.datFile.Seek(offset, whence)
-	if err != nil {
-		return err
 	}
-	self.datoff = newoffset
-
-	self.datlen = int64(len(data) + 1) // +1 for newline
-	iovecBytes := make([][]byte, 2)
-	iovecBytes[0] = []byte(data)
-	iovecBytes[1] = []byte("\n")
-	_, err = unix.Writev(int(self.datFile.Fd()), iovecBytes)
-	return err
+	self.datoff = offset
+	self.datlen = int64(len(data))
+	return nil
 }
 
-func (self *LinearHashIndex) writeIdx(key string, offset int64, whence int, ptrval int64) error {
-	if self.ptrval < 0 || self.ptrval > ptr_max {
-		return fmt.Errorf("Invalid pointer: %d", self.ptrval)
+func (self *LinearHashIndex) writeIdx(key []byte, offset int64, whence int, ptrval int64) error {
+	if ptrval < 0 {
+		return fmt.Errorf("Invalid pointer: %d", ptrval)
 	}
 
-	self.idxbuf = fmt.Sprintf("%s%c%d%c%d\n", key, sep, self.datoff, sep, self.datlen)
-	length := len(self.idxbuf)
+	record := encodeIdxRecord(ptrval, key, self.datoff, self.datlen)
+	length := len(record)
 	if length < idxlen_min || length > idxlen_max {
 		return errors.New("Invalid index record length")
 	}
 
-	indexRecPrefix := fmt.Sprintf("%*d%*d", ptr_sz, ptrval, idxlen_sz, length)
-
-	// if we are appending we need to lock the index file
+	// if we are appending we need to lock the bucket file
 	if whence == io.SeekEnd {
-		lockOff := self.hashoff + ((int64(self.nhash) + 1) * ptr_sz) + 1
-		err := WriteLockW(self.idxFile.Fd(), lockOff, io.SeekStart, 0)
+		err := WriteLockW(self.bktFile.Fd(), 0, io.SeekStart, 0)
 		if err != nil {
 			return err
 		}
 		defer func() error {
-			return Unlock(self.idxFile.Fd(), lockOff, io.SeekStart, 0)
+			return Unlock(self.bktFile.Fd(), 0, io.SeekStart, 0)
 		}()
 	}
 
@@ -668,36 +742,51 @@ func (self *LinearHashIndex) writeIdx(key string, offset int64, whence int, ptrv
 		return err
 	}
 	self.idxoff = idxoff
-	iovecBytes := make([][]byte, 2)
-	iovecBytes[0] = []byte(indexRecPrefix)
-	iovecBytes[1] = []byte(self.idxbuf)
-	bytesWritten, err := unix.Writev(int(self.bktFile.Fd()), iovecBytes)
+	self.idxbuf = key
+	bytesWritten, err := self.bktFile.Write(record)
 	if err != nil {
 		return err
 	}
-	if bytesWritten != len(indexRecPrefix)+len(self.idxbuf) {
+	if bytesWritten != length {
 		return errors.New("Error while writing index record")
 	}
 
 	return nil
 }
 
+/**
+ * Write a new index record into free space in the bucket file, or at its
+ * end if none fits
+ */
+func (self *LinearHashIndex) writeNewIdx(key []byte, ptrval int64) error {
+	offset, err := self.idxFree.alloc(idxrec_header_size + int64(len(key)))
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return self.writeIdx(key, 0, io.SeekEnd, ptrval)
+	}
+	return self.writeIdx(key, offset, io.SeekStart, ptrval)
+}
+
 /**
  * Write a chain pointer field in the index file
  */
 func (self *LinearHashIndex) writePtr(f *os.File, offset int64, ptrval int64) error {
-	if ptrval < 0 || ptrval > ptr_max {
+	if ptrval < 0 {
 		return fmt.Errorf("Invalid ptrval: %d", ptrval)
 	}
 	if self.debug {
 		fmt.Printf("[%d] writing ptr %d at offset %d\n", getGID(), ptrval, offset)
 	}
-	asciiptr := fmt.Sprintf("%*d", ptr_sz, ptrval)
 	_, err := f.Seek(offset, io.SeekStart)
 	if err != nil {
 		return err
 	}
-	bytesWritten, err := f.Write([]byte(asciiptr))
+	bytesWritten, err := f.Write(encodePtr(ptrval))
+	if err != nil {
+		return err
+	}
 	if bytesWritten != ptr_sz {
 		return errors.New("Failed to write index pointer")
 	}
@@ -705,29 +794,51 @@ func (self *LinearHashIndex) writePtr(f *os.File, offset int64, ptrval int64) er
 }
 
 func (self *LinearHashIndex) Insert(key string, value string) error {
-	if self.debug {
-		fmt.Printf("[%d] inserting key %s\n", getGID(), key)
-	}
-	err := self.store(key, value, insert)
-	if err != nil {
-		return err
+	return self.write([]byte(key), []byte(value), Insert)
+}
+
+/**
+ * Store the value of the key as op says, Insert fails with ErrKeyExists if
+ * the key is there and Update with ErrNotFound if it is not. A value of the
+ * same length is written over the old one, any other value is stored in a
+ * new record and the old record is freed. A store which adds a key, through
+ * Insert or Upsert, can split a bucket.
+ */
+func (self *LinearHashIndex) StoreBytes(key []byte, value []byte, op StoreOp) error {
+	switch op {
+	case Insert, Update, Upsert:
+		return self.write(key, value, op)
+	default:
+		return fmt.Errorf("Unsupported store op: %v", op)
 	}
+}
+
+/**
+ * Store the record and, if it is a new one, count it in the header and
+ * split a bucket if the load factor went over the threshold
+ */
+func (self *LinearHashIndex) write(key []byte, value []byte, op StoreOp) error {
 	if self.debug {
-		fmt.Printf("[%d] insert done\n", getGID())
+		fmt.Printf("[%d] storing key %s\n", getGID(), key)
 	}
 	// we read the header and lock the index file to update the header
 	defer func() error {
 		return Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
 	}()
+	added, err := self.store(key, value, op)
+	if err != nil || !added {
+		return err
+	}
+	if self.debug {
+		fmt.Printf("[%d] insert done\n", getGID())
+	}
+	Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+	err = self.readHeader(true, true)
+	if err != nil {
+		return err
+	}
 	self.nrecords++
-	//TODO: is the cast really required here?
-	if self.computeLoadFactor() >= 0.8 {
-		Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
-		self.readHeader(true, true)
-		self.nrecords++
-		if self.computeLoadFactor() < 0.8 {
-			return self.updateHeader(0, 0, 0)
-		}
+	if self.computeLoadFactor() >= self.threshold {
 		if self.debug {
 			fmt.Printf("[%d] Splitting bucket %d\n", getGID(), self.s)
 		}
@@ -735,23 +846,18 @@ func (self *LinearHashIndex) Insert(key string, value string) error {
 		if err != nil {
 			return err
 		}
-		self.updateHeader(0, 0, 0)
 		if self.debug {
 			fmt.Printf("[%d] split done, new s: %d\n", getGID(), self.s)
 		}
-	} else {
-		Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
-		self.readHeader(true, true)
-		err = self.updateHeader(1, 0, 0)
-		if err != nil {
-			return err
-		}
 	}
-	return nil
+	return self.updateHeader(0, 0, 0)
 }
 
+/**
+ * Average number of records per bucket
+ */
 func (self *LinearHashIndex) computeLoadFactor() float64 {
-	return float64(1.0 * self.nrecords / int64(30*self.nhash))
+	return float64(self.nrecords) / float64(self.nhash)
 }
 
 func getGID() uint64 {
@@ -772,9 +878,11 @@ func (self *LinearHashIndex) split() error {
 		return err
 	}
 	defer Unlock(self.idxFile.Fd(), oldChainPtrOff, io.SeekStart, 1)
-	hashPointer := fmt.Sprintf("%*d", ptr_sz, 0)
-	bytes := []byte(hashPointer)
+	bytes := make([]byte, ptr_sz)
 	newChainPtrOff, err := self.idxFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
 	bytesWritten, err := self.idxFile.Write(bytes)
 	if err != nil {
 		return errors.New("Write to index file failed")
@@ -831,26 +939,91 @@ func (self *LinearHashIndex) split() error {
 		self.ptroff = offset
 		offset = nextOffset
 	}
+	// the last record moved still points into the old chain
+	if newChainPtrOffFile == self.bktFile {
+		return self.writePtr(newChainPtrOffFile, newChainPtrOff, 0)
+	}
+	return nil
+}
 
+/**
+ * Undo the last split, the chain of the last bucket is moved to the bucket
+ * it was split from and the table shrinks by one. The caller must hold the
+ * header write locked.
+ */
+func (self *LinearHashIndex) merge() error {
+	last := self.nhash - 1
+	buddy := last - 1<<(bits.Len64(last)-1)
+	lastChainPtrOff := int64(last*ptr_sz) + self.hashoff
+	buddyChainPtrOff := int64(buddy*ptr_sz) + self.hashoff
+	err := WriteLockW(self.idxFile.Fd(), buddyChainPtrOff, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), buddyChainPtrOff, io.SeekStart, 1)
+	err = WriteLockW(self.idxFile.Fd(), lastChainPtrOff, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), lastChainPtrOff, io.SeekStart, 1)
+
+	offset, err := self.readPtr(lastChainPtrOff, self.idxFile)
+	if err != nil {
+		return err
+	}
+	if offset != 0 {
+		// link the tail of the last chain to the head of the buddy chain
+		buddyHead, err := self.readPtr(buddyChainPtrOff, self.idxFile)
+		if err != nil {
+			return err
+		}
+		tail := offset
+		for {
+			nextOffset, err := self.readIdx(tail)
+			if err != nil {
+				return err
+			}
+			if nextOffset == 0 {
+				break
+			}
+			tail = nextOffset
+		}
+		err = self.writePtr(self.bktFile, tail, buddyHead)
+		if err != nil {
+			return err
+		}
+		err = self.writePtr(self.idxFile, buddyChainPtrOff, offset)
+		if err != nil {
+			return err
+		}
+	}
+	// the chain pointer of the last bucket is at the end of the index file, split appends it again
+	err = self.idxFile.Truncate(lastChainPtrOff)
+	if err != nil {
+		return err
+	}
+	self.nhash = last
+	self.s = buddy
+	self.i = int16(bits.Len64(self.nhash - 1))
 	return nil
 }
 
 func (self *LinearHashIndex) Update(key string, value string) error {
-	defer Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
-	return self.store(key, value, update)
+	return self.StoreBytes([]byte(key), []byte(value), Update)
 }
 
 func (self *LinearHashIndex) Upsert(key string, value string) error {
-	//TODO: handle split
-	defer Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
-	return self.store(key, value, upsert)
+	return self.StoreBytes([]byte(key), []byte(value), Upsert)
 }
 
-func (self *LinearHashIndex) store(key string, value string, op indexStoreOp) error {
-	keyLen := int64(len(key))
+/**
+ * Store the record in its hash chain, returns whether a new record was added
+ */
+func (self *LinearHashIndex) store(key []byte, value []byte, op StoreOp) (bool, error) {
 	valueLen := int64(len(value))
-	if valueLen < datlen_min || valueLen > datlen_max {
-		return fmt.Errorf("Invalid data length: %d", valueLen)
+	err := checkSizes(key, value, self.maxKey, self.maxValue)
+	if err != nil {
+		return false, err
 	}
 
 	found, err := self.findAndLock(key, true)
@@ -858,102 +1031,285 @@ func (self *LinearHashIndex) store(key string, value string, op indexStoreOp) er
 		return Unlock(self.idxFile.Fd(), self.chainoff, io.SeekStart, 1)
 	}()
 	if err != nil {
-		return err
+		return false, err
 	}
 	if !found {
-		if op == update {
-			return fmt.Errorf("Record with key %s does not exist", key)
+		if op == Update {
+			return false, fmt.Errorf("%w: %s", ErrNotFound, key)
 		}
+		return true, self.insertRecord(key, value)
+	}
+	if op == Insert {
+		return false, fmt.Errorf("%w: %s", ErrKeyExists, key)
+	}
+	if valueLen == self.datlen {
+		return false, self.writeData(value, self.datoff, io.SeekStart)
+	}
+	return false, self.replaceRecord(key, value, -1)
+}
 
-		ptrval, err := self.readPtr(self.chainoff, self.idxFile)
+/**
+ * Write a new record for the value and link it in place of the record found
+ * last, the value is written first unless it is already at datoff. The swap
+ * is a single pointer write and the old record is only freed after it, so a
+ * crash at any point leaves either the old or the new record in the chain.
+ */
+func (self *LinearHashIndex) replaceRecord(key []byte, value []byte, datoff int64) error {
+	ptrfile, ptroff, ptrval := self.ptrfile, self.ptroff, self.ptrval
+	idxoff, idxlen := self.idxoff, self.idxlen
+	olddatoff, olddatlen := self.datoff, self.datlen
+	if datoff < 0 {
+		err := self.writeNewData(value)
 		if err != nil {
 			return err
 		}
+	} else {
+		self.datoff = datoff
+		self.datlen = int64(len(value))
+	}
+	err := self.writeNewIdx(key, ptrval)
+	if err != nil {
+		return err
+	}
+	err = self.writePtr(ptrfile, ptroff, self.idxoff)
+	if err != nil {
+		return err
+	}
+	err = self.idxFree.free(idxoff, idxlen)
+	if err != nil {
+		return err
+	}
+	return self.datFree.free(olddatoff, valueSize(olddatlen))
+}
 
-		foundFree, err := self.findFree(keyLen, valueLen)
+/**
+ * Write a new record and link it at the head of the locked hash chain
+ */
+func (self *LinearHashIndex) insertRecord(key []byte, value []byte) error {
+	ptrval, err := self.readPtr(self.chainoff, self.idxFile)
+	if err != nil {
+		return err
+	}
+	err = self.writeNewData(value)
+	if err != nil {
+		return err
+	}
+	err = self.writeNewIdx(key, ptrval)
+	if err != nil {
+		return err
+	}
+	return self.writePtr(self.idxFile, self.chainoff, self.idxoff)
+}
+
+/**
+ * Apply the stores and deletes of a batch, see BatchIndex. The header stays
+ * read locked while the chains are written, the records added and removed
+ * are counted in it afterwards and the table split or merged as needed.
+ */
+func (self *LinearHashIndex) WriteBatch(ops []BatchOp) error {
+	ops, err := checkBatch(ops, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
+	}
+	err = self.readHeader(true, false)
+	if err != nil {
+		return err
+	}
+	defer func() error {
+		return Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+	}()
+	/* the records linked before a failure are counted all the same */
+	added, batchErr := self.writeBatch(ops)
+	if added == 0 {
+		return batchErr
+	}
+	// same as in insert, we need the header write locked to update it
+	Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+	err = self.readHeader(true, true)
+	if err != nil {
+		return err
+	}
+	self.nrecords += added
+	if self.nrecords < 0 {
+		self.nrecords = 0
+	}
+	for self.computeLoadFactor() >= self.threshold {
+		err = self.split()
 		if err != nil {
 			return err
 		}
-		if !foundFree {
-			err = self.writeData(value, 0, io.SeekEnd)
-			if err != nil {
-				return err
-			}
-			err = self.writeIdx(key, 0, io.SeekEnd, ptrval)
-			if err != nil {
-				return err
-			}
-			err = self.writePtr(self.idxFile, self.chainoff, self.idxoff)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = self.writeData(value, self.datoff, io.SeekStart)
-			if err != nil {
-				return err
-			}
-			err = self.writeIdx(key, self.idxoff, io.SeekStart, ptrval)
-			if err != nil {
-				return err
+	}
+	for self.nhash > self.minBuckets && self.computeLoadFactor() < self.threshold*merge_ratio {
+		err = self.merge()
+		if err != nil {
+			return err
+		}
+	}
+	err = self.updateHeader(0, 0, 0)
+	if err != nil {
+		return err
+	}
+	return batchErr
+}
+
+/**
+ * Write the batch with the header read locked, returns the number of
+ * records added less the number removed, also when it fails part way
+ */
+func (self *LinearHashIndex) writeBatch(ops []BatchOp) (int64, error) {
+	chainoffs := make([]int64, len(ops))
+	for i, op := range ops {
+		chainoffs[i] = int64(self.dbHash(op.Key)*ptr_sz) + self.hashoff
+	}
+	sortBatch(ops, chainoffs)
+	locks, err := self.lockChains(self.idxFile.Fd(), chainoffs)
+	if err != nil {
+		return 0, err
+	}
+	defer unlockChains(self.idxFile.Fd(), locks)
+
+	/* the new values are appended before any record changes */
+	var values [][]byte
+	for i, op := range ops {
+		if op.Delete {
+			continue
+		}
+		self.chainoff = chainoffs[i]
+		found, err := self.find(op.Key)
+		if err != nil {
+			return 0, err
+		}
+		if !found || int64(len(op.Value)) != self.datlen {
+			values = append(values, op.Value)
+		}
+	}
+	datoffs, err := self.datFile.appendValues(values)
+	if err != nil {
+		return 0, err
+	}
+	var added int64
+	for i, op := range ops {
+		self.chainoff = chainoffs[i]
+		found, err := self.find(op.Key)
+		if err != nil {
+			return added, err
+		}
+		if found && !op.Delete {
+			if int64(len(op.Value)) == self.datlen {
+				err = self.writeData(op.Value, self.datoff, io.SeekStart)
+			} else {
+				err = self.replaceRecord(op.Key, op.Value, datoffs[0])
+				datoffs = datoffs[1:]
 			}
-			err = self.writePtr(self.idxFile, self.chainoff, self.idxoff)
 			if err != nil {
-				return err
+				return added, err
 			}
+			continue
 		}
-	} else {
-		if op == insert {
-			return fmt.Errorf("Record already exists with key: %s", key)
-		}
-		if valueLen != self.datlen {
+		if found {
 			err = self._delete()
 			if err != nil {
-				return err
-			}
-			ptrval, err := self.readPtr(self.chainoff, self.idxFile)
-			if err != nil {
-				return err
+				return added, err
 			}
-			self.writeData(value, 0, io.SeekEnd)
-			self.writeIdx(key, 0, io.SeekEnd, ptrval)
-			self.writePtr(self.idxFile, self.chainoff, self.idxoff)
-		} else {
-			self.writeData(value, self.datoff, io.SeekStart)
+			added--
+		}
+		if op.Delete {
+			continue
+		}
+		self.chainoff = chainoffs[i]
+		self.datoff = datoffs[0]
+		self.datlen = int64(len(op.Value))
+		datoffs = datoffs[1:]
+		ptrval, err := self.readPtr(self.chainoff, self.idxFile)
+		if err != nil {
+			return added, err
 		}
+		err = self.writeNewIdx(op.Key, ptrval)
+		if err != nil {
+			return added, err
+		}
+		err = self.writePtr(self.idxFile, self.chainoff, self.idxoff)
+		if err != nil {
+			return added, err
+		}
+		added++
 	}
-	return nil
+	return added, nil
 }
 
-func (self *LinearHashIndex) findFree(keylen int64, datlen int64) (bool, error) {
-	var offset, nextOffset, saveOffset int64
-	err := WriteLockW(self.idxFile.Fd(), free_off, io.SeekStart, 1)
+/**
+ * Read the records a chain at a time, see ScannableIndex. The records are
+ * returned in the order of their hash with its bits reversed. A bucket
+ * holds the keys whose hash ends with the bits of its number, so in that
+ * order every bucket covers a single range, a split cuts the range of its
+ * bucket in two and a merge puts the halves back together. The cursor is a
+ * position in that order, it lands on the same records whatever the size
+ * of the table.
+ */
+func (self *LinearHashIndex) Scan(cursor []byte, limit int, keysOnly bool, fn func(key []byte, value []byte) error) ([]byte, error) {
+	return scanRanges(cursor, limit, fn, func(pos uint64) ([]scanRecord, uint64, error) {
+		return self.scanBucket(pos, keysOnly)
+	})
+}
+
+/**
+ * Read the records of the bucket whose range holds pos, from pos on.
+ * Returns them along with the end of the range, 0 for the last bucket.
+ */
+func (self *LinearHashIndex) scanBucket(pos uint64, keysOnly bool) ([]scanRecord, uint64, error) {
+	err := self.readHeader(true, false)
 	if err != nil {
-		return false, err
+		return nil, 0, err
+	}
+	defer Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+	bucket := self.hashBucket(bits.Reverse64(pos))
+	/* a bucket whose buddy is not split off yet holds one bit less of the hash */
+	depth := uint(self.i)
+	if depth > 0 && bucket < 1<<(depth-1) && bucket+1<<(depth-1) >= self.nhash {
+		depth--
+	}
+	start := bits.Reverse64(bucket)
+	end := start + uint64(1)<<(64-depth) // wraps to 0 for the last range
+	chainoff := int64(bucket*ptr_sz) + self.hashoff
+	err = self.readLockW(self.idxFile.Fd(), chainoff, io.SeekStart, 1)
+	if err != nil {
+		return nil, 0, err
 	}
-	defer Unlock(self.idxFile.Fd(), free_off, io.SeekStart, 1)
-	saveOffset = free_off
-	offset, err = self.readPtr(saveOffset, self.idxFile)
-	found := false
+	defer Unlock(self.idxFile.Fd(), chainoff, io.SeekStart, 1)
+	offset, err := self.readPtr(chainoff, self.idxFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []scanRecord
 	for offset != 0 {
-		nextOffset, err = self.readIdx(offset)
+		nextOffset, err := self.readIdx(offset)
 		if err != nil {
-			return false, err
+			/* in quarantine mode the chain ends at a damaged record */
+			return records, end, quarantine(self.name, self.opts.QuarantineCorrupt, err)
 		}
-		if int64(len(self.idxbuf)) == keylen && self.datlen == datlen {
-			break
-		}
-		saveOffset = offset
 		offset = nextOffset
+		order := bits.Reverse64(self.keyHash(self.idxbuf))
+		if order < pos {
+			continue
+		}
+		record := scanRecord{order: order, key: self.idxbuf}
+		if !keysOnly {
+			record.value, err = self.readData()
+			if err != nil {
+				/* a quarantined record is not there */
+				err = quarantine(self.name, self.opts.QuarantineCorrupt, err)
+				if err != nil {
+					return nil, 0, err
+				}
+				continue
+			}
+		}
+		records = append(records, record)
 	}
-
-	if offset != 0 {
-		self.writePtr(self.bktFile, saveOffset, self.ptrval)
-		found = true
-	}
-	return found, nil
+	return records, end, nil
 }
 
 func (self *LinearHashIndex) Rewind() {
-	offset := (self.nhash + 1) * ptr_sz
+	offset := uint64(self.hashoff) + self.nhash*ptr_sz
 	self.idxFile.Seek(int64(offset), io.SeekStart)
 }
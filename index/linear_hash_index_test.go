@@ -27,7 +27,10 @@
 package index
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -139,12 +142,9 @@ func TestDeleteSimpleLinHashIndex(t *testing.T) {
 	if val != "v1" {
 		t.Errorf("Expected value v1, got %s", val)
 	}
-	val, err = hashIndex.Fetch("k2")
-	if err != nil {
-		t.Fatal(err)
-	}
-	if val != "" {
-		t.Errorf("Expected value for k2 to be deleted, found value %s", val)
+	_, err = hashIndex.Fetch("k2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected key k2 to be deleted, got error %v", err)
 	}
 }
 
@@ -180,12 +180,9 @@ func TestDeleteMultiLinHashIndex(t *testing.T) {
 	}
 
 	for _, k := range delKeys {
-		val, err := hashIndex.Fetch(k)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if val != "" {
-			t.Errorf("Expected value for key %s to be deleted, found value %s returned", k, val)
+		_, err := hashIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
 		}
 	}
 
@@ -253,6 +250,77 @@ func TestUpdateLinHashIndex(t *testing.T) {
 
 }
 
+/**
+ * An update to a value of another size writes the new record before it
+ * unlinks the old one, a crash in between must leave the old value in place.
+ */
+func TestCrashDuringResizingUpdateLinHashIndex(t *testing.T) {
+	hashIndex, err := linIndexopenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the first half of the update, the new record is written but not linked */
+	found, err := hashIndex.findAndLock([]byte("k2"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("Expected to find k2")
+	}
+	err = hashIndex.writeNewData([]byte("a longer v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.writeNewIdx([]byte("k2"), hashIndex.ptrval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Unlock(hashIndex.idxFile.Fd(), hashIndex.chainoff, io.SeekStart, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashIndex, err = linIndexopenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	val, err := hashIndex.Fetch("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "v2" {
+		t.Errorf("Expected value v2 for key k2, got %s", val)
+	}
+	err = hashIndex.Update("k2", "a longer v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"k1": "v1", "k2": "a longer v2"} {
+		val, err = hashIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %s for key %s, got %s", v, k, val)
+		}
+	}
+}
+
 func TestConcurrentReadWriteLinHashIndex(t *testing.T) {
 	go func() {
 		sigs := make(chan os.Signal, 1)
@@ -290,20 +358,23 @@ func linIndexWork(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string
 	defer wg.Done()
 	hashIndex, err := linIndexopenNewDB(false, os.O_RDWR)
 	if err != nil {
-		t.Fatal(err)
+		t.Error(err)
+		return
 	}
 	defer hashIndex.Close()
 	for i, k := range keys {
 		err := hashIndex.Insert(k, vals[i])
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 	}
 
 	for i, k := range keys {
 		val, err := hashIndex.Fetch(k)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		if val != vals[i] {
 			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
@@ -313,17 +384,15 @@ func linIndexWork(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string
 	for _, k := range keys {
 		err := hashIndex.Delete(k)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 	}
 
 	for _, k := range keys {
-		val, err := hashIndex.Fetch(k)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if val != "" {
-			t.Errorf("Expected key %s to be deleted, found value %s", k, val)
+		_, err := hashIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
 		}
 	}
 }
@@ -365,6 +434,676 @@ func TestFetchAllLinHashIndex(t *testing.T) {
 	}
 }
 
+func TestLargeOffsetsLinHashIndex(t *testing.T) {
+	hashIndex, err := linIndexopenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	/**
+	 * Grow the files past 4GB, the files stay sparse so this does not
+	 * need any disk space. All the new records get appended past this.
+	 */
+	err = os.Truncate(TEST_DB_NAME+".bkt", large_file_offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(TEST_DB_NAME+".dat", large_file_offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrecords := 10
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("k%d", i)
+		vals[i] = fmt.Sprintf("v%d", i)
+	}
+	for i, k := range keys {
+		err = hashIndex.Insert(k, vals[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, k := range keys {
+		val, err := hashIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != vals[i] {
+			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
+		}
+		if hashIndex.idxoff < large_file_offset || hashIndex.datoff < large_file_offset {
+			t.Errorf("Expected key %s to be stored past offset %d, bucket offset %d, data offset %d", k, int64(large_file_offset), hashIndex.idxoff, hashIndex.datoff)
+		}
+	}
+
+	// the deleted record goes on the free list and gets reused
+	_, err = hashIndex.Fetch("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxoff, datoff := hashIndex.idxoff, hashIndex.datoff
+	err = hashIndex.Delete("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("k1", "v9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.Fetch("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "v9" {
+		t.Errorf("Expected value v9 for key k1, got %s", val)
+	}
+	if hashIndex.idxoff != idxoff || hashIndex.datoff != datoff {
+		t.Errorf("Expected the reinserted key to reuse bucket offset %d and data offset %d, got %d and %d", idxoff, datoff, hashIndex.idxoff, hashIndex.datoff)
+	}
+}
+
+func TestBinaryKeysAndValuesLinHashIndex(t *testing.T) {
+	hashIndex, err := linIndexopenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	keys := [][]byte{
+		[]byte("key:with:separators"),
+		[]byte("key\nwith\nnewlines"),
+		{0x00, 0xff, 0x0a, 0x3a},
+		{0x07},
+	}
+	vals := [][]byte{
+		[]byte("value\nwith\nnewlines\n"),
+		{0x00, 0x00, 0x0a},
+		{},
+		{0x0a},
+	}
+	for i, k := range keys {
+		err = hashIndex.StoreBytes(k, vals[i], Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, k := range keys {
+		val, err := hashIndex.FetchBytes(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val == nil || !bytes.Equal(val, vals[i]) {
+			t.Errorf("Expected value %q for key %q, got %q", vals[i], k, val)
+		}
+	}
+	valuesMap, err := hashIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if v, ok := valuesMap[string(k)]; !ok || v != string(vals[i]) {
+			t.Errorf("Expected value %q for key %q in FetchAll, got %q", vals[i], k, v)
+		}
+	}
+
+	err = hashIndex.StoreBytes(keys[0], []byte("new\nvalue"), Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.DeleteBytes(keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.FetchBytes(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "new\nvalue" {
+		t.Errorf("Expected value %q for key %q, got %q", "new\nvalue", keys[0], val)
+	}
+	val, err = hashIndex.FetchBytes(keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != nil {
+		t.Errorf("Expected key %q to be deleted, found value %q", keys[2], val)
+	}
+
+	err = hashIndex.StoreBytes([]byte{}, []byte("v"), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing an empty key")
+	}
+}
+
+func TestLargeValuesLinHashIndex(t *testing.T) {
+	hashIndex, err := linIndexopenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	large := largeValue(500*1024, 1)
+	err = hashIndex.StoreBytes([]byte("large"), large, Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.Insert("small", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.FetchBytes([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Errorf("Value of %d bytes does not match the stored value of %d bytes", len(val), len(large))
+	}
+
+	/* same length, the extents are overwritten in place */
+	large = largeValue(500*1024, 2)
+	err = hashIndex.StoreBytes([]byte("large"), large, Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = hashIndex.FetchBytes([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Errorf("Value does not match after update in place")
+	}
+
+	/* deleted extents are reused for a value of the same length */
+	err = hashIndex.Delete("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	large = largeValue(500*1024, 3)
+	err = hashIndex.StoreBytes([]byte("large"), large, Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large = largeValue(700*1024+3, 4)
+	err = hashIndex.StoreBytes([]byte("large"), large, Upsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashIndex.Close()
+
+	hashIndex, err = linIndexopenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err = hashIndex.FetchBytes([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val, large) {
+		t.Errorf("Value does not match after reopening the index")
+	}
+	val2, err := hashIndex.Fetch("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val2 != "v1" {
+		t.Errorf("Expected value v1 for key small, got %s", val2)
+	}
+	err = hashIndex.StoreBytes([]byte("too-large"), largeValue(DefaultMaxValueSize+1, 5), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing a value larger than the maximum value size")
+	}
+}
+
+func TestMaxValueSizeLinHashIndex(t *testing.T) {
+	linIndexremoveDB(TEST_DB_NAME)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	hashIndex := &LinearHashIndex{opts: Options{MaxValueSize: 100}}
+	err := hashIndex.Open(TEST_DB_NAME, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hashIndex.StoreBytes([]byte("k1"), largeValue(100, 1), Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashIndex.Close()
+
+	/* the maximum value size is read from the header, not from the options */
+	hashIndex = &LinearHashIndex{opts: Options{MaxValueSize: 1000}}
+	err = hashIndex.Open(TEST_DB_NAME, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	err = hashIndex.StoreBytes([]byte("k2"), largeValue(101, 1), Insert)
+	if err == nil {
+		t.Errorf("Expected an error when storing a value larger than the maximum value size")
+	}
+
+	err = (&LinearHashIndex{opts: Options{MaxValueSize: -1}}).Open(TEST_DB_NAME+"_invalid", os.O_RDWR|os.O_CREATE)
+	if err == nil {
+		t.Errorf("Expected an error when opening an index with a negative maximum value size")
+	}
+}
+
+func TestCreateOptionsLinHashIndex(t *testing.T) {
+	linIndexremoveDB(TEST_DB_NAME)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	hashIndex := &LinearHashIndex{opts: Options{InitialBuckets: 4, SplitThreshold: 2, HashSeed: 7}}
+	err := hashIndex.Open(TEST_DB_NAME, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nrecords := 1000
+	for i := 0; i < nrecords; i++ {
+		err = hashIndex.Insert(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashIndex.Close()
+
+	/* the options are read from the header, not from the options */
+	hashIndex = &LinearHashIndex{opts: Options{InitialBuckets: 1024, SplitThreshold: 100}}
+	err = hashIndex.Open(TEST_DB_NAME, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	if hashIndex.threshold != 2 || hashIndex.seed != 7 {
+		t.Errorf("Expected split threshold 2 and seed 7, got %v and %d", hashIndex.threshold, hashIndex.seed)
+	}
+	/* a split is done for every insert which takes the load factor over the threshold */
+	if hashIndex.nhash < uint64(nrecords)/2 || hashIndex.nhash > uint64(nrecords) {
+		t.Errorf("Expected about %d buckets for %d records, got %d", nrecords/2, nrecords, hashIndex.nhash)
+	}
+	for i := 0; i < nrecords; i++ {
+		val, err := hashIndex.Fetch(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != fmt.Sprintf("val_%d", i) {
+			t.Errorf("Expected value val_%d for key key_%d, got %q", i, i, val)
+		}
+	}
+
+	err = (&LinearHashIndex{opts: Options{InitialBuckets: 3}}).Open(TEST_DB_NAME+"_invalid", os.O_RDWR|os.O_CREATE)
+	if err == nil {
+		t.Errorf("Expected an error when the initial number of buckets is not a power of two")
+	}
+	err = (&LinearHashIndex{opts: Options{SplitThreshold: -1}}).Open(TEST_DB_NAME+"_invalid", os.O_RDWR|os.O_CREATE)
+	if err == nil {
+		t.Errorf("Expected an error when opening an index with a negative split threshold")
+	}
+}
+
+func TestMergeLinHashIndex(t *testing.T) {
+	linIndexremoveDB(TEST_DB_NAME)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	hashIndex := &LinearHashIndex{opts: Options{InitialBuckets: 4, SplitThreshold: 2}}
+	err := hashIndex.Open(TEST_DB_NAME, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	nrecords := 1000
+	for i := 0; i < nrecords; i++ {
+		err = hashIndex.Insert(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := hashIndex.nhash
+	/* a record moved by a split must not stay reachable from the old chain */
+	if n := linIndexCountChained(t, hashIndex); n != nrecords {
+		t.Errorf("Expected %d records in the hash chains, got %d", nrecords, n)
+	}
+
+	/* every delete which takes the load factor below half the split threshold merges a bucket */
+	nkept := 100
+	for i := nkept; i < nrecords; i++ {
+		err = hashIndex.Delete(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = hashIndex.readHeader(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashIndex.nrecords != int64(nkept) {
+		t.Errorf("Expected %d records in the header, got %d", nkept, hashIndex.nrecords)
+	}
+	if hashIndex.nhash >= grown || hashIndex.nhash > uint64(nkept) {
+		t.Errorf("Expected the table to shrink from %d buckets to at most %d, got %d", grown, nkept, hashIndex.nhash)
+	}
+	idxFinfo, err := os.Stat(TEST_DB_NAME + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idxFinfo.Size() != hash_off+int64(hashIndex.nhash*ptr_sz) {
+		t.Errorf("Expected the index file to shrink with the table, got %d bytes for %d buckets", idxFinfo.Size(), hashIndex.nhash)
+	}
+	records, err := hashIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nkept {
+		t.Errorf("Expected %d records, got %d", nkept, len(records))
+	}
+	for i := 0; i < nkept; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if records[key] != fmt.Sprintf("val_%d", i) {
+			t.Errorf("Expected value val_%d for key %s, got %q", i, key, records[key])
+		}
+	}
+
+	/* the table never shrinks below its initial size, and grows again */
+	for i := 0; i < nkept; i++ {
+		err = hashIndex.Delete(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = hashIndex.readHeader(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashIndex.nhash != 4 || hashIndex.nrecords != 0 {
+		t.Errorf("Expected 4 buckets and no records, got %d buckets and %d records", hashIndex.nhash, hashIndex.nrecords)
+	}
+	for i := 0; i < nrecords; i++ {
+		err = hashIndex.Insert(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i++ {
+		val, err := hashIndex.Fetch(fmt.Sprintf("key_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != fmt.Sprintf("val_%d", i) {
+			t.Errorf("Expected value val_%d for key key_%d, got %q", i, i, val)
+		}
+	}
+}
+
+func TestConcurrentMergeLinHashIndex(t *testing.T) {
+	linIndexremoveDB(TEST_DB_NAME)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	hashIndex := &LinearHashIndex{opts: Options{InitialBuckets: 4, SplitThreshold: 2}}
+	err := hashIndex.Open(TEST_DB_NAME, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	var wg sync.WaitGroup
+	nrecords := 2000
+	nthreads := 10
+	step := nrecords / nthreads
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		vals[i] = fmt.Sprintf("val_%d", i)
+	}
+	/* the workers split the table while inserting and merge it back while deleting */
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		go linIndexWork(t, &wg, keys[i*step:(i+1)*step], vals[i*step:(i+1)*step])
+	}
+	wg.Wait()
+	err = hashIndex.readHeader(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashIndex.nrecords != 0 || hashIndex.nhash != 4 {
+		t.Errorf("Expected no records in 4 buckets, got %d records in %d buckets", hashIndex.nrecords, hashIndex.nhash)
+	}
+}
+
+func TestUpsertSplitLinHashIndex(t *testing.T) {
+	linIndexremoveDB(TEST_DB_NAME)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	hashIndex := &LinearHashIndex{opts: Options{InitialBuckets: 4, SplitThreshold: 2}}
+	err := hashIndex.Open(TEST_DB_NAME, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	nrecords := 1000
+	for i := 0; i < nrecords; i++ {
+		err = hashIndex.Upsert(fmt.Sprintf("key_%d", i), fmt.Sprintf("val_%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* updates of existing records are not counted again */
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		err = hashIndex.Upsert(key, "upserted")
+		if err == nil {
+			err = hashIndex.Update(key, "updated_"+key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = hashIndex.readHeader(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashIndex.nrecords != int64(nrecords) {
+		t.Errorf("Expected %d records in the header, got %d", nrecords, hashIndex.nrecords)
+	}
+	if hashIndex.nhash < uint64(nrecords)/2 || hashIndex.nhash > uint64(nrecords) {
+		t.Errorf("Expected about %d buckets for %d records, got %d", nrecords/2, nrecords, hashIndex.nhash)
+	}
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		val, err := hashIndex.Fetch(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != "updated_"+key {
+			t.Errorf("Expected value updated_%s for key %s, got %q", key, key, val)
+		}
+	}
+}
+
+func TestConcurrentMixedWritersLinHashIndex(t *testing.T) {
+	linIndexremoveDB(TEST_DB_NAME)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	hashIndex := &LinearHashIndex{opts: Options{InitialBuckets: 4, SplitThreshold: 2}}
+	err := hashIndex.Open(TEST_DB_NAME, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	var wg sync.WaitGroup
+	nthreads := 10
+	nrecords := 300
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			worker, err := linIndexopenNewDB(false, os.O_RDWR)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer worker.Close()
+			/* half the writers upsert, the other half insert and then upsert the same keys */
+			for j := 0; j < nrecords; j++ {
+				key := fmt.Sprintf("key_%d_%d", id, j)
+				if id%2 == 0 {
+					err = worker.Upsert(key, "val_"+key)
+				} else {
+					err = worker.Insert(key, "first")
+					if err == nil {
+						err = worker.Upsert(key, "val_"+key)
+					}
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := nthreads * nrecords
+	err = hashIndex.readHeader(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashIndex.nrecords != int64(total) {
+		t.Errorf("Expected %d records in the header, got %d", total, hashIndex.nrecords)
+	}
+	if hashIndex.nhash < uint64(total)/2 {
+		t.Errorf("Expected the table to grow to about %d buckets, got %d", total/2, hashIndex.nhash)
+	}
+	if n := linIndexCountChained(t, hashIndex); n != total {
+		t.Errorf("Expected %d records in the hash chains, got %d", total, n)
+	}
+	for i := 0; i < nthreads; i++ {
+		for j := 0; j < nrecords; j++ {
+			key := fmt.Sprintf("key_%d_%d", i, j)
+			val, err := hashIndex.Fetch(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != "val_"+key {
+				t.Errorf("Expected value val_%s for key %s, got %q", key, key, val)
+			}
+		}
+	}
+}
+
+/**
+ * Count the records in all the hash chains, a record linked into more than
+ * one chain is counted every time
+ */
+func linIndexCountChained(t *testing.T, hashIndex *LinearHashIndex) int {
+	err := hashIndex.readHeader(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	var i uint64
+	for i = 0; i < hashIndex.nhash; i++ {
+		offset, err := hashIndex.readPtr(hashIndex.hashoff+int64(i*ptr_sz), hashIndex.idxFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset != 0 {
+			offset, err = hashIndex.readIdx(offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+	}
+	return count
+}
+
+/**
+ * Offsets in the bucket file and in the index file overlap. Deleting the record
+ * after one that sits in the bucket file at the offset of its own chain pointer
+ * in the hash table must unlink it in the bucket file.
+ */
+func TestDeleteAfterRecordAtChainOffsetLinHashIndex(t *testing.T) {
+	hashIndex, err := linIndexopenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer linIndexremoveDB(TEST_DB_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	bktInfo, err := hashIndex.bktFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* a key whose chain pointer lies past the end of the bucket file */
+	var last []byte
+	var bucket uint64
+	var chainoff int64
+	for i := 0; ; i++ {
+		last = []byte(fmt.Sprintf("last-%d", i))
+		bucket = hashIndex.dbHash(last)
+		chainoff = hashIndex.hashoff + int64(bucket)*ptr_sz
+		if chainoff-(bktInfo.Size()+idxrec_header_size+int64(len(last))) > 2*idxrec_header_size+64 {
+			break
+		}
+	}
+	var first []byte
+	for i := 0; ; i++ {
+		first = []byte(fmt.Sprintf("first-%d", i))
+		if hashIndex.dbHash(first) == bucket {
+			break
+		}
+	}
+	err = hashIndex.Insert(string(last), "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* fill the bucket file up to the chain pointer with records in the other chains */
+	gap := chainoff - (bktInfo.Size() + idxrec_header_size + int64(len(last)))
+	for n := 0; gap > 0; n++ {
+		keylen := gap - idxrec_header_size
+		if keylen > 64 {
+			keylen = 32
+		}
+		filler := bytes.Repeat([]byte("f"), int(keylen))
+		copy(filler, fmt.Sprintf("%d-", n))
+		for i := 0; hashIndex.dbHash(filler) == bucket; i++ {
+			filler[len(filler)-1] = byte('a' + i)
+		}
+		err = hashIndex.Insert(string(filler), "v2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gap -= idxrec_header_size + keylen
+	}
+	bktInfo, err = hashIndex.bktFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bktInfo.Size() != chainoff {
+		t.Fatalf("Expected the next bucket record at offset %d, the bucket file is %d bytes", chainoff, bktInfo.Size())
+	}
+	/* the chain is now first -> last, with first at the offset of the chain pointer */
+	err = hashIndex.Insert(string(first), "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hashIndex.Delete(string(last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := hashIndex.Fetch(string(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "v3" {
+		t.Errorf("Expected value v3 for key %s, got %s", first, val)
+	}
+	deleted, err := hashIndex.FetchBytes(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != nil {
+		t.Errorf("Expected key %s to be deleted, got value %s", last, deleted)
+	}
+}
+
 func linIndexopenNewDB(removeExisting bool, mode int) (*LinearHashIndex, error) {
 	if removeExisting {
 		linIndexremoveDB(TEST_DB_NAME)
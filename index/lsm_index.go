@@ -0,0 +1,662 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+/**
+ * A log structured merge tree index for write heavy workloads. Writes are
+ * appended to a write-ahead log (the .wal file) and applied to an in-memory
+ * memtable. Once the log grows past lsm_memtable_max the memtable is written
+ * out as an immutable sorted table and the log is truncated. When enough
+ * tables pile up they are merged into one by a background compaction.
+ *
+ * The .idx file only holds the header:
+ *	file header (8 bytes) | max value size (8 bytes) | max key size (8 bytes) | log generation (8 bytes) |
+ *	log length (8 bytes) | next table id (8 bytes) | number of tables (8 bytes) |
+ *	table ids, oldest first (8 bytes each)
+ * The tables live in files named <name>.<id>.sst.
+ *
+ * Every handle keeps its own memtable built by replaying the log, before each
+ * operation it catches up with what other handles or processes appended. The
+ * log generation changes whenever the log is truncated, so a handle knows
+ * when to drop its memtable and pick up the new table instead.
+ *
+ * Locking uses three bytes of the index file. Readers share lsm_read_lock for
+ * the duration of an operation. There is a single writer at a time holding
+ * lsm_write_lock, it only takes lsm_read_lock exclusively for the short time
+ * it takes to publish a new header. lsm_compact_lock makes sure only one
+ * compaction runs at a time.
+ */
+const (
+	lsm_maxvalue_off       = file_header_size
+	lsm_maxkey_off         = lsm_maxvalue_off + 8
+	lsm_walgen_off         = lsm_maxkey_off + 8
+	lsm_wallen_off         = lsm_walgen_off + 8
+	lsm_nexttable_off      = lsm_wallen_off + 8
+	lsm_ntables_off        = lsm_nexttable_off + 8
+	lsm_header_size        = lsm_ntables_off + 8
+	lsm_read_lock          = 0
+	lsm_write_lock         = 1
+	lsm_compact_lock       = 2
+	lsm_memtable_max       = 4 << 20 // flush the memtable once the log is this long
+	lsm_compaction_trigger = 4       // number of tables starting a compaction
+	lsm_key_max            = IDXLEN_MAX - idxrec_header_size
+)
+
+type lsmHeader struct {
+	walGen      int64
+	walLen      int64
+	nextTableId int64
+	tableIds    []int64
+}
+
+type LSMIndex struct {
+	lockWaiter
+	idxFile     *os.File
+	walFile     *os.File
+	opts        Options
+	name        string
+	maxValue    int64
+	maxKey      int64
+	header      lsmHeader
+	walGen      int64 // log generation the memtable was built from
+	walRead     int64 // length of the log replayed into the memtable
+	memtable    map[string]lsmRecord
+	memtableMax int64
+	tables      []*lsmTable // oldest first
+	compactions sync.WaitGroup
+	mutex       sync.Mutex // protects compactErr
+	compactErr  error
+}
+
+func (self *LSMIndex) Open(name string, mode int) error {
+	self.name = name
+	self.memtableMax = lsm_memtable_max
+	self.walGen = -1
+	opts, err := self.opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create index file %s", self.name+".idx")
+	}
+
+	self.walFile, err = os.OpenFile(self.name+".wal", mode, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create log file %s", self.name+".wal")
+	}
+
+	isCreateMode := mode&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE || mode&(os.O_CREATE|os.O_TRUNC) == os.O_TRUNC
+	if isCreateMode {
+		/**
+		 * If the database was created we need to initialize it. We need to lock the entire file,
+		 * stat it, check its size and initialize it atomically
+		 */
+		if WriteLockW(self.idxFile.Fd(), 0, io.SeekStart, 0) != nil {
+			return errors.New("Failed to write lock index for init")
+		}
+		defer func() error {
+			return Unlock(self.idxFile.Fd(), 0, io.SeekStart, 0)
+		}()
+
+		idxFileInfo, err := self.idxFile.Stat()
+		if err != nil {
+			return errors.New("Failed to stat the index file")
+		}
+
+		if idxFileInfo.Size() == 0 {
+			self.maxValue = opts.MaxValueSize
+			self.maxKey = opts.MaxKeySize
+			err = self.writeHeader(lsmHeader{nextTableId: 1})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = verifyFileHeader(self.idxFile, LSMIndexType)
+	if err != nil {
+		self.Close()
+		return err
+	}
+	/* The maximum value and key sizes never change, read them once without locking */
+	buf := make([]byte, 16)
+	_, err = self.idxFile.ReadAt(buf, lsm_maxvalue_off)
+	if err != nil {
+		self.Close()
+		return fmt.Errorf("Failed to read index header: %w", err)
+	}
+	self.maxValue = int64(byteOrder.Uint64(buf))
+	self.maxKey = int64(byteOrder.Uint64(buf[8:]))
+	self.memtable = make(map[string]lsmRecord)
+	return nil
+}
+
+/**
+ * Close the handle, waits for a compaction started by this handle to finish
+ * and returns its error if it failed
+ */
+func (self *LSMIndex) Close() error {
+	self.compactions.Wait()
+	for _, table := range self.tables {
+		table.close()
+	}
+	self.tables = nil
+	if self.idxFile != nil {
+		err := self.idxFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if self.walFile != nil {
+		err := self.walFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.compactErr
+}
+
+func (self *LSMIndex) tableName(id int64) string {
+	return fmt.Sprintf("%s.%d.sst", self.name, id)
+}
+
+func readLsmHeader(f *os.File) (lsmHeader, error) {
+	var header lsmHeader
+	buf := make([]byte, lsm_header_size)
+	_, err := f.ReadAt(buf, 0)
+	if err != nil {
+		return header, fmt.Errorf("Failed to read index header: %w", err)
+	}
+	header.walGen = int64(byteOrder.Uint64(buf[lsm_walgen_off:]))
+	header.walLen = int64(byteOrder.Uint64(buf[lsm_wallen_off:]))
+	header.nextTableId = int64(byteOrder.Uint64(buf[lsm_nexttable_off:]))
+	ntables := int64(byteOrder.Uint64(buf[lsm_ntables_off:]))
+	if ntables < 0 || ntables > 1<<20 {
+		return header, fmt.Errorf("Invalid number of tables %d in index header", ntables)
+	}
+	idsbuf := make([]byte, ntables*8)
+	_, err = f.ReadAt(idsbuf, lsm_header_size)
+	if err != nil {
+		return header, fmt.Errorf("Failed to read index header: %w", err)
+	}
+	header.tableIds = make([]int64, ntables)
+	for i := range header.tableIds {
+		header.tableIds[i] = int64(byteOrder.Uint64(idsbuf[i*8:]))
+	}
+	return header, nil
+}
+
+func writeLsmHeader(f *os.File, header lsmHeader, maxValue int64, maxKey int64) error {
+	buf := make([]byte, lsm_header_size+len(header.tableIds)*8)
+	copy(buf, encodeFileHeader(LSMIndexType))
+	byteOrder.PutUint64(buf[lsm_maxvalue_off:], uint64(maxValue))
+	byteOrder.PutUint64(buf[lsm_maxkey_off:], uint64(maxKey))
+	byteOrder.PutUint64(buf[lsm_walgen_off:], uint64(header.walGen))
+	byteOrder.PutUint64(buf[lsm_wallen_off:], uint64(header.walLen))
+	byteOrder.PutUint64(buf[lsm_nexttable_off:], uint64(header.nextTableId))
+	byteOrder.PutUint64(buf[lsm_ntables_off:], uint64(len(header.tableIds)))
+	for i, id := range header.tableIds {
+		byteOrder.PutUint64(buf[lsm_header_size+i*8:], uint64(id))
+	}
+	_, err := f.WriteAt(buf, 0)
+	return err
+}
+
+func (self *LSMIndex) writeHeader(header lsmHeader) error {
+	err := writeLsmHeader(self.idxFile, header, self.maxValue, self.maxKey)
+	if err != nil {
+		return err
+	}
+	self.header = header
+	return nil
+}
+
+/**
+ * Bring the memtable and the list of tables up to date with the header.
+ * Must be called with either lsm_read_lock or lsm_write_lock held.
+ */
+func (self *LSMIndex) catchUp() error {
+	header, err := readLsmHeader(self.idxFile)
+	if err != nil {
+		return err
+	}
+	self.header = header
+	if header.walGen != self.walGen {
+		self.memtable = make(map[string]lsmRecord)
+		self.walRead = 0
+		self.walGen = header.walGen
+	}
+	err = self.loadTables(header.tableIds)
+	if err != nil {
+		return err
+	}
+	if header.walLen < self.walRead {
+		return fmt.Errorf("Write-ahead log of %s shrunk from %d to %d bytes", self.name, self.walRead, header.walLen)
+	}
+	r := io.NewSectionReader(self.walFile, self.walRead, header.walLen-self.walRead)
+	for self.walRead < header.walLen {
+		rec, reclen, err := readLsmRecord(r, self.maxValue)
+		if err != nil {
+			return fmt.Errorf("Corrupted write-ahead log at offset %d: %w", self.walRead, err)
+		}
+		self.memtable[string(rec.key)] = rec
+		self.walRead += reclen
+	}
+	return nil
+}
+
+/**
+ * Open the tables in the list which we don't have open yet, and close the
+ * ones which were compacted away
+ */
+func (self *LSMIndex) loadTables(ids []int64) error {
+	open := make(map[int64]*lsmTable)
+	for _, table := range self.tables {
+		open[table.id] = table
+	}
+	tables := make([]*lsmTable, 0, len(ids))
+	for _, id := range ids {
+		table, ok := open[id]
+		if ok {
+			delete(open, id)
+		} else {
+			var err error
+			table, err = openLsmTable(self.tableName(id), id)
+			if err != nil {
+				for _, t := range tables {
+					if _, ok := open[t.id]; !ok {
+						t.close()
+					}
+				}
+				return err
+			}
+		}
+		tables = append(tables, table)
+	}
+	for _, table := range open {
+		table.close()
+	}
+	self.tables = tables
+	return nil
+}
+
+/**
+ * Find the latest record for the key, which may be a tombstone
+ */
+func (self *LSMIndex) lookup(key []byte) (lsmRecord, bool, error) {
+	rec, found := self.memtable[string(key)]
+	if found {
+		return rec, true, nil
+	}
+	for i := len(self.tables) - 1; i >= 0; i-- {
+		rec, found, err := self.tables[i].get(key, self.maxValue)
+		if err != nil || found {
+			return rec, found, err
+		}
+	}
+	return lsmRecord{}, false, nil
+}
+
+func (self *LSMIndex) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of the given key, returns nil if the key does not exist
+ */
+func (self *LSMIndex) FetchBytes(key []byte) ([]byte, error) {
+	err := self.readLockW(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	err = self.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	rec, found, err := self.lookup(key)
+	if err != nil || !found || rec.deleted {
+		return nil, err
+	}
+	if rec.value == nil {
+		return []byte{}, nil
+	}
+	return rec.value, nil
+}
+
+func (self *LSMIndex) FetchAll() (map[string]string, error) {
+	err := self.readLockW(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer Unlock(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	err = self.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]string)
+	apply := func(rec lsmRecord) error {
+		if rec.deleted {
+			delete(records, string(rec.key))
+		} else {
+			records[string(rec.key)] = string(rec.value)
+		}
+		return nil
+	}
+	for _, table := range self.tables {
+		err = table.forEach(self.maxValue, apply)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rec := range self.memtable {
+		apply(rec)
+	}
+	return records, nil
+}
+
+func (self *LSMIndex) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *LSMIndex) DeleteBytes(key []byte) error {
+	return self.write(lsmRecord{key: key, deleted: true}, Update, false)
+}
+
+func (self *LSMIndex) Insert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Insert)
+}
+
+func (self *LSMIndex) Update(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Update)
+}
+
+func (self *LSMIndex) Upsert(key string, value string) error {
+	return self.store([]byte(key), []byte(value), Upsert)
+}
+
+func (self *LSMIndex) StoreBytes(key []byte, value []byte, op StoreOp) error {
+	return self.store(key, value, op)
+}
+
+func (self *LSMIndex) store(key []byte, value []byte, op StoreOp) error {
+	err := checkSizes(key, value, self.maxKey, self.maxValue)
+	if err != nil {
+		return err
+	}
+	return self.write(lsmRecord{key: key, value: value}, op, true)
+}
+
+/**
+ * Log the record and apply it to the memtable. Deletes of missing keys are
+ * ignored instead of failing like an update would.
+ */
+func (self *LSMIndex) write(rec lsmRecord, op StoreOp, failMissing bool) error {
+	err := self.writeLockW(self.idxFile.Fd(), lsm_write_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), lsm_write_lock, io.SeekStart, 1)
+	err = self.catchUp()
+	if err != nil {
+		return err
+	}
+
+	if op != Upsert {
+		existing, found, err := self.lookup(rec.key)
+		if err != nil {
+			return err
+		}
+		exists := found && !existing.deleted
+		if op == Insert && exists {
+			return fmt.Errorf("%w: %s", ErrKeyExists, rec.key)
+		}
+		if op == Update && !exists {
+			if !failMissing {
+				return nil
+			}
+			return fmt.Errorf("%w: %s", ErrNotFound, rec.key)
+		}
+	}
+
+	/**
+	 * Anything in the log past the length in the header is left over from a
+	 * writer which died before publishing it, so we write over it
+	 */
+	buf := encodeLsmRecord(rec)
+	bytesWritten, err := self.walFile.WriteAt(buf, self.header.walLen)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Error while writing to the write-ahead log")
+	}
+	header := self.header
+	header.walLen += int64(len(buf))
+	err = self.publish(header)
+	if err != nil {
+		return err
+	}
+	rec.key = append([]byte(nil), rec.key...)
+	rec.value = append([]byte(nil), rec.value...)
+	self.memtable[string(rec.key)] = rec
+	self.walRead = header.walLen
+
+	if header.walLen >= self.memtableMax {
+		return self.flush()
+	}
+	return nil
+}
+
+/**
+ * Write the new header while keeping the readers out
+ */
+func (self *LSMIndex) publish(header lsmHeader) error {
+	err := WriteLockW(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	return self.writeHeader(header)
+}
+
+/**
+ * Write the memtable out as a new table and start a new log. Called with
+ * lsm_write_lock held.
+ */
+func (self *LSMIndex) flush() error {
+	keys := make([]string, 0, len(self.memtable))
+	for key := range self.memtable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	i := 0
+	next := func() (*lsmRecord, error) {
+		if i == len(keys) {
+			return nil, nil
+		}
+		rec := self.memtable[keys[i]]
+		i++
+		return &rec, nil
+	}
+	header := self.header
+	id := header.nextTableId
+	err := writeLsmTable(self.tableName(id), next)
+	if err != nil {
+		return err
+	}
+
+	header.tableIds = append(append([]int64(nil), header.tableIds...), id)
+	header.nextTableId++
+	header.walGen++
+	header.walLen = 0
+	err = WriteLockW(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	/* the header listing the new table is on disk before the log goes */
+	err = self.writeHeader(header)
+	if err == nil {
+		err = self.idxFile.Sync()
+	}
+	if err == nil {
+		err = self.walFile.Truncate(0)
+	}
+	Unlock(self.idxFile.Fd(), lsm_read_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(header.tableIds) >= lsm_compaction_trigger {
+		self.startCompaction()
+	}
+	return nil
+}
+
+/**
+ * Merge all the tables into one in the background. The compaction uses its
+ * own file handle so the locks it takes are separate from the ones of this
+ * handle, which keeps being usable in the meantime.
+ */
+func (self *LSMIndex) startCompaction() {
+	self.compactions.Add(1)
+	go func() {
+		defer self.compactions.Done()
+		err := compactLsm(self.name, self.maxValue, self.maxKey)
+		if err != nil {
+			self.mutex.Lock()
+			self.compactErr = err
+			self.mutex.Unlock()
+		}
+	}()
+}
+
+func compactLsm(name string, maxValue int64, maxKey int64) error {
+	f, err := os.OpenFile(name+".idx", os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	/* If someone else is compacting there is nothing for us to do */
+	err = WriteLock(f.Fd(), lsm_compact_lock, io.SeekStart, 1)
+	if errors.Is(err, ErrLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer Unlock(f.Fd(), lsm_compact_lock, io.SeekStart, 1)
+	compactor := &LSMIndex{name: name, maxValue: maxValue, maxKey: maxKey, idxFile: f}
+
+	/* Reserve an id for the merged table */
+	var header lsmHeader
+	err = compactor.updateHeader(func(h *lsmHeader) {
+		header = *h
+		h.nextTableId++
+	})
+	if err != nil {
+		return err
+	}
+	if len(header.tableIds) < 2 {
+		return nil
+	}
+	err = compactor.loadTables(header.tableIds)
+	if err != nil {
+		return err
+	}
+	defer compactor.loadTables(nil)
+
+	/**
+	 * Tables are only ever added after the ones we are merging, so the
+	 * merge includes the oldest table and the tombstones can go
+	 */
+	next, err := mergeLsmTables(compactor.tables, maxValue, true)
+	if err != nil {
+		return err
+	}
+	id := header.nextTableId
+	err = writeLsmTable(compactor.tableName(id), next)
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[int64]bool)
+	for _, mergedId := range header.tableIds {
+		merged[mergedId] = true
+	}
+	err = compactor.updateHeader(func(h *lsmHeader) {
+		tableIds := []int64{id}
+		for _, tableId := range h.tableIds {
+			if !merged[tableId] {
+				tableIds = append(tableIds, tableId)
+			}
+		}
+		h.tableIds = tableIds
+	})
+	if err != nil {
+		os.Remove(compactor.tableName(id))
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	for mergedId := range merged {
+		os.Remove(compactor.tableName(mergedId))
+	}
+	return nil
+}
+
+/**
+ * Read, modify and publish the header as the writer
+ */
+func (self *LSMIndex) updateHeader(fn func(header *lsmHeader)) error {
+	err := WriteLockW(self.idxFile.Fd(), lsm_write_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), lsm_write_lock, io.SeekStart, 1)
+	header, err := readLsmHeader(self.idxFile)
+	if err != nil {
+		return err
+	}
+	fn(&header)
+	return self.publish(header)
+}
@@ -0,0 +1,357 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	lsm_test_db_name = "lsm_index_test"
+)
+
+func TestStoreFetchDeleteLSMIndex(t *testing.T) {
+	lsmIndex, err := lsmOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer lsmRemoveDB(lsm_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Insert("k1", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when inserting an existing key")
+	}
+	err = lsmIndex.Update("k3", "v3")
+	if err == nil {
+		t.Errorf("Expected an error when updating a missing key")
+	}
+	err = lsmIndex.Update("k1", "v1-updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Upsert("k3", "v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Delete("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Delete("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsmIndex.Insert("k2", "v2-again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsmIndex.Close()
+
+	/* everything is still in the log, a new handle has to replay it */
+	lsmIndex, err = lsmOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmIndex.Close()
+	expected := map[string]string{"k1": "v1-updated", "k2": "v2-again", "k3": "v3"}
+	for k, v := range expected {
+		val, err := lsmIndex.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+	valuesMap, err := lsmIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(valuesMap) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v from FetchAll, got %v", expected, valuesMap)
+	}
+}
+
+func TestFlushAndCompactionLSMIndex(t *testing.T) {
+	lsmIndex, err := lsmOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer lsmRemoveDB(lsm_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsmIndex.memtableMax = 4096
+	nrecords := 5000
+	keys := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		err = lsmIndex.Insert(keys[i], "val_"+keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i += 2 {
+		err = lsmIndex.Delete(keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < nrecords; i += 4 {
+		err = lsmIndex.Update(keys[i], "updated")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = lsmIndex.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables, _ := filepath.Glob(lsm_test_db_name + ".*.sst")
+	if len(tables) > lsm_compaction_trigger {
+		t.Errorf("Expected the tables to be compacted, found %d table files", len(tables))
+	}
+
+	lsmIndex, err = lsmOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmIndex.Close()
+	for i, k := range keys {
+		expected := "val_" + k
+		if i%2 == 0 {
+			expected = ""
+		} else if i%4 == 1 {
+			expected = "updated"
+		}
+		val, err := lsmIndex.Fetch(k)
+		if expected == "" && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != expected {
+			t.Errorf("Expected value %q for key %s, got %q", expected, k, val)
+		}
+	}
+	valuesMap, err := lsmIndex.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valuesMap) != nrecords/2 {
+		t.Errorf("Expected %d records from FetchAll, got %d", nrecords/2, len(valuesMap))
+	}
+}
+
+func TestUnpublishedLogTailLSMIndex(t *testing.T) {
+	lsmIndex, err := lsmOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer lsmRemoveDB(lsm_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmIndex.Close()
+	err = lsmIndex.Insert("k1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* a writer dying after appending to the log but before publishing it */
+	f, err := os.OpenFile(lsm_test_db_name+".wal", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeLsmRecord(lsmRecord{key: []byte("k2"), value: []byte("torn")})[:12])
+	f.Close()
+
+	_, err = lsmIndex.Fetch("k2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the unpublished record to be ignored, got error %v", err)
+	}
+	err = lsmIndex.Insert("k2", "v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := lsmOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for k, v := range map[string]string{"k1": "v1", "k2": "v2"} {
+		val, err := other.Fetch(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != v {
+			t.Errorf("Expected value %q for key %s, got %q", v, k, val)
+		}
+	}
+}
+
+func TestConcurrentReadWriteLSMIndex(t *testing.T) {
+	var wg sync.WaitGroup
+	lsmOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer lsmRemoveDB(lsm_test_db_name)
+	nrecords := 10000
+	keys := make([]string, nrecords)
+	vals := make([]string, nrecords)
+	for i := 0; i < nrecords; i++ {
+		keys[i] = fmt.Sprintf("key_%d", i)
+		vals[i] = fmt.Sprintf("val_%d", i)
+	}
+	nthreads := 20
+	step := nrecords / nthreads
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		start := i * step
+		end := start + step
+		go lsmWork(t, &wg, keys[start:end], vals[start:end])
+	}
+	wg.Wait()
+}
+
+func lsmWork(t *testing.T, wg *sync.WaitGroup, keys []string, vals []string) {
+	defer wg.Done()
+	lsmIndex, err := lsmOpenNewDB(false, os.O_RDWR)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		err := lsmIndex.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	/* small memtables so the handles keep picking up each other's tables */
+	lsmIndex.memtableMax = 16 << 10
+	for i, k := range keys {
+		err := lsmIndex.Insert(k, vals[i])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for i, k := range keys {
+		val, err := lsmIndex.Fetch(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if val != vals[i] {
+			t.Errorf("Expected value %s for key %s, got %s", vals[i], k, val)
+		}
+	}
+
+	for _, k := range keys {
+		err := lsmIndex.Delete(k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, k := range keys {
+		_, err := lsmIndex.Fetch(k)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected key %s to be deleted, got error %v", k, err)
+			return
+		}
+	}
+}
+
+func lsmOpenNewDB(removeExisting bool, mode int) (*LSMIndex, error) {
+	if removeExisting {
+		lsmRemoveDB(lsm_test_db_name)
+	}
+	lsmIndex := new(LSMIndex)
+	err := lsmIndex.Open(lsm_test_db_name, mode)
+	return lsmIndex, err
+}
+
+func lsmRemoveDB(name string) {
+	os.Remove(name + ".idx")
+	os.Remove(name + ".wal")
+	tables, _ := filepath.Glob(name + ".*.sst")
+	for _, table := range tables {
+		os.Remove(table)
+	}
+}
+
+func TestCorruptRecordLSMIndex(t *testing.T) {
+	lsmIndex, err := lsmOpenNewDB(true, os.O_RDWR|os.O_CREATE)
+	defer lsmRemoveDB(lsm_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmIndex.Close()
+	lsmIndex.memtableMax = 1024
+	/* the victim is flushed to a table, the last records stay in the log */
+	err = lsmIndex.Insert("victim", "value_of_victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		err = lsmIndex.Insert(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tables, _ := filepath.Glob(lsm_test_db_name + ".*.sst")
+	if len(tables) != 1 {
+		t.Fatalf("Expected a single table, found %d", len(tables))
+	}
+	flipByte(t, tables[0], []byte("value_of_victim"))
+	_, err = lsmIndex.Fetch("victim")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt fetching a corrupt table record, got %v", err)
+	}
+
+	err = lsmIndex.Upsert("log_victim", "value_of_log_victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipByte(t, lsm_test_db_name+".wal", []byte("value_of_log_victim"))
+	other, err := lsmOpenNewDB(false, os.O_RDWR)
+	if err == nil {
+		defer other.Close()
+		_, err = other.Fetch("key49")
+	}
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt replaying a corrupt log record, got %v", err)
+	}
+}
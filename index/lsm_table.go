@@ -0,0 +1,420 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+/**
+ * Immutable sorted string tables used by the LSM index. A table file is
+ * laid out as:
+ *	file header (8 bytes) | records in key order | sparse index | footer
+ * where a record uses the same encoding as the write-ahead log:
+ *	flags (1 byte) | key length (4 bytes) | value length (4 bytes) | checksum (4 bytes) | key | value
+ * The checksum is the CRC32C of the flags, the lengths, the key and the value.
+ * The sparse index has an entry for every lsm_index_interval'th record:
+ *	key length (4 bytes) | record offset (8 bytes) | key
+ * and the footer is:
+ *	sparse index offset (8 bytes) | number of records (8 bytes)
+ */
+const (
+	lsm_record_header_size = 13 // flags(1) + keylen(4) + vallen(4) + crc(4)
+	lsm_record_crc_off     = 9
+	lsm_tombstone          = 1 // flag set on records deleting a key
+	lsm_index_interval     = 16
+	lsm_footer_size        = 16
+)
+
+type lsmRecord struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+type lsmIndexEntry struct {
+	key    []byte
+	offset int64
+}
+
+type lsmTable struct {
+	id       int64
+	file     *os.File
+	index    []lsmIndexEntry
+	indexOff int64
+	count    int64
+}
+
+func encodeLsmRecord(rec lsmRecord) []byte {
+	buf := make([]byte, lsm_record_header_size+len(rec.key)+len(rec.value))
+	if rec.deleted {
+		buf[0] = lsm_tombstone
+	}
+	byteOrder.PutUint32(buf[1:], uint32(len(rec.key)))
+	byteOrder.PutUint32(buf[5:], uint32(len(rec.value)))
+	copy(buf[lsm_record_header_size:], rec.key)
+	copy(buf[lsm_record_header_size+len(rec.key):], rec.value)
+	byteOrder.PutUint32(buf[lsm_record_crc_off:], lsmRecordCrc(buf[:lsm_record_header_size], rec.key, rec.value))
+	return buf
+}
+
+func lsmRecordCrc(hdrbuf []byte, key []byte, value []byte) uint32 {
+	crc := crc32.Update(0, crcTable, hdrbuf[:lsm_record_crc_off])
+	crc = crc32.Update(crc, crcTable, key)
+	return crc32.Update(crc, crcTable, value)
+}
+
+/**
+ * Check the checksum of a whole encoded record, including that its lengths
+ * add up to the size of buf
+ */
+func verifyLsmRecord(buf []byte) bool {
+	if len(buf) < lsm_record_header_size {
+		return false
+	}
+	keylen := int64(byteOrder.Uint32(buf[1:]))
+	vallen := int64(byteOrder.Uint32(buf[5:]))
+	if lsm_record_header_size+keylen+vallen != int64(len(buf)) {
+		return false
+	}
+	key := buf[lsm_record_header_size : lsm_record_header_size+keylen]
+	return byteOrder.Uint32(buf[lsm_record_crc_off:]) == lsmRecordCrc(buf, key, buf[lsm_record_header_size+keylen:])
+}
+
+/**
+ * Read the record at the current position of the reader, returns io.EOF if
+ * the reader has no more data, io.ErrUnexpectedEOF for a truncated record
+ * and ErrCorrupt for a record which fails its checksum
+ */
+func readLsmRecord(r io.Reader, maxValue int64) (lsmRecord, int64, error) {
+	var rec lsmRecord
+	hdrbuf := make([]byte, lsm_record_header_size)
+	_, err := io.ReadFull(r, hdrbuf)
+	if err != nil {
+		return rec, 0, err
+	}
+	keylen := int64(byteOrder.Uint32(hdrbuf[1:]))
+	vallen := int64(byteOrder.Uint32(hdrbuf[5:]))
+	if hdrbuf[0]&^lsm_tombstone != 0 || keylen < 1 || keylen > lsm_key_max || vallen > maxValue {
+		return rec, 0, fmt.Errorf("Invalid LSM record header: %w", ErrCorrupt)
+	}
+	buf := make([]byte, keylen+vallen)
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return rec, 0, err
+	}
+	if byteOrder.Uint32(hdrbuf[lsm_record_crc_off:]) != lsmRecordCrc(hdrbuf, buf[:keylen], buf[keylen:]) {
+		return rec, 0, fmt.Errorf("LSM record checksum mismatch: %w", ErrCorrupt)
+	}
+	rec.deleted = hdrbuf[0]&lsm_tombstone != 0
+	rec.key = buf[:keylen]
+	rec.value = buf[keylen:]
+	return rec, lsm_record_header_size + keylen + vallen, nil
+}
+
+/**
+ * Write the records returned by next, which must come in key order, into a
+ * new table file. next returns nil once there are no more records. The table
+ * is written under a temporary name and renamed once complete so a partially
+ * written table is never picked up, it is on disk by the time it returns.
+ */
+func writeLsmTable(name string, next func() (*lsmRecord, error)) error {
+	tmpName := name + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	_, err = w.Write(encodeFileHeader(LSMIndexType))
+	if err != nil {
+		return err
+	}
+	var offset int64 = file_header_size
+	var index []lsmIndexEntry
+	var count int64
+	for {
+		rec, err := next()
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			break
+		}
+		if count%lsm_index_interval == 0 {
+			index = append(index, lsmIndexEntry{key: rec.key, offset: offset})
+		}
+		buf := encodeLsmRecord(*rec)
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(buf))
+		count++
+	}
+	indexOff := offset
+	for _, entry := range index {
+		buf := make([]byte, 12+len(entry.key))
+		byteOrder.PutUint32(buf, uint32(len(entry.key)))
+		byteOrder.PutUint64(buf[4:], uint64(entry.offset))
+		copy(buf[12:], entry.key)
+		_, err = w.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	footer := make([]byte, lsm_footer_size)
+	byteOrder.PutUint64(footer, uint64(indexOff))
+	byteOrder.PutUint64(footer[8:], uint64(count))
+	_, err = w.Write(footer)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, name)
+	if err != nil {
+		return err
+	}
+	return syncDir(name)
+}
+
+func openLsmTable(name string, id int64) (*lsmTable, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	table := &lsmTable{id: id, file: f}
+	err = table.readIndex()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to open table %s: %w", name, err)
+	}
+	return table, nil
+}
+
+func (self *lsmTable) readIndex() error {
+	err := verifyFileHeader(self.file, LSMIndexType)
+	if err != nil {
+		return err
+	}
+	finfo, err := self.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := finfo.Size()
+	if size < file_header_size+lsm_footer_size {
+		return errors.New("Table file is too small")
+	}
+	footer := make([]byte, lsm_footer_size)
+	_, err = self.file.ReadAt(footer, size-lsm_footer_size)
+	if err != nil {
+		return err
+	}
+	self.indexOff = int64(byteOrder.Uint64(footer))
+	self.count = int64(byteOrder.Uint64(footer[8:]))
+	if self.indexOff < file_header_size || self.indexOff > size-lsm_footer_size {
+		return fmt.Errorf("Invalid sparse index offset %d", self.indexOff)
+	}
+	buf := make([]byte, size-lsm_footer_size-self.indexOff)
+	_, err = self.file.ReadAt(buf, self.indexOff)
+	if err != nil {
+		return err
+	}
+	for pos := 0; pos < len(buf); {
+		if pos+12 > len(buf) {
+			return fmt.Errorf("Corrupted sparse index: %w", ErrCorrupt)
+		}
+		keylen := int(byteOrder.Uint32(buf[pos:]))
+		offset := int64(byteOrder.Uint64(buf[pos+4:]))
+		if keylen < 1 || pos+12+keylen > len(buf) {
+			return fmt.Errorf("Corrupted sparse index: %w", ErrCorrupt)
+		}
+		self.index = append(self.index, lsmIndexEntry{key: buf[pos+12 : pos+12+keylen], offset: offset})
+		pos += 12 + keylen
+	}
+	return nil
+}
+
+/**
+ * Look up the key, returns the record and whether the table has it. The
+ * record may be a tombstone.
+ */
+func (self *lsmTable) get(key []byte, maxValue int64) (lsmRecord, bool, error) {
+	i := sort.Search(len(self.index), func(i int) bool {
+		return bytes.Compare(self.index[i].key, key) > 0
+	})
+	if i == 0 {
+		return lsmRecord{}, false, nil
+	}
+	start := self.index[i-1].offset
+	end := self.indexOff
+	if i < len(self.index) {
+		end = self.index[i].offset
+	}
+	r := bufio.NewReader(io.NewSectionReader(self.file, start, end-start))
+	for {
+		rec, _, err := readLsmRecord(r, maxValue)
+		if err == io.EOF {
+			return lsmRecord{}, false, nil
+		}
+		if err != nil {
+			return lsmRecord{}, false, fmt.Errorf("Failed to read table %d: %w", self.id, err)
+		}
+		cmp := bytes.Compare(rec.key, key)
+		if cmp == 0 {
+			return rec, true, nil
+		}
+		if cmp > 0 {
+			return lsmRecord{}, false, nil
+		}
+	}
+}
+
+/**
+ * Call fn for every record in the table in key order
+ */
+func (self *lsmTable) forEach(maxValue int64, fn func(rec lsmRecord) error) error {
+	r := bufio.NewReader(io.NewSectionReader(self.file, file_header_size, self.indexOff-file_header_size))
+	for {
+		rec, _, err := readLsmRecord(r, maxValue)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read table %d: %w", self.id, err)
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/**
+ * Sequential reader over the records of a table, used to merge tables
+ */
+type lsmTableReader struct {
+	r        *bufio.Reader
+	maxValue int64
+	table    *lsmTable
+	rec      *lsmRecord
+}
+
+func (self *lsmTable) newReader(maxValue int64) (*lsmTableReader, error) {
+	reader := &lsmTableReader{
+		r:        bufio.NewReader(io.NewSectionReader(self.file, file_header_size, self.indexOff-file_header_size)),
+		maxValue: maxValue,
+		table:    self,
+	}
+	return reader, reader.advance()
+}
+
+/**
+ * Move to the next record, rec is nil at the end of the table
+ */
+func (self *lsmTableReader) advance() error {
+	rec, _, err := readLsmRecord(self.r, self.maxValue)
+	if err == io.EOF {
+		self.rec = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read table %d: %w", self.table.id, err)
+	}
+	self.rec = &rec
+	return nil
+}
+
+/**
+ * Merge the tables, given oldest first, into a single sorted stream of
+ * records. When several tables have the same key the newest record wins.
+ * Tombstones are dropped if dropDeleted is set, which is only safe when the
+ * merge includes the oldest table.
+ */
+func mergeLsmTables(tables []*lsmTable, maxValue int64, dropDeleted bool) (func() (*lsmRecord, error), error) {
+	readers := make([]*lsmTableReader, len(tables))
+	for i, table := range tables {
+		reader, err := table.newReader(maxValue)
+		if err != nil {
+			return nil, err
+		}
+		readers[i] = reader
+	}
+	next := func() (*lsmRecord, error) {
+		for {
+			newest := -1
+			for i, reader := range readers {
+				if reader.rec == nil {
+					continue
+				}
+				if newest == -1 || bytes.Compare(reader.rec.key, readers[newest].rec.key) <= 0 {
+					newest = i
+				}
+			}
+			if newest == -1 {
+				return nil, nil
+			}
+			rec := readers[newest].rec
+			/* skip the older versions of the key */
+			for _, reader := range readers {
+				if reader.rec != nil && bytes.Equal(reader.rec.key, rec.key) {
+					err := reader.advance()
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			if !dropDeleted || !rec.deleted {
+				return rec, nil
+			}
+		}
+	}
+	return next, nil
+}
+
+func (self *lsmTable) close() error {
+	return self.file.Close()
+}
@@ -0,0 +1,69 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bufio"
+	"errors"
+	"os"
+)
+
+/**
+ * With the QuarantineCorrupt option a corrupt record found by a read is
+ * treated as if it was not there and logged to <name>.quarantine, one line
+ * per record with the file and offset of the record. The records are left
+ * in place. A damaged index record ends its hash chain as far as the reads
+ * are concerned, since its pointer to the next record can't be trusted
+ * either.
+ */
+const quarantine_name_ext = ".quarantine"
+
+/**
+ * Returns nil if err is about a corrupt record and quarantine is set, after
+ * logging the record. Any other error is returned as is.
+ */
+func quarantine(name string, quarantineCorrupt bool, err error) error {
+	var corruptErr *CorruptError
+	if !quarantineCorrupt || !errors.As(err, &corruptErr) {
+		return err
+	}
+	line := corruptErr.Error()
+	f, err := os.OpenFile(name+quarantine_name_ext, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	/* the same record is found again by every read, log it once */
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() == line {
+			return nil
+		}
+	}
+	_, err = f.WriteString(line + "\n")
+	return err
+}
@@ -0,0 +1,408 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+/**
+ * Salvage of damaged hash index databases. A crash in the middle of a write
+ * can leave a chain pointing to a half written record, and a damaged record
+ * takes the rest of its chain down with it. Repair first walks the chains,
+ * then scans the whole record file for intact records no chain leads to
+ * anymore, and copies every record which passes its checksum, along with a
+ * value which passes its own, into a fresh database. Deleted records are
+ * cleared when they are freed, so the scan does not bring them back, except
+ * for a record which a crash left unlinked but not yet freed.
+ *
+ * The damaged files are kept with a ".damaged" suffix added to the name.
+ */
+const (
+	repair_name_ext  = ".repair"
+	damaged_name_ext = ".damaged"
+)
+
+/**
+ * A range of bytes Repair could not make sense of, or a record it had to
+ * leave out since its value was damaged
+ */
+type Discarded struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size,omitempty"` // 0 if the size is not known
+	Key    string `json:"key,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type RepairReport struct {
+	Name       string      `json:"name"`
+	BackupName string      `json:"backup_name"` // name under which the damaged files are kept
+	Recovered  []string    `json:"recovered"`   // keys copied into the repaired database
+	Unlinked   []string    `json:"unlinked"`    // recovered keys found by the scan outside of the chains
+	Discarded  []Discarded `json:"discarded"`
+}
+
+func (self *RepairReport) discard(file string, offset int64, size int64, key []byte, format string, args ...interface{}) {
+	discarded := Discarded{File: file, Offset: offset, Size: size, Reason: fmt.Sprintf(format, args...)}
+	if key != nil {
+		discarded.Key = string(key)
+	}
+	self.Discarded = append(self.Discarded, discarded)
+}
+
+/**
+ * Implemented by the indexes which can be salvaged by Repair
+ */
+type salvageableIndex interface {
+	rewritableIndex
+	salvage(report *RepairReport) (map[string][]byte, error)
+}
+
+/**
+ * Rebuild the database with the given name from the records which are still
+ * intact. Returns a report of the keys recovered and the parts of the files
+ * which had to be discarded.
+ */
+func Repair(name string) (*RepairReport, error) {
+	var report *RepairReport
+	err := withDatabaseLocked(name, func() error {
+		var err error
+		report, err = repairLocked(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func repairLocked(name string) (*RepairReport, error) {
+	idxType, version, err := ReadFileHeader(name + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	if version == LegacyFormatVersion {
+		return nil, ErrLegacyFormat
+	}
+	idx, err := NewIndex(idxType, Options{})
+	if err != nil {
+		return nil, err
+	}
+	src, ok := idx.(salvageableIndex)
+	if !ok {
+		return nil, fmt.Errorf("Index type %d does not support repair", idxType)
+	}
+	err = src.Open(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{
+		Name:       name,
+		BackupName: name + damaged_name_ext,
+		Recovered:  []string{},
+		Unlinked:   []string{},
+		Discarded:  []Discarded{},
+	}
+	opts := src.options()
+	records, err := src.salvage(report)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpName := name + repair_name_ext
+	exts := IndexFileExts(idxType)
+	removeFiles(tmpName, exts)
+	dst, err := NewIndex(idxType, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = dst.Open(tmpName, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		removeFiles(tmpName, exts)
+		return nil, err
+	}
+	for key, value := range records {
+		err = dst.StoreBytes([]byte(key), value, Insert)
+		if err != nil {
+			break
+		}
+		report.Recovered = append(report.Recovered, key)
+	}
+	dst.Close()
+	if err != nil {
+		removeFiles(tmpName, exts)
+		return nil, fmt.Errorf("Failed to repair database %s: %w", name, err)
+	}
+	sort.Strings(report.Recovered)
+	sort.Strings(report.Unlinked)
+
+	/**
+	 * The damaged files are linked under the backup name before the new
+	 * ones are renamed over them, so the database never goes missing
+	 */
+	removeFiles(report.BackupName, exts)
+	for _, ext := range exts {
+		err = os.Link(name+ext, report.BackupName+ext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	/* The index file goes last, the handles check it to find out they need to reopen */
+	for i := len(exts) - 1; i >= 0; i-- {
+		err = os.Rename(tmpName+exts[i], name+exts[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+/**
+ * Salvages the records of the static and linear hash indexes, which share
+ * the record format
+ */
+type salvager struct {
+	report   *RepairReport
+	tblFile  *os.File // file holding the hash table
+	hashOff  int64
+	nhash    uint64
+	recFile  *os.File // file holding the index records
+	recStart int64    // first byte of recFile which can hold a record
+	minBlock int64    // smallest free block in recFile
+	datFile  *dataFile
+	maxKey   int64
+	maxValue int64
+	recs     []byte // contents of recFile
+	records  map[string][]byte
+	reached  map[int64]bool // offsets of the records looked at through the chains
+}
+
+/**
+ * An index record parsed from the contents of the record file
+ */
+type salvagedRecord struct {
+	next   int64
+	key    []byte
+	datoff int64
+	datlen int64
+	size   int64
+}
+
+func (self *salvager) run() (map[string][]byte, error) {
+	var err error
+	self.recs, err = ioutil.ReadFile(self.recFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	self.records = make(map[string][]byte)
+	self.reached = make(map[int64]bool)
+
+	/* a damaged header may claim more buckets than there are */
+	finfo, err := self.tblFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	nhash := self.nhash
+	if avail := (finfo.Size() - self.hashOff) / ptr_size; avail < 0 {
+		nhash = 0
+	} else if uint64(avail) < nhash {
+		nhash = uint64(avail)
+	}
+	table := make([]byte, nhash*ptr_size)
+	_, err = self.tblFile.ReadAt(table, self.hashOff)
+	if err != nil {
+		return nil, err
+	}
+	var b uint64
+	for b = 0; b < nhash; b++ {
+		self.walkChain(self.tblFile.Name(), self.hashOff+int64(b*ptr_size), decodePtr(table[b*ptr_size:]))
+	}
+	self.scan()
+	return self.records, nil
+}
+
+func (self *salvager) walkChain(ptrFile string, ptrOff int64, offset int64) {
+	for offset != 0 && !self.reached[offset] {
+		self.reached[offset] = true
+		record, reason := self.parseRecord(offset)
+		if reason != "" {
+			self.report.discard(ptrFile, ptrOff, 0, nil, "chain pointer to offset %d: %s", offset, reason)
+			return
+		}
+		self.recover(offset, record)
+		ptrFile, ptrOff = self.recFile.Name(), offset
+		offset = record.next
+	}
+}
+
+/**
+ * Go through the whole record file for the records the chains did not lead
+ * to. Anything which is neither a record, a free block nor cleared space is
+ * discarded.
+ */
+func (self *salvager) scan() {
+	end := int64(len(self.recs))
+	junk := int64(-1) // start of the bytes not accounted for
+	junkEnd := int64(-1)
+	offset := self.recStart
+	for offset < end {
+		size := int64(0)
+		if record, reason := self.parseRecord(offset); reason == "" {
+			if !self.reached[offset] {
+				self.reached[offset] = true
+				if self.recover(offset, record) {
+					self.report.Unlinked = append(self.report.Unlinked, string(record.key))
+				}
+			}
+			size = record.size
+		} else {
+			size = self.freeBlockSize(offset)
+		}
+		if size > 0 {
+			if junk >= 0 {
+				self.report.discard(self.recFile.Name(), junk, junkEnd-junk, nil, "unreadable bytes")
+				junk = -1
+			}
+			offset += size
+			continue
+		}
+		/* zeroes are cleared space, unless there is junk on both sides */
+		if self.recs[offset] != 0 {
+			if junk < 0 {
+				junk = offset
+			}
+			junkEnd = offset + 1
+		}
+		offset++
+	}
+	if junk >= 0 {
+		self.report.discard(self.recFile.Name(), junk, junkEnd-junk, nil, "unreadable bytes")
+	}
+}
+
+/**
+ * Returns the size of the free block at offset, or 0 if there is none. A
+ * free block has a header with its size, the rest of it is cleared.
+ */
+func (self *salvager) freeBlockSize(offset int64) int64 {
+	if offset+freeblk_header_size > int64(len(self.recs)) {
+		return 0
+	}
+	size := int64(byteOrder.Uint32(self.recs[offset+8:]))
+	if size < self.minBlock || offset+size > int64(len(self.recs)) {
+		return 0
+	}
+	for _, c := range self.recs[offset+freeblk_header_size : offset+size] {
+		if c != 0 {
+			return 0
+		}
+	}
+	return size
+}
+
+/**
+ * Parse the index record at offset, returns the reason if there is no
+ * intact record there
+ */
+func (self *salvager) parseRecord(offset int64) (salvagedRecord, string) {
+	var record salvagedRecord
+	if offset < self.recStart || offset+idxrec_header_size > int64(len(self.recs)) {
+		return record, "pointer outside of the file"
+	}
+	hdrbuf := self.recs[offset : offset+idxrec_header_size]
+	next, keylen, datoff, datlen := decodeIdxHeader(hdrbuf)
+	if keylen < 1 || keylen > self.maxKey || offset+idxrec_header_size+keylen > int64(len(self.recs)) {
+		return record, fmt.Sprintf("invalid index record length %d", idxrec_header_size+keylen)
+	}
+	key := self.recs[offset+idxrec_header_size : offset+idxrec_header_size+keylen]
+	if !verifyIdxRecord(hdrbuf, key) {
+		return record, "index record checksum mismatch"
+	}
+	if datoff < 0 || datlen < 0 || datlen > self.maxValue {
+		return record, "invalid data record"
+	}
+	record = salvagedRecord{next: next, key: key, datoff: datoff, datlen: datlen, size: idxrec_header_size + keylen}
+	return record, ""
+}
+
+/**
+ * Read the value of the record, returns whether the record was added to the
+ * recovered ones. The first intact record of a key wins.
+ */
+func (self *salvager) recover(offset int64, record salvagedRecord) bool {
+	if _, ok := self.records[string(record.key)]; ok {
+		return false
+	}
+	value, err := self.datFile.readValue(record.datoff, record.datlen)
+	if err != nil {
+		if corruptErr, ok := err.(*CorruptError); ok {
+			self.report.discard(corruptErr.File, corruptErr.Offset, 0, record.key, "%s", corruptErr.Reason)
+		} else {
+			self.report.discard(self.datFile.Name(), record.datoff, 0, record.key, "%v", err)
+		}
+		return false
+	}
+	self.records[string(record.key)] = value
+	return true
+}
+
+func (self *HashIndex) salvage(report *RepairReport) (map[string][]byte, error) {
+	salvager := &salvager{
+		report:   report,
+		tblFile:  self.idxFile,
+		hashOff:  self.hashoff,
+		nhash:    self.nhash,
+		recFile:  self.idxFile,
+		recStart: self.hashoff + int64(self.nhash)*PTR_SZ,
+		minBlock: IDXLEN_MIN,
+		datFile:  self.datFile,
+		maxKey:   self.maxKey,
+		maxValue: self.maxValue,
+	}
+	return salvager.run()
+}
+
+func (self *LinearHashIndex) salvage(report *RepairReport) (map[string][]byte, error) {
+	salvager := &salvager{
+		report:   report,
+		tblFile:  self.idxFile,
+		hashOff:  self.hashoff,
+		nhash:    self.nhash,
+		recFile:  self.bktFile,
+		recStart: idxfile_startoffset,
+		minBlock: idxlen_min,
+		datFile:  self.datFile,
+		maxKey:   self.maxKey,
+		maxValue: self.maxValue,
+	}
+	return salvager.run()
+}
@@ -0,0 +1,208 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const (
+	repair_test_db_name = "repair_test"
+)
+
+func TestRepair(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, testRepair)
+}
+
+func TestRepairIntact(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, testRepairIntact)
+}
+
+/**
+ * Repairing a healthy database brings back neither the deleted records nor
+ * the old values of the updated ones
+ */
+func testRepairIntact(t *testing.T, idxType IndexType) {
+	exts := IndexFileExts(idxType)
+	defer removeFiles(repair_test_db_name+damaged_name_ext, exts)
+	idx := openNewIndex(t, repair_test_db_name, idxType, Options{InitialBuckets: 4, SplitThreshold: 2})
+	var err error
+	nrecords := 200
+	for i := 0; i < nrecords; i++ {
+		err = idx.StoreBytes([]byte(fmt.Sprintf("key%d", i)), largeValue(i*37, byte(i)), Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i += 2 {
+		err = idx.DeleteBytes([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < nrecords; i += 4 {
+		err = idx.StoreBytes([]byte(fmt.Sprintf("key%d", i)), largeValue(i*11, byte(i+1)), Update)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+
+	report, err := Repair(repair_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Recovered) != len(expected) || len(report.Unlinked) != 0 || len(report.Discarded) != 0 {
+		t.Errorf("Expected %d keys recovered and nothing else, got %d recovered, unlinked %v, discarded %+v",
+			len(expected), len(report.Recovered), report.Unlinked, report.Discarded)
+	}
+	idx, err = NewIndex(idxType, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Open(repair_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected the records to survive the repair unchanged")
+	}
+}
+
+/**
+ * Damage a value, cut a chain short and leave a half written record at the
+ * end of the record file, the repaired database has all the other records
+ */
+func testRepair(t *testing.T, idxType IndexType) {
+	exts := IndexFileExts(idxType)
+	recFileName := repair_test_db_name + ".idx"
+	if idxType == LinearHashIndexType {
+		recFileName = repair_test_db_name + ".bkt"
+	}
+	defer removeFiles(repair_test_db_name+damaged_name_ext, exts)
+	idx := openNewIndex(t, repair_test_db_name, idxType, Options{InitialBuckets: 2})
+	var err error
+	nrecords := 20
+	for i := 0; i < nrecords; i++ {
+		err = idx.Insert(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%02d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Close()
+
+	valoff := findBytes(t, repair_test_db_name+".dat", []byte("value03"))
+	writeBytes(t, repair_test_db_name+".dat", valoff, []byte("X"))
+	recoff := findBytes(t, recFileName, []byte("key15")) - idxrec_header_size
+	writeBytes(t, recFileName, recoff, encodePtr(1<<40))
+	finfo, err := os.Stat(recFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	halfWritten := encodeIdxRecord(0, []byte("key20"), 0, 7)[:20]
+	writeBytes(t, recFileName, finfo.Size(), halfWritten)
+
+	report, err := Repair(repair_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Recovered) != nrecords-1 {
+		t.Errorf("Expected %d keys recovered, got %d: %v", nrecords-1, len(report.Recovered), report.Recovered)
+	}
+	if len(report.Unlinked) == 0 {
+		t.Errorf("Expected the records after key15 to be found by the scan")
+	}
+	var valueDiscarded, recordDiscarded bool
+	for _, discarded := range report.Discarded {
+		if discarded.Key == "key03" && discarded.File == repair_test_db_name+".dat" {
+			valueDiscarded = true
+		}
+		if discarded.Offset < finfo.Size()+int64(len(halfWritten)) && discarded.Offset+discarded.Size > finfo.Size() {
+			recordDiscarded = true
+		}
+	}
+	if !valueDiscarded {
+		t.Errorf("Expected the value of key03 to be discarded, got %+v", report.Discarded)
+	}
+	if !recordDiscarded {
+		t.Errorf("Expected the half written record to be discarded, got %+v", report.Discarded)
+	}
+	for _, ext := range exts {
+		if _, err := os.Stat(report.BackupName + ext); err != nil {
+			t.Errorf("Expected the damaged files to be kept: %v", err)
+		}
+	}
+
+	verifyReport, err := Verify(repair_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyReport.OK() {
+		t.Errorf("Expected the repaired database to be consistent, got %+v", verifyReport.Problems)
+	}
+	idx, err = NewIndex(idxType, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Open(repair_test_db_name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != nrecords-1 {
+		t.Errorf("Expected %d records after the repair, got %d", nrecords-1, len(records))
+	}
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		value, ok := records[key]
+		if i == 3 {
+			if ok {
+				t.Errorf("Expected the damaged record of key03 to be left out")
+			}
+			continue
+		}
+		if value != fmt.Sprintf("value%02d", i) {
+			t.Errorf("Expected value%02d for %s, got %q", i, key, value)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"errors"
+	"sort"
+)
+
+/**
+ * Implemented by the indexes which can be read a hash chain at a time,
+ * without holding any lock between the calls.
+ *
+ * Scan calls fn for the records from the position given by cursor, nil for
+ * the start, and returns the position to continue from, nil once the end
+ * is reached. It stops once it has returned at least limit records, a limit
+ * of 0 or less reads the whole index. With keysOnly the values are not
+ * read and fn gets a nil value.
+ *
+ * The records are read in the order of the hash of their keys, and the
+ * cursor holds the hash to continue from, not the place of a record in the
+ * files. A record which is in the index for the whole scan is returned
+ * exactly once, whatever is stored, deleted, split or merged between the
+ * calls, and a cursor stays valid after the index is closed and opened
+ * again. Records with the same hash are always returned by the same call.
+ */
+type ScannableIndex interface {
+	Scan(cursor []byte, limit int, keysOnly bool, fn func(key []byte, value []byte) error) ([]byte, error)
+}
+
+var ErrInvalidCursor = errors.New("invalid scan cursor")
+
+/**
+ * A record read by a scan, order is its position in the scan order
+ */
+type scanRecord struct {
+	order uint64
+	key   []byte
+	value []byte
+}
+
+/**
+ * Call fn for the records of a chain in scan order, up to limit of them but
+ * never stopping between two records of the same order. Returns the number
+ * of records passed to fn and, if it stopped early, the order of the first
+ * record left out.
+ */
+func emitScan(records []scanRecord, limit int, fn func(key []byte, value []byte) error) (int, uint64, bool, error) {
+	sort.Slice(records, func(i, j int) bool { return records[i].order < records[j].order })
+	for i, record := range records {
+		if limit > 0 && i >= limit && record.order != records[i-1].order {
+			return i, record.order, true, nil
+		}
+		err := fn(record.key, record.value)
+		if err != nil {
+			return i, 0, false, err
+		}
+	}
+	return len(records), 0, false, nil
+}
+
+/**
+ * The Scan of the indexes whose buckets each hold one range of the hashes
+ * with their bits reversed, see LinearHashIndex.Scan. The cursor is the
+ * position in that order to continue from. readRange returns the records of
+ * the bucket whose range holds pos, from pos on, along with the end of the
+ * range, which wraps to 0 for the last one.
+ */
+func scanRanges(cursor []byte, limit int, fn func(key []byte, value []byte) error,
+	readRange func(pos uint64) ([]scanRecord, uint64, error)) ([]byte, error) {
+	var pos uint64
+	if cursor != nil {
+		if len(cursor) != ptr_size {
+			return nil, ErrInvalidCursor
+		}
+		pos = byteOrder.Uint64(cursor)
+	}
+	count := 0
+	for {
+		records, end, err := readRange(pos)
+		if err != nil {
+			return nil, err
+		}
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - count
+		}
+		n, next, stopped, err := emitScan(records, remaining, fn)
+		if err != nil {
+			return nil, err
+		}
+		count += n
+		if stopped {
+			return encodePtr(int64(next)), nil
+		}
+		if end == 0 {
+			return nil, nil
+		}
+		pos = end
+		if limit > 0 && count >= limit {
+			return encodePtr(int64(pos)), nil
+		}
+	}
+}
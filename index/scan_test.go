@@ -0,0 +1,179 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+const (
+	scan_test_db_name = "scan_test"
+)
+
+func TestScanReopen(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType, ExtendibleHashIndexType}, testScanReopen)
+}
+
+func TestScan(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType, ExtendibleHashIndexType}, testScan)
+}
+
+/**
+ * Scan a page at a time while other keys are stored and deleted between the
+ * pages, enough of them to split and merge the linear hash table. Every key
+ * which is there for the whole scan comes back exactly once.
+ */
+func testScan(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, scan_test_db_name, idxType, Options{InitialBuckets: 4, SplitThreshold: 2})
+	defer idx.Close()
+	var err error
+	scanner := idx.(ScannableIndex)
+
+	nrecords := 300
+	for i := 0; i < nrecords; i++ {
+		err = idx.Insert(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]int)
+	var cursor []byte
+	for page := 0; ; page++ {
+		cursor, err = scanner.Scan(cursor, 7, false, func(key []byte, value []byte) error {
+			seen[string(key)]++
+			if len(key) > 3 && key[0] == 'k' && string(value) != "value"+string(key[3:]) {
+				t.Errorf("Unexpected value %q for key %q", value, key)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor == nil {
+			break
+		}
+		/* grow the table for a while, then shrink it back */
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("extra%d_%d", page, i)
+			if page < 20 {
+				err = idx.Insert(key, "extra")
+			} else {
+				err = idx.Delete(fmt.Sprintf("extra%d_%d", page-20, i))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if seen[key] != 1 {
+			t.Errorf("Expected key %s once, got it %d times", key, seen[key])
+		}
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("Expected key %s at most once, got it %d times", key, n)
+		}
+	}
+
+	/* a keys only scan of everything in one call */
+	nkeys := 0
+	cursor, err = scanner.Scan(nil, 0, true, func(key []byte, value []byte) error {
+		if value != nil {
+			t.Errorf("Expected no value for key %s in a keys only scan", key)
+		}
+		nkeys++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := idx.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != nil || nkeys != len(records) {
+		t.Errorf("Expected %d keys and the end of the index, got %d keys and cursor %v", len(records), nkeys, cursor)
+	}
+}
+
+/**
+ * A cursor stays valid after the index is closed and opened again, and a
+ * cursor which is not one fails the scan
+ */
+func testScanReopen(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, scan_test_db_name, idxType, Options{InitialBuckets: 4, SplitThreshold: 2})
+	var err error
+	nrecords := 100
+	for i := 0; i < nrecords; i++ {
+		err = idx.Insert(fmt.Sprintf("key%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]int)
+	var cursor []byte
+	for {
+		cursor, err = idx.(ScannableIndex).Scan(cursor, 10, true, func(key []byte, value []byte) error {
+			seen[string(key)]++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.Close()
+		idx, err = NewIndex(idxType, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.Open(scan_test_db_name, os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor == nil {
+			break
+		}
+	}
+	defer idx.Close()
+	if len(seen) != nrecords {
+		t.Errorf("Expected %d keys, got %d", nrecords, len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("Expected key %s once, got it %d times", key, n)
+		}
+	}
+	_, err = idx.(ScannableIndex).Scan([]byte("bad"), 10, true, func(key []byte, value []byte) error {
+		return nil
+	})
+	if err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor for a bad cursor, got %v", err)
+	}
+}
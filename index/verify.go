@@ -0,0 +1,488 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+/**
+ * Offline consistency check of the hash indexes. Verify walks every hash
+ * chain, both free lists and the extents of every value, and maps out which
+ * bytes of the record and data files are taken by what. It finds:
+ *	- records failing their checksum or pointing outside of their file
+ *	- chains running in a cycle, or into the chain of another bucket
+ *	- records in a bucket their key does not hash to
+ *	- live records, values and free blocks overlapping each other
+ *	- a record count in the header different from the records found
+ *	- a header which does not match the size of the hash table
+ * Space used by nothing at all is listed as leaked. Leaks are not errors,
+ * the free lists give away remainders too small to hold a record and a
+ * crashed write can lose a block, the space comes back with Compact. Gaps
+ * smaller than the smallest block are left out of the list.
+ *
+ * The database is locked against brickdb handles and Compact for the whole
+ * check, raw index handles have to be closed.
+ */
+const (
+	ProblemCorrupt       = "corrupt"          // record or value failing its checksum or not making sense
+	ProblemDangling      = "dangling_pointer" // pointer outside of the file it points into
+	ProblemCycle         = "cycle"            // chain or free list leading back to itself
+	ProblemCrossLinked   = "cross_linked"     // chain running into the records of another bucket
+	ProblemWrongBucket   = "wrong_bucket"     // key in the chain of a bucket it does not hash to
+	ProblemOverlap       = "overlap"          // two things stored in the same bytes
+	ProblemCountMismatch = "count_mismatch"   // record count in the header is off
+	ProblemHeader        = "header"           // invalid table size or split pointer
+	ProblemFreeList      = "free_list"        // free block of a wrong size
+)
+
+type VerifyProblem struct {
+	Kind   string `json:"kind"`
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Detail string `json:"detail"`
+}
+
+type Leak struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+type VerifyReport struct {
+	Name          string          `json:"name"`
+	IndexType     IndexType       `json:"index_type"`
+	Buckets       uint64          `json:"buckets"`
+	Records       int64           `json:"records"`
+	HeaderRecords int64           `json:"header_records"` // -1 for the static hash index, it keeps no count
+	FreeBlocks    int64           `json:"free_blocks"`
+	FreeBytes     int64           `json:"free_bytes"`
+	LeakedBytes   int64           `json:"leaked_bytes"`
+	Leaks         []Leak          `json:"leaks"`
+	Problems      []VerifyProblem `json:"problems"`
+}
+
+/**
+ * True if no problems were found, leaks don't count
+ */
+func (self *VerifyReport) OK() bool {
+	return len(self.Problems) == 0
+}
+
+func (self *VerifyReport) add(kind string, file string, offset int64, format string, args ...interface{}) {
+	self.Problems = append(self.Problems, VerifyProblem{Kind: kind, File: file, Offset: offset, Detail: fmt.Sprintf(format, args...)})
+}
+
+/**
+ * Implemented by the indexes which can be checked by Verify
+ */
+type verifiableIndex interface {
+	BrickIndex
+	verify(report *VerifyReport) error
+}
+
+/**
+ * Check the consistency of the database with the given name. Problems found
+ * in the files are listed in the report, the error is only set if the check
+ * could not be done.
+ */
+func Verify(name string) (*VerifyReport, error) {
+	var report *VerifyReport
+	err := withDatabaseLocked(name, func() error {
+		var err error
+		report, err = verifyLocked(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func verifyLocked(name string) (*VerifyReport, error) {
+	idxType, version, err := ReadFileHeader(name + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	if version == LegacyFormatVersion {
+		return nil, ErrLegacyFormat
+	}
+	idx, err := NewIndex(idxType, Options{})
+	if err != nil {
+		return nil, err
+	}
+	verifiable, ok := idx.(verifiableIndex)
+	if !ok {
+		return nil, fmt.Errorf("Index type %d does not support verification", idxType)
+	}
+	err = idx.Open(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+	report := &VerifyReport{Name: name, IndexType: idxType, HeaderRecords: -1, Leaks: []Leak{}, Problems: []VerifyProblem{}}
+	err = verifiable.verify(report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+/**
+ * A range of bytes in a file and what it is used for
+ */
+type region struct {
+	offset int64
+	size   int64
+	owner  string
+}
+
+/**
+ * The regions of a file found in use so far
+ */
+type spaceMap struct {
+	file     *os.File
+	start    int64 // first byte of the file which is allocated from
+	size     int64
+	minBlock int64
+	regions  []region
+}
+
+func newSpaceMap(f *os.File, start int64, minBlock int64) (*spaceMap, error) {
+	finfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &spaceMap{file: f, start: start, size: finfo.Size(), minBlock: minBlock}, nil
+}
+
+func (self *spaceMap) contains(offset int64, size int64) bool {
+	return offset >= self.start && size >= 0 && offset+size <= self.size
+}
+
+func (self *spaceMap) add(offset int64, size int64, owner string) {
+	self.regions = append(self.regions, region{offset: offset, size: size, owner: owner})
+}
+
+/**
+ * Report the regions sharing bytes and the gaps between them
+ */
+func (self *spaceMap) check(report *VerifyReport) {
+	sort.Slice(self.regions, func(i, j int) bool {
+		return self.regions[i].offset < self.regions[j].offset
+	})
+	end := self.start
+	var last region
+	for _, r := range self.regions {
+		if r.offset < end {
+			report.add(ProblemOverlap, self.file.Name(), r.offset, "%s overlaps %s at offset %d", r.owner, last.owner, last.offset)
+		} else {
+			self.gap(report, end, r.offset)
+		}
+		if r.offset+r.size > end {
+			end = r.offset + r.size
+			last = r
+		}
+	}
+	self.gap(report, end, self.size)
+}
+
+func (self *spaceMap) gap(report *VerifyReport, start int64, end int64) {
+	if end-start < self.minBlock {
+		return
+	}
+	report.LeakedBytes += end - start
+	report.Leaks = append(report.Leaks, Leak{File: self.file.Name(), Offset: start, Size: end - start})
+}
+
+/**
+ * Checks the hash chains, free lists and values of the static and linear
+ * hash indexes, which share the record and free list formats
+ */
+type hashVerifier struct {
+	report   *VerifyReport
+	tblFile  *os.File // file holding the hash table and the free list tables
+	hashOff  int64
+	nhash    uint64
+	recs     *spaceMap // the file holding the index records
+	dat      *spaceMap
+	idxFree  *freeList
+	datFree  *freeList
+	maxKey   int64
+	maxValue int64
+	bucket   func(key []byte) uint64
+	seen     map[int64]uint64 // offsets of the records found so far and their bucket
+}
+
+func (self *hashVerifier) run() error {
+	self.seen = make(map[int64]uint64)
+	self.report.Buckets = self.nhash
+	table := make([]byte, self.nhash*ptr_size)
+	_, err := self.tblFile.ReadAt(table, self.hashOff)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var b uint64
+	for b = 0; b < self.nhash; b++ {
+		self.walkChain(b, decodePtr(table[b*ptr_size:]))
+	}
+	err = self.walkFreeList(self.idxFree, self.recs)
+	if err != nil {
+		return err
+	}
+	err = self.walkFreeList(self.datFree, self.dat)
+	if err != nil {
+		return err
+	}
+	self.recs.check(self.report)
+	self.dat.check(self.report)
+	return nil
+}
+
+func (self *hashVerifier) walkChain(b uint64, offset int64) {
+	recFile := self.recs.file.Name()
+	for offset != 0 {
+		if owner, ok := self.seen[offset]; ok {
+			if owner == b {
+				self.report.add(ProblemCycle, recFile, offset, "chain of bucket %d runs in a cycle", b)
+			} else {
+				self.report.add(ProblemCrossLinked, recFile, offset, "chain of bucket %d runs into the chain of bucket %d", b, owner)
+			}
+			return
+		}
+		if !self.recs.contains(offset, idxrec_header_size) {
+			self.report.add(ProblemDangling, recFile, offset, "chain of bucket %d points outside of the file", b)
+			return
+		}
+		self.seen[offset] = b
+		hdrbuf := make([]byte, idxrec_header_size)
+		_, err := self.recs.file.ReadAt(hdrbuf, offset)
+		if err != nil {
+			self.report.add(ProblemCorrupt, recFile, offset, "failed to read index record: %v", err)
+			return
+		}
+		next, keylen, datoff, datlen := decodeIdxHeader(hdrbuf)
+		if keylen < 1 || keylen > self.maxKey || !self.recs.contains(offset, idxrec_header_size+keylen) {
+			self.report.add(ProblemCorrupt, recFile, offset, "invalid key length %d", keylen)
+			return
+		}
+		key := make([]byte, keylen)
+		_, err = self.recs.file.ReadAt(key, offset+idxrec_header_size)
+		if err != nil {
+			self.report.add(ProblemCorrupt, recFile, offset, "failed to read key: %v", err)
+			return
+		}
+		if !verifyIdxRecord(hdrbuf, key) {
+			self.report.add(ProblemCorrupt, recFile, offset, "index record checksum mismatch")
+			return
+		}
+		owner := fmt.Sprintf("index record of key %q", key)
+		self.recs.add(offset, idxrec_header_size+keylen, owner)
+		self.report.Records++
+		if keyBucket := self.bucket(key); keyBucket != b {
+			self.report.add(ProblemWrongBucket, recFile, offset, "key %q is in bucket %d, it hashes to bucket %d", key, b, keyBucket)
+		}
+		if datlen > self.maxValue {
+			self.report.add(ProblemCorrupt, recFile, offset, "invalid data length %d for key %q", datlen, key)
+		} else {
+			self.walkExtents(key, datoff, datlen)
+		}
+		offset = next
+	}
+}
+
+func (self *hashVerifier) walkExtents(key []byte, datoff int64, datlen int64) {
+	datFile := self.dat.file.Name()
+	owner := fmt.Sprintf("value of key %q", key)
+	offset := datoff
+	var found int64
+	hdrbuf := make([]byte, datext_header_size)
+	for n := int64(0); n < numExtents(datlen); n++ {
+		if !self.dat.contains(offset, datext_header_size) {
+			self.report.add(ProblemDangling, datFile, offset, "%s points outside of the file", owner)
+			return
+		}
+		_, err := self.dat.file.ReadAt(hdrbuf, offset)
+		if err != nil {
+			self.report.add(ProblemCorrupt, datFile, offset, "failed to read data extent: %v", err)
+			return
+		}
+		next, length := decodeExtentHeader(hdrbuf)
+		if length > datext_payload_max || found+length > datlen || !self.dat.contains(offset, datext_header_size+length) {
+			self.report.add(ProblemCorrupt, datFile, offset, "invalid data extent length %d in %s", length, owner)
+			return
+		}
+		payload := make([]byte, length)
+		_, err = self.dat.file.ReadAt(payload, offset+datext_header_size)
+		if err != nil {
+			self.report.add(ProblemCorrupt, datFile, offset, "failed to read data extent: %v", err)
+			return
+		}
+		/* the length made sense, so the extent still owns its bytes */
+		self.dat.add(offset, datext_header_size+length, owner)
+		if !verifyExtent(hdrbuf, payload) {
+			self.report.add(ProblemCorrupt, datFile, offset, "data extent checksum mismatch in %s", owner)
+			return
+		}
+		found += length
+		if next == 0 {
+			break
+		}
+		offset = next
+	}
+	if found != datlen {
+		self.report.add(ProblemCorrupt, datFile, datoff, "%s has %d bytes, expected %d", owner, found, datlen)
+	}
+}
+
+func (self *hashVerifier) walkFreeList(freeList *freeList, space *spaceMap) error {
+	table, err := freeList.readTable()
+	if err != nil {
+		return err
+	}
+	fileName := space.file.Name()
+	for class := 0; class < free_nclasses; class++ {
+		seen := make(map[int64]bool)
+		offset := int64(byteOrder.Uint64(table[class*ptr_size:])) - 1
+		for offset >= 0 {
+			if seen[offset] {
+				self.report.add(ProblemCycle, fileName, offset, "free list of class %d runs in a cycle", class)
+				break
+			}
+			seen[offset] = true
+			if !space.contains(offset, freeblk_header_size) {
+				self.report.add(ProblemDangling, fileName, offset, "free list of class %d points outside of the file", class)
+				break
+			}
+			buf := make([]byte, freeblk_header_size)
+			_, err := space.file.ReadAt(buf, offset)
+			if err != nil {
+				return err
+			}
+			next := int64(byteOrder.Uint64(buf[0:])) - 1
+			size := int64(byteOrder.Uint32(buf[8:]))
+			if size < freeList.minBlock || freeClass(size) != class || !space.contains(offset, size) {
+				self.report.add(ProblemFreeList, fileName, offset, "free block of %d bytes on the list of class %d", size, class)
+				break
+			}
+			space.add(offset, size, fmt.Sprintf("free block of class %d", class))
+			self.report.FreeBlocks++
+			self.report.FreeBytes += size
+			offset = next
+		}
+	}
+	return nil
+}
+
+func (self *HashIndex) verify(report *VerifyReport) error {
+	recs, err := newSpaceMap(self.idxFile, self.hashoff+int64(self.nhash)*PTR_SZ, IDXLEN_MIN)
+	if err != nil {
+		return err
+	}
+	dat, err := newSpaceMap(self.datFile.File, 0, datext_header_size)
+	if err != nil {
+		return err
+	}
+	verifier := &hashVerifier{
+		report:   report,
+		tblFile:  self.idxFile,
+		hashOff:  self.hashoff,
+		nhash:    self.nhash,
+		recs:     recs,
+		dat:      dat,
+		idxFree:  self.idxFree,
+		datFree:  self.datFree,
+		maxKey:   self.maxKey,
+		maxValue: self.maxValue,
+		bucket:   self.dbHash,
+	}
+	return verifier.run()
+}
+
+func (self *LinearHashIndex) verify(report *VerifyReport) error {
+	err := self.readHeader(true, false)
+	if err != nil {
+		return err
+	}
+	defer Unlock(self.idxFile.Fd(), linidx_header_off, io.SeekStart, 1)
+	report.HeaderRecords = self.nrecords
+	idxName := self.idxFile.Name()
+	/* the split pointer is the number of buckets split in the current round */
+	var round uint64 = 1
+	if self.i > 0 {
+		round = 1 << (self.i - 1)
+	}
+	expectedS := self.nhash - round
+	if self.nhash&(self.nhash-1) == 0 {
+		expectedS = 0
+	}
+	if self.nhash < self.minBuckets || self.s != expectedS {
+		report.add(ProblemHeader, idxName, linidx_header_off, "%d buckets with split pointer %d, created with %d buckets", self.nhash, self.s, self.minBuckets)
+		return nil
+	}
+	finfo, err := self.idxFile.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.Size() < self.hashoff+int64(self.nhash)*ptr_sz {
+		report.add(ProblemHeader, idxName, linidx_header_off, "hash table of %d buckets does not fit in %d bytes", self.nhash, finfo.Size())
+		return nil
+	}
+
+	recs, err := newSpaceMap(self.bktFile, idxfile_startoffset, idxlen_min)
+	if err != nil {
+		return err
+	}
+	dat, err := newSpaceMap(self.datFile.File, 0, datext_header_size)
+	if err != nil {
+		return err
+	}
+	verifier := &hashVerifier{
+		report:   report,
+		tblFile:  self.idxFile,
+		hashOff:  self.hashoff,
+		nhash:    self.nhash,
+		recs:     recs,
+		dat:      dat,
+		idxFree:  self.idxFree,
+		datFree:  self.datFree,
+		maxKey:   self.maxKey,
+		maxValue: self.maxValue,
+		bucket:   self.dbHash,
+	}
+	err = verifier.run()
+	if err != nil {
+		return err
+	}
+	if report.Records != self.nrecords {
+		report.add(ProblemCountMismatch, idxName, linidx_header_off, "header counts %d records, found %d", self.nrecords, report.Records)
+	}
+	return nil
+}
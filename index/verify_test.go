@@ -0,0 +1,240 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const (
+	verify_test_db_name = "verify_test"
+)
+
+func TestVerify(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, testVerify)
+}
+
+func TestVerifyCorruption(t *testing.T) {
+	forEachIndexType(t, []IndexType{HashIndexType, LinearHashIndexType}, testVerifyCorruption)
+}
+
+/**
+ * A database which went through inserts, updates, deletes and splits is
+ * consistent
+ */
+func testVerify(t *testing.T, idxType IndexType) {
+	idx := openNewIndex(t, verify_test_db_name, idxType, Options{InitialBuckets: 4, SplitThreshold: 2})
+	var err error
+	nrecords := 300
+	for i := 0; i < nrecords; i++ {
+		err = idx.StoreBytes([]byte(fmt.Sprintf("key%d", i)), largeValue(i*37, byte(i)), Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < nrecords; i += 3 {
+		err = idx.DeleteBytes([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < nrecords; i += 3 {
+		err = idx.StoreBytes([]byte(fmt.Sprintf("key%d", i)), largeValue(i*11, byte(i)), Update)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Close()
+
+	report, err := Verify(verify_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("Expected no problems, got %+v", report.Problems)
+	}
+	expected := int64(nrecords - nrecords/3)
+	if report.Records != expected {
+		t.Errorf("Expected %d records, found %d", expected, report.Records)
+	}
+	if idxType == LinearHashIndexType && report.HeaderRecords != expected {
+		t.Errorf("Expected a count of %d records in the header, got %d", expected, report.HeaderRecords)
+	}
+	if report.FreeBlocks == 0 {
+		t.Errorf("Expected the deleted records on the free lists")
+	}
+}
+
+func testVerifyCorruption(t *testing.T, idxType IndexType) {
+	recFileName := verify_test_db_name + ".idx"
+	if idxType == LinearHashIndexType {
+		recFileName = verify_test_db_name + ".bkt"
+	}
+	idx := openNewIndex(t, verify_test_db_name, idxType, Options{InitialBuckets: 2})
+	var err error
+	for i := 0; i < 20; i++ {
+		err = idx.Insert(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%02d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx.Close()
+
+	/* point key01 at the value of key00, the old value of key01 is leaked */
+	recoff := findBytes(t, recFileName, []byte("key01")) - idxrec_header_size
+	hdrbuf := readBytes(t, recFileName, recoff, idxrec_header_size)
+	next, _, _, datlen := decodeIdxHeader(hdrbuf)
+	datoff := findBytes(t, verify_test_db_name+".dat", []byte("value00")) - datext_header_size
+	writeBytes(t, recFileName, recoff, encodeIdxRecord(next, []byte("key01"), datoff, datlen))
+
+	/* make the chain of key02 run back to its head */
+	recoff = findBytes(t, recFileName, []byte("key02")) - idxrec_header_size
+	tableOff := int64(HASH_OFF)
+	if idxType == LinearHashIndexType {
+		tableOff = hash_off
+	}
+	table := readBytes(t, verify_test_db_name+".idx", tableOff, 2*ptr_size)
+	var bucket int64 = -1
+	for b := int64(0); b < 2; b++ {
+		if chainContains(t, recFileName, decodePtr(table[b*ptr_size:]), recoff) {
+			bucket = b
+		}
+	}
+	if bucket < 0 {
+		t.Fatalf("Record of key02 not found in any chain")
+	}
+	head := decodePtr(table[bucket*ptr_size:])
+	tail := head
+	for {
+		next, _, _, _ := decodeIdxHeader(readBytes(t, recFileName, tail, idxrec_header_size))
+		if next == 0 {
+			break
+		}
+		tail = next
+	}
+	writeBytes(t, recFileName, tail, encodePtr(head))
+
+	/* flip a byte in the value of key03 */
+	valoff := findBytes(t, verify_test_db_name+".dat", []byte("value03"))
+	writeBytes(t, verify_test_db_name+".dat", valoff, []byte("X"))
+
+	report, err := Verify(verify_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]int)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	for _, kind := range []string{ProblemOverlap, ProblemCycle, ProblemCorrupt} {
+		if kinds[kind] != 1 {
+			t.Errorf("Expected one %s problem, got %+v", kind, report.Problems)
+		}
+	}
+	if report.LeakedBytes != valueSize(datlen) {
+		t.Errorf("Expected %d bytes leaked, got %d", valueSize(datlen), report.LeakedBytes)
+	}
+
+	/* the other bucket now holds the chain of the first one */
+	otherBucket := 1 - bucket
+	writeBytes(t, verify_test_db_name+".idx", tableOff+otherBucket*ptr_size, encodePtr(head))
+	/* and the first one points past the end of the file */
+	writeBytes(t, verify_test_db_name+".idx", tableOff+bucket*ptr_size, encodePtr(1<<40))
+	report, err = Verify(verify_test_db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds = make(map[string]int)
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	if kinds[ProblemDangling] != 1 {
+		t.Errorf("Expected one dangling pointer, got %+v", report.Problems)
+	}
+	if kinds[ProblemWrongBucket] == 0 {
+		t.Errorf("Expected records in the wrong bucket, got %+v", report.Problems)
+	}
+	if idxType == LinearHashIndexType && kinds[ProblemCountMismatch] != 1 {
+		t.Errorf("Expected the record count to be off, got %+v", report.Problems)
+	}
+}
+
+/**
+ * Check whether the record at recoff is in the chain starting at offset,
+ * the chain must not have cycles
+ */
+func chainContains(t *testing.T, fileName string, offset int64, recoff int64) bool {
+	for offset != 0 {
+		if offset == recoff {
+			return true
+		}
+		offset, _, _, _ = decodeIdxHeader(readBytes(t, fileName, offset, idxrec_header_size))
+	}
+	return false
+}
+
+func findBytes(t *testing.T, fileName string, pattern []byte) int64 {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(buf, pattern)
+	if pos < 0 {
+		t.Fatalf("%q not found in %s", pattern, fileName)
+	}
+	return int64(pos)
+}
+
+func readBytes(t *testing.T, fileName string, offset int64, size int64) []byte {
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, size)
+	_, err = f.ReadAt(buf, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func writeBytes(t *testing.T, fileName string, offset int64, buf []byte) {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt(buf, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"context"
+)
+
+/**
+ * A batch of stores and deletes written to the database together with
+ * Write. The zero value is an empty batch. Later operations on a key
+ * override the earlier ones.
+ */
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func (self *WriteBatch) Put(key string, value string) {
+	self.PutBytes([]byte(key), []byte(value))
+}
+
+/**
+ * Add a store of the key to the batch, the key is created or its value
+ * replaced. The key and value are copied.
+ */
+func (self *WriteBatch) PutBytes(key []byte, value []byte) {
+	self.ops = append(self.ops, batchOp{op: journal_upsert, key: append([]byte(nil), key...), value: append([]byte{}, value...)})
+}
+
+func (self *WriteBatch) Delete(key string) {
+	self.DeleteBytes([]byte(key))
+}
+
+func (self *WriteBatch) DeleteBytes(key []byte) {
+	self.ops = append(self.ops, batchOp{op: journal_delete, key: append([]byte(nil), key...)})
+}
+
+/**
+ * Number of operations in the batch
+ */
+func (self *WriteBatch) Len() int {
+	return len(self.ops)
+}
+
+func (self *WriteBatch) Reset() {
+	self.ops = nil
+}
+
+/**
+ * The operations of the batch without the ones overridden by a later
+ * operation on the same key
+ */
+func (self *WriteBatch) lastOps() []batchOp {
+	last := make(map[string]int, len(self.ops))
+	for i, op := range self.ops {
+		last[string(op.key)] = i
+	}
+	ops := make([]batchOp, 0, len(last))
+	for i, op := range self.ops {
+		if last[string(op.key)] == i {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+/**
+ * Apply the batch, it is logged to the journal as a single record and
+ * applied with all its keys locked. The hash indexes write it in one go,
+ * see index.BatchIndex, the other indexes one operation at a time. A batch
+ * left half applied by a crash or a failure is applied again in full from
+ * the journal, until then other handles can see the part applied.
+ */
+func (self *Brickdb) Write(batch *WriteBatch) error {
+	return self.WriteContext(context.Background(), batch)
+}
+
+func (self *Brickdb) WriteContext(ctx context.Context, batch *WriteBatch) error {
+	ops := batch.lastOps()
+	if len(ops) == 0 {
+		return nil
+	}
+	err := self.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer self.unlock()
+	keys := make([][]byte, len(ops))
+	for i, op := range ops {
+		keys[i] = op.key
+	}
+	locks, err := self.journal.lockKeys(ctx, keys, nil)
+	if err != nil {
+		return err
+	}
+	err = self.recordVersions(keys)
+	if err == nil {
+		err = self.logAndApply(journal_batch, nil, encodeBatch(ops))
+	}
+	self.journal.unlockKeys(locks)
+	if err != nil {
+		self.replayPending()
+		return err
+	}
+	return self.checkpointIfFull()
+}
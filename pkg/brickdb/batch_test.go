@@ -0,0 +1,156 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	batch_test_db_name = "batch_test_db"
+)
+
+func TestWriteBatch(t *testing.T) {
+	forEachIndexType(t, allIndexTypes, testWriteBatch)
+}
+
+/**
+ * A batch creates, replaces and deletes its keys, a later operation on a
+ * key overriding the earlier ones
+ */
+func testWriteBatch(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, batch_test_db_name, idxType, Options{})
+	defer db.Close()
+	for _, key := range []string{"same_size", "resized", "deleted"} {
+		err := db.Store(key, "old", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var batch WriteBatch
+	batch.Put("same_size", "new")
+	batch.Put("resized", "a longer value")
+	batch.Delete("deleted")
+	batch.Put("inserted", "new")
+	batch.Put("overridden", "first")
+	batch.Delete("overridden")
+	batch.Put("overridden", "last")
+	batch.Delete("missing")
+	err := db.Write(&batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, db, map[string]string{"same_size": "new", "resized": "a longer value", "deleted": "",
+		"inserted": "new", "overridden": "last", "missing": ""})
+	records, err := db.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Errorf("Expected 4 records after the batch, got %d", len(records))
+	}
+
+	batch.Reset()
+	if batch.Len() != 0 {
+		t.Errorf("Expected an empty batch after Reset, got %d operations", batch.Len())
+	}
+	err = db.Write(&batch)
+	if err != nil {
+		t.Errorf("Expected an empty batch to write nothing, got %v", err)
+	}
+}
+
+func TestWriteBatchTooLarge(t *testing.T) {
+	forEachIndexType(t, allIndexTypes, testWriteBatchTooLarge)
+}
+
+/**
+ * A batch with a value which is too large applies none of its operations,
+ * including the ones before it
+ */
+func testWriteBatchTooLarge(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, batch_test_db_name, idxType, Options{MaxValueSize: 16})
+	defer db.Close()
+	err := db.Store("k1", "old", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch WriteBatch
+	batch.Put("k1", "new")
+	batch.Put("k2", "new")
+	batch.Put("k3", strings.Repeat("x", 17))
+	batch.Put("k4", "new")
+	err = db.Write(&batch)
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Expected ErrValueTooLarge, got %v", err)
+	}
+	expectValues(t, db, map[string]string{"k1": "old", "k2": "", "k3": "", "k4": ""})
+	for _, status := range journalStatuses(t, db) {
+		if status == journal_pending {
+			t.Errorf("Expected the failed batch not to be left pending")
+		}
+	}
+}
+
+/**
+ * A batch which fails part way on an index without batch support is applied
+ * again in full from the journal
+ */
+func TestWriteBatchFailedApply(t *testing.T) {
+	db := openNewDB(t, batch_test_db_name, index.BTreeIndexType, Options{})
+	defer db.Close()
+	err := db.Store("k0", "old", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.index = &failingIndex{BrickIndex: db.index, skip: 2, failures: 1}
+
+	var batch WriteBatch
+	expected := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("k%d", i)
+		batch.Put(key, "new")
+		expected[key] = "new"
+	}
+	err = db.Write(&batch)
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("Expected the injected failure, got %v", err)
+	}
+	expectValues(t, db, expected)
+	for _, status := range journalStatuses(t, db) {
+		if status == journal_pending {
+			t.Errorf("Expected the failed batch to be replayed")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	context_test_db_name = "context_test_db"
+)
+
+/**
+ * The Context variants of the operations, against ctx
+ */
+func contextOps(db *Brickdb) map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"FetchContext": func(ctx context.Context) error {
+			_, err := db.FetchContext(ctx, "k1")
+			return err
+		},
+		"FetchAllContext": func(ctx context.Context) error {
+			_, err := db.FetchAllContext(ctx)
+			return err
+		},
+		"StoreContext": func(ctx context.Context) error {
+			return db.StoreContext(ctx, "k1", "new", Update)
+		},
+		"DeleteContext": func(ctx context.Context) error {
+			return db.DeleteContext(ctx, "k1")
+		},
+		"WriteContext": func(ctx context.Context) error {
+			var batch WriteBatch
+			batch.Put("k1", "new")
+			batch.Put("k2", "new")
+			return db.WriteContext(ctx, &batch)
+		},
+		"ScanContext": func(ctx context.Context) error {
+			_, _, err := db.ScanContext(ctx, "", 10)
+			return err
+		},
+		"CommitContext": func(ctx context.Context) error {
+			/* an upsert reads nothing before the commit */
+			txn := db.Begin()
+			err := txn.Store("k1", "new", Upsert)
+			if err != nil {
+				return err
+			}
+			return txn.CommitContext(ctx)
+		},
+	}
+}
+
+/**
+ * An operation with a context which is already done fails right away and
+ * writes nothing
+ */
+func TestContextCanceled(t *testing.T) {
+	db := openNewDB(t, context_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	err := db.Store("k1", "old", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, op := range contextOps(db) {
+		err = op(ctx)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled from %s, got %v", name, err)
+		}
+	}
+	expectValues(t, db, map[string]string{"k1": "old", "k2": ""})
+}
+
+/**
+ * With the database locked by a compaction, the operations give up once
+ * their deadline is past, without writing anything, and go through once
+ * the lock is released
+ */
+func TestContextDatabaseLocked(t *testing.T) {
+	db := openNewDB(t, context_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	err := db.Store("k1", "old", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := openDB(t, context_test_db_name, index.LinearHashIndexType, Options{})
+	defer other.Close()
+	err = index.LockDatabase(other.idxFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, op := range contextOps(db) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err = op(ctx)
+		cancel()
+		if !errors.Is(err, ErrLocked) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %s to give up at the deadline, got %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected %s to give up after 50ms, it took %v", name, elapsed)
+		}
+	}
+
+	err = index.UnlockDatabase(other.idxFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, db, map[string]string{"k1": "old", "k2": ""})
+	for _, status := range journalStatuses(t, db) {
+		if status == journal_pending {
+			t.Errorf("Expected no write left pending by the operations which gave up")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err = db.StoreContext(ctx, "k1", "new", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, db, map[string]string{"k1": "new"})
+}
+
+/**
+ * A write waiting for the lock of a key another handle holds gives up at
+ * its deadline before it has changed anything
+ */
+func TestContextKeyLocked(t *testing.T) {
+	db := openNewDB(t, context_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	err := db.Store("k1", "old", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := openDB(t, context_test_db_name, index.LinearHashIndexType, Options{})
+	defer other.Close()
+	locks, err := other.journal.lockKeys(context.Background(), [][]byte{[]byte("k1")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := contextOps(db)
+	for _, name := range []string{"StoreContext", "DeleteContext", "WriteContext", "CommitContext"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err = ops[name](ctx)
+		cancel()
+		if !errors.Is(err, ErrLocked) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %s to give up at the deadline, got %v", name, err)
+		}
+	}
+	other.journal.unlockKeys(locks)
+	expectValues(t, db, map[string]string{"k1": "old", "k2": ""})
+}
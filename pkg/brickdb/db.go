@@ -27,9 +27,11 @@
 package brickdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strconv"
+	"time"
 
 	"github.com/abhinav-upadhyay/brickdb/index"
 )
@@ -38,8 +40,52 @@ type Brickdb struct {
 	name      string
 	indexType index.IndexType
 	index     index.BrickIndex
+	idxFile   *os.File // used to coordinate with Compact
+	journal   *journal
+	versions  *versionLog
+	logOps    bool // false for the indexes which keep their own log
+	opts      Options
+	pending   bool // a write failed part way and was left pending in the journal
 }
 
+/**
+ * Options used when a new database is created, an existing database keeps
+ * the options it was created with. Zero values mean the defaults.
+ */
+type Options struct {
+	MaxValueSize      int64         // maximum length of a value in bytes, defaults to index.DefaultMaxValueSize
+	MaxKeySize        int64         // maximum length of a key in bytes, defaults to index.DefaultMaxKeySize
+	InitialBuckets    uint64        // initial size of the hash table for the hash based indexes
+	SplitThreshold    float64       // average records per bucket at which the linear hash index splits, defaults to index.DefaultSplitThreshold
+	HashSeed          uint64        // seed of the hash function, defaults to index.DefaultHashSeed
+	QuarantineCorrupt bool          // skip corrupt records and log them to <name>.quarantine, applies to this handle only
+	Sync              SyncMode      // when the writes of this handle are flushed to disk
+	SyncInterval      time.Duration // how long SyncInterval gathers writes for a flush, defaults to DefaultSyncInterval
+}
+
+/**
+ * Durability of the stores and deletes of a handle. With SyncAlways a write
+ * is on disk when it returns, with SyncInterval it is too but the writes
+ * of all the handles which come within SyncInterval of each other, in this
+ * process or others, share one flush. With SyncNone the writes survive a
+ * crash of the process, not of the machine.
+ *
+ * The journal record of a write is flushed before the write touches the
+ * index, and the index files are flushed before the write is marked done
+ * and before the journal is emptied, so whatever order the data, index and
+ * pointer writes reach the disk in, a crash leaves nothing the journal
+ * can't replay.
+ */
+type SyncMode int
+
+const (
+	SyncNone SyncMode = iota
+	SyncInterval
+	SyncAlways
+)
+
+const DefaultSyncInterval = 10 * time.Millisecond
+
 type StoreOp int
 
 const (
@@ -48,10 +94,43 @@ const (
 	Upsert
 )
 
+// returned by Open for databases which need to be converted using Upgrade
+var ErrLegacyFormat = index.ErrLegacyFormat
+
+// returned, wrapped in an *index.CorruptError, when a record fails its checksum
+var ErrCorrupt = index.ErrCorrupt
+
+// returned by Fetch for a key which does not exist, and by updates of one
+var ErrNotFound = index.ErrNotFound
+
+// returned by inserts of a key which exists
+var ErrKeyExists = index.ErrKeyExists
+
+// returned by stores of keys or values longer than the maximum sizes of the database
+var ErrKeyTooLarge = index.ErrKeyTooLarge
+var ErrValueTooLarge = index.ErrValueTooLarge
+
+// returned by stores of an empty key
+var ErrEmptyKey = index.ErrEmptyKey
+
+// returned when a lock is held by someone else and the operation does not wait for it
+var ErrLocked = index.ErrLocked
+
+// returned by the operations of a handle which is not open or has been closed
+var ErrClosed = index.ErrClosed
+
+// returned by the Context operations which gave up waiting for a lock
+type LockWaitError = index.LockWaitError
+
 func New(name string, indexType index.IndexType) *Brickdb {
+	return NewWithOptions(name, indexType, Options{})
+}
+
+func NewWithOptions(name string, indexType index.IndexType, opts Options) *Brickdb {
 	db := new(Brickdb)
 	db.name = name
 	db.indexType = indexType
+	db.opts = opts
 	return db
 }
 
@@ -59,93 +138,629 @@ func (self *Brickdb) create() error {
 	return self.openIndex(os.O_RDWR | os.O_CREATE)
 }
 
+/**
+ * The index file is opened before the index, so a compaction renaming the
+ * files while the index opens them is always noticed by the first operation
+ */
 func (self *Brickdb) openIndex(mode int) error {
-	switch self.indexType {
-	case index.HashIndexType:
-		self.index = new(index.HashIndex)
-	case index.LinearHashIndexType:
-		self.index = new(index.LinearHashIndex)
-	default:
-		return fmt.Errorf("Invalid indexType: %v", self.indexType)
+	var err error
+	self.idxFile, err = os.OpenFile(self.name+".idx", mode, 0644)
+	if err != nil {
+		return err
+	}
+	self.index, err = index.NewIndex(self.indexType, index.Options{
+		MaxValueSize:      self.opts.MaxValueSize,
+		MaxKeySize:        self.opts.MaxKeySize,
+		InitialBuckets:    self.opts.InitialBuckets,
+		SplitThreshold:    self.opts.SplitThreshold,
+		HashSeed:          self.opts.HashSeed,
+		QuarantineCorrupt: self.opts.QuarantineCorrupt,
+	})
+	if err != nil {
+		self.idxFile.Close()
+		return err
 	}
-	return self.index.Open(self.name, mode)
+	err = self.index.Open(self.name, mode)
+	if err != nil {
+		self.idxFile.Close()
+		return err
+	}
+	return nil
 }
 
+func (self *Brickdb) reopen() error {
+	self.index.Close()
+	self.idxFile.Close()
+	return self.openIndex(os.O_RDWR)
+}
+
+func (self *Brickdb) lock() error {
+	return self.lockContext(context.Background())
+}
+
+/**
+ * Lock the database against compaction for the duration of an operation,
+ * reopening it first if a compaction has replaced its files. Until unlock
+ * the index gives up waiting for its locks once ctx is done, and so does
+ * waiting for the database lock itself.
+ */
+func (self *Brickdb) lockContext(ctx context.Context) error {
+	if self.journal == nil {
+		return ErrClosed
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	for {
+		err = index.LockDatabaseContext(ctx, self.idxFile, false)
+		if err != nil {
+			return err
+		}
+		obsolete, err := index.IsObsolete(self.idxFile)
+		if err == nil && !obsolete {
+			self.setContext(ctx)
+			return nil
+		}
+		index.UnlockDatabase(self.idxFile)
+		if err != nil {
+			return err
+		}
+		err = self.reopen()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (self *Brickdb) unlock() error {
+	self.setContext(nil)
+	return index.UnlockDatabase(self.idxFile)
+}
+
+/**
+ * Bound the lock waits of the index by ctx, nil makes them wait for as long
+ * as it takes
+ */
+func (self *Brickdb) setContext(ctx context.Context) {
+	if ctxIndex, ok := self.index.(index.ContextIndex); ok {
+		ctxIndex.SetContext(ctx)
+	}
+}
+
+/**
+ * Opening the database first finishes a compaction which crashed while it
+ * swapped the files, see index.RecoverCompaction
+ */
 func (self *Brickdb) Open() error {
+	err := index.RecoverCompaction(self.name)
+	if err != nil {
+		return err
+	}
 	indexFileName := self.name + ".idx"
 	finfo, err := os.Stat(indexFileName)
-	exists := false
-	if os.IsNotExist(err) {
-		exists = false
-	}
-	if exists {
-		exists = !finfo.IsDir()
-	}
-	if exists {
-		indexType, err := getIndexType(self.name)
+	exists := err == nil && !finfo.IsDir()
+	if exists && finfo.Size() > 0 {
+		indexType, err := getIndexType(indexFileName)
 		if err != nil {
 			return err
 		}
 		self.indexType = indexType
-		return self.openIndex(os.O_RDWR)
+		err = self.openIndex(os.O_RDWR)
 	} else {
-		return self.create()
+		err = self.create()
+	}
+	if err != nil {
+		return err
+	}
+	self.versions, err = openVersionLog(self.name)
+	if err == nil {
+		err = self.openJournal()
+		if err != nil {
+			self.versions.close()
+		}
+	}
+	if err != nil {
+		self.index.Close()
+		self.idxFile.Close()
+		return err
 	}
-
 	return nil
 }
 
-func getIndexType(idxFileName string) (index.IndexType, error) {
-	f, err := os.OpenFile(idxFileName, os.O_RDONLY, 0644)
+/**
+ * The LSM tree and Bitcask indexes append every write to a log of their
+ * own, the other indexes log their operations to the journal. Operations a
+ * crash left unfinished are replayed right away.
+ */
+func (self *Brickdb) openJournal() error {
+	self.logOps = self.indexType != index.LSMIndexType && self.indexType != index.BitcaskIndexType
+	var err error
+	self.journal, err = openJournal(self.name)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	buf := make([]byte, 3)
-	bytesRead, err := f.Read(buf)
-	if err != nil {
-		return 0, err
+	err = self.lock()
+	if err == nil {
+		err = self.journal.checkpoint(self.redo, self.sync)
+		self.unlock()
 	}
-	if bytesRead != 3 {
-		return 0, fmt.Errorf("Failed to get index type")
+	if err != nil {
+		self.journal.close()
+		self.journal = nil
 	}
-	idxType, err := strconv.ParseInt(string(buf), 10, 64)
+	return err
+}
+
+func getIndexType(idxFileName string) (index.IndexType, error) {
+	idxType, version, err := index.ReadFileHeader(idxFileName)
 	if err != nil {
 		return 0, err
 	}
-	if idxType == int64(index.HashIndexType) {
-		return index.HashIndexType, nil
-	} else if idxType == int64(index.LinearHashIndexType) {
-		return index.LinearHashIndexType, nil
-	} else {
+	switch idxType {
+	case index.HashIndexType, index.LinearHashIndexType, index.BTreeIndexType, index.LSMIndexType, index.BitcaskIndexType,
+		index.ExtendibleHashIndexType:
+	default:
 		return 0, fmt.Errorf("Invalid index type number %d", idxType)
 	}
+	if version == index.LegacyFormatVersion {
+		return 0, fmt.Errorf("%s: %w", idxFileName, ErrLegacyFormat)
+	}
+	return idxType, nil
+}
+
+/**
+ * Convert a database created with the legacy ASCII format to the current
+ * binary format. The old files are kept with a ".v1" suffix added to the name.
+ */
+func Upgrade(name string) error {
+	return index.Upgrade(name)
+}
+
+/**
+ * Check the consistency of a database, see index.Verify. Handles of the
+ * database wait while the check runs.
+ */
+func Verify(name string) (*index.VerifyReport, error) {
+	return index.Verify(name)
+}
+
+/**
+ * Rebuild a damaged database from the records which are still intact, see
+ * index.Repair. The damaged files are kept with a ".damaged" suffix added to
+ * the name. Handles of the database switch to the repaired files with their
+ * next operation.
+ */
+func Repair(name string) (*index.RepairReport, error) {
+	return index.Repair(name)
+}
+
+func (self *Brickdb) Name() string {
+	return self.name
 }
 
 func (self *Brickdb) Close() error {
-	return self.index.Close()
+	if self.journal == nil {
+		return ErrClosed
+	}
+	err := self.index.Close()
+	self.idxFile.Close()
+	self.journal.close()
+	self.journal = nil
+	self.versions.close()
+	return err
+}
+
+/**
+ * Rewrite the database without the space taken up by deleted and overwritten
+ * records. Other handles, in this process or others, keep working while the
+ * records are copied, wait while the writes they made meanwhile are copied
+ * too and the files are swapped, and switch to the new files with their
+ * next operation. Returns the number of bytes reclaimed.
+ */
+func (self *Brickdb) Compact() (int64, error) {
+	if self.journal == nil {
+		return 0, ErrClosed
+	}
+	if !self.logOps {
+		return index.Compact(self.name)
+	}
+	return index.CompactWithLog(self.name, &compactionLog{name: self.name})
 }
 
 func (self *Brickdb) Fetch(key string) (string, error) {
+	return self.FetchContext(context.Background(), key)
+}
+
+/**
+ * The Context variants of the operations give up once ctx is done, if they
+ * are still waiting for a lock held by another handle they return a
+ * *LockWaitError, which matches ErrLocked and the error of the context
+ * with errors.Is. A write gives up only before it has changed anything.
+ */
+func (self *Brickdb) FetchContext(ctx context.Context, key string) (string, error) {
+	err := self.lockContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer self.unlock()
 	return self.index.Fetch(key)
 }
 
+/**
+ * Fetch the value of a key which can contain arbitrary bytes. Returns nil if
+ * the key does not exist, Fetch returns ErrNotFound.
+ */
+func (self *Brickdb) FetchBytes(key []byte) ([]byte, error) {
+	return self.FetchBytesContext(context.Background(), key)
+}
+
+func (self *Brickdb) FetchBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	err := self.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer self.unlock()
+	return self.index.FetchBytes(key)
+}
+
 func (self *Brickdb) Delete(key string) error {
-	return self.index.Delete(key)
+	return self.DeleteBytesContext(context.Background(), []byte(key))
+}
+
+func (self *Brickdb) DeleteContext(ctx context.Context, key string) error {
+	return self.DeleteBytesContext(ctx, []byte(key))
+}
+
+func (self *Brickdb) DeleteBytes(key []byte) error {
+	return self.DeleteBytesContext(context.Background(), key)
+}
+
+func (self *Brickdb) DeleteBytesContext(ctx context.Context, key []byte) error {
+	return self.write(ctx, journal_delete, key, nil)
 }
 
 func (self *Brickdb) Store(key string, value string, storeOp StoreOp) error {
+	return self.StoreBytesContext(context.Background(), []byte(key), []byte(value), storeOp)
+}
+
+func (self *Brickdb) StoreContext(ctx context.Context, key string, value string, storeOp StoreOp) error {
+	return self.StoreBytesContext(ctx, []byte(key), []byte(value), storeOp)
+}
+
+/**
+ * Store a key and value which can contain arbitrary bytes, including the
+ * newlines and separators which are not safe to use with the string API
+ */
+func (self *Brickdb) StoreBytes(key []byte, value []byte, storeOp StoreOp) error {
+	return self.StoreBytesContext(context.Background(), key, value, storeOp)
+}
+
+func (self *Brickdb) StoreBytesContext(ctx context.Context, key []byte, value []byte, storeOp StoreOp) error {
 	switch storeOp {
 	case Insert:
-		return self.index.Insert(key, value)
+		return self.write(ctx, journal_insert, key, value)
 	case Update:
-		return self.index.Update(key, value)
+		return self.write(ctx, journal_update, key, value)
 	case Upsert:
-		return self.index.Upsert(key, value)
+		return self.write(ctx, journal_upsert, key, value)
 	default:
 		return fmt.Errorf("Unsupported storeOp value: %v", storeOp)
 	}
 }
 
+/**
+ * Lock the key and log the operation, apply it and mark it done, see
+ * logAndApply. The LSM tree and Bitcask indexes lock the key too, the
+ * transactions which use the key wait for the write to finish.
+ */
+func (self *Brickdb) write(ctx context.Context, op byte, key []byte, value []byte) error {
+	err := self.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer self.unlock()
+	locks, err := self.journal.lockKeys(ctx, [][]byte{key}, nil)
+	if err != nil {
+		return err
+	}
+	err = self.recordVersions([][]byte{key})
+	if err == nil {
+		err = self.logAndApply(op, key, value)
+	}
+	self.journal.unlockKeys(locks)
+	if err != nil {
+		self.replayPending()
+		return err
+	}
+	return self.checkpointIfFull()
+}
+
+/**
+ * Log the operation to the journal, apply it to the index and mark it done,
+ * the keys of the operation have to be locked. If the handle syncs its
+ * writes, the journal record is on disk before the index is touched and the
+ * index is on disk before the operation is marked done, a done mark flushed
+ * ahead of the index would keep the replay from redoing a write lost with
+ * the index pages. Single operations on the LSM tree and Bitcask indexes
+ * are not logged, batches are.
+ *
+ * An operation which failed without changing the index is marked
+ * cancelled. One which failed part way is left pending for the replay to
+ * finish, see replayPending.
+ */
+func (self *Brickdb) logAndApply(op byte, key []byte, value []byte) error {
+	if !self.logOps && op != journal_batch {
+		err := self.apply(op, key, value)
+		if err != nil {
+			return err
+		}
+		return self.waitApplied()
+	}
+	recoff, seq, err := self.journal.log(op, key, value)
+	if err != nil {
+		return err
+	}
+	if self.opts.Sync != SyncNone {
+		err = self.journal.waitDurable(seq, self.syncInterval(), self.flush)
+		if err != nil {
+			self.journal.cancel(recoff)
+			return err
+		}
+	}
+	err = self.apply(op, key, value)
+	if err == nil {
+		err = self.waitApplied()
+		if err != nil {
+			/* applied but maybe not on disk, the replay redoes it */
+			self.pending = true
+			return err
+		}
+		return self.journal.done(recoff)
+	}
+	if unchanged(err) {
+		self.journal.cancel(recoff)
+	} else {
+		self.pending = true
+	}
+	return err
+}
+
+/**
+ * Whether a failed operation left the index untouched. The indexes check
+ * the keys and sizes before they write anything, and only give up waiting
+ * for the locks they take before they write anything.
+ */
+func unchanged(err error) bool {
+	return errors.Is(err, ErrKeyExists) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrEmptyKey) ||
+		errors.Is(err, ErrKeyTooLarge) || errors.Is(err, ErrValueTooLarge) || errors.Is(err, ErrLocked)
+}
+
+/**
+ * Replay the write which logAndApply left pending, right away rather than
+ * on the next checkpoint, after later writes of the same keys. Must be
+ * called with the keys unlocked. If the replay fails too, the write is left
+ * for the next checkpoint or Open.
+ */
+func (self *Brickdb) replayPending() {
+	if !self.pending {
+		return
+	}
+	self.pending = false
+	self.setContext(nil)
+	self.journal.checkpoint(self.redo, self.sync)
+}
+
+/**
+ * Empty the journal once it has grown past journal_checkpoint_size, must be
+ * called without any key locked. The write is done by then, the checkpoint
+ * does not give up with its context.
+ */
+func (self *Brickdb) checkpointIfFull() error {
+	self.setContext(nil)
+	size, err := self.journal.size()
+	if err != nil || size < journal_checkpoint_size {
+		return err
+	}
+	return self.journal.checkpoint(self.redo, self.sync)
+}
+
+/**
+ * Wait until the index writes of the operation just applied are on disk, if
+ * the handle syncs its writes. The wait is counted as a write of its own,
+ * so only a flush which starts after the operation covers it.
+ */
+func (self *Brickdb) waitApplied() error {
+	if self.opts.Sync == SyncNone {
+		return nil
+	}
+	seq, err := self.journal.count()
+	if err != nil {
+		return err
+	}
+	return self.journal.waitDurable(seq, self.syncInterval(), self.flush)
+}
+
+func (self *Brickdb) syncInterval() time.Duration {
+	switch self.opts.Sync {
+	case SyncAlways:
+		return 0
+	case SyncInterval:
+		if self.opts.SyncInterval == 0 {
+			return DefaultSyncInterval
+		}
+		return self.opts.SyncInterval
+	default:
+		return 0
+	}
+}
+
+func (self *Brickdb) apply(op byte, key []byte, value []byte) error {
+	if op == journal_batch {
+		return self.applyBatch(value)
+	}
+	return applyOp(self.index, op, key, value)
+}
+
+func applyOp(idx index.BrickIndex, op byte, key []byte, value []byte) error {
+	switch op {
+	case journal_insert:
+		return idx.StoreBytes(key, value, index.Insert)
+	case journal_update:
+		return idx.StoreBytes(key, value, index.Update)
+	case journal_upsert:
+		return idx.StoreBytes(key, value, index.Upsert)
+	case journal_delete:
+		return idx.DeleteBytes(key)
+	default:
+		return fmt.Errorf("Invalid journal operation %d", op)
+	}
+}
+
+/**
+ * Apply an operation replayed from the journal, after recording the versions
+ * the snapshots need, see redoOp
+ */
+func (self *Brickdb) redo(op byte, key []byte, value []byte) error {
+	if op == journal_batch {
+		ops, err := decodeBatch(value)
+		if err != nil {
+			return err
+		}
+		for _, batchOp := range ops {
+			err = self.redo(batchOp.op, batchOp.key, batchOp.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := self.recordVersions([][]byte{key})
+	if err != nil {
+		return err
+	}
+	return redoOp(self.index, op, key, value)
+}
+
+/**
+ * Apply an operation replayed from the journal to idx. The operation may
+ * have been applied already, an insert of a key which is there and an
+ * update of one which is not are left alone.
+ */
+func redoOp(idx index.BrickIndex, op byte, key []byte, value []byte) error {
+	if op == journal_batch {
+		ops, err := decodeBatch(value)
+		if err != nil {
+			return err
+		}
+		for _, batchOp := range ops {
+			err = redoOp(idx, batchOp.op, batchOp.key, batchOp.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if op == journal_insert || op == journal_update {
+		current, err := idx.FetchBytes(key)
+		if err != nil {
+			return err
+		}
+		if (current == nil) != (op == journal_insert) {
+			return nil
+		}
+	}
+	return applyOp(idx, op, key, value)
+}
+
+/**
+ * Apply the operations of a batch, with a single call if the index supports
+ * it. Otherwise if one of them fails the ones already applied are undone,
+ * as far as the undo gets, the journal record of the batch stays pending
+ * and replaying it applies the whole batch.
+ */
+func (self *Brickdb) applyBatch(buf []byte) error {
+	ops, err := decodeBatch(buf)
+	if err != nil {
+		return err
+	}
+	if batchIndex, ok := self.index.(index.BatchIndex); ok {
+		indexOps := make([]index.BatchOp, len(ops))
+		for i, op := range ops {
+			indexOps[i] = index.BatchOp{Key: op.key, Value: op.value, Delete: op.op == journal_delete}
+		}
+		return batchIndex.WriteBatch(indexOps)
+	}
+	undo := make([]batchOp, 0, len(ops))
+	for _, op := range ops {
+		current, err := self.index.FetchBytes(op.key)
+		if err == nil {
+			err = self.apply(op.op, op.key, op.value)
+		}
+		if err != nil {
+			/* the undo can't give up halfway */
+			self.setContext(nil)
+			for i := len(undo) - 1; i >= 0; i-- {
+				undoErr := self.apply(undo[i].op, undo[i].key, undo[i].value)
+				if undoErr != nil {
+					return fmt.Errorf("%v, and undoing the batch failed: %w", err, undoErr)
+				}
+			}
+			return err
+		}
+		if current == nil {
+			undo = append(undo, batchOp{op: journal_delete, key: op.key})
+		} else {
+			undo = append(undo, batchOp{op: journal_upsert, key: op.key, value: current})
+		}
+	}
+	return nil
+}
+
+func (self *Brickdb) sync() error {
+	return index.SyncDatabase(self.name, self.indexType)
+}
+
+/**
+ * Flush the journal and the index files, for waitDurable. Every handle
+ * flushes both, as the flush covers the writes of the other handles too,
+ * journal records as well as index writes.
+ */
+func (self *Brickdb) flush() error {
+	err := self.journal.sync()
+	if err != nil {
+		return err
+	}
+	return self.sync()
+}
+
 func (self *Brickdb) FetchAll() (map[string]string, error) {
+	return self.FetchAllContext(context.Background())
+}
+
+func (self *Brickdb) FetchAllContext(ctx context.Context) (map[string]string, error) {
+	err := self.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer self.unlock()
 	return self.index.FetchAll()
 }
+
+/**
+ * Call fn for every key in [start, end) in key order, a nil start or end
+ * leaves that side of the range open. Only supported by the B+tree index,
+ * fn must not modify the database.
+ */
+func (self *Brickdb) Range(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	err := self.lock()
+	if err != nil {
+		return err
+	}
+	defer self.unlock()
+	orderedIndex, ok := self.index.(index.OrderedIndex)
+	if !ok {
+		return fmt.Errorf("Index type %d does not support ordered access", self.indexType)
+	}
+	return orderedIndex.Range(start, end, fn)
+}
@@ -0,0 +1,200 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	db_test_name = "db_test_db"
+)
+
+/**
+ * The index types whose operations go through the journal
+ */
+var journaledIndexTypes = []index.IndexType{index.HashIndexType, index.LinearHashIndexType, index.BTreeIndexType,
+	index.ExtendibleHashIndexType}
+
+var allIndexTypes = []index.IndexType{index.HashIndexType, index.LinearHashIndexType, index.BTreeIndexType, index.LSMIndexType,
+	index.BitcaskIndexType, index.ExtendibleHashIndexType}
+
+/**
+ * The index types which support iterators and scans
+ */
+var scannableIndexTypes = []index.IndexType{index.HashIndexType, index.LinearHashIndexType, index.ExtendibleHashIndexType}
+
+/**
+ * Run test as a subtest for each of the index types
+ */
+func forEachIndexType(t *testing.T, idxTypes []index.IndexType, test func(t *testing.T, idxType index.IndexType)) {
+	for _, idxType := range idxTypes {
+		idxType := idxType
+		t.Run(fmt.Sprintf("type%d", idxType), func(t *testing.T) {
+			test(t, idxType)
+		})
+	}
+}
+
+/**
+ * Create a test database in place of the one left behind by an earlier
+ * run if any. Its files are removed once the test is done, closing the
+ * handle is up to the test.
+ */
+func openNewDB(t *testing.T, name string, idxType index.IndexType, opts Options) *Brickdb {
+	removeDB(name)
+	t.Cleanup(func() { removeDB(name) })
+	return openDB(t, name, idxType, opts)
+}
+
+func openDB(t *testing.T, name string, idxType index.IndexType, opts Options) *Brickdb {
+	db := NewWithOptions(name, idxType, opts)
+	err := db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+/**
+ * Remove the files of a test database, whatever its index type
+ */
+func removeDB(name string) {
+	files, _ := filepath.Glob(name + ".*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+/**
+ * Check the values of the keys, an empty value stands for a missing key
+ */
+func expectValues(t *testing.T, db *Brickdb, expected map[string]string) {
+	t.Helper()
+	for key, value := range expected {
+		val, err := db.FetchBytes([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val == nil && value != "" {
+			t.Errorf("Expected value %q for key %s, the key is missing", value, key)
+		} else if string(val) != value {
+			t.Errorf("Expected value %q for key %s, got %q", value, key, val)
+		}
+	}
+}
+
+/**
+ * Store nrecords records keyN with the value valueN
+ */
+func storeRecords(t *testing.T, db *Brickdb, nrecords int) map[string]string {
+	records := make(map[string]string)
+	for i := 0; i < nrecords; i++ {
+		key := fmt.Sprintf("key%d", i)
+		records[key] = fmt.Sprintf("value%d", i)
+		err := db.Store(key, records[key], Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return records
+}
+
+func TestSyncModes(t *testing.T) {
+	for _, mode := range []SyncMode{SyncNone, SyncInterval, SyncAlways} {
+		for _, idxType := range []index.IndexType{index.LinearHashIndexType, index.BitcaskIndexType} {
+			t.Run(fmt.Sprintf("mode%d/type%d", mode, idxType), func(t *testing.T) {
+				testSyncMode(t, mode, idxType)
+			})
+		}
+	}
+}
+
+/**
+ * Two handles write at the same time. With SyncInterval and SyncAlways
+ * every write has been flushed by the time it returns, whichever handle
+ * did the flush, with SyncNone nothing waits for a flush. A logged write
+ * waits twice, for its journal record and for its index writes.
+ */
+func testSyncMode(t *testing.T, mode SyncMode, idxType index.IndexType) {
+	opts := Options{Sync: mode, SyncInterval: time.Millisecond}
+	db := openNewDB(t, db_test_name, idxType, opts)
+	defer db.Close()
+	other := openDB(t, db_test_name, idxType, opts)
+	defer other.Close()
+
+	var wg sync.WaitGroup
+	nrecords := 50
+	for i, h := range []*Brickdb{db, other} {
+		wg.Add(1)
+		go func(id int, h *Brickdb) {
+			defer wg.Done()
+			for j := 0; j < nrecords; j++ {
+				err := h.Store(fmt.Sprintf("key_%d_%d", id, j), "value", Insert)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, h)
+	}
+	wg.Wait()
+
+	written, err := db.journal.readCount(journal_written_off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := db.journal.readCount(journal_synced_off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waits := int64(2 * nrecords)
+	if db.logOps {
+		waits *= 2
+	}
+	if mode == SyncNone {
+		if synced != 0 {
+			t.Errorf("Expected no writes to wait for a flush, %d did", synced)
+		}
+	} else if written != waits || synced != written {
+		t.Errorf("Expected %d waits flushed, %d of %d were", waits, synced, written)
+	}
+	records, err := other.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2*nrecords {
+		t.Errorf("Expected %d records, got %d", 2*nrecords, len(records))
+	}
+}
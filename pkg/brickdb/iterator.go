@@ -0,0 +1,156 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"fmt"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const iterator_page_size = 128
+
+/**
+ * Streams the records of the database a page at a time, instead of reading
+ * them all into memory like FetchAll. No lock is held between the pages,
+ * the writers keep going while the iterator is open. A record which is in
+ * the database for the whole iteration is returned exactly once, records
+ * stored or deleted meanwhile may or may not be. Only supported by the
+ * static, linear and extendible hash indexes.
+ *
+ *	it := db.NewIterator()
+ *	defer it.Close()
+ *	for it.Next() {
+ *		fmt.Printf("%s: %s\n", it.Key(), it.Value())
+ *	}
+ *	if it.Err() != nil {
+ *		...
+ *	}
+ */
+type Iterator struct {
+	db       *Brickdb
+	keysOnly bool
+	cursor   []byte // where the next page starts, nil once the last one is read
+	started  bool
+	keys     [][]byte
+	values   [][]byte
+	pos      int
+	err      error
+}
+
+func (self *Brickdb) NewIterator() *Iterator {
+	return &Iterator{db: self, pos: -1}
+}
+
+/**
+ * An iterator over the keys alone, the values are not read
+ */
+func (self *Brickdb) NewKeyIterator() *Iterator {
+	return &Iterator{db: self, keysOnly: true, pos: -1}
+}
+
+/**
+ * Move to the next record, returns false at the end or on an error
+ */
+func (self *Iterator) Next() bool {
+	if self.err != nil {
+		return false
+	}
+	for self.pos+1 >= len(self.keys) {
+		if self.started && self.cursor == nil {
+			return false
+		}
+		self.err = self.readPage()
+		if self.err != nil {
+			return false
+		}
+	}
+	self.pos++
+	return true
+}
+
+func (self *Iterator) readPage() error {
+	if self.db == nil {
+		return ErrClosed
+	}
+	err := self.db.lock()
+	if err != nil {
+		return err
+	}
+	defer self.db.unlock()
+	scanner, ok := self.db.index.(index.ScannableIndex)
+	if !ok {
+		return fmt.Errorf("Index type %d does not support iteration", self.db.indexType)
+	}
+	self.keys = self.keys[:0]
+	self.values = self.values[:0]
+	self.pos = -1
+	self.cursor, err = scanner.Scan(self.cursor, iterator_page_size, self.keysOnly, func(key []byte, value []byte) error {
+		self.keys = append(self.keys, key)
+		self.values = append(self.values, value)
+		return nil
+	})
+	self.started = true
+	return err
+}
+
+/**
+ * The key of the current record, valid until the next call to Next
+ */
+func (self *Iterator) Key() []byte {
+	if self.pos < 0 || self.pos >= len(self.keys) {
+		return nil
+	}
+	return self.keys[self.pos]
+}
+
+/**
+ * The value of the current record, nil for a key iterator
+ */
+func (self *Iterator) Value() []byte {
+	if self.pos < 0 || self.pos >= len(self.values) {
+		return nil
+	}
+	return self.values[self.pos]
+}
+
+func (self *Iterator) Err() error {
+	return self.err
+}
+
+/**
+ * Release the pages read, Next fails with ErrClosed afterwards
+ */
+func (self *Iterator) Close() error {
+	self.db = nil
+	self.cursor = nil
+	self.started = false
+	self.keys = nil
+	self.values = nil
+	self.pos = -1
+	return nil
+}
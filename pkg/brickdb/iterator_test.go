@@ -0,0 +1,180 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	iterator_test_db_name = "iterator_test_db"
+)
+
+func TestIterator(t *testing.T) {
+	forEachIndexType(t, scannableIndexTypes, testIterator)
+}
+
+/**
+ * The iterators return every record once, over several pages, the key
+ * iterator without the values
+ */
+func testIterator(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, iterator_test_db_name, idxType, Options{})
+	defer db.Close()
+	records := storeRecords(t, db, 3*iterator_page_size+10)
+
+	seen := make(map[string]string)
+	it := db.NewIterator()
+	for it.Next() {
+		key := string(it.Key())
+		if _, ok := seen[key]; ok {
+			t.Errorf("Key %s returned twice", key)
+		}
+		seen[key] = string(it.Value())
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if it.Next() {
+		t.Errorf("Expected Next to keep returning false at the end")
+	}
+	it.Close()
+	if len(seen) != len(records) {
+		t.Errorf("Expected %d records, got %d", len(records), len(seen))
+	}
+	for key, value := range records {
+		if seen[key] != value {
+			t.Errorf("Expected value %q for key %s, got %q", value, key, seen[key])
+		}
+	}
+
+	count := 0
+	it = db.NewKeyIterator()
+	for it.Next() {
+		if _, ok := records[string(it.Key())]; !ok {
+			t.Errorf("Unexpected key %s", it.Key())
+		}
+		if it.Value() != nil {
+			t.Errorf("Expected no value from a key iterator, got %q", it.Value())
+		}
+		count++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	it.Close()
+	if count != len(records) {
+		t.Errorf("Expected %d keys, got %d", len(records), count)
+	}
+}
+
+/**
+ * A closed iterator fails with ErrClosed, one over an index which can't be
+ * scanned with an error
+ */
+func TestIteratorErrors(t *testing.T) {
+	db := openNewDB(t, iterator_test_db_name, index.LinearHashIndexType, Options{})
+	storeRecords(t, db, 10)
+	it := db.NewIterator()
+	if !it.Next() {
+		t.Fatalf("Expected a record, got %v", it.Err())
+	}
+	it.Close()
+	if it.Next() || !errors.Is(it.Err(), ErrClosed) {
+		t.Errorf("Expected ErrClosed from a closed iterator, got %v", it.Err())
+	}
+	db.Close()
+
+	db = openNewDB(t, iterator_test_db_name, index.BTreeIndexType, Options{})
+	defer db.Close()
+	storeRecords(t, db, 10)
+	it = db.NewIterator()
+	defer it.Close()
+	if it.Next() || it.Err() == nil {
+		t.Errorf("Expected an error from an iterator over a B+tree")
+	}
+}
+
+/**
+ * The records which are in the database for the whole iteration are
+ * returned exactly once while another handle stores and deletes, splitting
+ * and merging the buckets between the pages
+ */
+func TestIteratorConcurrentWrites(t *testing.T) {
+	db := openNewDB(t, iterator_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	records := storeRecords(t, db, 3*iterator_page_size)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h := openDB(t, iterator_test_db_name, index.LinearHashIndexType, Options{})
+		defer h.Close()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			key := fmt.Sprintf("other%d", i%500)
+			err := h.Store(key, "value", Insert)
+			if errors.Is(err, ErrKeyExists) {
+				err = h.Delete(key)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		seen := make(map[string]int)
+		it := db.NewKeyIterator()
+		for it.Next() {
+			seen[string(it.Key())]++
+		}
+		if it.Err() != nil {
+			t.Error(it.Err())
+		}
+		it.Close()
+		for key := range records {
+			if seen[key] != 1 {
+				t.Errorf("Expected key %s once, got it %d times", key, seen[key])
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,588 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * Write-ahead journal of the stores and deletes, kept in <name>.journal. A
+ * store changes the index files with several writes, a crash in between
+ * leaves the database half way. Every store and delete is appended to the
+ * journal before it touches the index, and marked done once it has been
+ * applied. An operation which the index refused, or which gave up waiting
+ * for a lock, never changed the index and is marked cancelled instead. One
+ * which failed part way is left pending. Opening the database replays the
+ * pending operations, a record torn by the crash is dropped along with its
+ * operation, which never got to change the index.
+ *
+ * The journal is laid out as:
+ *	magic (4 bytes) | version (2 bytes) | unused (2 bytes) | written (8 bytes) | synced (8 bytes) | record | record | ...
+ * and a record as:
+ *	status (1 byte) | op (1 byte) | key length (4 bytes) | value length (4 bytes) | checksum (4 bytes) | key | value
+ * The checksum is the CRC32C of everything after the status, which is the
+ * only field written in place.
+ *
+ * Operations on the same key are ordered by a lock on the key, so replaying
+ * them in journal order gives the same result. The replay only inserts keys
+ * which are missing and only updates the ones which exist, an operation
+ * which had already been applied is not applied twice. The writes of a
+ * transaction are logged as a single batch record, a crash either drops
+ * them all with the torn record or replays them all.
+ *
+ * Once the journal grows past journal_checkpoint_size, the handle which
+ * notices waits for the operations in flight to finish, flushes the index
+ * files to disk and empties the journal. Not while a compaction holds the
+ * compaction lock though, it reads the operations done while it copied the
+ * database from the journal, see compactionLog.
+ *
+ * The written and synced fields of the header count the writes, and the
+ * writes flushed to disk, of the handles which wait for their writes to be
+ * durable. The handle which finds its write not flushed yet takes the sync
+ * lock and flushes for everyone whose write came before, the others wait
+ * on the lock and find their write flushed once they get it. With an
+ * interval set, the handle holding the lock waits that long before it
+ * flushes, so more writes make it into the same flush.
+ */
+const (
+	journal_name_ext        = ".journal"
+	journal_magic           = "BRKJ"
+	journal_version         = 1
+	journal_header_size     = 24
+	journal_written_off     = 8
+	journal_synced_off      = 16
+	journal_rec_header_size = 14 // status(1) + op(1) + keylen(4) + vallen(4) + crc(4)
+	journal_crc_off         = 10
+	journal_checkpoint_lock = 0       // held shared by every operation, exclusively by a checkpoint
+	journal_append_lock     = 1       // serializes the appends and the updates of the written count
+	journal_sync_lock       = 2       // held by the handle flushing the writes to disk
+	journal_compact_lock    = 3       // held shared by the compactions catching up from the journal
+	journal_key_lock_off    = 1 << 32 // locks of the keys, past the end of any journal
+	journal_key_locks       = 1024
+	journal_checkpoint_size = 4 << 20
+	batch_op_header_size    = 9 // op(1) + keylen(4) + vallen(4)
+)
+
+const (
+	journal_pending byte = iota
+	journal_done
+	journal_cancelled
+)
+
+const (
+	journal_insert byte = iota + 1
+	journal_update
+	journal_upsert
+	journal_delete
+	journal_batch // the value holds the operations of a transaction, see encodeBatch
+)
+
+var byteOrder = binary.LittleEndian
+
+var journalCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type journal struct {
+	file *os.File
+}
+
+func openJournal(name string) (*journal, error) {
+	f, err := os.OpenFile(name+journal_name_ext, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	self := &journal{file: f}
+	err = self.init()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+/**
+ * Write the header of a new journal, or check the one of an existing journal
+ */
+func (self *journal) init() error {
+	err := index.WriteLockW(self.file.Fd(), journal_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock(self.file.Fd(), journal_append_lock, io.SeekStart, 1)
+	header := make([]byte, journal_header_size)
+	copy(header, journal_magic)
+	byteOrder.PutUint16(header[4:], journal_version)
+	finfo, err := self.file.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.Size() == 0 {
+		_, err = self.file.WriteAt(header, 0)
+		return err
+	}
+	buf := make([]byte, journal_header_size)
+	_, err = self.file.ReadAt(buf, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to read journal header: %w", err)
+	}
+	if string(buf[:4]) != journal_magic || byteOrder.Uint16(buf[4:]) != journal_version {
+		return fmt.Errorf("Invalid journal header in %s", self.file.Name())
+	}
+	return nil
+}
+
+func (self *journal) close() error {
+	return self.file.Close()
+}
+
+func journalKeyLock(key []byte) int64 {
+	hasher := fnv.New32a()
+	hasher.Write(key)
+	return journal_key_lock_off + int64(hasher.Sum32()%journal_key_locks)
+}
+
+func encodeJournalRecord(op byte, key []byte, value []byte) []byte {
+	buf := make([]byte, journal_rec_header_size+len(key)+len(value))
+	buf[0] = journal_pending
+	buf[1] = op
+	byteOrder.PutUint32(buf[2:], uint32(len(key)))
+	byteOrder.PutUint32(buf[6:], uint32(len(value)))
+	copy(buf[journal_rec_header_size:], key)
+	copy(buf[journal_rec_header_size+len(key):], value)
+	byteOrder.PutUint32(buf[journal_crc_off:], journalRecordCrc(buf))
+	return buf
+}
+
+/**
+ * An operation of a batch record, the operations of a batch are applied
+ * together or not at all
+ */
+type batchOp struct {
+	op    byte
+	key   []byte
+	value []byte
+}
+
+/**
+ * Encode the operations of a batch as the value of its journal record, an
+ * operation is laid out as:
+ *	op (1 byte) | key length (4 bytes) | value length (4 bytes) | key | value
+ */
+func encodeBatch(ops []batchOp) []byte {
+	size := 0
+	for _, op := range ops {
+		size += batch_op_header_size + len(op.key) + len(op.value)
+	}
+	buf := make([]byte, 0, size)
+	for _, op := range ops {
+		hdrbuf := make([]byte, batch_op_header_size)
+		hdrbuf[0] = op.op
+		byteOrder.PutUint32(hdrbuf[1:], uint32(len(op.key)))
+		byteOrder.PutUint32(hdrbuf[5:], uint32(len(op.value)))
+		buf = append(buf, hdrbuf...)
+		buf = append(buf, op.key...)
+		buf = append(buf, op.value...)
+	}
+	return buf
+}
+
+func decodeBatch(buf []byte) ([]batchOp, error) {
+	var ops []batchOp
+	for off := 0; off < len(buf); {
+		if off+batch_op_header_size > len(buf) {
+			return nil, fmt.Errorf("Truncated batch operation: %w", ErrCorrupt)
+		}
+		keylen := int(byteOrder.Uint32(buf[off+1:]))
+		vallen := int(byteOrder.Uint32(buf[off+5:]))
+		end := off + batch_op_header_size + keylen + vallen
+		if end > len(buf) {
+			return nil, fmt.Errorf("Truncated batch operation: %w", ErrCorrupt)
+		}
+		key := buf[off+batch_op_header_size : off+batch_op_header_size+keylen]
+		ops = append(ops, batchOp{op: buf[off], key: key, value: buf[off+batch_op_header_size+keylen : end]})
+		off = end
+	}
+	return ops, nil
+}
+
+func journalRecordCrc(buf []byte) uint32 {
+	crc := crc32.Update(0, journalCrcTable, buf[1:journal_crc_off])
+	return crc32.Update(crc, journalCrcTable, buf[journal_rec_header_size:])
+}
+
+/**
+ * Lock the keys an operation writes and the keys it reads, and hold off the
+ * checkpoints until unlockKeys. A key which is both read and written is
+ * locked for writing. The locks are taken in the order of their offsets,
+ * operations locking several keys can wait on each other but never in a
+ * cycle. The waits give up once ctx is done. Returns the offsets of the
+ * locks taken.
+ */
+func (self *journal) lockKeys(ctx context.Context, writeKeys [][]byte, readKeys [][]byte) ([]int64, error) {
+	fd := self.file.Fd()
+	err := index.ReadLockContext(ctx, fd, journal_checkpoint_lock, io.SeekStart, 1)
+	if err != nil {
+		return nil, err
+	}
+	exclusive := make(map[int64]bool)
+	for _, key := range readKeys {
+		exclusive[journalKeyLock(key)] = false
+	}
+	for _, key := range writeKeys {
+		exclusive[journalKeyLock(key)] = true
+	}
+	locks := make([]int64, 0, len(exclusive))
+	for lock := range exclusive {
+		locks = append(locks, lock)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i] < locks[j] })
+	for i, lock := range locks {
+		if exclusive[lock] {
+			err = index.WriteLockContext(ctx, fd, lock, io.SeekStart, 1)
+		} else {
+			err = index.ReadLockContext(ctx, fd, lock, io.SeekStart, 1)
+		}
+		if err != nil {
+			self.unlockKeys(locks[:i])
+			return nil, err
+		}
+	}
+	return locks, nil
+}
+
+/**
+ * Wait for the operations in flight to finish and hold off the new ones
+ */
+func (self *journal) lockCheckpoint() error {
+	return index.WriteLockW(self.file.Fd(), journal_checkpoint_lock, io.SeekStart, 1)
+}
+
+func (self *journal) unlockCheckpoint() error {
+	return index.Unlock(self.file.Fd(), journal_checkpoint_lock, io.SeekStart, 1)
+}
+
+func (self *journal) unlockKeys(locks []int64) {
+	fd := self.file.Fd()
+	for _, lock := range locks {
+		index.Unlock(fd, lock, io.SeekStart, 1)
+	}
+	index.Unlock(fd, journal_checkpoint_lock, io.SeekStart, 1)
+}
+
+/**
+ * Append the operation to the journal, returns the offset of its record and
+ * the number of the write to wait for with waitDurable. The keys of the
+ * operation must be locked with lockKeys.
+ */
+func (self *journal) log(op byte, key []byte, value []byte) (int64, int64, error) {
+	return self.append(encodeJournalRecord(op, key, value))
+}
+
+/**
+ * Append the record, if any, and count the write
+ */
+func (self *journal) append(record []byte) (int64, int64, error) {
+	err := index.WriteLockW(self.file.Fd(), journal_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return -1, 0, err
+	}
+	defer index.Unlock(self.file.Fd(), journal_append_lock, io.SeekStart, 1)
+	recoff, err := self.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1, 0, err
+	}
+	if record != nil {
+		bytesWritten, err := self.file.WriteAt(record, recoff)
+		if err != nil {
+			return -1, 0, err
+		}
+		if bytesWritten != len(record) {
+			return -1, 0, errors.New("Failed to write journal record")
+		}
+	}
+	seq, err := self.readCount(journal_written_off)
+	if err != nil {
+		return -1, 0, err
+	}
+	seq++
+	err = self.writeCount(journal_written_off, seq)
+	if err != nil {
+		return -1, 0, err
+	}
+	return recoff, seq, nil
+}
+
+/**
+ * Count a write which did not go through the journal, returns its number
+ */
+func (self *journal) count() (int64, error) {
+	_, seq, err := self.append(nil)
+	return seq, err
+}
+
+func (self *journal) readCount(offset int64) (int64, error) {
+	buf := make([]byte, 8)
+	_, err := self.file.ReadAt(buf, offset)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read journal header: %w", err)
+	}
+	return int64(byteOrder.Uint64(buf)), nil
+}
+
+func (self *journal) writeCount(offset int64, count int64) error {
+	buf := make([]byte, 8)
+	byteOrder.PutUint64(buf, uint64(count))
+	_, err := self.file.WriteAt(buf, offset)
+	return err
+}
+
+/**
+ * Wait until the write numbered seq is on disk, flushing it with sync if
+ * no other handle already did
+ */
+func (self *journal) waitDurable(seq int64, interval time.Duration, sync func() error) error {
+	fd := self.file.Fd()
+	err := index.WriteLockW(fd, journal_sync_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock(fd, journal_sync_lock, io.SeekStart, 1)
+	synced, err := self.readCount(journal_synced_off)
+	if err != nil || synced >= seq {
+		return err
+	}
+	time.Sleep(interval)
+	/* everything counted by now gets flushed along with our write */
+	err = index.ReadLockW(fd, journal_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	written, err := self.readCount(journal_written_off)
+	index.Unlock(fd, journal_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	err = sync()
+	if err != nil {
+		return err
+	}
+	return self.writeCount(journal_synced_off, written)
+}
+
+/**
+ * Flush the journal itself
+ */
+func (self *journal) sync() error {
+	return unix.Fdatasync(int(self.file.Fd()))
+}
+
+/**
+ * Mark the operation logged at recoff as applied
+ */
+func (self *journal) done(recoff int64) error {
+	_, err := self.file.WriteAt([]byte{journal_done}, recoff)
+	return err
+}
+
+/**
+ * Mark the operation logged at recoff as never applied, the replay leaves
+ * it alone
+ */
+func (self *journal) cancel(recoff int64) error {
+	_, err := self.file.WriteAt([]byte{journal_cancelled}, recoff)
+	return err
+}
+
+func (self *journal) size() (int64, error) {
+	finfo, err := self.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return finfo.Size(), nil
+}
+
+/**
+ * Replay the operations left pending by a crash, and empty the journal if
+ * it has grown past journal_checkpoint_size, anything was replayed or it
+ * ends with a torn record. The index files are flushed with sync before the
+ * journal is emptied.
+ */
+func (self *journal) checkpoint(redo func(op byte, key []byte, value []byte) error, sync func() error) error {
+	err := self.lockCheckpoint()
+	if err != nil {
+		return err
+	}
+	defer self.unlockCheckpoint()
+	replayed := 0
+	/* with the checkpoint lock held, every pending operation is one which crashed */
+	end, err := readRecords(self.file, journal_header_size, func(recoff int64, record []byte) error {
+		if record[0] != journal_pending {
+			return nil
+		}
+		op, key, value := decodeJournalRecord(record)
+		err := redo(op, key, value)
+		if err != nil {
+			return fmt.Errorf("Failed to replay journal record at offset %d: %w", recoff, err)
+		}
+		replayed++
+		return self.done(recoff)
+	})
+	if err != nil {
+		return err
+	}
+	/* records appended after a torn one would never be read, the torn one has to go */
+	size, err := self.size()
+	if err != nil || replayed == 0 && end == size && size < journal_checkpoint_size {
+		return err
+	}
+	compacting, err := index.IsLocked(self.file.Fd(), journal_compact_lock, io.SeekStart, 1)
+	if err != nil || compacting {
+		return err
+	}
+	err = sync()
+	if err != nil {
+		return err
+	}
+	return self.file.Truncate(journal_header_size)
+}
+
+/**
+ * Call fn for the intact records of the journal from offset from on, the
+ * ones whose checksum does not match are skipped. A record torn by a crash
+ * ends the journal. Returns the offset where the records end.
+ */
+func readRecords(file *os.File, from int64, fn func(recoff int64, record []byte) error) (int64, error) {
+	finfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := finfo.Size()
+	if from >= size {
+		return from, nil
+	}
+	buf := make([]byte, size-from)
+	_, err = file.ReadAt(buf, from)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	off := int64(0)
+	for off+journal_rec_header_size <= int64(len(buf)) {
+		keylen := int64(byteOrder.Uint32(buf[off+2:]))
+		vallen := int64(byteOrder.Uint32(buf[off+6:]))
+		end := off + journal_rec_header_size + keylen + vallen
+		if end > int64(len(buf)) {
+			break // torn by the crash, the operation never started
+		}
+		record := buf[off:end]
+		if journalRecordCrc(record) == byteOrder.Uint32(record[journal_crc_off:]) {
+			err = fn(from+off, record)
+			if err != nil {
+				return 0, err
+			}
+		}
+		off = end
+	}
+	return from + off, nil
+}
+
+func decodeJournalRecord(record []byte) (byte, []byte, []byte) {
+	keylen := journal_rec_header_size + int(byteOrder.Uint32(record[2:]))
+	return record[1], record[journal_rec_header_size:keylen], record[keylen:]
+}
+
+/**
+ * The index.ChangeLog of a compaction of the database. Start takes a shared
+ * lock on journal_compact_lock, which keeps the checkpoints from emptying
+ * the journal, and remembers where the operations not done yet begin. With
+ * the database locked no operation is in flight, the only pending ones are
+ * those which failed part way. CatchUp replays the operations done from
+ * there on onto the copy, the same way a crash is recovered from.
+ */
+type compactionLog struct {
+	name  string
+	file  *os.File // the journal, opened apart from the one of the handle so the lock is its own
+	start int64
+}
+
+func (self *compactionLog) Start() error {
+	var err error
+	self.file, err = os.OpenFile(self.name+journal_name_ext, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = index.ReadLockW(self.file.Fd(), journal_compact_lock, io.SeekStart, 1)
+	if err == nil {
+		first := int64(-1)
+		self.start, err = readRecords(self.file, journal_header_size, func(recoff int64, record []byte) error {
+			if record[0] == journal_pending && first < 0 {
+				first = recoff
+			}
+			return nil
+		})
+		if first >= 0 {
+			self.start = first
+		}
+	}
+	if err != nil {
+		self.file.Close()
+		self.file = nil
+	}
+	return err
+}
+
+func (self *compactionLog) CatchUp(dst index.BrickIndex) error {
+	_, err := readRecords(self.file, self.start, func(recoff int64, record []byte) error {
+		if record[0] != journal_done {
+			return nil
+		}
+		op, key, value := decodeJournalRecord(record)
+		return redoOp(dst, op, key, value)
+	})
+	return err
+}
+
+/**
+ * Closing the journal releases the lock
+ */
+func (self *compactionLog) Finish() {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+}
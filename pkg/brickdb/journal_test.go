@@ -0,0 +1,202 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	journal_test_db_name = "journal_test_db"
+)
+
+/**
+ * Log an operation the way logAndApply does and leave it pending, as if
+ * the process crashed before it was applied
+ */
+func logPending(t *testing.T, db *Brickdb, op byte, key string, value string) {
+	_, _, err := db.journal.log(op, []byte(key), []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+/**
+ * The status of every intact record of the journal, in journal order
+ */
+func journalStatuses(t *testing.T, db *Brickdb) []byte {
+	var statuses []byte
+	_, err := readRecords(db.journal.file, journal_header_size, func(recoff int64, record []byte) error {
+		statuses = append(statuses, record[0])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return statuses
+}
+
+func TestJournalReplay(t *testing.T) {
+	forEachIndexType(t, journaledIndexTypes, testJournalReplay)
+}
+
+/**
+ * Opening the database after a crash replays the operations left pending,
+ * an operation which had been applied before the crash is not applied
+ * again and the journal is emptied
+ */
+func testJournalReplay(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, journal_test_db_name, idxType, Options{})
+	for _, key := range []string{"k1", "k3"} {
+		err := db.Store(key, "v", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logPending(t, db, journal_upsert, "k2", "v2")
+	logPending(t, db, journal_insert, "k1", "applied already")
+	logPending(t, db, journal_update, "missing", "deleted already")
+	logPending(t, db, journal_delete, "k3", "")
+	logPending(t, db, journal_batch, "", string(encodeBatch([]batchOp{
+		{op: journal_insert, key: []byte("b1"), value: []byte("vb1")},
+		{op: journal_upsert, key: []byte("k1"), value: []byte("v1")},
+	})))
+	db.Close()
+
+	db = openDB(t, journal_test_db_name, idxType, Options{})
+	defer db.Close()
+	expectValues(t, db, map[string]string{"k1": "v1", "k2": "v2", "k3": "", "missing": "", "b1": "vb1"})
+	size, err := db.journal.size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != journal_header_size {
+		t.Errorf("Expected the journal to be emptied by the replay, its size is %d", size)
+	}
+}
+
+/**
+ * A record torn by a crash is dropped along with its operation, and the
+ * operations logged after the database is opened again still get replayed,
+ * even with nothing else to replay when it was opened
+ */
+func TestJournalTornRecord(t *testing.T) {
+	db := openNewDB(t, journal_test_db_name, index.HashIndexType, Options{})
+	err := db.Store("k1", "v1", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := encodeJournalRecord(journal_upsert, []byte("torn"), []byte("value"))
+	size, err := db.journal.size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.journal.file.WriteAt(record[:len(record)-3], size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDB(t, journal_test_db_name, index.HashIndexType, Options{})
+	expectValues(t, db, map[string]string{"k1": "v1", "torn": ""})
+	logPending(t, db, journal_upsert, "k2", "v2")
+	db.Close()
+
+	db = openDB(t, journal_test_db_name, index.HashIndexType, Options{})
+	defer db.Close()
+	expectValues(t, db, map[string]string{"k1": "v1", "k2": "v2", "torn": ""})
+}
+
+/**
+ * An operation which the index refused never changed it, it is marked
+ * cancelled and the replay leaves it alone
+ */
+func TestJournalCancelled(t *testing.T) {
+	db := openNewDB(t, journal_test_db_name, index.HashIndexType, Options{})
+	defer db.Close()
+	err := db.Store("k1", "v1", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Store("k1", "v2", Insert)
+	if !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	err = db.Store("k2", "v2", Update)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	statuses := journalStatuses(t, db)
+	expected := []byte{journal_done, journal_cancelled, journal_cancelled}
+	if string(statuses) != string(expected) {
+		t.Errorf("Expected journal records with status %v, got %v", expected, statuses)
+	}
+}
+
+/**
+ * An index which fails the stores after the first skip ones, like an index
+ * which ran out of disk space half way through
+ */
+type failingIndex struct {
+	index.BrickIndex
+	skip     int
+	failures int
+}
+
+var errInjected = errors.New("injected failure")
+
+func (self *failingIndex) StoreBytes(key []byte, value []byte, op index.StoreOp) error {
+	if self.skip > 0 {
+		self.skip--
+	} else if self.failures > 0 {
+		self.failures--
+		return errInjected
+	}
+	return self.BrickIndex.StoreBytes(key, value, op)
+}
+
+/**
+ * A write which failed part way is left pending, and replayed right away
+ */
+func TestJournalFailedApply(t *testing.T) {
+	db := openNewDB(t, journal_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	db.index = &failingIndex{BrickIndex: db.index, failures: 1}
+	err := db.Store("k1", "v1", Insert)
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("Expected the injected failure, got %v", err)
+	}
+	expectValues(t, db, map[string]string{"k1": "v1"})
+	for _, status := range journalStatuses(t, db) {
+		if status == journal_pending {
+			t.Errorf("Expected the failed write to be replayed")
+		}
+	}
+}
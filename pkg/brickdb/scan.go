@@ -0,0 +1,112 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+// returned by Scan for a cursor it did not hand out
+var ErrInvalidCursor = index.ErrInvalidCursor
+
+type Record struct {
+	Key   []byte
+	Value []byte
+}
+
+/**
+ * Read the database a page at a time, for example to serve it over several
+ * requests. Pass an empty cursor for the first page and the cursor returned
+ * with a page for the next one, an empty cursor is returned with the last
+ * page. A page has at least limit records, unless it is the last one, and
+ * can have a few more.
+ *
+ * The cursor is a position in the order of the hashes of the keys, not a
+ * place in the files, so it stays valid after the database is closed and
+ * opened again, compacted, or its hash table split or merged. Like the
+ * Redis SCAN command, a record which is in the database for the whole scan
+ * is returned, records stored or deleted meanwhile may or may not be. Unlike
+ * it, no record is ever returned twice. Only supported by the static,
+ * linear and extendible hash indexes.
+ */
+func (self *Brickdb) Scan(cursor string, limit int) ([]Record, string, error) {
+	return self.ScanContext(context.Background(), cursor, limit)
+}
+
+func (self *Brickdb) ScanContext(ctx context.Context, cursor string, limit int) ([]Record, string, error) {
+	err := self.lockContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer self.unlock()
+	scanner, ok := self.index.(index.ScannableIndex)
+	if !ok {
+		return nil, "", fmt.Errorf("Index type %d does not support scans", self.indexType)
+	}
+	var position []byte
+	if cursor != "" {
+		position, err = decodeCursor(cursor, self.indexType)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	var records []Record
+	position, err = scanner.Scan(position, limit, false, func(key []byte, value []byte) error {
+		records = append(records, Record{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if position == nil {
+		return records, "", nil
+	}
+	return records, encodeCursor(position, self.indexType), nil
+}
+
+/**
+ * The cursor handed out is the position in the index prefixed with the
+ * index type, so the cursor of another database type is refused
+ */
+func encodeCursor(position []byte, indexType index.IndexType) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{byte(indexType)}, position...))
+}
+
+func decodeCursor(cursor string, indexType index.IndexType) ([]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) < 1 || index.IndexType(buf[0]) != indexType {
+		return nil, ErrInvalidCursor
+	}
+	return buf[1:], nil
+}
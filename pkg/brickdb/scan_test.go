@@ -0,0 +1,132 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	scan_test_db_name = "scan_test_db"
+)
+
+func TestScan(t *testing.T) {
+	forEachIndexType(t, scannableIndexTypes, testScan)
+}
+
+/**
+ * Scanning a page at a time returns every record once, and a cursor keeps
+ * its place when the database is closed and opened again in between
+ */
+func testScan(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, scan_test_db_name, idxType, Options{})
+	records := storeRecords(t, db, 500)
+
+	seen := make(map[string]string)
+	cursor := ""
+	limit := 50
+	for npages := 0; ; npages++ {
+		if npages == 3 {
+			/* continue with the cursor in another handle */
+			db.Close()
+			db = openDB(t, scan_test_db_name, idxType, Options{})
+		}
+		page, next, err := db.Scan(cursor, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != "" && len(page) < limit {
+			t.Errorf("Expected at least %d records in a page before the last, got %d", limit, len(page))
+		}
+		for _, record := range page {
+			key := string(record.Key)
+			if _, ok := seen[key]; ok {
+				t.Errorf("Key %s returned twice", key)
+			}
+			seen[key] = string(record.Value)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	defer db.Close()
+	if len(seen) != len(records) {
+		t.Errorf("Expected %d records, got %d", len(records), len(seen))
+	}
+	for key, value := range records {
+		if seen[key] != value {
+			t.Errorf("Expected value %q for key %s, got %q", value, key, seen[key])
+		}
+	}
+
+	page, _, err := db.Scan("", 0)
+	if err != nil || len(page) == 0 {
+		t.Errorf("Expected a limit of 0 to return a record, got %d, %v", len(page), err)
+	}
+}
+
+/**
+ * A cursor which was not handed out by a scan of the same index type is
+ * refused, and so is a scan of an index which can't be scanned
+ */
+func TestScanInvalidCursor(t *testing.T) {
+	db := openNewDB(t, scan_test_db_name, index.LinearHashIndexType, Options{})
+	storeRecords(t, db, 100)
+	_, cursor, err := db.Scan("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position, err := decodeCursor(cursor, index.LinearHashIndexType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]string{
+		"not base64":       "!!!",
+		"empty position":   encodeCursor(nil, index.LinearHashIndexType),
+		"short position":   encodeCursor(position[:1], index.LinearHashIndexType),
+		"other index type": encodeCursor(position, index.HashIndexType),
+	}
+	for name, cursor := range invalid {
+		_, _, err = db.Scan(cursor, 10)
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("Expected ErrInvalidCursor for a cursor with %s, got %v", name, err)
+		}
+	}
+	db.Close()
+
+	db = openNewDB(t, scan_test_db_name, index.BTreeIndexType, Options{})
+	defer db.Close()
+	storeRecords(t, db, 10)
+	_, _, err = db.Scan("", 10)
+	if err == nil {
+		t.Errorf("Expected an error from a scan of a B+tree")
+	}
+}
@@ -0,0 +1,526 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+/**
+ * Versions of the keys kept for the snapshots, in <name>.versions. While a
+ * snapshot is open, every store and delete first appends the value the key
+ * had before it, its before-image, tagged with the number of the write. A
+ * snapshot remembers the last write number when it was taken, and reads a
+ * key as the before-image of the first write after that, or as the value in
+ * the index if the key has not been written since. The writes never wait
+ * for the snapshots, and a snapshot never sees half of a write, or half of
+ * a transaction, whose writes all share the same number.
+ *
+ * The file is laid out as:
+ *	magic (4 bytes) | version (2 bytes) | unused (2 bytes) | last write number (8 bytes) | record | record | ...
+ * and a record as:
+ *	write number (8 bytes) | found (1 byte) | key length (4 bytes) | value length (4 bytes) | key | value
+ * where found is 0 for a key which did not exist before the write.
+ *
+ * Every open snapshot read locks versions_live_lock with its own open file,
+ * a write only records the before-images when that lock is held by
+ * someone. Taking a snapshot waits for the writes in flight to finish, the
+ * ones which come after see the lock. The last snapshot to close empties the
+ * file.
+ */
+const (
+	versions_name_ext        = ".versions"
+	versions_magic           = "BRKV"
+	versions_version         = 1
+	versions_header_size     = 16
+	versions_seq_off         = 8
+	versions_rec_header_size = 17 // seq(8) + found(1) + keylen(4) + vallen(4)
+	versions_append_lock     = 0  // serializes the appends, read locked while the records are read
+	versions_live_lock       = 1  // read locked by every open snapshot
+)
+
+type version struct {
+	key   []byte
+	value []byte // nil if the key did not exist
+}
+
+type versionLog struct {
+	file *os.File
+}
+
+func openVersionLog(name string) (*versionLog, error) {
+	f, err := os.OpenFile(name+versions_name_ext, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	self := &versionLog{file: f}
+	err = self.init()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+/**
+ * Write the header of a new version log, or check the one of an existing log
+ */
+func (self *versionLog) init() error {
+	err := index.WriteLockW(self.file.Fd(), versions_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock(self.file.Fd(), versions_append_lock, io.SeekStart, 1)
+	finfo, err := self.file.Stat()
+	if err != nil {
+		return err
+	}
+	if finfo.Size() == 0 {
+		header := make([]byte, versions_header_size)
+		copy(header, versions_magic)
+		byteOrder.PutUint16(header[4:], versions_version)
+		_, err = self.file.WriteAt(header, 0)
+		return err
+	}
+	buf := make([]byte, versions_header_size)
+	_, err = self.file.ReadAt(buf, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to read version log header: %w", err)
+	}
+	if string(buf[:4]) != versions_magic || byteOrder.Uint16(buf[4:]) != versions_version {
+		return fmt.Errorf("Invalid version log header in %s", self.file.Name())
+	}
+	return nil
+}
+
+func (self *versionLog) close() error {
+	return self.file.Close()
+}
+
+/**
+ * Check whether any snapshot is open, in this process or others
+ */
+func (self *versionLog) live() (bool, error) {
+	return index.IsLocked(self.file.Fd(), versions_live_lock, io.SeekStart, 1)
+}
+
+func (self *versionLog) readSeq() (int64, error) {
+	buf := make([]byte, 8)
+	_, err := self.file.ReadAt(buf, versions_seq_off)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read version log header: %w", err)
+	}
+	return int64(byteOrder.Uint64(buf)), nil
+}
+
+/**
+ * Append the before-images of a write, all under the same write number
+ */
+func (self *versionLog) append(versions []version) error {
+	fd := self.file.Fd()
+	err := index.WriteLockW(fd, versions_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock(fd, versions_append_lock, io.SeekStart, 1)
+	seq, err := self.readSeq()
+	if err != nil {
+		return err
+	}
+	seq++
+	var buf []byte
+	for _, v := range versions {
+		hdrbuf := make([]byte, versions_rec_header_size)
+		byteOrder.PutUint64(hdrbuf[0:], uint64(seq))
+		if v.value != nil {
+			hdrbuf[8] = 1
+		}
+		byteOrder.PutUint32(hdrbuf[9:], uint32(len(v.key)))
+		byteOrder.PutUint32(hdrbuf[13:], uint32(len(v.value)))
+		buf = append(buf, hdrbuf...)
+		buf = append(buf, v.key...)
+		buf = append(buf, v.value...)
+	}
+	recoff, err := self.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	bytesWritten, err := self.file.WriteAt(buf, recoff)
+	if err != nil {
+		return err
+	}
+	if bytesWritten != len(buf) {
+		return errors.New("Failed to write version record")
+	}
+	seqbuf := make([]byte, 8)
+	byteOrder.PutUint64(seqbuf, uint64(seq))
+	_, err = self.file.WriteAt(seqbuf, versions_seq_off)
+	return err
+}
+
+/**
+ * Returns the last write number and the end of the records
+ */
+func (self *versionLog) position() (int64, int64, error) {
+	fd := self.file.Fd()
+	err := index.ReadLockW(fd, versions_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer index.Unlock(fd, versions_append_lock, io.SeekStart, 1)
+	seq, err := self.readSeq()
+	if err != nil {
+		return 0, 0, err
+	}
+	finfo, err := self.file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return seq, finfo.Size(), nil
+}
+
+/**
+ * Call fn for every record from offset to the end of the log, returns the
+ * offset of the end
+ */
+func (self *versionLog) readFrom(offset int64, fn func(seq int64, v version)) (int64, error) {
+	fd := self.file.Fd()
+	err := index.ReadLockW(fd, versions_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return offset, err
+	}
+	defer index.Unlock(fd, versions_append_lock, io.SeekStart, 1)
+	finfo, err := self.file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	size := finfo.Size()
+	if size <= offset {
+		return offset, nil
+	}
+	buf := make([]byte, size-offset)
+	_, err = self.file.ReadAt(buf, offset)
+	if err != nil {
+		return offset, err
+	}
+	for off := int64(0); off < int64(len(buf)); {
+		if off+versions_rec_header_size > int64(len(buf)) {
+			return offset, fmt.Errorf("Truncated version record at offset %d", offset+off)
+		}
+		seq := int64(byteOrder.Uint64(buf[off:]))
+		found := buf[off+8] == 1
+		keylen := int64(byteOrder.Uint32(buf[off+9:]))
+		vallen := int64(byteOrder.Uint32(buf[off+13:]))
+		end := off + versions_rec_header_size + keylen + vallen
+		if end > int64(len(buf)) {
+			return offset, fmt.Errorf("Truncated version record at offset %d", offset+off)
+		}
+		v := version{key: buf[off+versions_rec_header_size : off+versions_rec_header_size+keylen]}
+		if found {
+			v.value = buf[off+versions_rec_header_size+keylen : end]
+		}
+		fn(seq, v)
+		off = end
+	}
+	return size, nil
+}
+
+/**
+ * Drop all the records, the writes must be held off
+ */
+func (self *versionLog) truncate() error {
+	fd := self.file.Fd()
+	err := index.WriteLockW(fd, versions_append_lock, io.SeekStart, 1)
+	if err != nil {
+		return err
+	}
+	defer index.Unlock(fd, versions_append_lock, io.SeekStart, 1)
+	return self.file.Truncate(versions_header_size)
+}
+
+/**
+ * Record the values of the keys before a write changes them, if any snapshot
+ * is open. The keys have to be locked.
+ */
+func (self *Brickdb) recordVersions(keys [][]byte) error {
+	live, err := self.versions.live()
+	if err != nil || !live {
+		return err
+	}
+	versions := make([]version, 0, len(keys))
+	for _, key := range keys {
+		value, err := self.index.FetchBytes(key)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, version{key: key, value: value})
+	}
+	return self.versions.append(versions)
+}
+
+/**
+ * Empty the version log if no snapshot is left to read it
+ */
+func (self *Brickdb) dropVersions() error {
+	if self.journal == nil {
+		return ErrClosed
+	}
+	live, err := self.versions.live()
+	if err != nil || live {
+		return err
+	}
+	err = self.journal.lockCheckpoint()
+	if err != nil {
+		return err
+	}
+	defer self.journal.unlockCheckpoint()
+	/* a snapshot taken since waits for us with its lock held */
+	live, err = self.versions.live()
+	if err != nil || live {
+		return err
+	}
+	return self.versions.truncate()
+}
+
+/**
+ * A read-only view of the database as it was when the snapshot was taken.
+ * Reads through the snapshot don't block the writers, and the writers don't
+ * change what the snapshot sees. The values the snapshot needs are kept in
+ * the version log until it is closed, and in memory once it has read them,
+ * long lived snapshots of busy databases get expensive.
+ *
+ * A snapshot belongs to its handle and has to be closed before the handle.
+ */
+type Snapshot struct {
+	db       *Brickdb
+	versions *versionLog // opened for the snapshot alone, it holds the live lock
+	seq      int64       // the last write the snapshot sees
+	readoff  int64       // end of the version records read so far
+	before   map[string][]byte
+}
+
+/**
+ * Take a snapshot of the database, it has to be closed with Close
+ */
+func (self *Brickdb) Snapshot() (*Snapshot, error) {
+	if self.journal == nil {
+		return nil, ErrClosed
+	}
+	versions := &versionLog{}
+	var err error
+	versions.file, err = os.OpenFile(self.name+versions_name_ext, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = index.ReadLockW(versions.file.Fd(), versions_live_lock, io.SeekStart, 1)
+	if err != nil {
+		versions.close()
+		return nil, err
+	}
+	/* every write which comes after this sees the live lock */
+	err = self.journal.lockCheckpoint()
+	if err != nil {
+		versions.close()
+		return nil, err
+	}
+	seq, readoff, err := versions.position()
+	self.journal.unlockCheckpoint()
+	if err != nil {
+		versions.close()
+		return nil, err
+	}
+	return &Snapshot{db: self, versions: versions, seq: seq, readoff: readoff, before: make(map[string][]byte)}, nil
+}
+
+/**
+ * Read the before-images recorded since the last call, the first one of a
+ * key after the snapshot is its value in the snapshot
+ */
+func (self *Snapshot) catchUp() error {
+	if self.versions == nil {
+		return ErrClosed
+	}
+	var err error
+	self.readoff, err = self.versions.readFrom(self.readoff, func(seq int64, v version) {
+		if seq <= self.seq {
+			return
+		}
+		if _, ok := self.before[string(v.key)]; !ok {
+			value := v.value
+			if value != nil {
+				value = append([]byte{}, value...)
+			}
+			self.before[string(v.key)] = value
+		}
+	})
+	return err
+}
+
+func (self *Snapshot) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return index.FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value the key had when the snapshot was taken, returns nil if
+ * it did not exist
+ */
+func (self *Snapshot) FetchBytes(key []byte) ([]byte, error) {
+	err := self.db.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer self.db.unlock()
+	/* the before-image is recorded before the index changes, read it after */
+	current, err := self.db.index.FetchBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	err = self.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	if val, ok := self.before[string(key)]; ok {
+		return val, nil
+	}
+	return current, nil
+}
+
+/**
+ * Fetch all the records as they were when the snapshot was taken. The hash
+ * indexes are read a chain at a time, the writers only wait for the chain
+ * being read. A record written meanwhile may be read with its old value,
+ * its new one or not at all, but its before-image is in the version log by
+ * the time the records are read, and replaces it.
+ */
+func (self *Snapshot) FetchAll() (map[string]string, error) {
+	err := self.db.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer self.db.unlock()
+	records, err := self.readAll()
+	if err != nil {
+		return nil, err
+	}
+	err = self.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range self.before {
+		if val == nil {
+			delete(records, key)
+		} else {
+			records[key] = string(val)
+		}
+	}
+	return records, nil
+}
+
+/**
+ * The records currently in the index
+ */
+func (self *Snapshot) readAll() (map[string]string, error) {
+	scanner, ok := self.db.index.(index.ScannableIndex)
+	if !ok {
+		return self.db.index.FetchAll()
+	}
+	records := make(map[string]string)
+	_, err := scanner.Scan(nil, 0, false, func(key []byte, value []byte) error {
+		records[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+/**
+ * Call fn for every key in [start, end) as it was when the snapshot was
+ * taken, in key order. Only supported by the B+tree index. The records of
+ * the range are read before fn is called, fn can modify the database.
+ */
+func (self *Snapshot) Range(start []byte, end []byte, fn func(key []byte, value []byte) error) error {
+	records := make(map[string][]byte)
+	err := self.db.Range(start, end, func(key []byte, value []byte) error {
+		records[string(key)] = append([]byte{}, value...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = self.catchUp()
+	if err != nil {
+		return err
+	}
+	for key, val := range self.before {
+		if start != nil && key < string(start) || end != nil && key >= string(end) {
+			continue
+		}
+		if val == nil {
+			delete(records, key)
+		} else {
+			records[key] = val
+		}
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err = fn([]byte(key), records[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Release the snapshot, the last one to close empties the version log
+ */
+func (self *Snapshot) Close() error {
+	if self.versions == nil {
+		return nil
+	}
+	err := self.versions.close()
+	self.versions = nil
+	self.before = nil
+	dropErr := self.db.dropVersions()
+	if err != nil {
+		return err
+	}
+	return dropErr
+}
@@ -0,0 +1,246 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	snapshot_test_db_name = "snapshot_test_db"
+)
+
+func TestSnapshot(t *testing.T) {
+	forEachIndexType(t, allIndexTypes, testSnapshot)
+}
+
+/**
+ * A snapshot keeps seeing the values as they were when it was taken,
+ * whatever another handle updates, deletes or inserts afterwards
+ */
+func testSnapshot(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, snapshot_test_db_name, idxType, Options{})
+	defer db.Close()
+	other := openDB(t, snapshot_test_db_name, idxType, Options{})
+	defer other.Close()
+	initial := map[string]string{"updated": "old", "deleted": "old", "unchanged": "old", "txn_updated": "old"}
+	for key, value := range initial {
+		err := db.Store(key, value, Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Store("updated", "new", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Delete("deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Store("inserted", "new", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := other.Begin()
+	err = txn.Store("txn_updated", "new", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Store("txn_inserted", "new", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* a second write of a key is not seen either */
+	err = other.Store("updated", "newer", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range initial {
+		val, err := snap.Fetch(key)
+		if err != nil || val != value {
+			t.Errorf("Expected value %q for key %s in the snapshot, got %q, %v", value, key, val, err)
+		}
+	}
+	for _, key := range []string{"inserted", "txn_inserted"} {
+		_, err := snap.Fetch(key)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for the key %s inserted after the snapshot, got %v", key, err)
+		}
+	}
+	records, err := snap.FetchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, initial) {
+		t.Errorf("Expected the snapshot to have the records %v, got %v", initial, records)
+	}
+	expectValues(t, db, map[string]string{"updated": "newer", "deleted": "", "inserted": "new", "txn_updated": "new",
+		"txn_inserted": "new"})
+
+	err = snap.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = snap.Fetch("updated")
+	if err == nil {
+		t.Errorf("Expected an error for a fetch from a closed snapshot")
+	}
+}
+
+/**
+ * A range of a snapshot of a B+tree has the keys of the range as they were
+ * when it was taken, in order
+ */
+func TestSnapshotRange(t *testing.T) {
+	db := openNewDB(t, snapshot_test_db_name, index.BTreeIndexType, Options{})
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		err := db.Store(fmt.Sprintf("key%02d", i), "old", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	err = db.Store("key03", "new", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Delete("key04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Store("key04a", "new", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	err = snap.Range([]byte("key02"), []byte("key06"), func(key []byte, value []byte) error {
+		if string(value) != "old" {
+			t.Errorf("Expected value old for key %s in the snapshot, got %q", key, value)
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"key02", "key03", "key04", "key05"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the keys %v in the range, got %v", expected, keys)
+	}
+}
+
+/**
+ * FetchAll of a snapshot returns the same records while another handle
+ * keeps writing, and splitting and merging the buckets under the scan
+ */
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	db := openNewDB(t, snapshot_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	initial := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		initial[key] = "old"
+		err := db.Store(key, "old", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h := openDB(t, snapshot_test_db_name, index.LinearHashIndexType, Options{})
+		defer h.Close()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			var err error
+			switch i % 3 {
+			case 0:
+				err = h.Store(fmt.Sprintf("new%d", i), "new", Insert)
+			case 1:
+				err = h.Store(fmt.Sprintf("key%d", i%200), fmt.Sprint(i), Upsert)
+			case 2:
+				err = h.Delete(fmt.Sprintf("key%d", i%200))
+				if errors.Is(err, ErrNotFound) {
+					err = nil
+				}
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		records, err := snap.FetchAll()
+		if err != nil {
+			t.Error(err)
+			break
+		}
+		if !reflect.DeepEqual(records, initial) {
+			t.Errorf("Expected the snapshot to keep its %d records, got %d which differ", len(initial), len(records))
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+}
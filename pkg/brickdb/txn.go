@@ -0,0 +1,234 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+// returned by Commit when a key the transaction read was changed by someone else
+var ErrConflict = errors.New("transaction conflict")
+
+// returned when a transaction is used after Commit or Rollback
+var ErrTxnDone = errors.New("transaction already committed or rolled back")
+
+/**
+ * A transaction stores and deletes several keys together. The writes are
+ * kept in the transaction and only reach the database with Commit, which
+ * applies them all or none of them, a crash in the middle leaves them to
+ * the journal replay.
+ *
+ * Every value the transaction fetches from the database is remembered.
+ * Commit locks the keys read and written, in the order of their journal
+ * locks so that two transactions never wait on each other in a cycle, and
+ * checks that the values read are still the same before it applies the
+ * writes. If one of them has changed, in this process or another, nothing
+ * is applied and Commit returns ErrConflict, the transaction can be run
+ * again from the start. A transaction which commits saw the database as
+ * it was when it committed, transactions are serializable.
+ *
+ * Like its handle, a transaction is not to be shared by several goroutines.
+ */
+type Txn struct {
+	db     *Brickdb
+	reads  map[string][]byte  // the values read from the database, nil for the keys which were not there
+	writes map[string]batchOp // the pending store or delete of each key
+	done   bool
+}
+
+/**
+ * Start a transaction on the database
+ */
+func (self *Brickdb) Begin() *Txn {
+	return &Txn{db: self, reads: make(map[string][]byte), writes: make(map[string]batchOp)}
+}
+
+func (self *Txn) Fetch(key string) (string, error) {
+	val, err := self.FetchBytes([]byte(key))
+	return index.FetchString(key, val, err)
+}
+
+/**
+ * Fetch the value of a key as the transaction sees it, with its own writes
+ * applied. Returns nil if the key does not exist.
+ */
+func (self *Txn) FetchBytes(key []byte) ([]byte, error) {
+	if self.done {
+		return nil, ErrTxnDone
+	}
+	if write, ok := self.writes[string(key)]; ok {
+		if write.op == journal_delete {
+			return nil, nil
+		}
+		return write.value, nil
+	}
+	if val, ok := self.reads[string(key)]; ok {
+		return val, nil
+	}
+	val, err := self.db.FetchBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	self.reads[string(key)] = val
+	return val, nil
+}
+
+func (self *Txn) Store(key string, value string, storeOp StoreOp) error {
+	return self.StoreBytes([]byte(key), []byte(value), storeOp)
+}
+
+/**
+ * Store a key in the transaction. An insert of a key which exists, or an
+ * update of one which does not, fails right away with ErrKeyExists or
+ * ErrNotFound and leaves the transaction as it was.
+ */
+func (self *Txn) StoreBytes(key []byte, value []byte, storeOp StoreOp) error {
+	if self.done {
+		return ErrTxnDone
+	}
+	if storeOp != Upsert {
+		if storeOp != Insert && storeOp != Update {
+			return fmt.Errorf("Unsupported storeOp value: %v", storeOp)
+		}
+		current, err := self.FetchBytes(key)
+		if err != nil {
+			return err
+		}
+		if storeOp == Insert && current != nil {
+			return fmt.Errorf("%w: %s", ErrKeyExists, key)
+		}
+		if storeOp == Update && current == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+	}
+	self.writes[string(key)] = batchOp{op: journal_upsert, key: append([]byte(nil), key...), value: append([]byte{}, value...)}
+	return nil
+}
+
+func (self *Txn) Delete(key string) error {
+	return self.DeleteBytes([]byte(key))
+}
+
+func (self *Txn) DeleteBytes(key []byte) error {
+	if self.done {
+		return ErrTxnDone
+	}
+	self.writes[string(key)] = batchOp{op: journal_delete, key: append([]byte(nil), key...)}
+	return nil
+}
+
+/**
+ * Apply the writes of the transaction, if the values it read have not
+ * changed since. Returns ErrConflict if they have, the transaction is over
+ * either way.
+ */
+func (self *Txn) Commit() error {
+	return self.CommitContext(context.Background())
+}
+
+/**
+ * Commit, giving up once ctx is done while the keys are still being locked,
+ * the transaction is over either way
+ */
+func (self *Txn) CommitContext(ctx context.Context) error {
+	if self.done {
+		return ErrTxnDone
+	}
+	self.done = true
+	db := self.db
+	err := db.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.unlock()
+
+	readKeys := make([][]byte, 0, len(self.reads))
+	for key := range self.reads {
+		readKeys = append(readKeys, []byte(key))
+	}
+	ops := make([]batchOp, 0, len(self.writes))
+	writeKeys := make([][]byte, 0, len(self.writes))
+	for _, op := range self.writes {
+		ops = append(ops, op)
+		writeKeys = append(writeKeys, op.key)
+	}
+	sort.Slice(ops, func(i, j int) bool { return bytes.Compare(ops[i].key, ops[j].key) < 0 })
+	locks, err := db.journal.lockKeys(ctx, writeKeys, readKeys)
+	if err != nil {
+		return err
+	}
+	err = self.validate()
+	if err == nil && len(ops) > 0 {
+		err = db.recordVersions(writeKeys)
+		if err == nil {
+			err = db.logAndApply(journal_batch, nil, encodeBatch(ops))
+		}
+	}
+	db.journal.unlockKeys(locks)
+	if err != nil {
+		db.replayPending()
+		return err
+	}
+	return db.checkpointIfFull()
+}
+
+/**
+ * Check that the keys read still have the values the transaction saw, the
+ * keys have to be locked
+ */
+func (self *Txn) validate() error {
+	for key, seen := range self.reads {
+		current, err := self.db.index.FetchBytes([]byte(key))
+		if err != nil {
+			return err
+		}
+		if (current == nil) != (seen == nil) || !bytes.Equal(current, seen) {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+/**
+ * Drop the writes of the transaction, nothing has reached the database
+ * before Commit so there is nothing to undo
+ */
+func (self *Txn) Rollback() error {
+	if self.done {
+		return ErrTxnDone
+	}
+	self.done = true
+	self.reads = nil
+	self.writes = nil
+	return nil
+}
@@ -0,0 +1,258 @@
+/*-
+ * Copyright (c) 2020 Abhinav Upadhyay
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS ``AS IS'' AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package brickdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abhinav-upadhyay/brickdb/index"
+)
+
+const (
+	txn_test_db_name = "txn_test_db"
+)
+
+func TestTxnCommit(t *testing.T) {
+	forEachIndexType(t, allIndexTypes, testTxnCommit)
+}
+
+/**
+ * The writes of a transaction are seen by the transaction itself right
+ * away, and by the database only once it commits
+ */
+func testTxnCommit(t *testing.T, idxType index.IndexType) {
+	db := openNewDB(t, txn_test_db_name, idxType, Options{})
+	defer db.Close()
+	for _, key := range []string{"k1", "k2"} {
+		err := db.Store(key, "old", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txn := db.Begin()
+	err := txn.Store("k1", "new", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Delete("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Store("k3", "new", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Store("k1", "again", Insert)
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists for an insert of a key the transaction stored, got %v", err)
+	}
+	err = txn.Store("k2", "again", Update)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an update of a key the transaction deleted, got %v", err)
+	}
+	val, err := txn.Fetch("k1")
+	if err != nil || val != "new" {
+		t.Errorf("Expected the transaction to see its own write of k1, got %q, %v", val, err)
+	}
+	_, err = txn.Fetch("k2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the transaction to see its own delete of k2, got %v", err)
+	}
+	expectValues(t, db, map[string]string{"k1": "old", "k2": "old", "k3": ""})
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, db, map[string]string{"k1": "new", "k2": "", "k3": "new"})
+	err = txn.Commit()
+	if !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Expected ErrTxnDone for a second commit, got %v", err)
+	}
+	_, err = txn.Fetch("k1")
+	if !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Expected ErrTxnDone for a fetch after the commit, got %v", err)
+	}
+
+	txn = db.Begin()
+	err = txn.Store("k4", "new", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, db, map[string]string{"k4": ""})
+}
+
+/**
+ * A transaction whose reads were changed by another handle before it
+ * committed applies none of its writes, whether the key read was changed,
+ * deleted or inserted
+ */
+func TestTxnConflict(t *testing.T) {
+	db := openNewDB(t, txn_test_db_name, index.LinearHashIndexType, Options{})
+	defer db.Close()
+	other := openDB(t, txn_test_db_name, index.LinearHashIndexType, Options{})
+	defer other.Close()
+	for _, key := range []string{"changed", "deleted", "unchanged"} {
+		err := db.Store(key, "old", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conflicting := map[string]func() error{
+		"changed":  func() error { return other.Store("changed", "new", Update) },
+		"deleted":  func() error { return other.Delete("deleted") },
+		"inserted": func() error { return other.Store("inserted", "new", Insert) },
+	}
+	for key, write := range conflicting {
+		txn := db.Begin()
+		_, err := txn.FetchBytes([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = txn.FetchBytes([]byte("unchanged"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = txn.Store("written_"+key, "value", Upsert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = txn.Commit()
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected ErrConflict after a write of the key %s read, got %v", key, err)
+		}
+		expectValues(t, db, map[string]string{"written_" + key: ""})
+	}
+
+	/* a change to a key which was not read is no conflict */
+	txn := db.Begin()
+	_, err := txn.FetchBytes([]byte("unchanged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Store("written", "value", Insert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Store("changed", "newer", Update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, db, map[string]string{"written": "value"})
+}
+
+/**
+ * Handles incrementing the same counters in transactions, running each
+ * transaction again after a conflict, lose no increment
+ */
+func TestTxnRetry(t *testing.T) {
+	db := openNewDB(t, txn_test_db_name, index.HashIndexType, Options{})
+	defer db.Close()
+	counters := []string{"counter1", "counter2"}
+	for _, counter := range counters {
+		err := db.Store(counter, "0", Insert)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	nthreads := 4
+	nincrements := 25
+	var conflicts int64
+	var mutex sync.Mutex
+	for i := 0; i < nthreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := openDB(t, txn_test_db_name, index.HashIndexType, Options{})
+			defer h.Close()
+			for j := 0; j < nincrements; j++ {
+				for {
+					err := increment(h, counters)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						t.Error(err)
+						return
+					}
+					mutex.Lock()
+					conflicts++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, counter := range counters {
+		expectValues(t, db, map[string]string{counter: strconv.Itoa(nthreads * nincrements)})
+	}
+	if conflicts == 0 {
+		t.Errorf("Expected some of the transactions to conflict")
+	}
+}
+
+func increment(db *Brickdb, counters []string) error {
+	txn := db.Begin()
+	for _, counter := range counters {
+		val, err := txn.Fetch(counter)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		err = txn.Store(counter, fmt.Sprint(n+1), Update)
+		if err != nil {
+			return err
+		}
+	}
+	/* give the other handles a chance to commit in between */
+	time.Sleep(time.Millisecond)
+	return txn.Commit()
+}